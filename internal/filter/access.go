@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// specialUseSubnets complements the checks of isSpecialUse with special-use
+// ranges not covered by the net package.
+var specialUseSubnets = []string{
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"2001:db8::/32",
+}
+
+// isSpecialUse reports whether addr is a private, loopback, link-local or
+// otherwise special-use address which must never be sent to public DNSBLs.
+func isSpecialUse(addr net.IP) bool {
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, s := range specialUseSubnets {
+		_, subnet, _ := net.ParseCIDR(s)
+		if subnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessList returns an empty access list logging to the debug log.
+func newAccessList(name string) *dnsbl.Allowlist {
+	l := dnsbl.NewAllowlist(name)
+	l.Now, l.Debugf = clock, debugf
+	return l
+}
+
+// parseAccessList parses an access list read from origin, a path or URL,
+// with the clock and logging of the filter.
+func parseAccessList(r io.Reader, name string, origin string) (*dnsbl.Allowlist, error) {
+	l := newAccessList(name)
+	if err := l.Parse(r, origin); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadAccessList reads a file containing one IP address, subnet in CIDR
+// notation or hostname per line. Comments start with a hash sign. An empty
+// path yields an empty list, and an HTTPS URL yields the last good copy of a
+// remote list.
+func loadAccessList(path string, name string) (*dnsbl.Allowlist, error) {
+	if path == "" {
+		return newAccessList(name), nil
+	}
+	if isRemote(path) {
+		return loadRemoteList(path, name)
+	}
+	if isCompiledList(path) {
+		c, err := openCompiledList(path)
+		if err != nil {
+			return nil, err
+		}
+		l := newAccessList(name)
+		l.Add(c)
+		return l, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseAccessList(file, name, path)
+}
+
+// loadAccessLists combines the access lists read from several files or URLs
+// into one.
+func loadAccessLists(paths []string, name string) (*dnsbl.Allowlist, error) {
+	l := newAccessList(name)
+	for _, path := range paths {
+		other, err := loadAccessList(path, name)
+		if err != nil {
+			return nil, err
+		}
+		l.Merge(other)
+	}
+	if before, after := l.Aggregate(); after < before {
+		logf("%s: aggregated %d subnets into %d", name, before, after)
+	}
+	return l, nil
+}
+
+// watchAccessLists polls the files of the allowlist and the blocklist every
+// -allowlistWatch and has the main loop reload them whenever one of them
+// changes, so that updates take effect without a SIGHUP. Remote lists are left
+// to refreshRemoteLists.
+func watchAccessLists() {
+	type fileState struct {
+		modTime time.Time
+		size    int64
+	}
+	var states map[string]fileState
+	for {
+		var paths []string
+		runControl(func() string {
+			paths = append(slices.Clone(opts().allowlistFiles), opts().blocklistFile)
+			return ""
+		})
+
+		newStates := make(map[string]fileState)
+		for _, path := range paths {
+			if path == "" || isRemote(path) {
+				continue
+			}
+			if fi, err := os.Stat(path); err == nil {
+				newStates[path] = fileState{fi.ModTime(), fi.Size()}
+			}
+		}
+		if states != nil && !maps.Equal(states, newStates) {
+			runControl(func() string {
+				if err := reloadAccessLists(); err != nil {
+					errorf("unable to reload allowlist and blocklist: %v", err)
+				}
+				return ""
+			})
+		}
+		states = newStates
+		time.Sleep(opts().allowlistWatch)
+	}
+}
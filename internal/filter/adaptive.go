@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+// junkTuner adjusts the junk threshold to the recent score distribution, so
+// that about -junkTarget percent of the scored sessions are junked even as
+// the composition of the lists changes.
+type junkTuner struct {
+	mu        sync.Mutex
+	scores    []float64
+	next      int
+	seen      int64
+	threshold float64
+	tuned     bool
+}
+
+var tuner = &junkTuner{}
+
+// add records the score of a session and, once -junkTargetWindow sessions
+// have been seen, every tenth of that many sessions moves the threshold to
+// the score which only -junkTarget percent of the recent sessions exceed.
+// Unknown scores are not recorded.
+func (t *junkTuner) add(score float64) {
+	if opts().junkTarget <= 0 || score < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	window := int(opts().junkTargetWindow)
+	if len(t.scores) < window {
+		t.scores = append(t.scores, score)
+	} else {
+		t.next %= len(t.scores)
+		t.scores[t.next] = score
+		t.next++
+	}
+	t.seen++
+	if len(t.scores) < window || t.seen%max(int64(window)/10, 1) != 0 {
+		return
+	}
+
+	sorted := slices.Sorted(slices.Values(t.scores))
+	i := int(math.Ceil(float64(len(sorted))*(1-opts().junkTarget/100))) - 1
+	threshold := sorted[max(i, 0)]
+	current := opts().junkAbove
+	if t.tuned {
+		current = t.threshold
+	}
+	if threshold == current {
+		return
+	}
+	above := len(sorted) - 1
+	for above >= 0 && sorted[above] > current {
+		above--
+	}
+	rate := float64(len(sorted)-1-above) * 100 / float64(len(sorted))
+	logf("adjusting junk threshold from %v to %v, %.1f%% of the last %d scored sessions were above it, target %v%%", current, threshold, rate, len(sorted), opts().junkTarget)
+	t.threshold, t.tuned = threshold, true
+}
+
+// junkThreshold returns the score above which sessions are junked: the tuned
+// one with -junkTarget, -junkAbove otherwise.
+func junkThreshold() float64 {
+	if opts().junkTarget <= 0 {
+		return opts().junkAbove
+	}
+	tuner.mu.Lock()
+	defer tuner.mu.Unlock()
+	if !tuner.tuned {
+		return opts().junkAbove
+	}
+	return tuner.threshold
+}
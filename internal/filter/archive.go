@@ -0,0 +1,259 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// archiveSchema creates the tables of the decision archive. Each decision
+// is a row of decisions, the lists the IP address was found on at the time
+// are rows of hits referring to it.
+const archiveSchema = `CREATE TABLE IF NOT EXISTS decisions (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	session TEXT NOT NULL,
+	ip TEXT,
+	rdns TEXT,
+	score REAL,
+	action TEXT NOT NULL,
+	phase TEXT,
+	delay INTEGER,
+	dry_run INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS decisions_time ON decisions (time);
+CREATE TABLE IF NOT EXISTS hits (
+	decision INTEGER NOT NULL REFERENCES decisions (id),
+	list TEXT NOT NULL,
+	codes TEXT
+);
+CREATE INDEX IF NOT EXISTS hits_decision ON hits (decision);
+`
+
+// archiveTime is the format of the time column, which the date and time
+// functions of SQLite understand.
+const archiveTime = "2006-01-02 15:04:05"
+
+// decisionArchive records every decision in an SQLite database for offline
+// analysis. Rather than linking a database driver, it feeds statements to a
+// long-running sqlite3(1) shell. Decisions are queued and written in batches
+// by a goroutine of their own, so that a slow disk never holds up sessions;
+// if the queue is full, decisions are dropped.
+type decisionArchive struct {
+	path    string
+	rows    chan string
+	done    chan struct{}
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	batches int
+	dropped atomic.Int64
+}
+
+var archive *decisionArchive
+
+// openArchive creates the tables of the database at path if needed, prunes
+// it and starts writing to it. An empty path yields a nil archive.
+func openArchive(path string) (*decisionArchive, error) {
+	if path == "" {
+		return nil, nil
+	}
+	// the schema is set up by a shell of its own, so that a missing
+	// sqlite3 or a file which is not a database stops the filter
+	// right away
+	out, err := exec.Command(opts().sqliteCommand, "-batch", "-bail", path, archiveSchema).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open decision archive %s: %v %s", path, err, strings.TrimSpace(string(out)))
+	}
+	a := &decisionArchive{path: path, rows: make(chan string, 10000), done: make(chan struct{})}
+	if err := a.start(); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+// start starts the shell, which exits on the first failing statement, so
+// that a failed batch never leaves its transaction open for the next one.
+func (a *decisionArchive) start() error {
+	cmd := exec.Command(opts().sqliteCommand, "-batch", "-bail", a.path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start %s: %v", opts().sqliteCommand, err)
+	}
+	a.cmd, a.stdin, a.stdout = cmd, stdin, bufio.NewReader(stdout)
+	// wait for readers of the archive instead of failing right away
+	io.WriteString(stdin, ".timeout 5000\n")
+	return nil
+}
+
+// run writes the queued decisions, one transaction per batch, and prunes
+// the archive every hour until the queue is closed.
+func (a *decisionArchive) run() {
+	defer close(a.done)
+	a.write(a.pruneStatement(), 0)
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	for {
+		select {
+		case row, ok := <-a.rows:
+			if !ok {
+				a.stdin.Close()
+				a.cmd.Wait()
+				return
+			}
+			batch := []string{"BEGIN;", row}
+		drain:
+			for len(batch) < 1000 {
+				select {
+				case row, ok := <-a.rows:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, row)
+				default:
+					break drain
+				}
+			}
+			batch = append(batch, "COMMIT;")
+			a.write(strings.Join(batch, "\n"), len(batch)-2)
+			if n := a.dropped.Swap(0); n > 0 {
+				errorf("decision archive fell behind, dropped %d decisions", n)
+			}
+		case <-prune.C:
+			a.write(a.pruneStatement(), 0)
+		}
+	}
+}
+
+// write runs statements holding the given number of decisions in the shell,
+// restarting it if it went away. Batches are transactions, which are rolled
+// back if the shell dies in the middle of them, so a failed batch is written
+// once more by the new shell before its decisions are given up on.
+func (a *decisionArchive) write(statements string, decisions int) {
+	if statements == "" {
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := a.exec(statements)
+		if err == nil {
+			return
+		}
+		a.stdin.Close()
+		if waitErr := a.cmd.Wait(); waitErr != nil {
+			err = fmt.Errorf("%s failed: %v", opts().sqliteCommand, waitErr)
+		}
+		errorf("unable to write decision archive: %v", err)
+		if err := a.start(); err != nil {
+			errorf("%v", err)
+		}
+		if attempt == 2 {
+			if decisions > 0 {
+				errorf("decision archive failed twice, dropped %d decisions", decisions)
+			}
+			return
+		}
+	}
+}
+
+// exec sends statements to the shell and waits until it got through them,
+// which it confirms by printing a marker after them.
+func (a *decisionArchive) exec(statements string) error {
+	a.batches++
+	marker := fmt.Sprintf("batch %d written", a.batches)
+	if _, err := io.WriteString(a.stdin, statements+"\nSELECT "+sqlQuote(marker)+";\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := a.stdout.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == marker {
+			return nil
+		}
+	}
+}
+
+// pruneStatement deletes decisions older than -archiveRetention.
+func (a *decisionArchive) pruneStatement() string {
+	if opts().archiveRetention <= 0 {
+		return ""
+	}
+	before := sqlQuote(clock().Add(-opts().archiveRetention).UTC().Format(archiveTime))
+	return "DELETE FROM hits WHERE decision IN (SELECT id FROM decisions WHERE time < " + before + ");\n" +
+		"DELETE FROM decisions WHERE time < " + before + ";"
+}
+
+// record queues a decision taken for a session.
+func (a *decisionArchive) record(sessionId string, s *session, action string, delay int64) {
+	if a == nil {
+		return
+	}
+	ip := "NULL"
+	if s.Addr != nil {
+		ip = sqlQuote(s.Addr.String())
+	}
+	dry := 0
+	if opts().dryRun {
+		dry = 1
+	}
+	row := fmt.Sprintf("INSERT INTO decisions (time, session, ip, rdns, score, action, phase, delay, dry_run) VALUES (%s, %s, %s, %s, %s, %s, %s, %d, %d);",
+		sqlQuote(clock().UTC().Format(archiveTime)), sqlQuote(sessionId), ip, sqlQuote(s.rdns),
+		strconv.FormatFloat(s.Score, 'f', -1, 64), sqlQuote(action), sqlQuote(s.phase), delay, dry)
+	for _, list := range s.Lists {
+		row += fmt.Sprintf("\nINSERT INTO hits (decision, list, codes) SELECT max(id), %s, %s FROM decisions;",
+			sqlQuote(list), sqlQuote(s.Codes[list]))
+	}
+	select {
+	case a.rows <- row:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// close writes the queued decisions and waits for the shell to exit.
+func (a *decisionArchive) close() {
+	if a == nil {
+		return
+	}
+	close(a.rows)
+	<-a.done
+}
+
+// sqlQuote quotes s as an SQL string literal. NUL bytes cannot be part of
+// one and are dropped.
+func sqlQuote(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// testArchive opens an archive in a temporary directory with the given
+// sqlite3 command.
+func testArchive(t *testing.T, command string) (*decisionArchive, string) {
+	o := testOptions(t)
+	o.logLevelName = "error"
+	o.sqliteCommand, o.archiveRetention, o.dryRun = command, 0, false
+
+	path := filepath.Join(t.TempDir(), "archive.db")
+	a, err := openArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, path
+}
+
+// queryArchive runs a query against the database at path.
+func queryArchive(t *testing.T, path string, query string) string {
+	out, err := exec.Command("sqlite3", "-batch", path, query).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func testSession(addr string) *session {
+	return &session{
+		Session: dnsbl.Session{
+			Addr:  net.ParseIP(addr),
+			Score: 60,
+			Lists: []string{"bl.spamcop.net"},
+			Codes: map[string]string{"bl.spamcop.net": "127.0.0.2"},
+		},
+		rdns:  "mail.example.org",
+		phase: "connect",
+	}
+}
+
+func TestArchive(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	a, path := testArchive(t, "sqlite3")
+	a.record("7641df9771b4ed00", testSession("192.0.2.1"), "disconnect", 0)
+	a.record("7641df9771b4ed01", testSession("192.0.2.2"), "junk", 0)
+	a.close()
+
+	got := queryArchive(t, path, "SELECT ip, action, list FROM decisions JOIN hits ON hits.decision = decisions.id ORDER BY ip;")
+	want := "192.0.2.1|disconnect|bl.spamcop.net\n192.0.2.2|junk|bl.spamcop.net"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestArchiveRestart(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	// the first shell writing decisions dies in the middle of its first
+	// batch, after the transaction was begun
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sqlite3")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+if [ $# -eq 3 ] && [ ! -e "$0.died" ]; then
+	touch "$0.died"
+	head -n 3 | sqlite3 "$@"
+	kill -9 $$
+fi
+exec sqlite3 "$@"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, path := testArchive(t, script)
+	a.record("7641df9771b4ed00", testSession("192.0.2.1"), "disconnect", 0)
+	a.record("7641df9771b4ed01", testSession("192.0.2.2"), "junk", 0)
+	a.close()
+
+	if _, err := os.Stat(script + ".died"); err != nil {
+		t.Fatal("the first shell did not die")
+	}
+	if got := queryArchive(t, path, "SELECT count(*) FROM decisions;"); got != "2" {
+		t.Fatalf("got %s decisions, want 2", got)
+	}
+}
+
+func TestArchiveFailedStatement(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	a, path := testArchive(t, "sqlite3")
+	a.close()
+
+	// the batches are written one after the other by hand rather than
+	// by run, which could merge them into one
+	a = &decisionArchive{path: path, rows: make(chan string, 1)}
+	if err := a.start(); err != nil {
+		t.Fatal(err)
+	}
+	// a batch failing halfway must neither be committed in part nor leave
+	// its transaction open for the next one
+	a.write("BEGIN;\nINSERT INTO decisions (time, session, action) VALUES ('2025-01-01 00:00:00', 'partial', 'junk');\nINSERT INTO nonexistent VALUES (1);\nCOMMIT;", 1)
+	a.record("7641df9771b4ed00", testSession("192.0.2.1"), "disconnect", 0)
+	a.write("BEGIN;\n"+<-a.rows+"\nCOMMIT;", 1)
+	a.stdin.Close()
+	a.cmd.Wait()
+
+	if got := queryArchive(t, path, "SELECT session FROM decisions;"); got != "7641df9771b4ed00" {
+		t.Fatalf("got sessions %q, want only 7641df9771b4ed00", got)
+	}
+}
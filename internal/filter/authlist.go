@@ -0,0 +1,136 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authAllowlist remembers IP addresses which completed SMTP AUTH
+// successfully, so that later sessions from them are treated as allowlisted
+// for -authAllowDuration. Roaming users on dynamic address space thus do not
+// get delayed before they even get to authenticate. If a path is given, the
+// list is kept across restarts.
+type authAllowlist struct {
+	mu      sync.Mutex
+	path    string
+	expires map[string]time.Time
+}
+
+var authAllowed *authAllowlist
+
+// loadAuthAllowlist reads the list of authenticated IP addresses from path.
+// A missing file is treated as an empty list. Nothing is remembered unless
+// -authAllowDuration is set.
+func loadAuthAllowlist(path string) (*authAllowlist, error) {
+	if opts().authAllowDuration <= 0 {
+		return nil, nil
+	}
+	l := &authAllowlist{path: path, expires: make(map[string]time.Time)}
+	if path == "" {
+		return l, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid authentication allowlist entry: %s", scanner.Text())
+		}
+		expires, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication allowlist entry: %s", scanner.Text())
+		}
+		l.expires[fields[0]] = time.Unix(expires, 0)
+	}
+	return l, scanner.Err()
+}
+
+// contains returns the time until which the given IP address is allowlisted,
+// if it is.
+func (l *authAllowlist) contains(addr string) (time.Time, bool) {
+	if l == nil {
+		return time.Time{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires, ok := l.expires[addr]
+	return expires, ok && clock().Before(expires)
+}
+
+// add allowlists the given IP address for another -authAllowDuration.
+func (l *authAllowlist) add(addr string) {
+	if l == nil {
+		return
+	}
+	now := clock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expires[addr] = now.Add(opts().authAllowDuration)
+	for k, expires := range l.expires {
+		if !now.Before(expires) {
+			delete(l.expires, k)
+		}
+	}
+	if l.path == "" {
+		return
+	}
+	if err := l.save(); err != nil {
+		errorf("unable to save authentication allowlist: %v", err)
+	}
+}
+
+// save writes the list to a temporary file which then replaces the previous
+// one, so that a crash never leaves a truncated list behind.
+func (l *authAllowlist) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".authallow")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for addr, expires := range l.expires {
+		fmt.Fprintf(w, "%s\t%d\n", addr, expires.Unix())
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
@@ -0,0 +1,161 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// breaker takes a blocklist out of rotation after too many consecutive
+// failed queries and probes it in the background until it answers again.
+// Lists can also be disabled by hand through the control socket or with
+// -disableList.
+type breaker struct {
+	domain string
+
+	mu       sync.Mutex
+	failures int64
+	open     bool
+	disabled bool
+	// configured is set if disabled stems from -disableList rather than
+	// the control socket
+	configured bool
+	// stopProbe cancels the probe while the breaker is open, dropped is
+	// set once a reload removed the list
+	stopProbe context.CancelFunc
+	dropped   bool
+}
+
+var breakers = make(map[string]*breaker)
+
+var errBreakerOpen = errors.New("blocklist temporarily disabled")
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open && !b.disabled
+}
+
+// setDisabled takes the list out of rotation or puts it back until the
+// breaker is told otherwise.
+func (b *breaker) setDisabled(disabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disabled = disabled
+	b.configured = false
+}
+
+// readDisabledLists checks that each list given by -disableList is one of
+// the given lists.
+func readDisabledLists(specs []string, lists ...map[string]float64) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, list := range specs {
+		known := false
+		for _, m := range lists {
+			_, ok := m[list]
+			known = known || ok
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown list given to -disableList: %s", list)
+		}
+		result[list] = true
+	}
+	return result, nil
+}
+
+// setDisabledLists takes the given lists out of rotation and puts lists
+// which were only disabled by a previous configuration back. Lists disabled
+// through the control socket stay disabled.
+func setDisabledLists(disabled map[string]bool) {
+	for domain, b := range breakers {
+		b.mu.Lock()
+		if disabled[domain] {
+			b.disabled, b.configured = true, true
+		} else if b.configured {
+			b.disabled, b.configured = false, false
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.open || b.dropped || opts().breakerThreshold <= 0 || b.failures < opts().breakerThreshold {
+		return
+	}
+	b.open = true
+	errorf("disabling blocklist %s after %d consecutive failures, last error: %v", b.domain, b.failures, err)
+	webhook.notify("list-disabled", logFields{"list": b.domain, "failures": b.failures, "error": err.Error()})
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopProbe = cancel
+	go b.probe(ctx)
+}
+
+// drop stops probing the list once a reload removed it.
+func (b *breaker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropped = true
+	if b.stopProbe != nil {
+		b.stopProbe()
+		b.stopProbe = nil
+	}
+}
+
+// probe periodically queries the standard 127.0.0.2 test point of the list,
+// bypassing the cache, which may still hold an answer from before the outage.
+// Any definite answer, listed or not, means the list is responsive again.
+// Probing ends early once ctx is cancelled by drop.
+func (b *breaker) probe(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(opts().breakerRetry):
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, opts().lookupTimeout)
+		_, err := resolve(lookupCtx, b.domain, queryName(b.domain, "2.0.0.127"))
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+
+	b.mu.Lock()
+	if b.dropped {
+		b.mu.Unlock()
+		return
+	}
+	b.open = false
+	b.failures = 0
+	b.stopProbe = nil
+	b.mu.Unlock()
+	logf("re-enabling blocklist %s", b.domain)
+	webhook.notify("list-enabled", logFields{"list": b.domain})
+}
@@ -0,0 +1,235 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cachePurgeInterval   = time.Minute
+	cacheRefreshInterval = 30 * time.Second
+	cacheRefreshAhead    = time.Minute
+)
+
+// cacheEntry is a cached answer along with the list it came from, unknown for
+// answers loaded from -cacheFile, and the number of times it was used.
+type cacheEntry struct {
+	list    string
+	addrs   []net.IP
+	expires time.Time
+	hits    int64
+}
+
+// lookupCache remembers the outcome of DNSBL queries, keyed by query name.
+// Positive and negative answers expire after different amounts of time.
+type lookupCache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	lastPurged time.Time
+}
+
+var cache = &lookupCache{entries: make(map[string]cacheEntry)}
+
+// get returns the cached addresses for the given query name. An empty result
+// with ok set denotes a cached negative answer.
+// Answers missing locally are looked up in the shared cache, if any.
+func (c *lookupCache) get(list string, name string) (addrs []net.IP, ok bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	if ok && clock().After(entry.expires) {
+		delete(c.entries, name)
+		ok = false
+	} else if ok {
+		entry.hits++
+		c.entries[name] = entry
+	}
+	c.mu.Unlock()
+	if ok {
+		return entry.addrs, true
+	}
+
+	addrs, ttl, ok := shared.get(name)
+	if ok {
+		c.store(list, name, addrs, ttl)
+	}
+	return addrs, ok
+}
+
+// put caches an answer of the given list locally and in the shared cache, if
+// any.
+func (c *lookupCache) put(list string, name string, addrs []net.IP) {
+	ttl := opts().negativeCacheTTL
+	if len(addrs) > 0 {
+		ttl = opts().cacheTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.store(list, name, addrs, ttl)
+	shared.put(name, addrs, ttl)
+}
+
+func (c *lookupCache) store(list string, name string, addrs []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := clock()
+	c.entries[name] = cacheEntry{list: list, addrs: addrs, expires: now.Add(ttl)}
+
+	if now.Sub(c.lastPurged) >= cachePurgeInterval {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPurged = now
+	}
+}
+
+// refresh queries the lists again for answers which are about to expire and
+// were used at least -cacheRefresh times since they were cached, so that
+// decisions for frequently seen addresses follow changes to the lists
+// without waiting for the next session to miss the cache. Lists disabled by
+// their breaker are skipped, and failed queries leave the answer to expire.
+func (c *lookupCache) refresh() {
+	type query struct{ list, name string }
+	var due []query
+
+	c.mu.Lock()
+	now := clock()
+	for name, entry := range c.entries {
+		if entry.list == "" || entry.hits < opts().cacheRefresh || entry.expires.Sub(now) > cacheRefreshAhead {
+			continue
+		}
+		entry.hits = 0
+		c.entries[name] = entry
+		due = append(due, query{entry.list, name})
+	}
+	c.mu.Unlock()
+
+	for _, q := range due {
+		configMu.RLock()
+		if b, ok := breakers[q.list]; ok && b.allow() {
+			ctx, cancel := listContext(context.Background(), q.list)
+			resolve(ctx, q.list, q.name)
+			cancel()
+		}
+		configMu.RUnlock()
+	}
+}
+
+// refreshCache refreshes the lookup cache every cacheRefreshInterval.
+func refreshCache() {
+	for range time.Tick(cacheRefreshInterval) {
+		cache.refresh()
+	}
+}
+
+// load reads the answers saved by save, skipping those which have expired in
+// the meantime. A missing file is not an error.
+func (c *lookupCache) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := clock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid cache entry: %s", scanner.Text())
+		}
+		expires, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cache entry: %s", scanner.Text())
+		}
+		var addrs []net.IP
+		for _, s := range strings.Split(fields[2], ",") {
+			if s == "" {
+				continue
+			}
+			addr := net.ParseIP(s)
+			if addr == nil {
+				return fmt.Errorf("invalid cache entry: %s", scanner.Text())
+			}
+			addrs = append(addrs, addr)
+		}
+		if entry := (cacheEntry{addrs: addrs, expires: time.Unix(expires, 0)}); now.Before(entry.expires) {
+			c.entries[fields[0]] = entry
+		}
+	}
+	return scanner.Err()
+}
+
+// save writes all answers which have not expired yet to a temporary file
+// which then replaces the previous one. As query names may contain the keys of
+// commercial lists, the file is only readable by its owner.
+func (c *lookupCache) save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	c.mu.Lock()
+	now := clock()
+	w := bufio.NewWriter(tmp)
+	for name, entry := range c.entries {
+		if now.After(entry.expires) {
+			continue
+		}
+		addrs := make([]string, len(entry.addrs))
+		for i, addr := range entry.addrs {
+			addrs[i] = addr.String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, entry.expires.Unix(), strings.Join(addrs, ","))
+	}
+	c.mu.Unlock()
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// flush forgets all cached answers.
+func (c *lookupCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
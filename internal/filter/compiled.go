@@ -0,0 +1,235 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"syscall"
+)
+
+// compiledMagic starts compiled access lists, followed by the number of IPv4
+// and IPv6 ranges as big-endian 64-bit integers and the ranges themselves,
+// sorted and without overlaps: 4 bytes each for the first and last address
+// of IPv4 ranges, 16 bytes each for IPv6 ranges.
+const compiledMagic = "DNSBLAL1"
+
+// compiledList is an access list in the compiled format, mapped into memory
+// rather than read, so that lists with millions of entries cost neither
+// startup time nor heap.
+type compiledList struct {
+	data    []byte
+	ranges4 []byte
+	ranges6 []byte
+}
+
+// isCompiledList reports whether the file at path is a compiled access list.
+func isCompiledList(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, len(compiledMagic))
+	_, err = io.ReadFull(file, magic)
+	return err == nil && string(magic) == compiledMagic
+}
+
+// openCompiledList maps a compiled access list into memory. The mapping is
+// released once the list is no longer referenced.
+func openCompiledList(path string) (*compiledList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(len(compiledMagic)+16) {
+		return nil, fmt.Errorf("truncated compiled list: %s", path)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	header := data[len(compiledMagic):]
+	n4, n6 := binary.BigEndian.Uint64(header), binary.BigEndian.Uint64(header[8:])
+	body := header[16:]
+	if n4 > uint64(len(body))/8 || n6 > (uint64(len(body))-n4*8)/32 || n4*8+n6*32 != uint64(len(body)) {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("corrupt compiled list: %s", path)
+	}
+	c := &compiledList{data: data, ranges4: body[:n4*8], ranges6: body[n4*8:]}
+	runtime.SetFinalizer(c, func(c *compiledList) {
+		syscall.Munmap(c.data)
+	})
+	return c, nil
+}
+
+// Match returns the range containing addr, if any, found by binary search.
+func (c *compiledList) Match(addr net.IP) (string, bool) {
+	ranges, size := c.ranges6, 16
+	if addr4 := addr.To4(); addr4 != nil {
+		addr, ranges, size = addr4, c.ranges4, 4
+	} else {
+		addr = addr.To16()
+	}
+
+	n := len(ranges) / (2 * size)
+	first := func(i int) []byte { return ranges[2*size*i : 2*size*i+size] }
+	last := func(i int) []byte { return ranges[2*size*i+size : 2*size*(i+1)] }
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(first(i), addr) > 0
+	})
+	if i == 0 || bytes.Compare(last(i-1), addr) < 0 {
+		return "", false
+	}
+	return formatRange(first(i-1), last(i-1)), true
+}
+
+// Entries returns the ranges of the list.
+func (c *compiledList) Entries() []string {
+	var entries []string
+	for _, size := range []int{4, 16} {
+		ranges := c.ranges4
+		if size == 16 {
+			ranges = c.ranges6
+		}
+		for i := 0; i < len(ranges); i += 2 * size {
+			entries = append(entries, formatRange(ranges[i:i+size], ranges[i+size:i+2*size]))
+		}
+	}
+	return entries
+}
+
+// formatRange returns the subnet spanning first to last in CIDR notation if
+// there is one, and first-last otherwise.
+func formatRange(first []byte, last []byte) string {
+	bits := len(first) * 8
+	for ones := 0; ones <= bits; ones++ {
+		subnet := net.IPNet{IP: net.IP(first), Mask: net.CIDRMask(ones, bits)}
+		if subnet.IP.Mask(subnet.Mask).Equal(net.IP(first)) && lastAddress(&subnet).Equal(net.IP(last)) {
+			return subnet.String()
+		}
+	}
+	return net.IP(first).String() + "-" + net.IP(last).String()
+}
+
+// lastAddress returns the highest address of a subnet.
+func lastAddress(subnet *net.IPNet) net.IP {
+	addr := slices.Clone(subnet.IP)
+	for i := range addr {
+		addr[i] |= ^subnet.Mask[i]
+	}
+	return addr
+}
+
+// compileAccessLists reads access lists in the text format and writes their
+// subnets to a compiled list at path. Hostnames and expiring entries cannot
+// be compiled.
+func compileAccessLists(path string, sources []string) error {
+	l, err := loadAccessLists(sources, "compiled list")
+	if err != nil {
+		return err
+	}
+	if hostnames := l.Hostnames(); len(hostnames) > 0 {
+		return fmt.Errorf("hostnames cannot be compiled: %s", hostnames[0])
+	}
+	if l.Expiring() {
+		return errors.New("expiring entries cannot be compiled")
+	}
+
+	type addrRange struct{ first, last []byte }
+	var ranges4, ranges6 []addrRange
+	for _, subnet := range l.Subnets() {
+		first, last := subnet.IP, lastAddress(subnet)
+		if first.To4() != nil {
+			ranges4 = append(ranges4, addrRange{first.To4(), last.To4()})
+		} else {
+			ranges6 = append(ranges6, addrRange{first.To16(), last.To16()})
+		}
+	}
+	for _, m := range l.Matchers() {
+		compiled, ok := m.(*compiledList)
+		if !ok {
+			continue
+		}
+		for _, size := range []int{4, 16} {
+			ranges, target := compiled.ranges4, &ranges4
+			if size == 16 {
+				ranges, target = compiled.ranges6, &ranges6
+			}
+			for i := 0; i < len(ranges); i += 2 * size {
+				*target = append(*target, addrRange{ranges[i : i+size], ranges[i+size : i+2*size]})
+			}
+		}
+	}
+
+	// overlapping ranges are merged, so that the one starting right
+	// before an address is the only one which can contain it
+	merge := func(ranges []addrRange) []addrRange {
+		slices.SortFunc(ranges, func(a, b addrRange) int {
+			return bytes.Compare(a.first, b.first)
+		})
+		var merged []addrRange
+		for _, r := range ranges {
+			if n := len(merged); n > 0 && bytes.Compare(r.first, merged[n-1].last) <= 0 {
+				if bytes.Compare(r.last, merged[n-1].last) > 0 {
+					merged[n-1].last = r.last
+				}
+				continue
+			}
+			merged = append(merged, r)
+		}
+		return merged
+	}
+	ranges4, ranges6 = merge(ranges4), merge(ranges6)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(compiledMagic)
+	binary.Write(w, binary.BigEndian, uint64(len(ranges4)))
+	binary.Write(w, binary.BigEndian, uint64(len(ranges6)))
+	for _, r := range append(ranges4, ranges6...) {
+		w.Write(r.first)
+		w.Write(r.last)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	logf("compiled %d IPv4 and %d IPv6 ranges into %s", len(ranges4), len(ranges6), path)
+	return nil
+}
@@ -0,0 +1,466 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// configTable is a parsed TOML table. Values are strings, int64, float64,
+// bool, []any, configTable or []configTable (for arrays of tables).
+type configTable map[string]any
+
+// readConfig parses a TOML configuration file.
+func readConfig(path string) (configTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseConfig(file, path)
+}
+
+// parseConfig parses a configuration file read from r. Errors are prefixed
+// with path and, for syntax errors, the line number.
+func parseConfig(r io.Reader, path string) (configTable, error) {
+	var raw map[string]any
+	if _, err := toml.NewDecoder(r).Decode(&raw); err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("%s:%d: %s", path, perr.Position.Line, perr.Message)
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	t, err := convertTable(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// convertTable turns a table as decoded by the TOML package into a
+// configTable, rejecting dates and times, which no option takes.
+func convertTable(raw map[string]any) (configTable, error) {
+	t := make(configTable, len(raw))
+	for key, value := range raw {
+		v, err := convertValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		t[key] = v
+	}
+	return t, nil
+}
+
+func convertValue(value any) (any, error) {
+	switch v := value.(type) {
+	case string, int64, float64, bool:
+		return v, nil
+	case map[string]any:
+		return convertTable(v)
+	case []map[string]any:
+		tables := make([]configTable, len(v))
+		for i, raw := range v {
+			t, err := convertTable(raw)
+			if err != nil {
+				return nil, err
+			}
+			tables[i] = t
+		}
+		return tables, nil
+	case []any:
+		values := make([]any, len(v))
+		for i, elem := range v {
+			converted, err := convertValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = converted
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value: %v", value)
+}
+
+// stringsFlag is an option which may be given multiple times.
+type stringsFlag []string
+
+func (l *stringsFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *stringsFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// cmdlineOptions records the options given on the command line, which take
+// precedence over the configuration file.
+var cmdlineOptions = make(map[string]bool)
+
+// staticOptions are only evaluated on startup and cannot be changed by
+// reloading the configuration.
+var staticOptions = map[string]bool{
+	"config":            true,
+	"testMode":          true,
+	"dot":               true,
+	"doh":               true,
+	"resolver":          true,
+	"lookupTXT":         true,
+	"maxLookups":        true,
+	"sessionMaxIdle":    true,
+	"selfCheckInterval": true,
+	"check":             true,
+	"lookup":            true,
+	"greylistDB":        true,
+	"reputationDB":      true,
+	"authAllowDB":       true,
+	"cacheFile":         true,
+	"cacheRefresh":      true,
+	"sharedCache":       true,
+	"gossipChannel":     true,
+	"authAllowDuration": true,
+	"statsInterval":     true,
+	"statsd":            true,
+	"statsdPrefix":      true,
+	"syslog":            true,
+	"syslogFacility":    true,
+	"syslogTag":         true,
+	"decisionLog":       true,
+	"archiveDB":         true,
+	"webhook":           true,
+	"sqlite":            true,
+	"controlSocket":     true,
+	"httpListen":        true,
+	"pfTable":           true,
+	"pfExpire":          true,
+	"pfctl":             true,
+	"spamdFeed":         true,
+	"geoipDB":           true,
+	"asnDB":             true,
+	"policyCommand":     true,
+	"maxLineLength":     true,
+	"replay":            true,
+	"fakeDNS":           true,
+	"allowlistRefresh":  true,
+	"allowlistWatch":    true,
+	"partnerDomain":     true,
+	"partnerRefresh":    true,
+	"warmup":            true,
+	"warmupInterval":    true,
+}
+
+// loadConfig reads the configuration file of the given options, if any, and
+// applies its options to them, including those of the schedules currently in
+// effect.
+func loadConfig(o *options) (configTable, error) {
+	if o.configFile == "" {
+		return nil, nil
+	}
+	cfg, err := readConfig(o.configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyConfig(o.flags, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, applySchedules(o.flags, cfg)
+}
+
+// applyConfig sets each flag named by a top-level key of the configuration
+// file, unless it was given on the command line. Tables are left to their
+// respective consumers.
+func applyConfig(flags *flag.FlagSet, cfg configTable) error {
+	for key, value := range cfg {
+		switch value.(type) {
+		case configTable, []configTable:
+			continue
+		}
+		if flags.Lookup(key) == nil || key == "config" {
+			return fmt.Errorf("unknown option: %s", key)
+		}
+		if cmdlineOptions[key] {
+			continue
+		}
+
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			if err := flags.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configReload is a configuration being reloaded: the options it was
+// validated with and everything derived from them, which are quick to
+// compute, and the access lists and local zones, which are read from files
+// or URLs in the background. Nothing of it is in effect until commitConfig
+// puts all of it into effect at once.
+type configReload struct {
+	options *options
+
+	lists, dnswls, rhsbls, dbls, uribls, ebls map[string]float64
+	timeouts                                  map[string]time.Duration
+	keys, groups, geoipRules                  map[string]string
+	limits                                    map[string]*rateLimit
+	disabledLists                             map[string]bool
+	dynamicPatterns                           []*regexp.Regexp
+	rules                                     []rule
+	shadow                                    *shadowPolicy
+	script                                    *scriptPolicy
+	profiles                                  []*profile
+
+	// read by load, along with the error of doing so
+	allowlist, blocklist *dnsbl.Allowlist
+	zones                map[string]*localZone
+	err                  error
+}
+
+// configReloads receives the reloads whose files have been read.
+var configReloads = make(chan *configReload)
+
+// reloading is set while the files of a reload are read, and reloadQueued if
+// another reload was requested in the meantime. Both are only used by the
+// main loop.
+var reloading, reloadQueued bool
+
+// reloadConfig re-reads the configuration file, the allowlist and the
+// blocklist in the background and sends them to the main loop on
+// configReloads. An invalid configuration leaves the running one untouched.
+func reloadConfig() {
+	if reloading {
+		// the reload in progress may have read the files too early
+		reloadQueued = true
+		return
+	}
+	r, err := stageConfig()
+	if err != nil {
+		errorf("failed to reload configuration: %v", err)
+		return
+	}
+	if opts().testMode {
+		r.load()
+		commitConfig(r)
+		return
+	}
+	reloading = true
+	go func() {
+		r.load()
+		configReloads <- r
+	}()
+}
+
+// stageConfig reads and validates the configuration file into a new set of
+// options and derives everything but the access lists and local zones from
+// them. The options in effect are left alone.
+func stageConfig() (*configReload, error) {
+	running := opts()
+	o := newOptions(flag.NewFlagSet("config", flag.ContinueOnError))
+
+	// options given on the command line and those which cannot be changed
+	// keep their values, the others revert to their defaults unless set by
+	// the configuration file
+	var err error
+	running.flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || !cmdlineOptions[f.Name] && !staticOptions[f.Name] {
+			return
+		}
+		if l, ok := f.Value.(*stringsFlag); ok {
+			*o.flags.Lookup(f.Name).Value.(*stringsFlag) = append(stringsFlag{}, *l...)
+		} else {
+			err = o.flags.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	for name := range staticOptions {
+		if o.flags.Lookup(name).Value.String() != running.flags.Lookup(name).Value.String() {
+			return nil, fmt.Errorf("option %s cannot be changed at runtime", name)
+		}
+	}
+	if err := validateOptions(o); err != nil {
+		return nil, err
+	}
+
+	r := &configReload{
+		options:  o,
+		timeouts: make(map[string]time.Duration),
+	}
+	if r.lists, err = readLists(cfg, "lists", flag.Args(), r.timeouts); err != nil {
+		return nil, err
+	}
+	if len(r.lists) == 0 {
+		return nil, errors.New("missing blocklist domains")
+	}
+	if r.dnswls, err = readLists(cfg, "dnswl", o.dnswlSpecs, r.timeouts); err != nil {
+		return nil, err
+	}
+	if r.rhsbls, err = readLists(cfg, "rhsbl", o.rhsblSpecs, r.timeouts); err != nil {
+		return nil, err
+	}
+	if r.dbls, err = readLists(cfg, "dbl", o.dblSpecs, r.timeouts); err != nil {
+		return nil, err
+	}
+	if r.uribls, err = readLists(cfg, "uribl", o.uriblSpecs, r.timeouts); err != nil {
+		return nil, err
+	}
+	if r.ebls, err = readLists(cfg, "ebl", o.eblSpecs, r.timeouts); err != nil {
+		return nil, err
+	}
+	all := []map[string]float64{r.lists, r.dnswls, r.rhsbls, r.dbls, r.uribls, r.ebls}
+	if r.keys, err = readListKeys(o.listKeySpecs, all...); err != nil {
+		return nil, err
+	}
+	if r.groups, err = readListGroups(o.listGroupSpecs, r.lists); err != nil {
+		return nil, err
+	}
+	if r.limits, err = readListLimits(o.listLimitSpecs, all...); err != nil {
+		return nil, err
+	}
+	if r.disabledLists, err = readDisabledLists(o.disabledListSpecs, all...); err != nil {
+		return nil, err
+	}
+	if r.geoipRules, err = readGeoipRules(cfg, o.geoipRuleSpecs); err != nil {
+		return nil, err
+	}
+	if r.rules, err = readRules(cfg); err != nil {
+		return nil, err
+	}
+	if r.shadow, err = readShadowPolicy(o.shadowConfig); err != nil {
+		return nil, err
+	}
+	if r.script, err = readScriptPolicy(o.policyScript); err != nil {
+		return nil, err
+	}
+	if r.profiles, err = readProfiles(cfg, r.lists); err != nil {
+		return nil, err
+	}
+	if r.dynamicPatterns, err = compileDynamicPatterns(o.dynamicPatternSpecs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the access lists and local zones of a reload. It may take a
+// while, as lists given by URL are downloaded, and only touches the reload
+// itself.
+func (r *configReload) load() {
+	if r.allowlist, r.err = loadAccessLists(r.options.allowlistFiles, "allowlist"); r.err != nil {
+		return
+	}
+	if r.blocklist, r.err = loadAccessList(r.options.blocklistFile, "blocklist"); r.err != nil {
+		return
+	}
+	r.zones, r.err = readLocalZones(r.options.localZoneSpecs, r.lists, r.dnswls, r.rhsbls, r.dbls, r.uribls, r.ebls)
+}
+
+// commitConfig puts a reload into effect, options and all, unless reading its
+// files failed, and starts the reload requested while it was being read, if
+// any.
+func commitConfig(r *configReload) {
+	reloading = false
+	if r.err != nil {
+		errorf("failed to reload configuration: %v", r.err)
+	} else {
+		configMu.Lock()
+		currentOptions.Store(r.options)
+		listGroups = r.groups
+		setLists(r.lists, r.dnswls, r.rhsbls, r.dbls, r.uribls, r.ebls, r.timeouts)
+		setListKeys(r.keys)
+		setListLimits(r.limits)
+		setDisabledLists(r.disabledLists)
+		setLocalZones(r.zones)
+		allowlist, blocklist = r.allowlist, r.blocklist
+		geoipRules, rules, shadow, profiles = r.geoipRules, r.rules, r.shadow, r.profiles
+		dynamicPatterns, script = r.dynamicPatterns, r.script
+		configMu.Unlock()
+		logf("configuration reloaded")
+	}
+	if reloadQueued {
+		reloadQueued = false
+		reloadConfig()
+	}
+}
+
+// configLists returns the lists declared in the given table, such as [lists]
+// or [dnswl], mapping each domain to its weight. A domain may also be a table
+// of its own with a weight and a timeout, which is recorded in timeouts.
+func configLists(cfg configTable, key string, timeouts map[string]time.Duration) (map[string]float64, error) {
+	lists := make(map[string]float64)
+	if cfg[key] == nil {
+		return lists, nil
+	}
+	table, ok := cfg[key].(configTable)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a table", key)
+	}
+	for domain, value := range table {
+		if t, ok := value.(configTable); ok {
+			value = t["weight"]
+			if s, ok := t["timeout"].(string); ok {
+				d, err := time.ParseDuration(s)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("invalid timeout for domain %q", domain)
+				}
+				timeouts[domain] = d
+			} else if t["timeout"] != nil {
+				return nil, fmt.Errorf("invalid timeout for domain %q", domain)
+			}
+		}
+		weight, ok := configScore(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid weight for domain %q", domain)
+		}
+		lists[domain] = weight
+	}
+	return lists, nil
+}
+
+// configScore accepts an integer or a float as a score or weight.
+func configScore(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOptions puts the default options into effect for the duration of the
+// test and returns them to be changed.
+func testOptions(t *testing.T) *options {
+	old := opts()
+	o := newOptions(flag.NewFlagSet("test", flag.ContinueOnError))
+	currentOptions.Store(o)
+	t.Cleanup(func() { currentOptions.Store(old) })
+	return o
+}
+
+// TestStageConfig checks that staging a reload leaves the options in effect
+// alone while they are read concurrently, as by the background refreshes.
+func TestStageConfig(t *testing.T) {
+	o := testOptions(t)
+	o.logLevelName = "error"
+	o.configFile = filepath.Join(t.TempDir(), "filter.conf")
+	config := "junkAbove = 10\nlogLevel = \"debug\"\n[lists]\n\"example.org\" = 1\n"
+	if err := os.WriteFile(o.configFile, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	read := make(chan bool)
+	go func() {
+		changed := false
+		for {
+			select {
+			case <-done:
+				read <- changed
+				return
+			default:
+				changed = changed || opts().junkAbove != -1 || opts().logLevelName != "error"
+			}
+		}
+	}()
+	r, err := stageConfig()
+	close(done)
+	if <-read {
+		t.Error("staged options leaked into the options in effect")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts() != o {
+		t.Error("staging replaced the options in effect")
+	}
+	if r.options.junkAbove != 10 || r.options.logLevelName != "debug" {
+		t.Errorf("staged junkAbove=%v logLevel=%s, want 10 and debug", r.options.junkAbove, r.options.logLevelName)
+	}
+}
+
+func FuzzParseConfig(f *testing.F) {
+	f.Add("blockAbove = 50\n[lists]\n\"zen.spamhaus.org\" = 80\n")
+	f.Add("[[profile]]\nlisteners = [\"10.0.0.1:25\",\n  \"10.0.0.1:587\"]\nweights.a = 1.5 # comment\n")
+	f.Add("a.b.c = [[1, 2], [\"x]\", 'y']]\nflag = true\n")
+	f.Fuzz(func(t *testing.T, config string) {
+		parseConfig(strings.NewReader(config), "fuzz")
+	})
+}
@@ -0,0 +1,113 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// connRateTracker counts the connections from each source, an IPv4 subnet
+// of -connRatePrefix or IPv6 subnet of -connRatePrefix6 bits, within the
+// sliding window of -connRateWindow. Only as many connections as it takes to
+// exceed -connRate are remembered per source.
+type connRateTracker struct {
+	mu         sync.Mutex
+	times      map[string][]time.Time
+	lastPurged time.Time
+}
+
+var connRates = &connRateTracker{times: make(map[string][]time.Time)}
+
+// connRateMessage is sent to sessions disconnected by -connRateAction
+// tempfail.
+const connRateMessage = "too many connections from your network, please try again later"
+
+// connSource returns the subnet connections from addr are counted for.
+func connSource(addr net.IP) string {
+	if addr4 := addr.To4(); addr4 != nil {
+		return (&net.IPNet{IP: addr4.Mask(net.CIDRMask(opts().connRatePrefix, 32)), Mask: net.CIDRMask(opts().connRatePrefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(opts().connRatePrefix6, 128)), Mask: net.CIDRMask(opts().connRatePrefix6, 128)}).String()
+}
+
+// add counts a connection from source and returns the number of connections
+// from it within the window, including this one.
+func (t *connRateTracker) add(source string) int64 {
+	now := clock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// sources which stopped connecting are forgotten once per window
+	if now.Sub(t.lastPurged) > opts().connRateWindow {
+		for k, times := range t.times {
+			if now.Sub(times[len(times)-1]) > opts().connRateWindow {
+				delete(t.times, k)
+			}
+		}
+		t.lastPurged = now
+	}
+
+	times := t.times[source]
+	for len(times) > 0 && now.Sub(times[0]) > opts().connRateWindow {
+		times = times[1:]
+	}
+	times = append(times, now)
+	if int64(len(times)) > opts().connRate+1 {
+		times = times[1:]
+	}
+	t.times[source] = times
+	return int64(len(times))
+}
+
+// applyConnRate throttles sessions with a score above -connRateAbove whose
+// source opened more than -connRate connections within -connRateWindow,
+// which scoring each session on its own cannot see: -connRateAction penalty
+// adds -connRatePenalty to their score, tempfail disconnects them with a
+// temporary failure.
+func applyConnRate(s *session) {
+	if opts().connRate <= 0 || s.connections <= opts().connRate || s.Score <= opts().connRateAbove {
+		return
+	}
+	source := connSource(s.Addr)
+	statsd.send("connrate.exceeded:1|c")
+	if opts().connRateAction == "tempfail" {
+		logf("IP address %s: more than %d connections from %s within %s, throttling it", s.Addr, opts().connRate, source, opts().connRateWindow)
+		s.throttled = true
+		return
+	}
+	logf("IP address %s: more than %d connections from %s within %s, adding %v", s.Addr, opts().connRate, source, opts().connRateWindow, opts().connRatePenalty)
+	s.Score += opts().connRatePenalty
+}
+
+// validateConnRate checks the connection rate options.
+func validateConnRate() error {
+	switch {
+	case opts().connRate < 0 || opts().connRateWindow <= 0:
+		return fmt.Errorf("invalid connection rate: %d per %s", opts().connRate, opts().connRateWindow)
+	case opts().connRatePrefix < 0 || opts().connRatePrefix > 32 || opts().connRatePrefix6 < 0 || opts().connRatePrefix6 > 128:
+		return fmt.Errorf("invalid connection rate prefix length: %d or %d", opts().connRatePrefix, opts().connRatePrefix6)
+	case opts().connRateAction != "penalty" && opts().connRateAction != "tempfail":
+		return fmt.Errorf("invalid connection rate action: %s", opts().connRateAction)
+	case opts().connRatePenalty < 0 || opts().connRateAbove < 0:
+		return errors.New("invalid connection rate penalty or threshold")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// controlRequest is a command received on the control socket or the HTTP
+// API. Commands are run by the main loop in between events, just like
+// configuration reloads, and the response is sent back on reply.
+type controlRequest struct {
+	run   func() string
+	reply chan string
+}
+
+var controlRequests = make(chan controlRequest)
+
+// listenControl accepts connections on the control socket given by
+// -controlSocket, if any. Each line received is a command whose response is
+// written back as a single line.
+func listenControl(path string) error {
+	if path == "" {
+		return nil
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				errorf("unable to accept control connection: %v", err)
+				return
+			}
+			go serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := scanner.Text()
+		response := runControl(func() string {
+			return handleControl(command)
+		})
+		if _, err := fmt.Fprintln(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// runControl has the main loop run fn and returns its result.
+func runControl(fn func() string) string {
+	req := controlRequest{run: fn, reply: make(chan string)}
+	controlRequests <- req
+	return <-req.reply
+}
+
+// reloadAccessLists re-reads the allowlist and the blocklist. Either both or
+// none of them are replaced.
+func reloadAccessLists() error {
+	newAllowlist, err := loadAccessLists(opts().allowlistFiles, "allowlist")
+	if err != nil {
+		return err
+	}
+	newBlocklist, err := loadAccessList(opts().blocklistFile, "blocklist")
+	if err != nil {
+		return err
+	}
+	allowlist, blocklist = newAllowlist, newBlocklist
+	logf("allowlist and blocklist reloaded")
+	return nil
+}
+
+// handleControl executes a command received on the control socket.
+func handleControl(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "error: missing command"
+	}
+
+	switch {
+	case fields[0] == "query" && len(fields) == 2:
+		addr := net.ParseIP(fields[1])
+		if addr == nil {
+			return "error: invalid IP address"
+		}
+		return queryAddress(addr)
+	case fields[0] == "flush-cache" && len(fields) == 1:
+		cache.flush()
+		logf("lookup cache flushed")
+		return "ok"
+	case fields[0] == "reload-allowlist" && len(fields) == 1:
+		if err := reloadAccessLists(); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return "ok"
+	case (fields[0] == "disable-list" || fields[0] == "enable-list") && len(fields) == 2:
+		b, ok := breakers[fields[1]]
+		if !ok {
+			return "error: unknown list"
+		}
+		b.setDisabled(fields[0] == "disable-list")
+		logf("%s %s", fields[0], fields[1])
+		return "ok"
+	case fields[0] == "limit" && len(fields) == 2:
+		l := rateLimitOf(fields[1])
+		if l == nil {
+			return "error: list has no limit"
+		}
+		return l.format(fields[1])
+	case (fields[0] == "report-spam" || fields[0] == "report-ham") && len(fields) == 2:
+		return feedback.report(fields[1], fields[0] == "report-spam")
+	case fields[0] == "stats" && len(fields) == 1:
+		return stats.current()
+	case fields[0] == "stats" && len(fields) == 2 && fields[1] == "feedback":
+		return feedback.format()
+	case fields[0] == "stats" && len(fields) == 2 && fields[1] == "allowlist":
+		return stats.formatEntries("allowlist", allowlist)
+	case fields[0] == "stats" && len(fields) == 2 && fields[1] == "blocklist":
+		return stats.formatEntries("blocklist", blocklist)
+	case fields[0] == "stats" && len(fields) == 2:
+		line, ok := stats.currentList(fields[1])
+		if !ok {
+			return "error: no lookups in list"
+		}
+		return line
+	}
+	return "error: unknown command"
+}
+
+// queryAddress returns the score and lists of an IP address as they would be
+// assigned to a session, without taking reverse DNS into account. Answers
+// are taken from the lookup cache where possible.
+func queryAddress(addr net.IP) string {
+	result, detail := lookupAddress(addr)
+	line := fmt.Sprintf("score=%v lists=%s", result.Score, strings.Join(result.Lists, ","))
+	if detail != "" {
+		line += " " + detail
+	}
+	return line
+}
+
+// lookupAddress scores an IP address from the allowlist, partner domains,
+// GeoIP rules, repeat offenders, the blocklist and the DNSBLs. The matching
+// allowlist, GeoIP or blocklist entry or partner domain, if any, is returned
+// as a key=value pair.
+func lookupAddress(addr net.IP) (lookupResult, string) {
+	if entry, ok := allowlist.Match(addr); ok {
+		return lookupResult{}, "allowlist=" + entry
+	}
+	if domain, ok := partners.match(addr); ok {
+		return lookupResult{}, "partner=" + domain
+	}
+	if key, ok := geoipAllowed(addr); ok {
+		return lookupResult{}, "geoip=" + key
+	}
+	if key, ok := geoipBlocked(addr); ok {
+		return lookupResult{Score: maxScore, Lists: []string{"geoip"}}, "geoip=" + key
+	}
+	if offenders.blocked(addr.String()) {
+		return lookupResult{Score: maxScore, Lists: []string{"offender"}}, ""
+	}
+	if entry, ok := blocklist.Match(addr); ok {
+		return lookupResult{Score: maxScore, Lists: []string{"blocklist"}}, "blocklist=" + entry
+	}
+	if addr.To4() == nil {
+		return lookupResult{Score: -1}, ""
+	}
+
+	atoms := strings.Split(addr.To4().String(), ".")
+	var result lookupResult
+	if scoredByLastOctet(atoms) {
+		result.Score = -1
+		if atoms[3] != "255" {
+			n, _ := strconv.ParseInt(atoms[3], 10, 8)
+			result.Score = float64(n)
+		}
+	} else {
+		result, _ = scoreLookups.do(context.Background(), addr.String(), func(ctx context.Context) lookupResult {
+			return queryLists(ctx, addr)
+		})
+	}
+	return result, ""
+}
@@ -0,0 +1,44 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"slices"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// decision is the answer to a filter request. Decisions are made by the
+// scoring and policy layer, from the rules, the policy command and the
+// built-in thresholds, and carried out by respond, which alone knows how
+// answers are logged, delayed and put on the wire.
+type decision = dnsbl.Decision
+
+// addHeaders remembers headers to be added to the messages of a session: to
+// all of them if decided on before the first transaction, else to the
+// current one only.
+func addHeaders(s *session, headers []string) {
+	for _, header := range headers {
+		if slices.Contains(s.policyHeaders, header) {
+			continue
+		}
+		s.policyHeaders = append(s.policyHeaders, header)
+		if s.phase == "connect" || s.phase == "helo" || s.phase == "ehlo" {
+			s.sessionHeaders = len(s.policyHeaders)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decisionLog appends decisions to a dedicated file, one per line. The file
+// is rotated once it grows beyond -decisionLogSize and can be reopened, e.g.
+// after it was rotated by newsyslog(8).
+type decisionLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+var decisions *decisionLog
+
+// openDecisionLog opens the decision log at path for appending. An empty
+// path yields a nil log.
+func openDecisionLog(path string) (*decisionLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &decisionLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *decisionLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// reopen closes the decision log and opens it again.
+func (l *decisionLog) reopen() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	if err := l.open(); err != nil {
+		errorf("unable to reopen decision log: %v", err)
+	}
+}
+
+// write appends a decision. In text mode, the fields are written as
+// key=value pairs after the time, otherwise as a JSON object.
+func (l *decisionLog) write(fields logFields) {
+	if l == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var line string
+	if opts().logFormat == "json" {
+		obj := logFields{"time": now}
+		for k, v := range fields {
+			obj[k] = v
+		}
+		b, _ := json.Marshal(obj)
+		line = string(b)
+	} else {
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := []string{now}
+		for _, k := range keys {
+			v := fields[k]
+			switch value := v.(type) {
+			case []string:
+				v = strings.Join(value, ",")
+			case map[string]string:
+				v = strconv.Quote(joinReasons(value))
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+		}
+		line = strings.Join(pairs, " ")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if opts().decisionLogSize > 0 && l.size+int64(len(line)+1) > opts().decisionLogSize && l.size > 0 {
+		l.rotate()
+	}
+	n, err := fmt.Fprintln(l.file, line)
+	l.size += int64(n)
+	if err != nil {
+		errorf("unable to write decision log: %v", err)
+	}
+}
+
+// rotate renames the decision log to path.1, shifting older files up to
+// -decisionLogKeep, and starts a new one.
+func (l *decisionLog) rotate() {
+	l.file.Close()
+	l.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.path, opts().decisionLogKeep))
+	for i := opts().decisionLogKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if opts().decisionLogKeep > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	if err := l.open(); err != nil {
+		errorf("unable to rotate decision log: %v", err)
+	}
+}
@@ -0,0 +1,796 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dotDefaultPort   = "853"
+	dotMaxIdle       = 8
+	dotIdleTimeout   = 10 * time.Second
+	dohMaxResponse   = 65535
+	dohContentType   = "application/dns-message"
+	dohClientTimeout = 10 * time.Second
+	maxReasonLength  = 200
+)
+
+// dnsResolver resolves names to addresses, TXT and MX records. It is
+// satisfied by *net.Resolver, by the stubResolver and by the scripted
+// fakeResolver.
+type dnsResolver interface {
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var resolver dnsResolver = net.DefaultResolver
+
+var lookupSlots chan struct{}
+
+// errRefused is returned for answers in 127.255.255.0/24, by which lists
+// signal that they refuse to answer, e.g. because the query went through a
+// public resolver or carried an invalid account key.
+var errRefused = errors.New("query refused by list")
+
+// publicResolvers are well-known open resolvers, whose queries most lists
+// refuse.
+var publicResolvers = map[string]bool{
+	"8.8.8.8":              true,
+	"8.8.4.4":              true,
+	"2001:4860:4860::8888": true,
+	"2001:4860:4860::8844": true,
+	"dns.google":           true,
+	"1.1.1.1":              true,
+	"1.0.0.1":              true,
+	"2606:4700:4700::1111": true,
+	"2606:4700:4700::1001": true,
+	"cloudflare-dns.com":   true,
+	"9.9.9.9":              true,
+	"149.112.112.112":      true,
+	"2620:fe::fe":          true,
+	"2620:fe::9":           true,
+	"dns.quad9.net":        true,
+	"208.67.222.222":       true,
+	"208.67.220.220":       true,
+	"dns.opendns.com":      true,
+}
+
+// listKeys holds the account keys of commercial lists along with a replacer
+// which redacts them from log messages.
+type listKeys struct {
+	keys     map[string]string
+	redactor *strings.Replacer
+}
+
+var keys atomic.Pointer[listKeys]
+
+// lookup resolves the given DNSBL query name, consulting the lookup cache
+// first. A negative answer yields an empty result. Lists over their rate
+// limit are not queried, and with -listLimitAction skip not even answered
+// from the cache. Lists with a local zone are answered from it.
+func lookup(ctx context.Context, list string, query string) ([]net.IP, error) {
+	if z := localZoneOf(list); z != nil {
+		// local zones are cheap to query and never fail
+		addrs := z.lookup(query)
+		debugf("query %s: addrs=%v (local zone %s)", query, addrs, z.path)
+		stats.addLookup(list, len(addrs) > 0, nil)
+		return addrs, nil
+	}
+	name := queryName(list, query)
+	limit := rateLimitOf(list)
+	if limit != nil && opts().listLimitAction == "skip" && limit.exhausted() {
+		stats.addLimited(list)
+		return nil, errRateLimited
+	}
+	if addrs, ok := cache.get(list, name); ok {
+		debugf("query %s: addrs=%v (cached)", name, addrs)
+		stats.addLookup(list, len(addrs) > 0, nil)
+		return addrs, nil
+	}
+	if limit != nil && !limit.take() {
+		debugf("query %s: skipped, rate limit of %s exceeded", name, list)
+		stats.addLimited(list)
+		return nil, errRateLimited
+	}
+	return resolve(ctx, list, name)
+}
+
+// reasonCache remembers the TXT records of listings, which explain them and
+// usually point to a delisting form, for as long as positive answers are
+// cached.
+type reasonCache struct {
+	mu         sync.Mutex
+	entries    map[string]reasonEntry
+	lastPurged time.Time
+}
+
+type reasonEntry struct {
+	reason  string
+	expires time.Time
+}
+
+var reasons = &reasonCache{entries: make(map[string]reasonEntry)}
+
+func (c *reasonCache) get(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || clock().After(entry.expires) {
+		return "", false
+	}
+	return entry.reason, true
+}
+
+func (c *reasonCache) put(name string, reason string) {
+	if opts().cacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clock()
+	c.entries[name] = reasonEntry{reason: reason, expires: now.Add(opts().cacheTTL)}
+	if now.Sub(c.lastPurged) >= cachePurgeInterval {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPurged = now
+	}
+}
+
+// listingReason returns the TXT record a list publishes for a listing,
+// typically a reason along with a delisting link, or an empty string if it
+// has none or cannot be reached. Local zones have no TXT records.
+func listingReason(ctx context.Context, list string, query string) string {
+	if localZoneOf(list) != nil {
+		return ""
+	}
+	name := queryName(list, query)
+	if reason, ok := reasons.get(name); ok {
+		return reason
+	}
+	txt, err := resolver.LookupTXT(ctx, name)
+	debugf("query %s: txt=%q err=%v", name, txt, err)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return ""
+	}
+	reason := reasonText(txt)
+	reasons.put(name, reason)
+	return reason
+}
+
+// reasonText joins TXT records into a single line of printable ASCII, which
+// can be put into SMTP replies and headers, cut to maxReasonLength bytes.
+func reasonText(txt []string) string {
+	reason := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, strings.Join(txt, " "))
+	reason = strings.Join(strings.Fields(reason), " ")
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	return reason
+}
+
+// resolve queries the DNS for the given query name of a list and caches the
+// answer. Only definite answers are cached; in particular, timeouts and
+// server failures are not. They are retried up to -dnsRetries times with a
+// backoff starting at -dnsRetryDelay, as long as ctx permits, and eventually
+// returned as an error.
+func resolve(ctx context.Context, list string, name string) ([]net.IP, error) {
+	delay := opts().dnsRetryDelay
+	for attempt := int64(0); ; attempt++ {
+		start := time.Now()
+		var addrs []net.IP
+		var txt []string
+		var err error
+		if stub, ok := resolver.(*stubResolver); ok {
+			addrs, txt, err = stub.lookupWithTXT(ctx, name)
+		} else {
+			addrs, err = resolver.LookupIP(ctx, "ip4", name)
+		}
+		elapsed := time.Since(start)
+		if len(txt) > 0 {
+			debugf("query %s: addrs=%v txt=%q err=%v (%dms)", name, addrs, txt, err, elapsed.Milliseconds())
+		} else {
+			debugf("query %s: addrs=%v err=%v (%dms)", name, addrs, err, elapsed.Milliseconds())
+		}
+		if len(addrs) > 0 && opts().lookupTXT {
+			// fetched along with the addresses by the stub resolver
+			if _, ok := resolver.(*stubResolver); ok {
+				reasons.put(name, reasonText(txt))
+			}
+		}
+		stats.addLatency(list, elapsed)
+		var dnsErr *net.DNSError
+		switch {
+		case err == nil && isRefusal(addrs):
+			err = errRefused
+		case err == nil:
+			cache.put(list, name, addrs)
+			stats.addLookup(list, len(addrs) > 0, nil)
+			return addrs, nil
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			cache.put(list, name, nil)
+			stats.addLookup(list, false, nil)
+			return nil, nil
+		}
+
+		if attempt >= opts().dnsRetries || !isTransient(err) || ctx.Err() != nil {
+			// lookups abandoned by their caller did not fail
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				stats.addLookup(list, false, err)
+			}
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				stats.addLookup(list, false, err)
+			}
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// isRefusal reports whether a DNS answer is an error code in
+// 127.255.255.0/24 rather than a listing.
+func isRefusal(addrs []net.IP) bool {
+	for _, a := range addrs {
+		if a4 := a.To4(); a4 != nil && a4[0] == 127 && a4[1] == 255 && a4[2] == 255 {
+			return true
+		}
+	}
+	return false
+}
+
+// queryName returns the name to look up in list for query, filling in a
+// template such as {revip}.{key}.dnsbl.example.com or else prepending the
+// query and the account key, if any.
+func queryName(list string, query string) string {
+	key := ""
+	if k := keys.Load(); k != nil {
+		key = k.keys[list]
+	}
+	if !strings.Contains(list, "{") {
+		if key != "" {
+			return query + "." + key + "." + list
+		}
+		return query + "." + list
+	}
+	labels := strings.Split(query, ".")
+	slices.Reverse(labels)
+	return strings.NewReplacer("{revip}", query, "{name}", query, "{ip}", strings.Join(labels, "."), "{key}", key).Replace(list)
+}
+
+// checkTemplate reports lists with unknown placeholders.
+func checkTemplate(list string) error {
+	rest := strings.NewReplacer("{revip}", "", "{name}", "", "{ip}", "", "{key}", "").Replace(list)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("invalid query template: %q", list)
+	}
+	return nil
+}
+
+// readListKeys parses the list=key specifiers given by -listKey. Each key
+// must belong to one of the given lists and each template containing {key}
+// must have a key.
+func readListKeys(specs []string, lists ...map[string]float64) (map[string]string, error) {
+	known := func(list string) bool {
+		return slices.ContainsFunc(lists, func(m map[string]float64) bool {
+			_, ok := m[list]
+			return ok
+		})
+	}
+
+	result := make(map[string]string)
+	for _, s := range specs {
+		list, key, ok := strings.Cut(s, "=")
+		if !ok || key == "" || strings.ContainsAny(key, ".{}") || !isDomainName("x."+key) {
+			return nil, fmt.Errorf("invalid list key specifier: %q", redactKey(s, key))
+		}
+		if !known(list) {
+			return nil, fmt.Errorf("key given for unknown list: %s", list)
+		}
+		result[list] = key
+	}
+
+	for _, m := range lists {
+		for list := range m {
+			if strings.Contains(list, "{key}") && result[list] == "" {
+				return nil, fmt.Errorf("missing key for list: %s", list)
+			}
+		}
+	}
+	return result, nil
+}
+
+// setListKeys puts a new set of account keys into effect.
+func setListKeys(m map[string]string) {
+	var pairs []string
+	for _, key := range m {
+		pairs = append(pairs, key, "<redacted>")
+	}
+	keys.Store(&listKeys{keys: m, redactor: strings.NewReplacer(pairs...)})
+}
+
+// redactKey replaces key in s, unless it is empty.
+func redactKey(s string, key string) string {
+	if key == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, key, "<redacted>")
+}
+
+// redactKeys replaces all account keys in s.
+func redactKeys(s string) string {
+	if k := keys.Load(); k != nil && len(k.keys) > 0 {
+		return k.redactor.Replace(s)
+	}
+	return s
+}
+
+// isTransient reports whether a lookup error is worth retrying, such as a
+// timeout or a server failure.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+}
+
+// listContext applies the timeout configured for list, if any, to ctx.
+func listContext(ctx context.Context, list string) (context.Context, context.CancelFunc) {
+	if d, ok := listTimeouts[list]; ok {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isListed reports whether query is listed in list.
+func isListed(ctx context.Context, list string, query string) (bool, error) {
+	addrs, err := lookup(ctx, list, query)
+	return len(addrs) > 0, err
+}
+
+// checkLists queries each blocklist and DNS allowlist for the test points of
+// RFC 5782, to find lists which are defunct or refuse our queries.
+func checkLists() {
+	if opts().listCheck == "none" {
+		return
+	}
+
+	failed := false
+	for _, server := range resolverHosts() {
+		if !publicResolvers[strings.ToLower(server)] {
+			continue
+		}
+		if opts().listCheck == "strict" {
+			log.Fatalf("DNS queries go through the public resolver %s, which most blocklists refuse to answer", server)
+		}
+		errorf("DNS queries go through the public resolver %s, which most blocklists refuse to answer", server)
+	}
+
+	for domain := range breakers {
+		if localZoneOf(domain) != nil {
+			continue
+		}
+		points := []string{"test", "invalid"}
+		_, isDNSBL := domainWeights[domain]
+		_, isDNSWL := dnswlWeights[domain]
+		if isDNSBL || isDNSWL {
+			points = []string{"2.0.0.127", "1.0.0.127"}
+		}
+		for i, point := range points {
+			ctx, cancel := listContext(context.Background(), domain)
+			listed, err := isListed(ctx, domain, point)
+			cancel()
+			if err != nil {
+				errorf("unable to check blocklist %s: %v", domain, err)
+				failed = failed || errors.Is(err, errRefused)
+				break
+			}
+			if listed != (i == 0) {
+				errorf("blocklist %s fails test point %s", domain, point)
+				failed = true
+			}
+		}
+	}
+
+	if failed && opts().listCheck == "strict" {
+		log.Fatal("blocklist sanity check failed")
+	}
+}
+
+// resolverHosts returns the hosts DNS queries are sent to: the -dot server,
+// the host of the -doh URL or the nameservers of the system resolver.
+func resolverHosts() []string {
+	switch {
+	case opts().fakeDNS != "":
+		return nil
+	case opts().dotServer != "":
+		host, _, err := net.SplitHostPort(opts().dotServer)
+		if err != nil {
+			host = opts().dotServer
+		}
+		return []string{strings.Trim(host, "[]")}
+	case opts().dohURL != "":
+		if u, err := url.Parse(opts().dohURL); err == nil {
+			return []string{u.Hostname()}
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	var hosts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			hosts = append(hosts, strings.Split(fields[1], "%")[0])
+		}
+	}
+	return hosts
+}
+
+// acquireLookupSlot reserves one of the -maxLookups slots for looking up an
+// address. It never blocks; if all slots are taken, it returns false and the
+// caller is expected to fall back to -overflowScore.
+func acquireLookupSlot() bool {
+	if lookupSlots == nil {
+		return true
+	}
+	select {
+	case lookupSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseLookupSlot() {
+	if lookupSlots != nil {
+		<-lookupSlots
+	}
+}
+
+// flightGroup deduplicates concurrent calls sharing the same key, in the
+// spirit of golang.org/x/sync/singleflight: while a call is in flight, later
+// callers wait for it and receive its result instead of starting their own.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done    chan struct{}
+	val     T
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// do returns the result of fn, unless ctx is done first. fn runs on a context
+// of its own, which is only cancelled once every caller waiting for it has
+// gone away, so that one caller cannot cut the others short.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(context.Context) T) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(context.Background())
+		c = &flightCall[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.val = fn(flightCtx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// setupResolver replaces the system resolver by one that tunnels all queries
+// through the DNS-over-TLS or DNS-over-HTTPS upstream given on the command
+// line, if any. In both cases, the Go resolver is instructed to use a stream
+// connection which we provide ourselves, so it takes care of building and
+// parsing DNS messages while we only take care of the transport.
+func setupResolver() {
+	if opts().maxLookups > 0 {
+		lookupSlots = make(chan struct{}, opts().maxLookups)
+	}
+
+	if opts().dotServer != "" && opts().dohURL != "" {
+		log.Fatal("-dot and -doh are mutually exclusive")
+	}
+
+	if opts().fakeDNS != "" {
+		fake, err := loadFakeResolver(opts().fakeDNS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resolver = fake
+		return
+	}
+	if opts().testMode {
+		// only the scripted addresses of test mode are looked up
+		resolver = testResolver{}
+		return
+	}
+
+	switch opts().resolverMode {
+	case "stub":
+		if opts().dotServer == "" && opts().dohURL == "" {
+			resolver = newStubResolver(resolverHosts())
+		}
+	case "system":
+	default:
+		log.Fatalf("invalid resolver: %s", opts().resolverMode)
+	}
+
+	if opts().dotServer != "" {
+		addr := opts().dotServer
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), dotDefaultPort)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		pool := &dotPool{addr: addr, config: &tls.Config{ServerName: host}}
+		resolver = &net.Resolver{PreferGo: true, Dial: pool.dial}
+	}
+
+	if opts().dohURL != "" {
+		u, err := url.Parse(opts().dohURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			log.Fatalf("invalid DNS-over-HTTPS URL: %s", opts().dohURL)
+		}
+		client := &dohClient{
+			url:    u.String(),
+			client: &http.Client{Timeout: dohClientTimeout},
+		}
+		resolver = &net.Resolver{PreferGo: true, Dial: client.dial}
+	}
+}
+
+// dotPool keeps idle DNS-over-TLS connections around so that consecutive
+// lookups, even across sessions, don't pay for a TCP and TLS handshake each.
+type dotPool struct {
+	addr   string
+	config *tls.Config
+
+	mu   sync.Mutex
+	idle []*dotConn
+}
+
+type dotConn struct {
+	*tls.Conn
+	pool     *dotPool
+	broken   bool
+	lastUsed time.Time
+}
+
+func (p *dotPool) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(c.lastUsed) < dotIdleTimeout {
+			p.mu.Unlock()
+			return c, nil
+		}
+		c.Conn.Close()
+	}
+	p.mu.Unlock()
+
+	dialer := &tls.Dialer{Config: p.config}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dotConn{Conn: conn.(*tls.Conn), pool: p}, nil
+}
+
+func (c *dotConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *dotConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+// Close hands the connection back to the pool unless an error occurred on it,
+// in which case it cannot be trusted to be in sync with the server anymore.
+func (c *dotConn) Close() error {
+	if c.broken || c.Conn.SetDeadline(time.Time{}) != nil {
+		return c.Conn.Close()
+	}
+	c.lastUsed = time.Now()
+
+	p := c.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= dotMaxIdle {
+		return c.Conn.Close()
+	}
+	p.idle = append(p.idle, c)
+	return nil
+}
+
+// dohClient sends DNS queries as RFC 8484 POST requests. Connection reuse is
+// left to the HTTP client.
+type dohClient struct {
+	url    string
+	client *http.Client
+}
+
+func (d *dohClient) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return &dohConn{client: d, ctx: ctx}, nil
+}
+
+// dohConn emulates a DNS-over-TCP stream: the length-prefixed query written
+// by the resolver is sent upon the first read and the response is handed
+// back with a length prefix.
+type dohConn struct {
+	client   *dohClient
+	ctx      context.Context
+	deadline time.Time
+	query    bytes.Buffer
+	response *bytes.Reader
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response == nil {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) exchange() error {
+	query := c.query.Bytes()
+	if len(query) < 2 {
+		return errors.New("short DNS query")
+	}
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.client.url, bytes.NewReader(query[2:]))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS-over-HTTPS upstream returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxResponse))
+	if err != nil {
+		return err
+	}
+
+	framed := make([]byte, 2, 2+len(body))
+	framed[0] = byte(len(body) >> 8)
+	framed[1] = byte(len(body))
+	c.response = bytes.NewReader(append(framed, body...))
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.client.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.client.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
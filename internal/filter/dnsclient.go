@@ -0,0 +1,416 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTypeA      = 1
+	dnsTypeMX     = 15
+	dnsTypeTXT    = 16
+	dnsTypeOPT    = 41
+	dnsClassIN    = 1
+	dnsUDPSize    = 1232
+	stubTryPeriod = 2 * time.Second
+)
+
+// rcodeNames are the DNS response codes the stub resolver distinguishes.
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// stubResolver sends queries straight to the nameservers of the system
+// instead of going through the resolver of the Go runtime, which hides the
+// response code and TXT records and may append search domains. Queries go
+// over UDP with EDNS0 and are repeated over TCP if the answer is truncated.
+// Each nameserver is tried in turn until one answers.
+//
+// Messages are built and parsed by hand rather than with a DNS library, as
+// the resolver only needs the question, the response code and A, TXT and MX
+// records, which do not justify a dependency the size of a full DNS
+// implementation. parseDNSResponse bounds-checks every read and is fuzzed
+// with malformed and truncated messages.
+type stubResolver struct {
+	servers []string
+	txt     bool
+}
+
+// dnsAnswer is the part of a DNS response the filter cares about.
+type dnsAnswer struct {
+	rcode int
+	addrs []net.IP
+	txt   []string
+	mx    []*net.MX
+}
+
+func newStubResolver(hosts []string) *stubResolver {
+	if len(hosts) == 0 {
+		hosts = []string{"127.0.0.1"}
+	}
+	r := &stubResolver{txt: opts().lookupTXT}
+	for _, host := range hosts {
+		r.servers = append(r.servers, net.JoinHostPort(host, "53"))
+	}
+	return r
+}
+
+func (r *stubResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	answer, err := r.lookup(ctx, host, dnsTypeA)
+	if err != nil {
+		return nil, err
+	}
+	return answer.addrs, nil
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	answer, err := r.lookup(ctx, host, dnsTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	return answer.txt, nil
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := r.lookup(ctx, name, dnsTypeMX)
+	if err != nil {
+		return nil, err
+	}
+	return answer.mx, nil
+}
+
+// lookupWithTXT looks up the A records of host and, with -lookupTXT, its TXT
+// records at the same time, so that the reason for a listing is known
+// without another round trip. Failures of the TXT query are ignored.
+func (r *stubResolver) lookupWithTXT(ctx context.Context, host string) ([]net.IP, []string, error) {
+	var txt []string
+	var wg sync.WaitGroup
+	if r.txt {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txt, _ = r.LookupTXT(ctx, host)
+		}()
+	}
+	addrs, err := r.LookupIP(ctx, "ip4", host)
+	wg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	return addrs, txt, nil
+}
+
+// lookup queries the records of the given type of host and maps failures to
+// the errors of the resolver of the Go runtime. As with the latter, an empty
+// answer is reported as a name which does not exist.
+func (r *stubResolver) lookup(ctx context.Context, host string, qtype uint16) (*dnsAnswer, error) {
+	name := strings.TrimSuffix(host, ".") + "."
+	dnsErr := &net.DNSError{Name: host}
+	if _, err := encodeDNSName(name); err != nil {
+		dnsErr.Err = err.Error()
+		return nil, dnsErr
+	}
+	answer, err := r.query(ctx, name, qtype)
+	switch {
+	case err != nil:
+		dnsErr.Err = err.Error()
+		dnsErr.IsTimeout = errors.Is(err, context.DeadlineExceeded) || isTimeout(err)
+		dnsErr.IsTemporary = !dnsErr.IsTimeout
+	case answer.rcode == 3 || answer.rcode == 0 && len(answer.addrs)+len(answer.txt)+len(answer.mx) == 0:
+		dnsErr.Err = "no such host"
+		dnsErr.IsNotFound = true
+	case answer.rcode == 0:
+		return answer, nil
+	case answer.rcode == 2:
+		dnsErr.Err = "server misbehaving (SERVFAIL)"
+		dnsErr.IsTemporary = true
+	default:
+		dnsErr.Err = fmt.Sprintf("query failed (%s)", rcodeName(answer.rcode))
+	}
+	return nil, dnsErr
+}
+
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// query asks the nameservers in turn until one of them answers. A SERVFAIL
+// or REFUSED only tells that this nameserver cannot answer, so the next one
+// is asked, and the answer of the last one is returned if none can.
+func (r *stubResolver) query(ctx context.Context, name string, qtype uint16) (*dnsAnswer, error) {
+	var lastAnswer *dnsAnswer
+	var lastErr error
+	for _, server := range r.servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		answer, err := exchangeDNS(ctx, server, name, qtype)
+		switch {
+		case err != nil:
+			debugf("query %s: nameserver %s failed: %v", name, server, err)
+		case answer.rcode == 2 || answer.rcode == 5:
+			debugf("query %s: nameserver %s answered %s", name, server, rcodeName(answer.rcode))
+		default:
+			return answer, nil
+		}
+		lastAnswer, lastErr = answer, err
+	}
+	return lastAnswer, lastErr
+}
+
+// exchangeDNS sends a query to server over UDP, and over TCP if the answer
+// does not fit into a datagram.
+func exchangeDNS(ctx context.Context, server string, name string, qtype uint16) (*dnsAnswer, error) {
+	ctx, cancel := context.WithTimeout(ctx, stubTryPeriod)
+	defer cancel()
+	// the ID is all that keeps off-path attackers from forging answers,
+	// so it must not be predictable
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	msg, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		answer, truncated, err := parseDNSResponse(buf[:n], id, name, qtype)
+		if err != nil {
+			// an answer to another query or a forgery, keep
+			// waiting for the real one
+			debugf("query %s: ignoring response from %s: %v", name, server, err)
+			continue
+		}
+		if !truncated {
+			return answer, nil
+		}
+		break
+	}
+
+	tcp, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(deadline)
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := tcp.Write(append(framed, msg...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(tcp, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(tcp, buf[:n]); err != nil {
+		return nil, err
+	}
+	answer, _, err := parseDNSResponse(buf[:n], id, name, qtype)
+	return answer, err
+}
+
+// buildDNSQuery builds a recursive query for name with an EDNS0 record
+// announcing dnsUDPSize.
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00) // recursion desired
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 1)
+	wire, err := encodeDNSName(name)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, wire...)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	msg = append(msg, 0) // root
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsUDPSize)
+	msg = append(msg, 0, 0, 0, 0, 0, 0)
+	return msg, nil
+}
+
+func encodeDNSName(name string) ([]byte, error) {
+	var wire []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name: %s", name)
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	if len(wire) > 254 {
+		return nil, fmt.Errorf("name too long: %s", name)
+	}
+	return append(wire, 0), nil
+}
+
+// parseDNSResponse checks that msg answers the query and returns the A, TXT
+// or MX records it holds along with the response code, including the upper
+// bits carried by EDNS0, and whether it was truncated.
+func parseDNSResponse(msg []byte, id uint16, name string, qtype uint16) (*dnsAnswer, bool, error) {
+	if len(msg) < 12 {
+		return nil, false, errors.New("short message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if binary.BigEndian.Uint16(msg) != id || flags&0x8000 == 0 {
+		return nil, false, errors.New("not a response to the query")
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	nscount := binary.BigEndian.Uint16(msg[8:])
+	arcount := binary.BigEndian.Uint16(msg[10:])
+	answer := &dnsAnswer{rcode: int(flags & 0x0f)}
+	truncated := flags&0x0200 != 0
+	if qdcount != 1 {
+		return nil, false, errors.New("unexpected question count")
+	}
+
+	off := 12
+	qname, off, err := decodeDNSName(msg, off)
+	if err != nil {
+		return nil, false, err
+	}
+	if off+4 > len(msg) || !strings.EqualFold(qname, name) || binary.BigEndian.Uint16(msg[off:]) != qtype {
+		return nil, false, errors.New("question does not match the query")
+	}
+	off += 4
+	if truncated {
+		return answer, true, nil
+	}
+
+	for i := 0; i < int(ancount)+int(nscount)+int(arcount); i++ {
+		if _, off, err = decodeDNSName(msg, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, false, errors.New("short record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, false, errors.New("short record data")
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		switch {
+		case rtype == dnsTypeOPT:
+			answer.rcode |= int(ttl>>24) << 4
+		case i >= int(ancount):
+		case rtype == dnsTypeA && rdlen == 4:
+			answer.addrs = append(answer.addrs, net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3]))
+		case rtype == dnsTypeTXT:
+			var txt []byte
+			for len(rdata) > 0 && int(rdata[0]) < len(rdata) {
+				txt = append(txt, rdata[1:1+rdata[0]]...)
+				rdata = rdata[1+rdata[0]:]
+			}
+			answer.txt = append(answer.txt, string(txt))
+		case rtype == dnsTypeMX && rdlen > 2:
+			host, _, err := decodeDNSName(msg, off-rdlen+2)
+			if err != nil {
+				return nil, false, err
+			}
+			answer.mx = append(answer.mx, &net.MX{Host: host, Pref: binary.BigEndian.Uint16(rdata)})
+		}
+	}
+	return answer, false, nil
+}
+
+// decodeDNSName reads a possibly compressed name at off and returns it along
+// with the offset of what follows it. Names longer than RFC 1035 allows are
+// rejected, however they were compressed.
+func decodeDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end, length := -1, 1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("short name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid name compression")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errors.New("invalid label type")
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("short label")
+			}
+			if length += 1 + n; length > 255 {
+				return "", 0, errors.New("name too long")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,284 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// quietLogs keeps the debug messages of the resolver out of the test output.
+func quietLogs(t *testing.T) {
+	testOptions(t).logLevelName = "error"
+}
+
+// testResponse answers query with the given response code and A records.
+func testResponse(query []byte, rcode int, truncated bool, addrs ...string) []byte {
+	_, off, _ := decodeDNSName(query, 12)
+	msg := append([]byte{}, query[:off+4]...)
+	msg[2] |= 0x80
+	if truncated {
+		msg[2] |= 0x02
+	}
+	msg[3] = byte(rcode)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(addrs)))
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	for _, addr := range addrs {
+		msg = append(msg, 0xc0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4)
+		msg = append(msg, net.ParseIP(addr).To4()...)
+	}
+	return msg
+}
+
+// testNameserver serves DNS over UDP and TCP on the same port of the
+// loopback address, answering each query with what answer returns for it.
+// UDP queries may get several datagrams in response.
+func testNameserver(t *testing.T, udp func(query []byte) [][]byte, tcp func(query []byte) []byte) string {
+	var pc net.PacketConn
+	var l net.Listener
+	for {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, msg := range udp(buf[:n]) {
+				pc.WriteTo(msg, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 65535)
+			if _, err := io.ReadFull(conn, buf[:2]); err == nil {
+				n := binary.BigEndian.Uint16(buf)
+				if _, err := io.ReadFull(conn, buf[:n]); err == nil && tcp != nil {
+					msg := tcp(buf[:n])
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestExchangeDNSTruncated(t *testing.T) {
+	server := testNameserver(t, func(query []byte) [][]byte {
+		return [][]byte{testResponse(query, 0, true)}
+	}, func(query []byte) []byte {
+		return testResponse(query, 0, false, "127.0.0.2", "127.0.0.10")
+	})
+	answer, err := exchangeDNS(context.Background(), server, "2.0.0.127.zen.spamhaus.org.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.addrs) != 2 || !answer.addrs[1].Equal(net.ParseIP("127.0.0.10")) {
+		t.Fatalf("got %v over TCP, want 127.0.0.2 and 127.0.0.10", answer.addrs)
+	}
+}
+
+func TestExchangeDNSMismatchedID(t *testing.T) {
+	quietLogs(t)
+	server := testNameserver(t, func(query []byte) [][]byte {
+		forged := testResponse(query, 0, false, "127.0.0.4")
+		forged[0] ^= 0xff
+		return [][]byte{forged, testResponse(query, 0, false, "127.0.0.2")}
+	}, nil)
+	answer, err := exchangeDNS(context.Background(), server, "2.0.0.127.zen.spamhaus.org.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.addrs) != 1 || !answer.addrs[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("got %v, want the answer with the ID of the query", answer.addrs)
+	}
+}
+
+func TestStubResolverServfail(t *testing.T) {
+	quietLogs(t)
+	servfail := testNameserver(t, func(query []byte) [][]byte {
+		return [][]byte{testResponse(query, 2, false)}
+	}, nil)
+	refused := testNameserver(t, func(query []byte) [][]byte {
+		return [][]byte{testResponse(query, 5, false)}
+	}, nil)
+	good := testNameserver(t, func(query []byte) [][]byte {
+		return [][]byte{testResponse(query, 0, false, "127.0.0.2")}
+	}, nil)
+
+	r := &stubResolver{servers: []string{servfail, refused, good}}
+	addrs, err := r.LookupIP(context.Background(), "ip4", "2.0.0.127.zen.spamhaus.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("got %v, want the answer of the third nameserver", addrs)
+	}
+
+	r = &stubResolver{servers: []string{refused, servfail}}
+	_, err = r.LookupIP(context.Background(), "ip4", "2.0.0.127.zen.spamhaus.org")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary || !strings.Contains(dnsErr.Err, "SERVFAIL") {
+		t.Fatalf("got %v, want the SERVFAIL of the last nameserver", err)
+	}
+}
+
+func TestParseDNSResponseExtendedRcode(t *testing.T) {
+	query, _ := buildDNSQuery(0x1234, "example.org", dnsTypeA)
+	msg := testResponse(query, 0, false)
+	// an OPT record carrying the upper bits of BADVERS (16)
+	binary.BigEndian.PutUint16(msg[10:], 1)
+	msg = append(msg, 0, 0, dnsTypeOPT, 0x04, 0xd0, 1, 0, 0, 0, 0, 0)
+	answer, _, err := parseDNSResponse(msg, 0x1234, "example.org.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.rcode != 16 || rcodeName(answer.rcode) != "RCODE16" {
+		t.Fatalf("got rcode %d (%s), want 16", answer.rcode, rcodeName(answer.rcode))
+	}
+}
+
+func TestParseDNSResponseMalformed(t *testing.T) {
+	query, _ := buildDNSQuery(0x1234, "example.org", dnsTypeA)
+	good := testResponse(query, 0, false, "127.0.0.2")
+	// the name of the answer points to itself
+	loop := testResponse(query, 0, false)
+	binary.BigEndian.PutUint16(loop[6:], 1)
+	loop = append(loop, 0xc0, byte(len(loop)), 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 0)
+	// the name of the answer has a label of the reserved type 01
+	reserved := testResponse(query, 0, false)
+	binary.BigEndian.PutUint16(reserved[6:], 1)
+	reserved = append(reserved, 0x41, 'a', 0, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 0)
+	tests := map[string][]byte{
+		"short message":     good[:11],
+		"short question":    good[:len(query)-13],
+		"short record":      good[:len(good)-8],
+		"short record data": good[:len(good)-2],
+		"compression loop":  loop,
+		"reserved label":    reserved,
+		"other question":    testResponse(mustQuery(t, "example.com"), 0, false, "127.0.0.2"),
+		"not a response":    query,
+	}
+	for name, msg := range tests {
+		if _, _, err := parseDNSResponse(msg, 0x1234, "example.org.", dnsTypeA); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func mustQuery(t *testing.T, name string) []byte {
+	query, err := buildDNSQuery(0x1234, name, dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// testRecordResponse answers query with a single record of the given type
+// and data.
+func testRecordResponse(query []byte, rtype uint16, rdata []byte) []byte {
+	msg := testResponse(query, 0, false)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	msg = append(msg, 0xc0, 12)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = append(msg, 0, dnsClassIN, 0, 0, 0, 60)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func FuzzParseDNSResponse(f *testing.F) {
+	query, _ := buildDNSQuery(0x1234, "example.org", dnsTypeA)
+	good := testResponse(query, 0, false, "127.0.0.2", "127.0.0.10")
+	f.Add(good, uint16(dnsTypeA))
+	f.Add(testResponse(query, 0, true), uint16(dnsTypeA))
+	f.Add(testResponse(query, 3, false), uint16(dnsTypeA))
+	for i := 12; i < len(good); i += 7 {
+		f.Add(good[:i], uint16(dnsTypeA))
+	}
+	query, _ = buildDNSQuery(0x1234, "example.org", dnsTypeTXT)
+	f.Add(testRecordResponse(query, dnsTypeTXT, []byte("\x05hello\x06 world")), uint16(dnsTypeTXT))
+	f.Add(testRecordResponse(query, dnsTypeTXT, []byte("\x09short")), uint16(dnsTypeTXT))
+	query, _ = buildDNSQuery(0x1234, "example.org", dnsTypeMX)
+	f.Add(testRecordResponse(query, dnsTypeMX, []byte("\x00\x0a\x02mx\xc0\x0c")), uint16(dnsTypeMX))
+	f.Add(testRecordResponse(query, dnsTypeMX, []byte("\x00\x0a\x02mx")), uint16(dnsTypeMX))
+
+	f.Fuzz(func(t *testing.T, msg []byte, qtype uint16) {
+		answer, truncated, err := parseDNSResponse(msg, 0x1234, "example.org.", qtype)
+		if err != nil {
+			return
+		}
+		if truncated && (answer.addrs != nil || answer.txt != nil || answer.mx != nil) {
+			t.Fatal("truncated response with records")
+		}
+		for _, addr := range answer.addrs {
+			if addr.To4() == nil {
+				t.Fatalf("invalid address %v", addr)
+			}
+		}
+		for _, mx := range answer.mx {
+			if len(mx.Host) > 255 {
+				t.Fatalf("MX host of %d bytes", len(mx.Host))
+			}
+		}
+	})
+}
+
+func FuzzDecodeDNSName(f *testing.F) {
+	f.Add([]byte("\x07example\x03org\x00"), 0)
+	f.Add([]byte("\x03www\xc0\x00"), 0)
+	f.Add([]byte("\x3f"+strings.Repeat("a", 63)+"\xc0\x00"), 0)
+	f.Fuzz(func(t *testing.T, msg []byte, off int) {
+		if off < 0 {
+			return
+		}
+		name, next, err := decodeDNSName(msg, off)
+		if err != nil {
+			return
+		}
+		if next <= 0 || next > len(msg) {
+			t.Fatalf("offset %d out of range for message of %d bytes", next, len(msg))
+		}
+		if len(name) > 255 {
+			t.Fatalf("name of %d bytes", len(name))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+)
+
+// collectAddresses unfolds the From and Reply-To headers of a message line by
+// line and scans each of them once it is complete.
+func collectAddresses(s *session, line string) {
+	if s.addressHeader != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+		s.addressHeader += line
+		return
+	}
+	if s.addressHeader != "" {
+		scanAddresses(s, s.addressHeader)
+		s.addressHeader = ""
+	}
+	name, _, _ := strings.Cut(line, ":")
+	switch strings.ToLower(name) {
+	case "from", "reply-to":
+		s.addressHeader = line
+	}
+}
+
+// scanAddresses collects the addresses of an unfolded From or Reply-To header
+// to be looked up in the configured hashed email blocklists before the
+// message is committed.
+func scanAddresses(s *session, header string) {
+	_, value, _ := strings.Cut(header, ":")
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		addr := strings.ToLower(a.Address)
+		if s.mailboxes[addr] {
+			continue
+		}
+		if s.mailboxes == nil {
+			s.mailboxes = make(map[string]bool)
+		}
+		s.mailboxes[addr] = true
+
+		for list, weight := range eblWeights {
+			s.queries = append(s.queries, rhsblQuery{name: eblName(addr), list: list, weight: weight, what: "email address " + addr})
+		}
+	}
+}
+
+// eblName returns the name addr is looked up as in EBLs, the hex-encoded
+// SHA-1 hash of the lowercase address.
+func eblName(addr string) string {
+	if opts().testMode && opts().fakeDNS == "" {
+		// in test mode, addresses with the local part listed are
+		// considered to be listed everywhere
+		return addr
+	}
+	hash := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,217 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fakeResolver answers lookups from the script given by -fakeDNS instead of
+// the DNS, so that the lookup code can be tested without any network.
+type fakeResolver struct {
+	answers map[string]fakeAnswer
+	txt     map[string]string
+	mx      map[string][]string
+}
+
+type fakeAnswer struct {
+	addrs []net.IP
+	err   string
+	delay time.Duration
+}
+
+// testListsOctet is the first octet of the addresses whose lookups are
+// scripted per list in -testMode, see testResolver.
+const testListsOctet = "99"
+
+// scoredByLastOctet reports whether the score of an IPv4 address, given as
+// its octets, is taken from its last octet, as in -testMode without
+// -fakeDNS, instead of being looked up.
+func scoredByLastOctet(atoms []string) bool {
+	return opts().testMode && opts().fakeDNS == "" && atoms[0] != testListsOctet
+}
+
+// testResolver answers the lookups of -testMode without -fakeDNS for
+// addresses of the form 99.L.F.C: bit n of L lists the address on list n with
+// 127.0.0.C, and bit n of F makes it fail.
+type testResolver struct{}
+
+// testLists returns the blocklists and DNS allowlists in the order in which
+// the bits of testResolver addresses refer to them.
+func testLists() []string {
+	lists := slices.Collect(maps.Keys(domainWeights))
+	lists = slices.AppendSeq(lists, maps.Keys(dnswlWeights))
+	slices.Sort(lists)
+	return lists
+}
+
+func (testResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: host, Server: "test", IsNotFound: true}
+	labels := strings.SplitN(strings.ToLower(strings.TrimSuffix(host, ".")), ".", 5)
+	if len(labels) < 5 || labels[3] != testListsOctet {
+		return nil, dnsErr
+	}
+	code, err1 := strconv.ParseUint(labels[0], 10, 8)
+	fails, err2 := strconv.ParseUint(labels[1], 10, 8)
+	hits, err3 := strconv.ParseUint(labels[2], 10, 8)
+	n := slices.Index(testLists(), labels[4])
+	if err1 != nil || err2 != nil || err3 != nil || n < 0 || n > 7 {
+		return nil, dnsErr
+	}
+
+	listed, failed := hits&(1<<n) != 0, fails&(1<<n) != 0
+	switch {
+	case listed && failed:
+		dnsErr.Err, dnsErr.IsNotFound, dnsErr.IsTimeout = "i/o timeout", false, true
+	case failed:
+		dnsErr.Err, dnsErr.IsNotFound, dnsErr.IsTemporary = "server misbehaving", false, true
+	case listed:
+		return []net.IP{net.IPv4(127, 0, 0, byte(code))}, nil
+	}
+	return nil, dnsErr
+}
+
+func (testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, Server: "test", IsNotFound: true}
+}
+
+func (testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, Server: "test", IsNotFound: true}
+}
+
+func loadFakeResolver(path string) (*fakeResolver, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := &fakeResolver{answers: make(map[string]fakeAnswer), txt: make(map[string]string), mx: make(map[string][]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing answer for %s in %s", fields[0], path)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if fields[1] == "TXT" {
+			r.txt[name] = strings.Join(fields[2:], " ")
+			continue
+		}
+		if fields[1] == "MX" {
+			r.mx[name] = fields[2:]
+			continue
+		}
+
+		var answer fakeAnswer
+		if fields[1] == "DELAY" && len(fields) > 3 {
+			if answer.delay, err = time.ParseDuration(fields[2]); err != nil {
+				return nil, fmt.Errorf("invalid delay for %s in %s: %s", fields[0], path, fields[2])
+			}
+			fields = append(fields[:1], fields[3:]...)
+		}
+		switch fields[1] {
+		case "NXDOMAIN", "SERVFAIL", "TIMEOUT", "HANG":
+			answer.err = fields[1]
+		default:
+			for _, field := range fields[1:] {
+				addr := net.ParseIP(field)
+				if addr == nil {
+					return nil, fmt.Errorf("invalid answer for %s in %s: %s", fields[0], path, field)
+				}
+				answer.addrs = append(answer.addrs, addr)
+			}
+		}
+		r.answers[name] = answer
+	}
+	return r, scanner.Err()
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	answer, ok := r.answers[name]
+	for zone := name; !ok && zone != ""; {
+		_, zone, _ = strings.Cut(zone, ".")
+		answer, ok = r.answers["*."+zone]
+	}
+
+	dnsErr := &net.DNSError{Name: host, Server: "fake"}
+	if answer.delay > 0 {
+		select {
+		case <-time.After(answer.delay):
+		case <-ctx.Done():
+			answer.err = "HANG"
+		}
+	}
+	switch {
+	case !ok || answer.err == "NXDOMAIN":
+		dnsErr.Err = "no such host"
+		dnsErr.IsNotFound = true
+	case answer.err == "SERVFAIL":
+		dnsErr.Err = "server misbehaving"
+		dnsErr.IsTemporary = true
+	case answer.err == "TIMEOUT":
+		dnsErr.Err = "i/o timeout"
+		dnsErr.IsTimeout = true
+	case answer.err == "HANG":
+		<-ctx.Done()
+		dnsErr.Err = ctx.Err().Error()
+		dnsErr.IsTimeout = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	default:
+		return answer.addrs, nil
+	}
+	return nil, dnsErr
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	txt, ok := r.txt[name]
+	for zone := name; !ok && zone != ""; {
+		_, zone, _ = strings.Cut(zone, ".")
+		txt, ok = r.txt["*."+zone]
+	}
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: "fake", IsNotFound: true}
+	}
+	return []string{txt}, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[strings.ToLower(strings.TrimSuffix(name, "."))]
+	if !ok || len(hosts) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: "fake", IsNotFound: true}
+	}
+	var mx []*net.MX
+	for i, host := range hosts {
+		mx = append(mx, &net.MX{Host: host, Pref: uint16(10 * (i + 1))})
+	}
+	return mx, nil
+}
@@ -0,0 +1,169 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxOutcomes bounds the number of messages remembered for feedback, however
+// long -feedbackWindow is.
+const maxOutcomes = 100000
+
+// outcome is what became of a message, remembered so that a verdict on it can
+// be traced back to its IP address and the lists which listed it.
+type outcome struct {
+	keys     []string
+	addr     string
+	lists    []string
+	junked   bool
+	reported bool
+	seen     time.Time
+}
+
+// feedbackTracker takes verdicts on messages the filter let through or
+// junked and counts them towards the reputation of the sender and the
+// accuracy of the lists.
+type feedbackTracker struct {
+	mu       sync.Mutex
+	messages map[string]*outcome
+	order    []*outcome
+
+	// counts since the start, as verdicts trickle in over days
+	falsePositives map[string]int64
+	falseNegatives map[string]int64
+}
+
+var feedback = &feedbackTracker{
+	messages:       make(map[string]*outcome),
+	falsePositives: make(map[string]int64),
+	falseNegatives: make(map[string]int64),
+}
+
+// messageKey normalizes a message ID or Message-ID header for lookups.
+func messageKey(id string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(id), "<>"))
+}
+
+// remember records the outcome of the message a session just committed.
+func (ft *feedbackTracker) remember(s *session) {
+	if s.exempt || s.Addr == nil || opts().feedbackWindow <= 0 {
+		return
+	}
+	o := &outcome{addr: s.Addr.String(), lists: slices.Clone(s.Lists), junked: s.junked || shouldJunk(s), seen: clock()}
+	if s.tx != nil && s.tx.msgid != "" {
+		o.keys = append(o.keys, messageKey(s.tx.msgid))
+	}
+	if s.messageID != "" {
+		o.keys = append(o.keys, messageKey(s.messageID))
+	}
+	if len(o.keys) == 0 {
+		return
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.expire()
+	for _, key := range o.keys {
+		ft.messages[key] = o
+	}
+	ft.order = append(ft.order, o)
+}
+
+// expire forgets the messages older than -feedbackWindow and the oldest ones
+// beyond maxOutcomes.
+func (ft *feedbackTracker) expire() {
+	n := 0
+	for n < len(ft.order) && (len(ft.order)-n >= maxOutcomes || clock().Sub(ft.order[n].seen) > opts().feedbackWindow) {
+		for _, key := range ft.order[n].keys {
+			if ft.messages[key] == ft.order[n] {
+				delete(ft.messages, key)
+			}
+		}
+		n++
+	}
+	ft.order = ft.order[n:]
+}
+
+// report applies a verdict on a message, given by its message ID or
+// Message-ID header, or on an IP address, whose messages are not known and
+// only has its reputation adjusted.
+func (ft *feedbackTracker) report(id string, spam bool) string {
+	verdict := "ham"
+	if spam {
+		verdict = "spam"
+	}
+	if addr := net.ParseIP(id); addr != nil {
+		reputation.feedback(addr.String(), spam)
+		logf("operator reported %s from IP address %s", verdict, addr)
+		return "ok"
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.expire()
+	o, ok := ft.messages[messageKey(id)]
+	if !ok {
+		return "error: unknown message"
+	}
+	if o.reported {
+		return "error: message already reported"
+	}
+	o.reported = true
+
+	var counted []string
+	for list := range domainWeights {
+		listed := slices.Contains(o.lists, list)
+		switch {
+		case spam && !listed:
+			ft.falseNegatives[list]++
+		case !spam && listed:
+			ft.falsePositives[list]++
+		default:
+			continue
+		}
+		counted = append(counted, list)
+	}
+	slices.Sort(counted)
+	reputation.feedback(o.addr, spam)
+
+	kind := "false positive"
+	if spam {
+		kind = "false negative"
+	}
+	logf("operator reported %s for message %s from %s (junked=%v), %s of %s", verdict, id, o.addr, o.junked, kind, strings.Join(counted, ","))
+	return fmt.Sprintf("ok addr=%s lists=%s junked=%v", o.addr, strings.Join(o.lists, ","), o.junked)
+}
+
+// format returns the number of false positives and negatives reported so far
+// for each DNSBL.
+func (ft *feedbackTracker) format() string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var fp, fn []string
+	for _, list := range slices.Sorted(maps.Keys(domainWeights)) {
+		fp = append(fp, fmt.Sprintf("%s:%d", list, ft.falsePositives[list]))
+		fn = append(fn, fmt.Sprintf("%s:%d", list, ft.falseNegatives[list]))
+	}
+	return fmt.Sprintf("stats feedback falsePositives=%s falseNegatives=%s", strings.Join(fp, ","), strings.Join(fn, ","))
+}
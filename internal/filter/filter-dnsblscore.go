@@ -0,0 +1,2722 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+// Copyright (c) 2019-2021 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"io"
+	"log"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+	"github.com/lfos/filter-dnsblscore/pkg/smtpdfilter"
+)
+
+var domainWeights = make(map[string]float64)
+var dnswlWeights = make(map[string]float64)
+var rhsblWeights = make(map[string]float64)
+var dblWeights = make(map[string]float64)
+var uriblWeights = make(map[string]float64)
+var eblWeights = make(map[string]float64)
+var listTimeouts = make(map[string]time.Duration)
+var maxScore float64
+var allowlist *dnsbl.Allowlist
+var blocklist *dnsbl.Allowlist
+
+// options are the values of the command line options, which the
+// configuration file may set as well. Reloading the configuration parses
+// them into a new set, which replaces the one in effect at once.
+type options struct {
+	// flags is the flag set the options are defined on
+	flags *flag.FlagSet
+
+	dnswlSpecs            stringsFlag
+	rhsblSpecs            stringsFlag
+	dblSpecs              stringsFlag
+	uriblSpecs            stringsFlag
+	eblSpecs              stringsFlag
+	listKeySpecs          stringsFlag
+	listLimitSpecs        stringsFlag
+	listGroupSpecs        stringsFlag
+	localZoneSpecs        stringsFlag
+	selfIPs               stringsFlag
+	selfZoneSpecs         stringsFlag
+	selfCheckInterval     time.Duration
+	selfCheck             bool
+	lookupIP              string
+	disabledListSpecs     stringsFlag
+	listLimitAction       string
+	learnWeights          bool
+	learnWindow           int64
+	geoipRuleSpecs        stringsFlag
+	geoipFile             string
+	asnFile               string
+	blockAbove            *thresholdFlag
+	blockPhase            string
+	minLists              int64
+	onDnsFailure          string
+	onOutage              string
+	onUnknown             string
+	sessionMaxIdle        time.Duration
+	webhookURL            string
+	webhookInterval       time.Duration
+	dnsRetries            int64
+	dnsRetryDelay         time.Duration
+	lookupTimeout         time.Duration
+	scoreTimeout          time.Duration
+	aggregate             string
+	tempfailAbove         *thresholdFlag
+	rejectAbove           *thresholdFlag
+	junkAbove             float64
+	greylistAbove         float64
+	requireTLSAbove       float64
+	quarantineAbove       float64
+	quarantineAddress     string
+	greylistDelay         time.Duration
+	greylistExpire        time.Duration
+	greylistFile          string
+	reputationFile        string
+	authAllowFile         string
+	authAllowDuration     time.Duration
+	reputationExpire      time.Duration
+	feedbackWindow        time.Duration
+	reputationClean       int64
+	reputationGrace       float64
+	reputationOffenses    int64
+	reputationPenalty     float64
+	connRate              int64
+	connRateWindow        time.Duration
+	connRatePrefix        int
+	connRatePrefix6       int
+	connRateAbove         float64
+	connRatePenalty       float64
+	connRateAction        string
+	neighborhoodCount     int64
+	neighborhoodWindow    time.Duration
+	neighborhoodPrefix    int
+	neighborhoodPrefix6   int
+	neighborhoodAbove     float64
+	neighborhoodPenalty   float64
+	escalateAfter         int64
+	escalateWindow        time.Duration
+	escalateDuration      time.Duration
+	recipientLimit        int64
+	recipientLimitAbove   float64
+	messageLimit          int64
+	messageLimitAbove     float64
+	sizeLimit             int64
+	sizeLimitAbove        float64
+	sizeLimitAction       string
+	junkPhase             string
+	junkTarget            float64
+	junkTargetWindow      int64
+	junkAction            bool
+	junkHeader            bool
+	junkSubject           string
+	slowFactor            int64
+	slowJitter            int64
+	maxDelay              int64
+	blockDelay            int64
+	slowGrowth            int64
+	bannerDelay           bool
+	uriblMaxLookups       int64
+	messageJunkAbove      float64
+	messageRejectAbove    float64
+	scoreHeader           bool
+	headerAbove           float64
+	headerName            string
+	headerDetails         string
+	headerPosition        string
+	stripHeaders          bool
+	stripHeaderNames      string
+	listedHeader          bool
+	authservID            string
+	allowlistFiles        stringsFlag
+	allowlistRefresh      time.Duration
+	allowlistWatch        time.Duration
+	partnerDomains        stringsFlag
+	partnerRefresh        time.Duration
+	blocklistFile         string
+	blocklistScore        float64
+	noRdnsScore           float64
+	fcrdnsScore           float64
+	dynamicRdnsScore      float64
+	heloForgeryScore      float64
+	tlsBonus              float64
+	weakTLSPenalty        float64
+	localHostnames        string
+	dynamicPatternSpecs   stringsFlag
+	testMode              bool
+	scoreSpecialUse       bool
+	sampleRate            float64
+	skipListeners         string
+	trustedRelays         string
+	exemptRecipients      string
+	allowSenders          string
+	exemptRecipientAction string
+	dryRun                bool
+	strict                bool
+	fakeDNS               string
+	replayFile            string
+	compileFile           string
+	simulateScript        string
+	maxLineLength         int
+	statsInterval         time.Duration
+	statsdAddr            string
+	statsdPrefix          string
+	logFormat             string
+	decisionLogFile       string
+	controlSocket         string
+	httpListen            string
+	pfTable               string
+	pfAbove               float64
+	pfExpire              time.Duration
+	pfctlPath             string
+	spamdFile             string
+	spamdExpire           time.Duration
+	execScorer            string
+	execScorerTimeout     time.Duration
+	policyCommand         string
+	policyTimeout         time.Duration
+	policyScript          string
+	decisionLogSize       int64
+	decisionLogKeep       int64
+	archiveDB             string
+	archiveRetention      time.Duration
+	sqliteCommand         string
+	logLevelName          string
+	useSyslog             bool
+	syslogFacility        string
+	syslogTag             string
+	blockMessage          string
+	blockURL              string
+	disclose              string
+	dotServer             string
+	dohURL                string
+	resolverMode          string
+	lookupTXT             bool
+	cacheTTL              time.Duration
+	cacheFile             string
+	cacheRefresh          int64
+	warmupFeed            string
+	warmupInterval        time.Duration
+	sharedCacheURL        string
+	gossipChannel         string
+	negativeCacheTTL      time.Duration
+	maxLookups            int
+	overflowScore         float64
+	breakerThreshold      int64
+	breakerRetry          time.Duration
+	listCheck             string
+	configFile            string
+	shadowConfig          string
+}
+
+var currentOptions atomic.Pointer[options]
+
+// opts returns the options in effect.
+func opts() *options {
+	return currentOptions.Load()
+}
+
+var outputChannel chan string
+var outputDone = make(chan struct{})
+
+// version is passed to Main by the command.
+var version string
+
+// shuttingDown is closed when the filter stops, so that delayed answers are
+// given right away.
+var shuttingDown = make(chan struct{})
+
+type session struct {
+	id string
+	// decisionId identifies the decision about the session across logs,
+	// headers and rejection messages
+	decisionId string
+
+	// the address, score and lists of the client
+	dnsbl.Session
+
+	local         net.IP
+	sender        string
+	rdns          string
+	helo          string
+	blocklisted   bool
+	dnsFailed     bool
+	outage        bool
+	junk          bool
+	rejected      bool
+	blocked       bool
+	shadowLogged  bool
+	junked        bool
+	exempt        bool
+	senderAllowed bool
+	authenticated bool
+	checked       map[string]bool
+	answers       map[string]rhsblAnswer
+	heloChecked   bool
+	tls           bool
+	uris          map[string]bool
+	mailboxes     map[string]bool
+	addressHeader string
+	uriLookups    int64
+	queries       []rhsblQuery
+	messageScore  float64
+	messages      int64
+	tx            *transaction
+
+	// sessions from trusted relays hold back the header of each message
+	// until the first untrusted Received hop has been scored
+	relayed   bool
+	hopScored bool
+	held      []string
+
+	phase      string
+	delay      int64
+	first_line bool
+	pending    bool
+	inHeaders  bool
+	stripping  bool
+
+	policyHeaders  []string
+	sessionHeaders int
+
+	// lastSeen is the time of the latest event of the session, which is
+	// evicted once it has been idle for -sessionMaxIdle
+	lastSeen time.Time
+	// connected is when the session started, tarpitted how many
+	// milliseconds its answers were delayed in total
+	connected time.Time
+	tarpitted int64
+	// connections is the number of connections from the source of the
+	// session within -connRateWindow, throttled whether it exceeded
+	// -connRate with -connRateAction tempfail
+	connections int64
+	throttled   bool
+	// profile is the policy of the listener the session was received
+	// on, nil for the top-level one
+	profile *profile
+	// entry is the allowlist or blocklist entry the session matched as
+	// written, source the file or URL and line it came from
+	entry  string
+	source string
+	// tlsVersion and tlsCipher are what the session negotiated as
+	// reported by link-tls
+	tlsVersion string
+	tlsCipher  string
+	// messageID is the Message-ID header of the current message,
+	// messageSize the bytes of it seen so far and oversized whether
+	// they exceeded -sizeLimit
+	messageID   string
+	messageSize int64
+	oversized   bool
+}
+
+// sessions holds the active sessions.
+var sessions = smtpdfilter.NewSessions[*session]()
+
+// decisionCount numbers the decisions in test mode.
+var decisionCount atomic.Uint64
+
+// evictIdle removes the sessions without any events since the given time,
+// except for those still being scored, and returns their IDs.
+func evictIdle(before time.Time) []string {
+	return sessions.Evict(func(sessionId string, s *session) bool {
+		_, scoring := pendingScores[sessionId]
+		return !scoring && s.lastSeen.Before(before)
+	})
+}
+
+// sessionSweepInterval is how often idle sessions are looked for, unless
+// -sessionMaxIdle is shorter.
+const sessionSweepInterval = time.Minute
+
+// sweepSessions evicts sessions idle for longer than -sessionMaxIdle, as
+// sessions are otherwise only removed when smtpd reports their disconnect,
+// which may never come, e.g. if smtpd restarts a listener. It also reports
+// the number of sessions to StatsD.
+func sweepSessions() {
+	interval := min(opts().sessionMaxIdle, sessionSweepInterval)
+	for range time.Tick(interval) {
+		runControl(func() string {
+			for _, sessionId := range evictIdle(clock().Add(-opts().sessionMaxIdle)) {
+				logf("session %s idle for more than %s, evicting it", sessionId, opts().sessionMaxIdle)
+				answers.cancel(sessionId)
+			}
+			statsd.send(fmt.Sprintf("sessions:%d|g", sessions.Len()))
+			return ""
+		})
+	}
+}
+
+// lookupResult is the outcome of querying all lists for an address.
+type lookupResult = dnsbl.Result
+
+var scoreLookups flightGroup[lookupResult]
+
+var reporters = map[string]func(string, string, []string){
+	"link-connect":    linkConnect,
+	"link-disconnect": linkDisconnect,
+	"link-auth":       linkAuth,
+	"link-tls":        linkTLS,
+	"tx-begin":        txBegin,
+	"tx-mail":         txMail,
+	"tx-rcpt":         txRcpt,
+	"tx-commit":       txCommit,
+	"tx-rollback":     txEnd,
+	"tx-reset":        txEnd,
+}
+
+var filters = map[string]func(string, string, []string){
+	"connect": filterConnect,
+
+	"helo":      delayedAnswer,
+	"ehlo":      delayedAnswer,
+	"starttls":  delayedAnswer,
+	"auth":      delayedAnswer,
+	"mail-from": delayedAnswer,
+	"rcpt-to":   delayedAnswer,
+	"data":      delayedAnswer,
+	"data-line": dataline,
+	"commit":    delayedAnswer,
+
+	"quit": delayedAnswer,
+}
+
+func linkConnect(phase string, sessionId string, params []string) {
+	if len(params) != 4 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+
+	s := &session{}
+	s.first_line = true
+	s.inHeaders = true
+	s.Score = -1
+	s.lastSeen = clock()
+	s.connected = s.lastSeen
+	sessions.Put(sessionId, s)
+
+	rdns, fcrdns := params[0], params[1]
+	s.rdns = rdns
+	if matchListener(params[3]) {
+		logf("skipping session on listener %s", params[3])
+		s.exempt = true
+		return
+	}
+
+	addr := parseAddress(params[2])
+	if addr == nil {
+		return
+	}
+
+	s.Addr = addr
+	s.decisionId = newDecisionId()
+	s.local = parseAddress(params[3])
+	if opts().connRate > 0 {
+		s.connections = connRates.add(connSource(addr))
+	}
+	if s.profile = profileFor(params[3]); s.profile != nil {
+		debugf("session %s on listener %s uses profile %s", sessionId, params[3], s.profile.name)
+	}
+
+	// lookups may take a while, so they must not hold up the events of
+	// other sessions
+	if opts().testMode {
+		scoreSession(context.Background(), sessionId, s, rdns, fcrdns)
+	} else {
+		startSessionScoring(sessionId, s, rdns, fcrdns)
+	}
+}
+
+// scoreSession assigns a score to a new session based on the access lists,
+// GeoIP rules, the history of its IP address, the blocklists it is listed on
+// and its reverse DNS. Cancelling ctx abandons outstanding lookups.
+func scoreSession(ctx context.Context, sessionId string, s *session, rdns string, fcrdns string) {
+	addr := s.Addr
+	defer func(addr net.IP, s *session) {
+		logEvent(levelInfo, sessionFields(sessionId, s), "link-connect addr=%s score=%v lists=%s id=%s", addr, s.Score, strings.Join(s.Lists, ","), s.decisionId)
+		stats.addSession(s.Score)
+		tuner.add(s.Score)
+		stats.addHits(s.Lists...)
+	}(addr, s)
+	defer applyUnknown(s)
+	defer pfCheck(s)
+	defer applyProfile(s)
+
+	if entry, ok := matchAccessList(allowlist, addr, rdns, fcrdns); ok {
+		logf("IP address %s matches allowlist entry %s", addr, describeEntry(allowlist, s, entry))
+		stats.addEntryHit("allowlist", s.entry)
+		s.Score = 0
+		fields := sessionFields(sessionId, s)
+		fields["decision"] = "allow"
+		decisions.write(fields)
+		return
+	}
+
+	if domain, ok := partners.match(addr); ok {
+		logf("IP address %s is a mail server of partner domain %s", addr, domain)
+		s.Score = 0
+		fields := sessionFields(sessionId, s)
+		fields["decision"] = "allow"
+		decisions.write(fields)
+		return
+	}
+
+	if isTrustedRelay(addr) {
+		logf("IP address %s is a trusted relay, scoring the Received headers of its messages instead", addr)
+		s.relayed = true
+		s.Score = 0
+		return
+	}
+
+	if expires, ok := authAllowed.contains(addr.String()); ok {
+		logf("IP address %s authenticated successfully before, allowlisted until %s", addr, expires.UTC().Format(time.RFC3339))
+		s.Score = 0
+		return
+	}
+
+	if key, ok := geoipAllowed(addr); ok {
+		logf("IP address %s matches GeoIP rule %s:allow", addr, key)
+		s.Score = 0
+		return
+	}
+
+	if key, ok := geoipBlocked(addr); ok {
+		logf("IP address %s matches GeoIP rule %s:block", addr, key)
+		s.Lists = []string{"geoip"}
+		s.Score = maxScore
+		s.blocklisted = true
+		return
+	}
+
+	if offenders.blocked(addr.String()) {
+		logf("IP address %s is temporarily blocked as a repeat offender", addr)
+		s.Lists = []string{"offender"}
+		s.Score = maxScore
+		s.blocklisted = true
+		return
+	}
+
+	if entry, ok := matchAccessList(blocklist, addr, rdns, fcrdns); ok {
+		logf("IP address %s matches blocklist entry %s", addr, describeEntry(blocklist, s, entry))
+		stats.addEntryHit("blocklist", s.entry)
+		s.Lists = []string{"blocklist"}
+		if opts().blocklistScore >= 0 {
+			s.Score = opts().blocklistScore
+		} else {
+			s.Score = maxScore
+			s.blocklisted = true
+		}
+		return
+	}
+
+	if !opts().scoreSpecialUse && isSpecialUse(addr) {
+		logf("IP address %s is a special-use address", addr)
+		s.Score = 0
+		return
+	}
+
+	if !sampled() {
+		logf("IP address %s is not sampled, skipping lookups", addr)
+		s.exempt = true
+		return
+	}
+
+	// the history of the address, GeoIP rules, the external scorer,
+	// reverse DNS penalties, the connection rate and the neighborhood
+	// apply even if the address cannot be looked up
+	defer applyNeighborhood(s)
+	defer applyConnRate(s)
+	defer applyReputation(s)
+	defer applyGeoip(s)
+	defer execScore(s, rdns, fcrdns)
+	defer addRDNSPenalty(s, rdns, fcrdns)
+
+	// DNSBL lookups are only supported for IPv4 addresses
+	if addr.To4() == nil {
+		return
+	}
+
+	atoms := strings.Split(addr.String(), ".")
+
+	var result lookupResult
+	if scoredByLastOctet(atoms) {
+		// if test mode is enabled, the DNS queries are skipped and the
+		// score is derived directly from the connecting IP address; IP
+		// addresses ending with 255 can be used to simulate missing
+		// DNS entries and those ending with 254 to simulate failures,
+		// while those starting with 99 are looked up on the lists
+		// through testResolver
+		switch atoms[3] {
+		case "255":
+			return
+		case "254":
+			result = lookupResult{Score: -1, Failed: true, Outage: true}
+		default:
+			n, _ := strconv.ParseInt(atoms[3], 10, 8)
+			result.Score = float64(n)
+		}
+		outage.observe(result.Outage)
+	} else {
+		// sessions from the same address connecting simultaneously
+		// share a single set of lookups, which is only cancelled once
+		// all of them have gone away
+		var err error
+		result, err = scoreLookups.do(ctx, addr.String(), func(ctx context.Context) lookupResult {
+			if !acquireLookupSlot() {
+				logf("too many concurrent lookups, assigning score %v to %s", opts().overflowScore, addr)
+				return lookupResult{Score: opts().overflowScore}
+			}
+			defer releaseLookupSlot()
+			defer statsd.timing("lookup", time.Now())
+			return queryLists(ctx, addr)
+		})
+		if err != nil {
+			result = lookupResult{Score: -1, Failed: true}
+		}
+	}
+
+	// the result may be shared with other sessions from the same address
+	s.Apply(result)
+	if result.Failed && ctx.Err() == nil {
+		markDNSFailed(s, result.Outage)
+		logf("DNS lookups for IP address %s failed, applying %s policy", addr, failurePolicy(s))
+	}
+}
+
+// sampled reports whether a session is among the -sampleRate percent of
+// sessions which are scored.
+func sampled() bool {
+	return opts().sampleRate >= 100 || float64(random(10000)) < opts().sampleRate*100
+}
+
+// markDNSFailed records that the blocklists could not tell anything about the
+// IP address of a session and applies -onDnsFailure, or -onOutage if all
+// lists failed.
+func markDNSFailed(s *session, outage bool) {
+	stats.addDNSFailure()
+	s.dnsFailed, s.outage = true, outage
+	if failurePolicy(s) == "junk" {
+		s.junk = true
+	}
+}
+
+// addRDNSPenalty adds -noRdnsScore to the score of sessions from IP addresses
+// without a PTR record, -fcrdnsScore to those whose PTR record fails forward
+// confirmation and -dynamicRdnsScore to those whose PTR record looks like it
+// belongs to a dynamic or residential address. Temporary DNS errors are not
+// penalized.
+func addRDNSPenalty(s *session, rdns string, fcrdns string) {
+	var penalty float64
+	if rdns == "" {
+		penalty += opts().noRdnsScore
+	} else {
+		if fcrdns == "fail" {
+			penalty += opts().fcrdnsScore
+		}
+		if opts().dynamicRdnsScore > 0 && isDynamic(strings.ToLower(rdns)) {
+			penalty += opts().dynamicRdnsScore
+		}
+	}
+	if penalty <= 0 {
+		return
+	}
+	s.Score = max(s.Score, 0) + penalty
+	logf("IP address %s has suspicious reverse DNS %q, adding %v", s.Addr, rdns, penalty)
+}
+
+// addHeloPenalty adds -heloForgeryScore to the score of sessions greeting with
+// one of -localHostnames, the address of the listener they connected to or a
+// name which is neither qualified nor an address literal, as no legitimate
+// MTA does so. Only the first greeting of a session is checked, and clients
+// which are exempt from lookups as special-use addresses are not penalized.
+func addHeloPenalty(s *session) {
+	if opts().heloForgeryScore <= 0 || s.heloChecked || s.Addr == nil || !opts().scoreSpecialUse && isSpecialUse(s.Addr) {
+		return
+	}
+	s.heloChecked = true
+
+	helo := strings.ToLower(strings.TrimSuffix(s.helo, "."))
+	var reason string
+	literal := strings.TrimPrefix(strings.Trim(helo, "[]"), "ipv6:")
+	switch addr := net.ParseIP(literal); {
+	case addr != nil:
+		if s.local != nil && addr.Equal(s.local) {
+			reason = "our IP address"
+		}
+	case isLocalHostname(helo):
+		reason = "our hostname"
+	case !strings.Contains(helo, "."):
+		reason = "an unqualified name"
+	}
+	if reason == "" {
+		return
+	}
+	s.Score = max(s.Score, 0) + opts().heloForgeryScore
+	logf("IP address %s greeted with %s %q, adding %v", s.Addr, reason, s.helo, opts().heloForgeryScore)
+}
+
+// isLocalHostname reports whether name is one of -localHostnames or, if none
+// are given, the name of the host.
+func isLocalHostname(name string) bool {
+	names := opts().localHostnames
+	if names == "" {
+		names, _ = os.Hostname()
+	}
+	for _, entry := range strings.Split(names, ",") {
+		entry = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(entry), "."))
+		if entry != "" && entry == name {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDynamicPatterns match PTR records commonly assigned to dynamic and
+// residential IP addresses.
+var defaultDynamicPatterns = []string{
+	`^(dsl|adsl|xdsl|dyn|dynamic|dhcp|pool|ppp|pppoe|cable|dial|dialup|client|cust|customer)[-.]?[0-9]`,
+	`[0-9]+[-.][0-9]+[-.][0-9]+[-.][0-9]+`,
+	`[.-](dyn|dynamic|dynip|dhcp|pool|ppp|pppoe|dsl|adsl|xdsl|cable|dialup|broadband|residential)[.-]`,
+}
+
+// dynamicPatterns are compiled along with the rest of the configuration.
+var dynamicPatterns []*regexp.Regexp
+
+// compileDynamicPatterns compiles the built-in patterns and the given ones of
+// -dynamicPattern.
+func compileDynamicPatterns(specs []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, p := range append(defaultDynamicPatterns, specs...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dynamic reverse DNS pattern: %v", err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// isDynamic reports whether a PTR record matches any of the dynamic patterns.
+func isDynamic(rdns string) bool {
+	for _, re := range dynamicPatterns {
+		if re.MatchString(rdns) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateWeights combines the weights of the lists an IP address is listed
+// on according to -aggregate: their sum, the largest one, or the largest one
+// plus half the second largest plus a quarter of the third largest and so on.
+func aggregateWeights(weights []float64) float64 {
+	sort.Sort(sort.Reverse(sort.Float64Slice(weights)))
+	var score float64
+	factor := 1.0
+	for _, weight := range weights {
+		switch opts().aggregate {
+		case "max":
+			return weight
+		case "weighted":
+			score += weight * factor
+			factor /= 2
+		default:
+			score += weight
+		}
+	}
+	return score
+}
+
+// queryLists looks up an IP address on all blocklists and DNS allowlists at
+// once. As soon as the hits so far put the address above -blockAbove at every
+// phase, even if all DNS allowlists still pending vouched for it, the
+// remaining lookups are cancelled.
+func queryLists(ctx context.Context, addr net.IP) lookupResult {
+	// all lookups for an address, including retries, share one budget,
+	// which lists may shorten with a timeout of their own
+	ctx, cancel := context.WithTimeout(ctx, opts().lookupTimeout)
+	defer cancel()
+
+	threshold := earlyExitThreshold()
+	scorer := dnsbl.Scorer{
+		Blocklists: domainWeights,
+		DNSWLs:     dnswlWeights,
+		Lookup: func(ctx context.Context, list string, name string) ([]net.IP, error) {
+			ctx, cancel := listContext(ctx, list)
+			defer cancel()
+			addrs, err := lookup(ctx, list, name)
+			if !errors.Is(ctx.Err(), context.Canceled) && !errors.Is(err, errRateLimited) {
+				breakers[list].record(err)
+			}
+			return addrs, err
+		},
+		Allow: func(list string) bool {
+			return breakers[list].allow()
+		},
+		Skip: func(err error) bool {
+			return errors.Is(err, errRateLimited)
+		},
+		Weight: func(list string, weight float64) float64 {
+			return weight * reliability.confidence(list)
+		},
+		Combine: func(weights map[string]float64) float64 {
+			return aggregateWeights(groupedWeights(weights))
+		},
+		Enough: func(lists []string, score float64) bool {
+			if threshold < 0 || countLists(lists) < opts().minLists || score <= threshold {
+				return false
+			}
+			debugf("IP address %s is above the block threshold, skipping the remaining lookups", addr)
+			return true
+		},
+	}
+	if opts().lookupTXT {
+		scorer.Reason = func(ctx context.Context, list string, name string) string {
+			ctx, cancel := listContext(ctx, list)
+			defer cancel()
+			return listingReason(ctx, list, name)
+		}
+	}
+	result := scorer.Query(ctx, addr)
+	if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		outage.observe(result.Outage)
+	}
+	return result
+}
+
+// scoreDomain adds the weights of the given RHSBLs a hostname or domain of a
+// session is listed on to its score. The lookups are done by eventLookups.
+func scoreDomain(s *session, hostname string, lists map[string]float64) {
+	var domains []string
+	for _, q := range domainQueries(s, hostname, lists) {
+		listed, err := takeAnswer(s, q)
+		if err != nil {
+			continue
+		}
+		if s.checked == nil {
+			s.checked = make(map[string]bool)
+		}
+		s.checked[q.key()] = true
+		if listed {
+			s.Score = max(s.Score, 0) + q.weight
+			domains = append(domains, q.list)
+		}
+	}
+
+	if len(domains) > 0 {
+		sort.Strings(domains)
+		s.Lists = append(s.Lists, domains...)
+		stats.addHits(domains...)
+		logf("%s is listed on %s, score=%v", strings.ToLower(strings.TrimSuffix(hostname, ".")), strings.Join(domains, ","), s.Score)
+	}
+}
+
+// domainQueries returns the lookups of a hostname or domain in the given
+// RHSBLs. Address literals are never looked up, as RHSBLs such as
+// dbl.spamhaus.org answer queries for IP addresses with an error code. Each
+// name is only scored once per session, even if it is sent again, e.g. with
+// EHLO after STARTTLS.
+func domainQueries(s *session, hostname string, lists map[string]float64) []rhsblQuery {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if len(lists) == 0 || !isDomainName(hostname) {
+		return nil
+	}
+	var queries []rhsblQuery
+	for list, weight := range lists {
+		q := rhsblQuery{name: hostname, list: list, weight: weight}
+		if !s.checked[q.key()] {
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
+
+// queryRHSBL looks up name in the given RHSBL, unless the list is currently
+// disabled by its circuit breaker.
+func queryRHSBL(ctx context.Context, name string, domain string) (bool, error) {
+	if opts().testMode && opts().fakeDNS == "" {
+		// in test mode, names starting with listed are considered to be
+		// listed everywhere
+		return strings.HasPrefix(name, "listed.") || strings.HasPrefix(name, "listed@"), nil
+	}
+
+	b := breakers[domain]
+	if !b.allow() {
+		return false, errBreakerOpen
+	}
+	ctx, cancel := listContext(ctx, domain)
+	defer cancel()
+	addrs, err := lookup(ctx, domain, name)
+	if !errors.Is(err, errRateLimited) {
+		b.record(err)
+	}
+	return isRHSBLHit(addrs), err
+}
+
+// isDomainName reports whether s is a fully qualified domain name, as opposed
+// to an address literal or a bare label.
+func isDomainName(s string) bool {
+	if !strings.Contains(s, ".") || strings.HasPrefix(s, ".") || net.ParseIP(s) != nil {
+		return false
+	}
+	return !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_')
+	})
+}
+
+// isRHSBLHit reports whether an RHSBL answer denotes a listing. Answers in
+// 127.255.255.0/24 are error codes, e.g. for queries sent through public
+// resolvers, and do not count.
+func isRHSBLHit(addrs []net.IP) bool {
+	for _, a := range addrs {
+		if a4 := a.To4(); a4 != nil && !(a4[0] == 127 && a4[1] == 255 && a4[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAccessList matches the address and, if it is forward-confirmed, the
+// hostname of a session against an allowlist or blocklist. Unconfirmed
+// hostnames are not considered since anybody can set up arbitrary PTR records
+// for their own address space.
+func matchAccessList(l *dnsbl.Allowlist, addr net.IP, rdns string, fcrdns string) (string, bool) {
+	if subnet, ok := l.Match(addr); ok {
+		return subnet, true
+	}
+	if fcrdns == "pass" {
+		return l.MatchHostname(rdns)
+	}
+	return "", false
+}
+
+// describeEntry records which entry of l as written made the session match
+// with the given entry, and where it came from, and describes it for logging.
+func describeEntry(l *dnsbl.Allowlist, s *session, entry string) string {
+	s.entry, s.source = l.Attribute(entry, s.Addr)
+	description := entry
+	switch {
+	case s.entry != entry && s.source != "":
+		description += fmt.Sprintf(" (%s at %s)", s.entry, s.source)
+	case s.entry != entry:
+		description += fmt.Sprintf(" (%s)", s.entry)
+	case s.source != "":
+		description += " at " + s.source
+	}
+	return description
+}
+
+// matchListener reports whether the destination address of a session matches
+// any of the listeners given by -skipListeners. Entries are of the form
+// address:port, address, :port or a literal socket path.
+func matchListener(dest string) bool {
+	return listenerMatches(strings.Split(opts().skipListeners, ","), dest)
+}
+
+// listenerMatches reports whether the destination address of a session
+// matches any of the given listener entries.
+func listenerMatches(entries []string, dest string) bool {
+	host, port, err := net.SplitHostPort(dest)
+	host = strings.TrimPrefix(host, "IPv6:")
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == dest {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+
+		entryHost, entryPort, entryErr := net.SplitHostPort(entry)
+		if entryErr != nil {
+			entryHost, entryPort = strings.Trim(entry, "[]"), ""
+		}
+		hostMatches := entryHost == "" || entryHost == host ||
+			net.ParseIP(entryHost) != nil && net.ParseIP(entryHost).Equal(net.ParseIP(host))
+		if hostMatches && (entryPort == "" || entryPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSender reports whether an envelope sender matches any of the entries
+// given by -allowSenders and returns the matching entry. Entries are either
+// addresses or domains, optionally preceded by an @, and are compared
+// case-insensitively. The null sender never matches.
+func matchSender(sender string) (string, bool) {
+	sender = strings.ToLower(strings.Trim(sender, "<> "))
+	_, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		return "", false
+	}
+
+	for _, entry := range strings.Split(opts().allowSenders, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == sender || strings.TrimPrefix(entry, "@") == domain {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// matchRecipient reports whether a recipient matches any of the entries given
+// by -exemptRecipients. Entries are of the form local part, which matches at
+// any domain, address or @domain and are compared case-insensitively.
+func matchRecipient(rcpt string) bool {
+	rcpt = strings.ToLower(strings.Trim(rcpt, "<> "))
+	local, domain, _ := strings.Cut(rcpt, "@")
+
+	for _, entry := range strings.Split(opts().exemptRecipients, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(entry, "@"):
+			if domain != "" && entry == "@"+domain {
+				return true
+			}
+		case strings.Contains(entry, "@"):
+			if entry == rcpt {
+				return true
+			}
+		case entry == local:
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress extracts the IP address from a source or destination address
+// as reported by smtpd, i.e. 192.0.2.1:25 or [2001:db8::1]:25. It returns nil
+// for anything else, such as local socket paths.
+func parseAddress(s string) net.IP {
+	host := s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		host = s[:i]
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	host = strings.TrimPrefix(host, "IPv6:")
+	return net.ParseIP(host)
+}
+
+func linkDisconnect(phase string, sessionId string, params []string) {
+	// parameters added by newer protocol versions don't matter here, the
+	// session is gone either way
+	if s, ok := sessions.Get(sessionId); ok {
+		reliability.observe(s.Lists, s.blocked)
+		if len(s.Lists) > 0 || s.blocklisted {
+			stats.addListedSession(clock().Sub(s.connected), s.tarpitted, s.blocked)
+		}
+	}
+	if n := answers.cancel(sessionId); n > 0 {
+		debugf("session %s disconnected, dropping %d pending answers", sessionId, n)
+	}
+}
+
+func linkAuth(phase string, sessionId string, params []string) {
+	if len(params) < 2 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+
+	// older protocol versions send the username first, newer ones send
+	// the result first since the username may contain separators
+	result := params[0]
+	if result != "pass" && result != "fail" && result != "error" {
+		result = params[len(params)-1]
+	}
+	if result != "pass" {
+		return
+	}
+
+	// authenticated sessions are exempt from any further delays and
+	// actions, regardless of their score
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	s.exempt = true
+	s.authenticated = true
+	s.delay = 0
+	if s.Addr != nil {
+		authAllowed.add(s.Addr.String())
+	}
+}
+
+// newDecisionId returns a short random identifier for the decision about a
+// session, which senders can quote from their bounces. In test mode,
+// decisions are numbered instead so that the output stays reproducible.
+func newDecisionId() string {
+	if opts().testMode {
+		return fmt.Sprintf("%08d", decisionCount.Add(1))
+	}
+	b := make([]byte, 5)
+	rand.Read(b)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// getSession returns the session with the given ID. It reports false for
+// sessions the filter does not know, whose events are to be skipped.
+func getSession(sessionId string) (*session, bool) {
+	return sessions.Get(sessionId)
+}
+
+// unknownSession logs an event of a session the filter does not know, which
+// is skipped.
+func unknownSession(phase string, sessionId string) {
+	errorf("%s for unknown session %s, ignoring", phase, sessionId)
+}
+
+// blockAction returns the decision blocking the session at the given phase
+// according to -blockAbove, -tempfailAbove, -rejectAbove, -minLists and
+// -onDnsFailure, or no decision if it is not to be blocked.
+func blockAction(s *session, phase string) decision {
+	var d decision
+	switch {
+	case s.exempt, s.senderAllowed, s.relayed:
+		// trusted relays would bounce what they cannot deliver
+		return decision{}
+	case s.blocklisted:
+		if !hasPhase(opts().blockPhase, phase) {
+			return decision{}
+		}
+		d = dnsbl.Disconnect(550, "")
+	case s.profile.blockThreshold().exceeded(phase, s.Score) && countLists(s.Lists) >= opts().minLists:
+		d = dnsbl.Disconnect(550, "")
+	case s.dnsFailed && failurePolicy(s) == "tempfail" && hasPhase(opts().blockPhase, phase):
+		return dnsbl.Disconnect(451, dnsFailureMessage)
+	case s.throttled && hasPhase(opts().blockPhase, phase):
+		return dnsbl.Disconnect(451, connRateMessage)
+	case unknownPolicy(s) == "tempfail" && hasPhase(opts().blockPhase, phase):
+		return dnsbl.Disconnect(451, unknownMessage)
+	case s.Score == -1:
+		return decision{}
+	case s.profile.tempfailThreshold().exceeded(phase, s.Score):
+		d = dnsbl.Disconnect(451, "")
+	case s.profile.rejectThreshold().exceeded(phase, s.Score):
+		d = dnsbl.Reject(550, "")
+	default:
+		return decision{}
+	}
+	d.Message = rejectionMessage(s)
+	return d
+}
+
+// destinedToBlock reports whether the score of a session is above the block
+// threshold of any phase, so that it is going to be disconnected at the
+// latest once that phase is reached.
+func destinedToBlock(s *session) bool {
+	if s.exempt || s.senderAllowed || s.relayed {
+		return false
+	}
+	if s.blocklisted {
+		return true
+	}
+	t := s.profile.blockThreshold()
+	return countLists(s.Lists) >= opts().minLists && slices.ContainsFunc(decisionPhases, func(phase string) bool {
+		return t.exceeded(phase, s.Score)
+	})
+}
+
+// dnsFailureMessage is sent to sessions disconnected by -onDnsFailure
+// tempfail.
+const dnsFailureMessage = "temporary failure checking your IP address, please try again later"
+
+// countLists returns the number of distinct lists among the given ones,
+// counting the members of a -listGroup as one.
+func countLists(lists []string) int64 {
+	distinct := make(map[string]bool)
+	for _, list := range lists {
+		distinct[groupOf(list)] = true
+	}
+	return int64(len(distinct))
+}
+
+// shouldJunk reports whether the session is to be marked as junk once the
+// junk phase is reached.
+func shouldJunk(s *session) bool {
+	if s.exempt || s.senderAllowed {
+		return false
+	}
+	threshold := s.profile.junkThreshold()
+	return s.junk || s.Score != -1 && threshold >= 0 && s.Score > threshold
+}
+
+// exceedsRecipientLimit reports whether the session has a score above
+// -recipientLimitAbove and smtpd already accepted as many recipients for the
+// current transaction as -recipientLimit allows.
+func exceedsRecipientLimit(s *session) bool {
+	if s.exempt || opts().recipientLimit <= 0 || s.Score == -1 || s.tx == nil {
+		return false
+	}
+	return s.Score > opts().recipientLimitAbove && s.tx.recipients >= opts().recipientLimit
+}
+
+// exceedsMessageLimit reports whether the session has a score above
+// -messageLimitAbove and has already committed as many messages as allowed by
+// -messageLimit.
+func exceedsMessageLimit(s *session) bool {
+	if s.exempt || opts().messageLimit <= 0 || s.Score == -1 {
+		return false
+	}
+	return s.Score > opts().messageLimitAbove && s.messages >= opts().messageLimit
+}
+
+// exceedsSizeLimit reports whether the session has a score above
+// -sizeLimitAbove and the message it is sending has grown beyond -sizeLimit.
+func exceedsSizeLimit(s *session) bool {
+	if s.exempt || opts().sizeLimit <= 0 || s.Score == -1 {
+		return false
+	}
+	return s.Score > opts().sizeLimitAbove && s.messageSize > opts().sizeLimit
+}
+
+// shouldGreylist reports whether the recipients of the session are subject to
+// greylisting.
+func shouldGreylist(s *session) bool {
+	return !s.exempt && s.Addr != nil && s.Score != -1 && opts().greylistAbove >= 0 && s.Score > opts().greylistAbove
+}
+
+// shouldQuarantine reports whether the recipients of the session are to be
+// replaced by -quarantineAddress. Mail from allowlisted senders and to exempt
+// recipients is delivered as usual.
+func shouldQuarantine(s *session, rcpt string) bool {
+	if s.exempt || s.senderAllowed || s.Score == -1 || opts().quarantineAbove < 0 || s.Score <= opts().quarantineAbove {
+		return false
+	}
+	return !matchRecipient(rcpt)
+}
+
+// requiresTLS reports whether the session has a score above -requireTLSAbove
+// and has not issued STARTTLS yet.
+func requiresTLS(s *session) bool {
+	return !s.exempt && !s.senderAllowed && !s.tls && s.Score != -1 && opts().requireTLSAbove >= 0 && s.Score > opts().requireTLSAbove
+}
+
+// tarpit returns the delay in milliseconds by which the answers to a session
+// are held back, in proportion to its score.
+func tarpit(s *session) int64 {
+	factor := s.profile.slowFactor()
+	switch {
+	case factor > 0 && s.Score > 0:
+		return int64(float64(factor) * s.Score / s.profile.maxScore())
+	case unknownPolicy(s) == "delay":
+		// as much as for the highest score, as nothing vouches for it
+		return factor
+	}
+	// no slow factor or neutral IP address
+	return 0
+}
+
+func filterConnect(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	s.delay = tarpit(s)
+
+	delayedAnswer(phase, sessionId, params)
+
+	// only the banner is delayed, the remainder of the session proceeds
+	// at full speed
+	if opts().bannerDelay {
+		s.delay = 0
+	}
+}
+
+func produceOutput(msgType string, sessionId string, token string, format string, a ...interface{}) {
+	smtpd.Send(msgType, sessionId, token, fmt.Sprintf(format, a...))
+}
+
+func dataline(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	token := params[0]
+	line := strings.Join(params[1:], "|")
+
+	if s.relayed && !s.hopScored && !s.exempt {
+		s.held = append(s.held, line)
+		if line != "" && line != "." {
+			return
+		}
+		scoreRelayedMessage(sessionId, s, s.held)
+		held := s.held
+		s.held = nil
+		for _, line := range held {
+			dataline(phase, sessionId, append([]string{token}, strings.Split(line, "|")...))
+		}
+		return
+	}
+
+	// the lines beyond the size limit are dropped, only the end of the
+	// message is passed on so that it can be refused at commit
+	if s.oversized && line != "." {
+		return
+	}
+	if line != "." {
+		s.messageSize += int64(len(line)) + 2
+		if exceedsSizeLimit(s) {
+			logf("session %s from %s exceeded the size limit of %d bytes with score %v, dropping the rest of the message", sessionId, s.Addr, opts().sizeLimit, s.Score)
+			s.oversized = true
+			return
+		}
+	}
+
+	if s.first_line == true {
+		s.first_line = false
+		s.pending = true
+		// the envelope line of messages in mbox format must stay first
+		if strings.HasPrefix(line, "From ") {
+			produceOutput("filter-dataline", sessionId, token, "%s", line)
+			return
+		}
+	}
+	if s.pending && headerPositionReached(s, line) {
+		if s.Score != -1 && !s.exempt {
+			injectHeaders(s, sessionId, token)
+		}
+		// the policy command sees the exemption and decides for itself
+		for _, header := range s.policyHeaders {
+			produceOutput("filter-dataline", sessionId, token, "%s", header)
+		}
+		s.pending = false
+	}
+
+	if len(uriblWeights) > 0 && !s.exempt {
+		scanURIs(s, line)
+	}
+
+	if s.inHeaders {
+		// folded header lines belong to the preceding header
+		if s.stripping && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			return
+		}
+		s.stripping = false
+
+		if len(eblWeights) > 0 && !s.exempt {
+			collectAddresses(s, line)
+		}
+
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "message-id") {
+			s.messageID = strings.TrimSpace(value)
+		}
+
+		if line == "" {
+			s.inHeaders = false
+		} else if opts().stripHeaders && isStrippedHeader(line) {
+			s.stripping = true
+			return
+		} else if opts().junkSubject != "" && shouldJunk(s) && strings.HasPrefix(strings.ToLower(line), "subject:") {
+			line = strings.TrimRight("Subject: "+opts().junkSubject+" "+strings.TrimLeft(line[8:], " "), " ")
+		}
+	}
+
+	produceOutput("filter-dataline", sessionId, token, "%s", line)
+}
+
+// scoreHeaderDetails returns the details given by -headerDetails to append to
+// the score header, e.g. " (zen.spamhaus.org=127.0.0.4) id=k3v7q2xa". Lists
+// without return codes, such as RHSBLs, are given by name only.
+func scoreHeaderDetails(s *session) string {
+	details := make(map[string]bool)
+	for _, detail := range strings.Split(opts().headerDetails, ",") {
+		details[strings.TrimSpace(detail)] = true
+	}
+
+	var b strings.Builder
+	if details["lists"] && len(s.Lists) > 0 {
+		var lists []string
+		for _, list := range s.Lists {
+			if code, ok := s.Codes[list]; ok {
+				list += "=" + code
+			}
+			if !slices.Contains(lists, list) {
+				lists = append(lists, list)
+			}
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(lists, " "))
+	}
+	if details["reasons"] && len(s.Reasons) > 0 {
+		fmt.Fprintf(&b, " (%s)", joinReasons(s.Reasons))
+	}
+	if details["id"] && s.decisionId != "" {
+		fmt.Fprintf(&b, " id=%s", s.decisionId)
+	}
+	if details["host"] {
+		host, _ := os.Hostname()
+		if names := strings.Split(opts().localHostnames, ","); names[0] != "" {
+			host = strings.TrimSpace(names[0])
+		}
+		fmt.Fprintf(&b, " by %s", host)
+	}
+	if details["version"] {
+		fmt.Fprintf(&b, " (filter-dnsblscore %s)", version)
+	}
+	if details["time"] {
+		fmt.Fprintf(&b, "; %s", clock().Format(time.RFC1123Z))
+	}
+	return b.String()
+}
+
+// isStrippedHeader reports whether a header line starts one of the headers
+// given by -stripHeaderNames or, by default, one of those the filter adds
+// about the blocklists, so that senders cannot pre-seed trusted-looking
+// values for downstream rules.
+func isStrippedHeader(line string) bool {
+	names := opts().stripHeaderNames
+	if names == "" {
+		names = opts().headerName + ",X-DNSBL-Listed"
+	}
+	name, _, ok := strings.Cut(line, ":")
+	if !ok {
+		return false
+	}
+	for _, entry := range strings.Split(names, ",") {
+		if strings.EqualFold(strings.TrimSpace(entry), strings.TrimRight(name, " \t")) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerPositionReached reports whether our headers go before the given line
+// of the message according to -headerPosition: at the top of the header
+// block, after the Received headers at its top, or at its end. Messages
+// without a body get them before their final line at the latest.
+func headerPositionReached(s *session, line string) bool {
+	if !s.inHeaders || line == "" || line == "." {
+		return true
+	}
+	switch opts().headerPosition {
+	case "received":
+		continued := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		return !continued && !strings.HasPrefix(strings.ToLower(line), "received:")
+	case "end":
+		return false
+	}
+	return true
+}
+
+// injectHeaders prepends the configured headers to the message of a scored
+// session.
+func injectHeaders(s *session, sessionId string, token string) {
+	if opts().scoreHeader && s.Score > opts().headerAbove {
+		produceOutput("filter-dataline", sessionId, token, "%s: %v%s", opts().headerName, s.Score, scoreHeaderDetails(s))
+	}
+	if opts().junkHeader && shouldJunk(s) {
+		produceOutput("filter-dataline", sessionId, token, "X-Spam: yes")
+	}
+	if opts().listedHeader && len(s.Lists) > 0 {
+		produceOutput("filter-dataline", sessionId, token, "X-DNSBL-Listed: %s", strings.Join(s.Lists, ", "))
+	}
+	if opts().authservID != "" {
+		result := "pass"
+		if s.Score > 0 {
+			result = "fail"
+		}
+		produceOutput("filter-dataline", sessionId, token, "Authentication-Results: %s; dnsbl=%s (score=%v) ip=%s",
+			opts().authservID, result, s.Score, s.Addr)
+	}
+}
+
+func delayedAnswer(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	s.phase = phase
+
+	if (phase == "helo" || phase == "ehlo") && len(params) > 1 {
+		s.helo = params[1]
+	}
+	if phase == "mail-from" && len(params) > 1 {
+		s.sender = params[1]
+	}
+	if phase == "mail-from" {
+		// headers added during a transaction only apply to its message
+		s.policyHeaders = s.policyHeaders[:s.sessionHeaders]
+		if s.relayed {
+			s.Score, s.Lists, s.Codes, s.Reasons, s.hopScored = 0, nil, nil, nil, false
+		}
+
+		entry, ok := matchSender(s.sender)
+		if ok {
+			logf("session %s: sender %s matches sender allowlist entry %s", sessionId, s.sender, entry)
+		}
+		s.senderAllowed = ok
+	}
+	if phase == "data" {
+		s.first_line = true
+		s.inHeaders = true
+		s.uris, s.uriLookups, s.mailboxes, s.messageScore, s.messageID = nil, 0, nil, 0, ""
+		s.queries = nil
+		s.addressHeader = ""
+		s.messageSize, s.oversized = 0, false
+	}
+	compareShadow(s, sessionId, phase)
+
+	decide(s, sessionId, phase, params, func(s *session, d decision) {
+		d.Delay = nextDelay(s)
+		if opts().blockDelay >= 0 && d.Blocks() {
+			d.Delay = opts().blockDelay
+		}
+		respond(sessionId, params[0], d)
+	})
+}
+
+// decide makes the decision on a filter request of a session and passes it to
+// answer. Rules take precedence over the policy script, the policy command
+// and the built-in logic, in that order.
+func decide(s *session, sessionId string, phase string, params []string, answer func(s *session, d decision)) {
+	ruled := matchRules(s, phase).decision(s)
+	if ruled.Action != "" {
+		answer(s, ruled)
+		return
+	}
+	scripted := runScript(s, sessionId, phase).decision(s)
+	headers := append(ruled.Headers, scripted.Headers...)
+	if scripted.Action != "" {
+		scripted.Headers = headers
+		answer(s, scripted)
+		return
+	}
+
+	finish := func(s *session, asked policyDecision) {
+		d := asked.decision(s)
+		headers := append(headers, d.Headers...)
+		if d.Action == "" {
+			d = decideBuiltin(s, sessionId, phase, params)
+		}
+		d.Headers = headers
+		answer(s, d)
+	}
+	if opts().policyCommand == "" {
+		finish(s, policyDecision{})
+		return
+	}
+	req := newPolicyRequest(s, sessionId, phase)
+	if opts().testMode {
+		finish(s, askPolicy(context.Background(), req))
+		return
+	}
+	startScoring(sessionId, nil, func(ctx context.Context) func(s *session) {
+		asked := askPolicy(ctx, req)
+		return func(s *session) { finish(s, asked) }
+	}, func(s *session) {
+		errorf("policy command did not answer for session %s within %s", sessionId, opts().scoreTimeout)
+		finish(s, policyDecision{})
+	})
+}
+
+// decideBuiltin applies the thresholds and limits to a filter request of a
+// session.
+func decideBuiltin(s *session, sessionId string, phase string, params []string) decision {
+	// mail to postmaster, abuse and the like must get through, so that
+	// blocked senders can reach a human
+	if phase == "rcpt-to" && len(params) > 1 && blockAction(s, phase).Action != "" && matchRecipient(params[1]) {
+		logf("session %s sends to exempt recipient %s, applying %s instead of blocking it", sessionId, params[1], opts().exemptRecipientAction)
+		if opts().exemptRecipientAction == "junk" {
+			s.junk = true
+			if !s.junked {
+				s.junked = true
+				stats.addJunked()
+			}
+			return dnsbl.Junk()
+		}
+		return dnsbl.Proceed()
+	}
+	if d := blockAction(s, phase); d.Action != "" {
+		if !s.rejected {
+			stats.addBlocked()
+		}
+		s.blocked = true
+		recordReputation(s, true)
+		if d.Action == "disconnect" && d.Permanent() {
+			spamd.add(s.Addr.String())
+		}
+		return d
+	}
+	if (phase == "helo" || phase == "ehlo") && s.helo != "" && !s.exempt {
+		addHeloPenalty(s)
+		scoreDomain(s, s.helo, rhsblWeights)
+	}
+	if phase == "starttls" {
+		// a failed handshake ends the session, so the request is as
+		// good as the negotiation itself
+		s.tls = true
+	}
+	if phase == "mail-from" && exceedsMessageLimit(s) {
+		logf("session %s from %s exceeded the message limit", sessionId, s.Addr)
+		return dnsbl.Reject(451, "too many messages in this session, please try again later")
+	}
+	if phase == "mail-from" && requiresTLS(s) {
+		logf("session %s from %s did not issue STARTTLS, rejecting mail-from", sessionId, s.Addr)
+		recordReputation(s, true)
+		return dnsbl.Reject(530, "5.7.0 must issue a STARTTLS command first")
+	}
+	if phase == "mail-from" && !s.exempt {
+		if _, domain, ok := strings.Cut(strings.Trim(s.sender, "<>"), "@"); ok {
+			scoreDomain(s, domain, dblWeights)
+		}
+	}
+	if phase == "commit" && s.oversized {
+		if opts().sizeLimitAction == "disconnect" {
+			return dnsbl.Disconnect(552, "5.3.4 message too big for your IP reputation")
+		}
+		return dnsbl.Reject(552, "5.3.4 message too big for your IP reputation")
+	}
+	if phase == "commit" && !s.exempt {
+		scoreMessage(s)
+		if d := messageAction(s); d.Action != "" {
+			return d
+		}
+		if s.relayed && opts().junkAction && shouldJunk(s) {
+			logf("session %s: junking message relayed from a host with score %v", sessionId, s.Score)
+			if !s.junked {
+				s.junked = true
+				stats.addJunked()
+			}
+			return dnsbl.Junk()
+		}
+		if !shouldJunk(s) {
+			recordReputation(s, false)
+		}
+	}
+	if phase == "rcpt-to" {
+		if exceedsRecipientLimit(s) {
+			return dnsbl.Reject(452, "too many recipients")
+		}
+		if shouldGreylist(s) && !greylist.pass(s.Addr.String(), s.sender, strings.Join(params[1:], "|")) {
+			fields := sessionFields(sessionId, s)
+			fields["decision"] = "greylist"
+			logEvent(levelInfo, fields, "greylisting session %s from %s", sessionId, s.Addr)
+			return dnsbl.Reject(451, "greylisted, please try again later")
+		}
+		if rcpt := strings.Join(params[1:], "|"); shouldQuarantine(s, rcpt) {
+			logf("session %s: quarantining mail for %s to %s", sessionId, rcpt, opts().quarantineAddress)
+			return dnsbl.Rewrite(opts().quarantineAddress)
+		}
+	}
+	if opts().junkAction && shouldJunk(s) && hasPhase(opts().junkPhase, phase) {
+		if !s.junked {
+			s.junked = true
+			stats.addJunked()
+		}
+		return dnsbl.Junk()
+	}
+	return dnsbl.Proceed()
+}
+
+// policyRejection is the whole rejection message with -disclose none.
+const policyRejection = "policy rejection"
+
+// rejectionMessage returns the text of a rejection message for the given
+// session, revealing as much about the decision as -disclose allows: with
+// none, a fixed text, with score, the score but neither the lists nor their
+// reasons, which are withheld from the template, and with full, everything.
+func rejectionMessage(s *session) string {
+	score := strconv.FormatFloat(s.Score, 'f', -1, 64)
+	switch opts().disclose {
+	case "none":
+		return policyRejection
+	case "score":
+		return expandMessage(s.profile.blockMessage(), s, true) + " (score " + score + ")"
+	case "full":
+		message := expandMessage(s.profile.blockMessage(), s, false) + " (score " + score
+		if len(s.Lists) > 0 {
+			message += ", listed on " + strings.Join(s.Lists, ",")
+		}
+		if len(s.Reasons) > 0 {
+			message += "; " + joinReasons(s.Reasons)
+		}
+		return message + ")"
+	}
+	return expandMessage(s.profile.blockMessage(), s, false)
+}
+
+// expandMessage replaces the placeholders in a rejection message template by
+// the details of the given session. Withheld lists are given as such and
+// their reasons left out.
+func expandMessage(template string, s *session, withhold bool) string {
+	ip := ""
+	if s.Addr != nil {
+		ip = s.Addr.String()
+	}
+	lists := strings.Join(s.Lists, ",")
+	if lists == "" {
+		lists = "none"
+	}
+	reasons := joinReasons(s.Reasons)
+	if withhold {
+		lists, reasons = "withheld", ""
+	}
+	url := strings.NewReplacer("{ip}", ip, "{id}", s.decisionId).Replace(opts().blockURL)
+	return strings.NewReplacer(
+		"{score}", strconv.FormatFloat(s.Score, 'f', -1, 64),
+		"{ip}", ip,
+		"{id}", s.decisionId,
+		"{lists}", lists,
+		"{url}", url,
+		"{reasons}", reasons,
+	).Replace(template)
+}
+
+// joinReasons returns the TXT records explaining the listings of a session,
+// each preceded by its list, e.g. bl.spamcop.net: Blocked - see
+// https://www.spamcop.net/bl.shtml?192.0.2.1, in the order of the lists.
+func joinReasons(reasons map[string]string) string {
+	var parts []string
+	for _, list := range slices.Sorted(maps.Keys(reasons)) {
+		parts = append(parts, list+": "+reasons[list])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// nextDelay returns the time the answer to the current request of a session
+// is held back. With -slowGrowth, each further command of a delayed session
+// is delayed longer than the previous one.
+func nextDelay(s *session) int64 {
+	if opts().blockDelay >= 0 && destinedToBlock(s) {
+		// holding on to a session which is going to be blocked anyway
+		// only ties up our own resources
+		return 0
+	}
+	delay := tarpitDelay(s.delay)
+	if opts().slowGrowth > 0 && s.delay > 0 {
+		s.delay = min(s.delay+s.delay*opts().slowGrowth/100, opts().maxDelay)
+	}
+	return delay
+}
+
+// respond carries out a decision on a filter request: it logs and records
+// the decision and answers the request once its delay has passed. In dry-run
+// mode, the decision is only logged and the request is answered with proceed
+// right away.
+func respond(sessionId string, token string, d decision) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession("decision", sessionId)
+		return
+	}
+	addHeaders(s, d.Headers)
+
+	fields := sessionFields(sessionId, s)
+	fields["decision"], fields["delay"] = d.Action, d.Delay
+	if len(s.Reasons) > 0 {
+		fields["reasons"] = s.Reasons
+	}
+	if opts().dryRun {
+		fields["dryRun"] = true
+	}
+	if d.Action != "proceed" {
+		decisions.write(fields)
+	}
+	archive.record(sessionId, s, d.Action, d.Delay)
+	if opts().dryRun {
+		if d.Action != "proceed" || d.Delay > 0 {
+			logEvent(levelInfo, fields, "dry run: session %s would %s after %dms (score=%v lists=%s id=%s)",
+				sessionId, d.Action, d.Delay, s.Score, strings.Join(s.Lists, ","), s.decisionId)
+		}
+		d = dnsbl.Proceed()
+	} else if d.Action != "proceed" {
+		level := levelInfo
+		if d.Blocks() {
+			level = levelError
+		}
+		logEvent(level, fields, "session %s: %s after %dms (score=%v lists=%s id=%s)",
+			sessionId, d.Action, d.Delay, s.Score, strings.Join(s.Lists, ","), s.decisionId)
+		if d.Blocks() {
+			fields["message"] = d.Reply()
+			webhook.notify("block", fields)
+		}
+	}
+	if d.Delay > 0 {
+		s.tarpitted += d.Delay
+		stats.addDelay(d.Delay)
+	}
+
+	if opts().testMode {
+		waitThenAction(sessionId, token, d.Delay, "%s", d.Result())
+	} else {
+		answers.schedule(sessionId, token, d.Delay, d.Result())
+	}
+}
+
+// tarpitDelay applies -slowJitter and -maxDelay to the delay of a session so
+// that delays are harder to fingerprint and never exceed the configured cap.
+func tarpitDelay(delay int64) int64 {
+	if delay > 0 && opts().slowJitter > 0 {
+		delay += delay * (random(2*opts().slowJitter+1) - opts().slowJitter) / 100
+	}
+	if opts().maxDelay > 0 && delay > opts().maxDelay {
+		delay = opts().maxDelay
+	}
+	return delay
+}
+
+func waitThenAction(sessionId string, token string, delay int64, format string, a ...interface{}) {
+	if delay > 0 && replay != nil {
+		replay.sleep(time.Duration(delay) * time.Millisecond)
+	} else if delay > 0 {
+		timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+		select {
+		case <-timer.C:
+		case <-shuttingDown:
+			timer.Stop()
+		}
+	}
+	if _, ok := sessions.Get(sessionId); !ok {
+		debugf("session %s disconnected before being answered", sessionId)
+		return
+	}
+	produceOutput("filter-result", sessionId, token, format, a...)
+}
+
+func filterInit() {
+	smtpd.Reports, smtpd.Filters = handlers(reporters), handlers(filters)
+	smtpd.Sessions = sessions
+	smtpd.Debugf, smtpd.Errorf = debugf, errorf
+	smtpd.Malformed = func(err error) {
+		malformed("%v", err)
+	}
+	if err := smtpd.Register(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// malformed reports an event the filter cannot make sense of. Unless -strict
+// is given, the event is ignored so that mail keeps flowing if smtpd sends
+// something new.
+func malformed(format string, a ...any) {
+	if opts().strict {
+		log.Fatalf(format, a...)
+	}
+	errorf(format+", ignoring", a...)
+}
+
+// readLists returns the lists given by specs, which come from the command
+// line, or, if there are none, those declared in the given table of the
+// configuration file.
+func readLists(cfg configTable, key string, specs []string, timeouts map[string]time.Duration) (map[string]float64, error) {
+	lists := make(map[string]float64)
+	if len(specs) == 0 && cfg != nil {
+		var err error
+		if lists, err = configLists(cfg, key, timeouts); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range specs {
+		tokens := strings.Split(s, ":")
+		if len(tokens) != 2 && len(tokens) != 3 {
+			return nil, fmt.Errorf("invalid domain weight specifier: %q", s)
+		}
+		weight, err := parseScore(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight for domain %q: %s", tokens[0], tokens[1])
+		}
+		lists[tokens[0]] = weight
+		if len(tokens) == 3 {
+			d, err := time.ParseDuration(tokens[2])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout for domain %q", tokens[0])
+			}
+			timeouts[tokens[0]] = d
+		}
+	}
+
+	for domain, weight := range lists {
+		if weight <= 0 || weight > math.MaxInt8 {
+			return nil, fmt.Errorf("invalid domain weight %v for domain %q", weight, domain)
+		}
+		if err := checkTemplate(domain); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// setLists puts a new set of blocklists, DNS allowlists, RHSBLs, sender
+// domain blocklists, URIBLs and EBLs into effect, along with their timeouts.
+// Lists which were configured before keep their circuit breaker state, and
+// those which are gone are no longer probed.
+func setLists(lists map[string]float64, dnswls map[string]float64, rhsbls map[string]float64, dbls map[string]float64, uribls map[string]float64, ebls map[string]float64, timeouts map[string]time.Duration) {
+	newBreakers := make(map[string]*breaker)
+	for _, m := range []map[string]float64{lists, dnswls, rhsbls, dbls, uribls, ebls} {
+		for domain := range m {
+			if b, ok := breakers[domain]; ok {
+				newBreakers[domain] = b
+			} else {
+				newBreakers[domain] = &breaker{domain: domain}
+			}
+		}
+	}
+
+	maxScore = aggregateWeights(groupedWeights(lists))
+	for _, m := range []map[string]float64{rhsbls, dbls} {
+		for _, weight := range m {
+			maxScore += weight
+		}
+	}
+	domainWeights = lists
+	dnswlWeights = dnswls
+	rhsblWeights = rhsbls
+	dblWeights = dbls
+	uriblWeights = uribls
+	eblWeights = ebls
+	listTimeouts = timeouts
+	for domain, b := range breakers {
+		if _, ok := newBreakers[domain]; !ok {
+			b.drop()
+		}
+	}
+	breakers = newBreakers
+}
+
+// activeMaxScore returns the highest score the lists currently in rotation
+// can assign, so that delays stay in proportion while lists are disabled by
+// hand or by their circuit breaker.
+func activeMaxScore() float64 {
+	return maxScoreOf(domainWeights)
+}
+
+// maxScoreOf returns the highest score the given DNSBLs in rotation can
+// assign along with the RHSBLs and DBLs in rotation.
+func maxScoreOf(lists map[string]float64) float64 {
+	weights := make(map[string]float64)
+	for domain, weight := range lists {
+		if breakers[domain].allow() {
+			weights[domain] = weight
+		}
+	}
+	score := aggregateWeights(groupedWeights(weights))
+	for _, m := range []map[string]float64{rhsblWeights, dblWeights} {
+		for domain, weight := range m {
+			if breakers[domain].allow() {
+				score += weight
+			}
+		}
+	}
+	if score == 0 {
+		// nothing is in rotation, the score stems from elsewhere
+		return maxScore
+	}
+	return score
+}
+
+// hasPhase reports whether the given comma-separated list of phases contains
+// phase.
+func hasPhase(phases string, phase string) bool {
+	for _, p := range strings.Split(phases, ",") {
+		if strings.TrimSpace(p) == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// decisionPhases are the phases which may be given to -blockPhase,
+// -junkPhase and per-phase thresholds.
+var decisionPhases = []string{"connect", "helo", "ehlo", "starttls", "auth", "mail-from", "rcpt-to", "quit"}
+
+func validatePhases(kind string, phases string) error {
+	for _, phase := range strings.Split(phases, ",") {
+		if !slices.Contains(decisionPhases, strings.TrimSpace(phase)) {
+			return fmt.Errorf("invalid %s phase: %s", kind, phase)
+		}
+	}
+	return nil
+}
+
+func validateOptions(o *options) error {
+	if err := validatePhases("block", o.blockPhase); err != nil {
+		return err
+	}
+	if err := validatePhases("junk", o.junkPhase); err != nil {
+		return err
+	}
+	if o.onDnsFailure != "proceed" && o.onDnsFailure != "junk" && o.onDnsFailure != "tempfail" {
+		return fmt.Errorf("invalid DNS failure policy: %s", o.onDnsFailure)
+	}
+	if o.onOutage != "" && o.onOutage != "proceed" && o.onOutage != "junk" && o.onOutage != "tempfail" {
+		return fmt.Errorf("invalid outage policy: %s", o.onOutage)
+	}
+	if o.sizeLimitAction != "reject" && o.sizeLimitAction != "disconnect" {
+		return fmt.Errorf("invalid size limit action: %s", o.sizeLimitAction)
+	}
+	if o.onUnknown != "proceed" && o.onUnknown != "junk" && o.onUnknown != "delay" && o.onUnknown != "tempfail" {
+		return fmt.Errorf("invalid unknown score policy: %s", o.onUnknown)
+	}
+	if o.quarantineAbove >= 0 && o.quarantineAddress == "" {
+		return errors.New("-quarantineAbove requires -quarantineAddress")
+	}
+	if o.trustedRelays != "" {
+		for _, entry := range strings.Split(o.trustedRelays, ",") {
+			if _, err := parseTrustedRelay(entry); err != nil {
+				return err
+			}
+		}
+	}
+	if o.junkTarget < 0 || o.junkTarget > 100 || o.junkTargetWindow <= 0 {
+		return errors.New("invalid junk target")
+	}
+	if o.learnWindow <= 0 {
+		return fmt.Errorf("invalid learn window: %d", o.learnWindow)
+	}
+	for _, self := range o.selfIPs {
+		if ip := net.ParseIP(self); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid own IP address: %s", self)
+		}
+	}
+	if o.selfCheckInterval < 0 {
+		return fmt.Errorf("invalid self check interval: %s", o.selfCheckInterval)
+	}
+	if o.selfCheck && len(o.selfIPs) == 0 {
+		return errors.New("-check requires -selfIP")
+	}
+	if o.webhookInterval <= 0 {
+		return fmt.Errorf("invalid webhook interval: %s", o.webhookInterval)
+	}
+	if o.sessionMaxIdle < 0 {
+		return fmt.Errorf("invalid session idle time: %s", o.sessionMaxIdle)
+	}
+	if o.sampleRate < 0 || o.sampleRate > 100 {
+		return fmt.Errorf("invalid sample rate: %v", o.sampleRate)
+	}
+	if o.listLimitAction != "cache" && o.listLimitAction != "skip" {
+		return fmt.Errorf("invalid list limit action: %s", o.listLimitAction)
+	}
+	if o.exemptRecipientAction != "junk" && o.exemptRecipientAction != "proceed" {
+		return fmt.Errorf("invalid exempt recipient action: %s", o.exemptRecipientAction)
+	}
+	if o.aggregate != "sum" && o.aggregate != "max" && o.aggregate != "weighted" {
+		return fmt.Errorf("invalid aggregation: %s", o.aggregate)
+	}
+	if o.logFormat != "text" && o.logFormat != "json" {
+		return fmt.Errorf("invalid log format: %s", o.logFormat)
+	}
+	if o.dnsRetries < 0 || o.dnsRetryDelay < 0 {
+		return errors.New("invalid DNS retry settings")
+	}
+	if o.lookupTimeout <= 0 || o.scoreTimeout <= 0 {
+		return errors.New("invalid lookup timeout")
+	}
+	if o.maxLineLength < 512 {
+		return errors.New("maximum line length must be at least 512 bytes")
+	}
+	if o.policyTimeout <= 0 {
+		return errors.New("invalid policy command timeout")
+	}
+	if o.execScorerTimeout <= 0 {
+		return errors.New("invalid external scorer timeout")
+	}
+	if o.spamdExpire <= 0 {
+		return errors.New("invalid spamd feed expiry")
+	}
+	if o.pfExpire < time.Second {
+		return errors.New("invalid pf table expiry")
+	}
+	if o.decisionLogSize < 0 || o.decisionLogKeep < 0 {
+		return errors.New("invalid decision log rotation settings")
+	}
+	if o.archiveRetention < 0 {
+		return fmt.Errorf("invalid archive retention: %v", o.archiveRetention)
+	}
+	if _, ok := logLevels[o.logLevelName]; !ok {
+		return fmt.Errorf("invalid log level: %s", o.logLevelName)
+	}
+	if strings.ContainsAny(o.blockMessage+o.blockURL, "\r\n") {
+		return errors.New("rejection message must not contain line breaks")
+	}
+	if o.headerName == "" || strings.ContainsAny(o.headerName, ": \t\r\n") {
+		return errors.New("invalid header name")
+	}
+	switch o.disclose {
+	case "template", "none", "score", "full":
+	default:
+		return fmt.Errorf("invalid disclosure: %s", o.disclose)
+	}
+	switch o.headerPosition {
+	case "top", "received", "end":
+	default:
+		return fmt.Errorf("invalid header position: %s", o.headerPosition)
+	}
+	for _, detail := range strings.Split(o.headerDetails, ",") {
+		switch strings.TrimSpace(detail) {
+		case "", "lists", "reasons", "id", "host", "version", "time":
+		default:
+			return fmt.Errorf("invalid header detail: %s", detail)
+		}
+	}
+	for _, name := range strings.Split(o.stripHeaderNames, ",") {
+		if strings.ContainsAny(name, ":\r\n") {
+			return fmt.Errorf("invalid header name: %s", name)
+		}
+	}
+	if strings.ContainsAny(o.junkSubject, "\r\n") {
+		return errors.New("invalid subject prefix")
+	}
+	if strings.ContainsAny(o.authservID, " ;\r\n") {
+		return errors.New("invalid authserv-id")
+	}
+	if _, err := compileDynamicPatterns(o.dynamicPatternSpecs); err != nil {
+		return err
+	}
+	if o.feedbackWindow < 0 {
+		return errors.New("invalid feedback window")
+	}
+	if o.reputationExpire <= 0 || o.reputationClean < 1 || o.reputationOffenses < 1 || o.reputationGrace < 0 || o.reputationPenalty < 0 {
+		return errors.New("invalid reputation settings")
+	}
+	if o.escalateAfter < 0 || o.escalateWindow <= 0 || o.escalateDuration <= 0 {
+		return errors.New("invalid escalation settings")
+	}
+	if err := validateConnRate(); err != nil {
+		return err
+	}
+	if err := validateNeighborhood(); err != nil {
+		return err
+	}
+	if o.tlsBonus < 0 || o.weakTLSPenalty < 0 {
+		return errors.New("invalid TLS bonus or penalty")
+	}
+	if o.blockDelay < -1 {
+		return errors.New("invalid block delay")
+	}
+	if o.slowJitter < 0 || o.slowJitter > 100 || o.maxDelay < 0 {
+		return errors.New("invalid delay jitter or maximum delay")
+	}
+	if o.slowGrowth < 0 || o.slowGrowth > 0 && o.maxDelay == 0 {
+		return errors.New("-slowGrowth requires -maxDelay")
+	}
+	if o.greylistDelay < 0 || o.greylistExpire <= o.greylistDelay {
+		return errors.New("invalid greylisting delay or expiry")
+	}
+	if o.blocklistScore < -1 {
+		return errors.New("invalid blocklist score")
+	}
+	if o.cacheRefresh < 0 {
+		return errors.New("invalid cache refresh threshold")
+	}
+	if o.warmupInterval < 0 {
+		return errors.New("invalid warmup interval")
+	}
+	if o.maxLookups < 0 || o.overflowScore < -1 {
+		return errors.New("invalid lookup limit or overflow score")
+	}
+	if o.breakerRetry <= 0 {
+		return errors.New("invalid blocklist retry interval")
+	}
+	switch o.listCheck {
+	case "none", "warn", "strict":
+	default:
+		return fmt.Errorf("invalid blocklist check mode: %s", o.listCheck)
+	}
+	return nil
+}
+
+// newOptions defines the options on the given flag set, whose values end up
+// in the returned options.
+func newOptions(flags *flag.FlagSet) *options {
+	o := &options{
+		flags:         flags,
+		blockAbove:    newThresholdFlag(-1),
+		tempfailAbove: newThresholdFlag(-1),
+		rejectAbove:   newThresholdFlag(-1),
+	}
+	flags.StringVar(&o.configFile, "config", "", "configuration file")
+	flags.StringVar(&o.shadowConfig, "shadowConfig", "", "file with candidate thresholds and weights which are compared to the active ones for each session")
+	flags.Var(o.blockAbove, "blockAbove", "score above which session is blocked, optionally per phase (phase=score,...)")
+	flags.StringVar(&o.blockPhase, "blockPhase", "connect", "comma-separated list of phases at which blockAbove triggers")
+	flags.StringVar(&o.aggregate, "aggregate", "sum", "how the weights of the lists an IP address is listed on make up its score: sum, max or weighted")
+	flags.StringVar(&o.onDnsFailure, "onDnsFailure", "proceed", "what to do with sessions whose blocklist lookups failed: proceed, junk or tempfail")
+	flags.StringVar(&o.onUnknown, "onUnknown", "proceed", "what to do with sessions whose score is unknown for reasons other than failed lookups: proceed, junk, delay or tempfail")
+	flags.StringVar(&o.onOutage, "onOutage", "", "what to do with sessions while all blocklists are unreachable: proceed, junk or tempfail, defaults to onDnsFailure")
+	flags.Int64Var(&o.dnsRetries, "dnsRetries", 2, "number of times lookups failing with a timeout or server failure are retried")
+	flags.DurationVar(&o.dnsRetryDelay, "dnsRetryDelay", 100*time.Millisecond, "time before the first retry of a failed lookup, doubled with each retry")
+	flags.DurationVar(&o.lookupTimeout, "lookupTimeout", 10*time.Second, "time allotted to looking up an IP address on all blocklists, including retries")
+	flags.DurationVar(&o.scoreTimeout, "scoreTimeout", 15*time.Second, "time the events of a session wait for its score before it is treated as unknown")
+	flags.Int64Var(&o.minLists, "minLists", 0, "number of distinct lists an IP address must be listed on for blockAbove to trigger")
+	flags.StringVar(&o.blockMessage, "blockMessage", "your IP reputation is too low for this MX", "rejection message, may contain {score}, {ip}, {id}, {lists} and {url}")
+	flags.StringVar(&o.blockURL, "blockURL", "", "URL substituted for {url} in the rejection message, may contain {ip} and {id}")
+	flags.StringVar(&o.disclose, "disclose", "template", "what rejection messages reveal: template for the message as is, none for a fixed text, score to add the score while withholding lists, full to add the score, lists and reasons")
+	flags.Var(o.tempfailAbove, "tempfailAbove", "score above which session is disconnected with a temporary failure, optionally per phase")
+	flags.Var(o.rejectAbove, "rejectAbove", "score above which commands are rejected without disconnecting, optionally per phase")
+	flags.Float64Var(&o.junkAbove, "junkAbove", -1, "score below which session is junked")
+	flags.Float64Var(&o.junkTarget, "junkTarget", 0, "percentage of scored sessions to junk by adjusting the junk threshold to recent scores, 0 to keep junkAbove fixed")
+	flags.Int64Var(&o.junkTargetWindow, "junkTargetWindow", 1000, "number of recent sessions whose scores junkTarget is based on")
+	flags.StringVar(&o.junkPhase, "junkPhase", "connect", "comma-separated list of phases at which junkAbove triggers")
+	flags.Float64Var(&o.greylistAbove, "greylistAbove", -1, "score above which recipients are greylisted")
+	flags.Float64Var(&o.quarantineAbove, "quarantineAbove", -1, "score above which recipients are replaced by quarantineAddress")
+	flags.StringVar(&o.quarantineAddress, "quarantineAddress", "", "mailbox or alias receiving the mail of sessions above quarantineAbove")
+	flags.Float64Var(&o.requireTLSAbove, "requireTLSAbove", -1, "score above which sessions must issue STARTTLS before mail-from")
+	flags.DurationVar(&o.greylistDelay, "greylistDelay", 5*time.Minute, "time after which a greylisted delivery attempt may be retried")
+	flags.DurationVar(&o.greylistExpire, "greylistExpire", 4*time.Hour, "time within which a greylisted delivery attempt must be retried")
+	flags.StringVar(&o.greylistFile, "greylistDB", "", "file in which greylisting state is kept across restarts")
+	flags.StringVar(&o.reputationFile, "reputationDB", "", "file in which the history of IP addresses is kept across restarts")
+	flags.DurationVar(&o.authAllowDuration, "authAllowDuration", 0, "time for which IP addresses that authenticated successfully are treated as allowlisted, 0 to disable")
+	flags.StringVar(&o.authAllowFile, "authAllowDB", "", "file in which IP addresses that authenticated successfully are kept across restarts")
+	flags.DurationVar(&o.reputationExpire, "reputationExpire", 90*24*time.Hour, "time without activity after which the history of an IP address is forgotten")
+	flags.DurationVar(&o.feedbackWindow, "feedbackWindow", 7*24*time.Hour, "time for which messages are remembered so that verdicts can be reported on them, 0 to disable")
+	flags.Int64Var(&o.reputationClean, "reputationClean", 5, "number of deliveries without rejects after which an IP address has a clean history")
+	flags.Float64Var(&o.reputationGrace, "reputationGrace", 0, "score subtracted for IP addresses with a clean history")
+	flags.Int64Var(&o.reputationOffenses, "reputationOffenses", 3, "number of rejected sessions after which an IP address is a repeat offender")
+	flags.Float64Var(&o.reputationPenalty, "reputationPenalty", 0, "score added for repeat offenders")
+	flags.Int64Var(&o.connRate, "connRate", 0, "number of connections from a source within connRateWindow above which listed sessions are throttled, 0 to disable")
+	flags.DurationVar(&o.connRateWindow, "connRateWindow", time.Minute, "sliding time window within which connections from a source are counted")
+	flags.IntVar(&o.connRatePrefix, "connRatePrefix", 32, "prefix length of the IPv4 subnets connections are counted for")
+	flags.IntVar(&o.connRatePrefix6, "connRatePrefix6", 64, "prefix length of the IPv6 subnets connections are counted for")
+	flags.Float64Var(&o.connRateAbove, "connRateAbove", 0, "score above which sessions from sources above connRate are throttled")
+	flags.Float64Var(&o.connRatePenalty, "connRatePenalty", 10, "score added to throttled sessions with connRateAction penalty")
+	flags.StringVar(&o.connRateAction, "connRateAction", "penalty", "what happens to throttled sessions: penalty or tempfail")
+	flags.Int64Var(&o.neighborhoodCount, "neighborhoodCount", 0, "number of other addresses of a neighborhood scoring high within neighborhoodWindow from which new addresses are penalized, 0 to disable")
+	flags.DurationVar(&o.neighborhoodWindow, "neighborhoodWindow", time.Hour, "time within which high scores count against the neighborhood of an address")
+	flags.IntVar(&o.neighborhoodPrefix, "neighborhoodPrefix", 24, "prefix length of the IPv4 subnets forming neighborhoods")
+	flags.IntVar(&o.neighborhoodPrefix6, "neighborhoodPrefix6", 64, "prefix length of the IPv6 subnets forming neighborhoods")
+	flags.Float64Var(&o.neighborhoodAbove, "neighborhoodAbove", 50, "score above which an address counts against its neighborhood")
+	flags.Float64Var(&o.neighborhoodPenalty, "neighborhoodPenalty", 20, "score added to new addresses of a neighborhood above neighborhoodCount")
+	flags.Int64Var(&o.escalateAfter, "escalateAfter", 0, "number of rejected sessions within escalateWindow after which an IP address is temporarily blocked, 0 to disable")
+	flags.DurationVar(&o.escalateWindow, "escalateWindow", time.Hour, "time window within which rejected sessions are counted")
+	flags.DurationVar(&o.escalateDuration, "escalateDuration", 24*time.Hour, "time for which repeat offenders are blocked")
+	flags.BoolVar(&o.junkAction, "junkAction", true, "mark sessions above junkAbove as junk")
+	flags.BoolVar(&o.junkHeader, "junkHeader", false, "add X-Spam header to messages of sessions above junkAbove")
+	flags.StringVar(&o.junkSubject, "junkSubject", "", "prefix the subject of messages of sessions above junkAbove with this tag")
+	flags.Int64Var(&o.recipientLimit, "recipientLimit", 0, "number of recipients per message above which recipients are rejected for listed IP addresses, 0 for no limit")
+	flags.Float64Var(&o.recipientLimitAbove, "recipientLimitAbove", 0, "score above which recipientLimit applies")
+	flags.Int64Var(&o.messageLimit, "messageLimit", 0, "number of messages per session above which further transactions are rejected for listed IP addresses, 0 for no limit")
+	flags.Float64Var(&o.messageLimitAbove, "messageLimitAbove", 0, "score above which messageLimit applies")
+	flags.Int64Var(&o.sizeLimit, "sizeLimit", 0, "size in bytes above which the rest of a message from a listed IP address is dropped and the message refused, 0 for no limit")
+	flags.Float64Var(&o.sizeLimitAbove, "sizeLimitAbove", 0, "score above which sizeLimit applies")
+	flags.StringVar(&o.sizeLimitAction, "sizeLimitAction", "reject", "action for messages exceeding sizeLimit: reject or disconnect")
+	flags.Int64Var(&o.slowFactor, "slowFactor", -1, "delay factor to apply to sessions")
+	flags.Int64Var(&o.slowJitter, "slowJitter", 0, "percentage by which delays are randomly varied in either direction")
+	flags.BoolVar(&o.bannerDelay, "bannerDelay", false, "only delay the SMTP banner, not subsequent commands")
+	flags.Int64Var(&o.slowGrowth, "slowGrowth", 0, "percentage by which the delay of a session grows with each command, requires maxDelay")
+	flags.Int64Var(&o.maxDelay, "maxDelay", 0, "maximum delay in milliseconds, 0 for no limit")
+	flags.Int64Var(&o.blockDelay, "blockDelay", -1, "delay in milliseconds of answers blocking a session, whose earlier answers are not delayed, -1 to delay them like any other answer")
+	flags.BoolVar(&o.scoreHeader, "scoreHeader", false, "add X-DNSBL-Score header")
+	flags.StringVar(&o.authservID, "authservID", "", "add Authentication-Results header with this authserv-id")
+	flags.StringVar(&o.headerName, "headerName", "X-DNSBL-Score", "name of the score header")
+	flags.StringVar(&o.headerPosition, "headerPosition", "top", "where headers are added to the header block of messages: top, received or end")
+	flags.StringVar(&o.headerDetails, "headerDetails", "", "comma-separated list of details added to the score header: lists, reasons, id, host, version, time")
+	flags.BoolVar(&o.stripHeaders, "stripHeaders", false, "remove score headers already present in incoming messages")
+	flags.StringVar(&o.stripHeaderNames, "stripHeaderNames", "", "comma-separated list of headers removed by stripHeaders, defaults to the score header and X-DNSBL-Listed")
+	flags.Float64Var(&o.headerAbove, "headerAbove", -1, "score above which the X-DNSBL-Score header is added, -1 to always add it")
+	flags.BoolVar(&o.listedHeader, "listedHeader", false, "add X-DNSBL-Listed header with the lists the IP address was found on")
+	flags.Var(&o.allowlistFiles, "allowlist", "file or HTTPS URL containing a list of IP addresses or subnets in CIDR notation to allowlist, one per line, may be given multiple times")
+	flags.DurationVar(&o.allowlistWatch, "allowlistWatch", 5*time.Second, "interval at which the allowlist and blocklist files are checked for changes, 0 to never check them")
+	flags.DurationVar(&o.allowlistRefresh, "allowlistRefresh", time.Hour, "interval at which allowlists and blocklists given by URL are downloaded again, 0 to never refresh them")
+	flags.Var(&o.partnerDomains, "partnerDomain", "domain whose mail servers, resolved from its MX records, are allowlisted, may be given multiple times")
+	flags.DurationVar(&o.partnerRefresh, "partnerRefresh", time.Hour, "interval at which the mail servers of partner domains are resolved again, 0 to never resolve them again")
+	flags.StringVar(&o.blocklistFile, "blocklist", "", "file or HTTPS URL containing a list of IP addresses or subnets in CIDR notation to block, one per line")
+	flags.Float64Var(&o.noRdnsScore, "noRdnsScore", 0, "score added for IP addresses without reverse DNS")
+	flags.Float64Var(&o.fcrdnsScore, "fcrdnsScore", 0, "score added for IP addresses whose reverse DNS fails forward confirmation")
+	flags.Float64Var(&o.dynamicRdnsScore, "dynamicRdnsScore", 0, "score added for IP addresses whose reverse DNS looks dynamic")
+	flags.Float64Var(&o.heloForgeryScore, "heloForgeryScore", 0, "score added for clients greeting with our own hostname or IP address or an unqualified name")
+	flags.Float64Var(&o.tlsBonus, "tlsBonus", 0, "score subtracted from listed sessions negotiating TLS 1.3")
+	flags.Float64Var(&o.weakTLSPenalty, "weakTLSPenalty", 0, "score added for sessions negotiating SSL, TLS before 1.2 or a weak cipher")
+	flags.StringVar(&o.localHostnames, "localHostnames", "", "comma-separated list of our own hostnames, defaults to the name of the host")
+	flags.Var(&o.dynamicPatternSpecs, "dynamicPattern", "additional regular expression matching dynamic reverse DNS names, may be given multiple times")
+	flags.StringVar(&o.execScorer, "execScorer", "", "command run for each connection with the IP address, reverse DNS name and forward-confirmation result as arguments, printing a score delta")
+	flags.DurationVar(&o.execScorerTimeout, "execScorerTimeout", 2*time.Second, "time after which the external scorer is killed")
+	flags.StringVar(&o.policyCommand, "policyCommand", "", "long-running command consulted at each phase with the facts about the session as JSON")
+	flags.DurationVar(&o.policyTimeout, "policyTimeout", time.Second, "time after which the policy command is restarted if it has not answered")
+	flags.StringVar(&o.policyScript, "policyScript", "", "file with a policy script run at each phase with the facts about the session")
+	flags.Float64Var(&o.blocklistScore, "blocklistScore", -1, "score assigned to blocklisted IP addresses, -1 to always block them")
+	flags.Var(&o.dnswlSpecs, "dnswl", "DNS allowlist domain:weight whose weight multiplied by the trust level is subtracted from the score, may be given multiple times")
+	flags.Var(&o.rhsblSpecs, "rhsbl", "RHSBL domain:weight against which the HELO/EHLO hostname is checked, may be given multiple times")
+	flags.Var(&o.dblSpecs, "dbl", "RHSBL domain:weight against which the envelope sender domain is checked, may be given multiple times")
+	flags.Var(&o.uriblSpecs, "uribl", "URIBL domain:weight against which domains of URLs in messages are checked, may be given multiple times")
+	flags.Var(&o.eblSpecs, "ebl", "hashed email blocklist domain:weight against which From and Reply-To addresses are checked, may be given multiple times")
+	flags.Var(&o.listGroupSpecs, "listGroup", "name=list,list... grouping mirrors of the same DNSBL so that a hit on any of them counts once, may be given multiple times")
+	flags.Var(&o.listKeySpecs, "listKey", "list=key giving the account key of a commercial list, may be given multiple times")
+	flags.Var(&o.localZoneSpecs, "localZone", "list=file answering the queries of a list from a local rbldnsd data file instead of the DNS, may be given multiple times")
+	flags.Var(&o.disabledListSpecs, "disableList", "list kept in the configuration but not queried, may be given multiple times")
+	flags.Var(&o.selfIPs, "selfIP", "own outbound IPv4 address of the MX checked against the blocklists, may be given multiple times")
+	flags.Var(&o.selfZoneSpecs, "selfZone", "additional zone the own addresses are checked against, may be given multiple times")
+	flags.DurationVar(&o.selfCheckInterval, "selfCheckInterval", time.Hour, "interval between checks of the own addresses, 0 to disable")
+	flags.BoolVar(&o.selfCheck, "check", false, "check the own addresses once and exit with status 1 if one of them is listed")
+	flags.StringVar(&o.lookupIP, "lookup", "", "score the given IP address once, print the answer of each list and the decision, and exit")
+	flags.Var(&o.listLimitSpecs, "listLimit", "list=n/s or list=n/d limiting the queries sent to a list per second or per day, may be given multiple times")
+	flags.StringVar(&o.listLimitAction, "listLimitAction", "cache", "what to do with a list whose limit is exceeded: cache to use only cached answers, skip to ignore the list")
+	flags.BoolVar(&o.learnWeights, "learnWeights", false, "scale the weight of each DNSBL by how often its hits agree with other lists and with blocks")
+	flags.Int64Var(&o.learnWindow, "learnWindow", 1000, "number of hits of a DNSBL after which learnWeights has mostly forgotten older ones")
+	flags.StringVar(&o.geoipFile, "geoipDB", "", "MaxMind country database used to look up the country of IP addresses")
+	flags.StringVar(&o.asnFile, "asnDB", "", "MaxMind ASN database used to look up the autonomous system of IP addresses")
+	flags.Var(&o.geoipRuleSpecs, "geoipRule", "country code or AS number followed by a colon and a score adjustment, junk or block, may be given multiple times")
+	flags.Int64Var(&o.uriblMaxLookups, "uriblMaxLookups", 20, "maximum number of URL domains looked up per message")
+	flags.Float64Var(&o.messageJunkAbove, "messageJunkAbove", -1, "message score above which messages are junked")
+	flags.Float64Var(&o.messageRejectAbove, "messageRejectAbove", -1, "message score above which messages are rejected")
+	flags.Float64Var(&o.sampleRate, "sampleRate", 100, "percentage of connections which are scored, the others proceed unscored")
+	flags.BoolVar(&o.scoreSpecialUse, "scoreSpecialUse", false, "look up private, loopback, link-local and other special-use addresses instead of assigning them a score of 0")
+	flags.StringVar(&o.allowSenders, "allowSenders", "", "comma-separated list of envelope sender addresses or domains whose mail is neither blocked nor junked from mail-from on")
+	flags.StringVar(&o.exemptRecipients, "exemptRecipients", "postmaster,abuse", "comma-separated list of recipients (local part, address or @domain) for which sessions are not blocked at rcpt-to")
+	flags.StringVar(&o.exemptRecipientAction, "exemptRecipientAction", "junk", "what to do with blocked sessions sending to exemptRecipients: junk or proceed")
+	flags.StringVar(&o.trustedRelays, "trustedRelays", "", "comma-separated list of addresses or subnets of forwarders and secondary MXes whose messages are scored by their first untrusted Received hop")
+	flags.StringVar(&o.skipListeners, "skipListeners", "", "comma-separated list of listener addresses (address:port, address, :port or socket path) on which sessions are not scored")
+	flags.DurationVar(&o.statsInterval, "statsInterval", 0, "interval at which a summary of sessions and decisions is logged, 0 to disable")
+	flags.StringVar(&o.statsdAddr, "statsd", "", "push metrics to this StatsD server (host:port) over UDP")
+	flags.StringVar(&o.statsdPrefix, "statsdPrefix", "dnsblscore", "prefix of StatsD metric names")
+	flags.StringVar(&o.logFormat, "logFormat", "text", "format of log messages: text or json")
+	flags.StringVar(&o.controlSocket, "controlSocket", "", "path of a UNIX socket accepting commands to inspect and adjust the running filter")
+	flags.StringVar(&o.pfTable, "pfTable", "", "pf table to which IP addresses above pfAbove and repeat offenders are added")
+	flags.Float64Var(&o.pfAbove, "pfAbove", -1, "score above which IP addresses are added to pfTable")
+	flags.DurationVar(&o.pfExpire, "pfExpire", 24*time.Hour, "time after which IP addresses are removed from pfTable")
+	flags.StringVar(&o.pfctlPath, "pfctl", "/sbin/pfctl", "path of pfctl")
+	flags.StringVar(&o.spamdFile, "spamdFeed", "", "file in which blocked IP addresses are listed for spamd-setup")
+	flags.DurationVar(&o.spamdExpire, "spamdExpire", 24*time.Hour, "time for which blocked IP addresses are listed in spamdFeed")
+	flags.StringVar(&o.httpListen, "httpListen", "", "address (host:port) on which to serve the HTTP health and lookup API")
+	flags.StringVar(&o.decisionLogFile, "decisionLog", "", "file to which decisions are appended")
+	flags.Int64Var(&o.decisionLogSize, "decisionLogSize", 10<<20, "size in bytes above which the decision log is rotated, 0 to never rotate it")
+	flags.Int64Var(&o.decisionLogKeep, "decisionLogKeep", 5, "number of rotated decision logs to keep")
+	flags.StringVar(&o.archiveDB, "archiveDB", "", "SQLite database in which every decision is recorded")
+	flags.StringVar(&o.webhookURL, "webhook", "", "URL to which block decisions and operational events are posted as JSON")
+	flags.DurationVar(&o.webhookInterval, "webhookInterval", 5*time.Second, "time for which events are collected before they are posted to the webhook")
+	flags.DurationVar(&o.archiveRetention, "archiveRetention", 90*24*time.Hour, "age after which decisions are pruned from archiveDB, 0 to keep them forever")
+	flags.StringVar(&o.sqliteCommand, "sqlite", "sqlite3", "path to the sqlite3 shell used to write archiveDB")
+	flags.StringVar(&o.logLevelName, "logLevel", "info", "verbosity of log messages: error, info or debug")
+	flags.BoolVar(&o.useSyslog, "syslog", false, "send log messages to syslog instead of stderr")
+	flags.StringVar(&o.syslogFacility, "syslogFacility", "mail", "syslog facility")
+	flags.StringVar(&o.syslogTag, "syslogTag", "filter-dnsblscore", "syslog tag")
+	flags.BoolVar(&o.dryRun, "dryRun", false, "log decisions but always proceed without delay")
+	flags.IntVar(&o.maxLineLength, "maxLineLength", 1<<20, "maximum length of a line from smtpd, longer data lines are passed on unchanged")
+	flags.DurationVar(&o.sessionMaxIdle, "sessionMaxIdle", time.Hour, "time after which sessions without any events are forgotten, 0 to keep them until they disconnect")
+	flags.StringVar(&o.compileFile, "compile", "", "compile the allowlists given as arguments into file and exit")
+	flags.StringVar(&o.simulateScript, "simulate", "", "run the filter with the other options against the smtpd events of a script and exit")
+	flags.StringVar(&o.replayFile, "replay", "", "read a recorded transcript from file and answer it deterministically, implies testMode")
+	flags.BoolVar(&o.strict, "strict", false, "abort on unknown events and malformed lines instead of ignoring them")
+	flags.BoolVar(&o.testMode, "testMode", false, "skip all DNS queries, process all requests sequentially, only for debugging purposes")
+	flags.StringVar(&o.dotServer, "dot", "", "send DNS queries to this DNS-over-TLS server (host[:port])")
+	flags.StringVar(&o.dohURL, "doh", "", "send DNS queries to this DNS-over-HTTPS URL")
+	flags.StringVar(&o.resolverMode, "resolver", "system", "send DNS queries through the system resolver (system) or directly to the nameservers (stub)")
+	flags.BoolVar(&o.lookupTXT, "lookupTXT", false, "fetch the TXT records explaining listings for the rejection message, the score header and the decision log")
+	flags.StringVar(&o.fakeDNS, "fakeDNS", "", "answer DNS queries from this script instead of the DNS, only for testing purposes")
+	flags.DurationVar(&o.cacheTTL, "cacheTTL", time.Hour, "time to cache positive DNSBL answers, 0 to disable")
+	flags.StringVar(&o.cacheFile, "cacheFile", "", "file in which cached DNSBL answers are kept across restarts")
+	flags.Int64Var(&o.cacheRefresh, "cacheRefresh", 0, "refresh cached DNSBL answers used at least this many times before they expire, 0 to disable")
+	flags.StringVar(&o.warmupFeed, "warmup", "", "file or HTTPS URL of IP addresses, one per line, looked up on startup to warm the cache")
+	flags.DurationVar(&o.warmupInterval, "warmupInterval", 0, "interval at which the cache is warmed again from the warmup feed, 0 to only warm it on startup")
+	flags.StringVar(&o.sharedCacheURL, "sharedCache", "", "Redis server (redis://[:password@]host:port[/db]) on which DNSBL answers are cached for all filters using it")
+	flags.StringVar(&o.gossipChannel, "gossipChannel", "", "Redis channel on which rejects and repeat offenders are shared with other filters using sharedCache")
+	flags.DurationVar(&o.negativeCacheTTL, "negativeCacheTTL", 5*time.Minute, "time to cache negative DNSBL answers, 0 to disable")
+	flags.IntVar(&o.maxLookups, "maxLookups", 64, "maximum number of addresses looked up concurrently, 0 for no limit")
+	flags.Float64Var(&o.overflowScore, "overflowScore", 0, "score assigned to sessions exceeding maxLookups")
+	flags.Int64Var(&o.breakerThreshold, "breakerThreshold", 5, "consecutive failures after which a blocklist is disabled, 0 to never disable")
+	flags.DurationVar(&o.breakerRetry, "breakerRetry", time.Minute, "interval at which disabled blocklists are probed")
+	flags.StringVar(&o.listCheck, "listCheck", "warn", "startup check of blocklist test points: none, warn or strict")
+	return o
+}
+
+// Main runs the filter, reporting the given version in score headers.
+func Main(v string) {
+	version = v
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s: [<flags>] [<domain>:<weight>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	currentOptions.Store(newOptions(flag.CommandLine))
+
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineOptions[f.Name] = true
+	})
+
+	if opts().compileFile != "" {
+		if err := compileAccessLists(opts().compileFile, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if opts().simulateScript != "" {
+		if !simulate(opts().simulateScript, withoutFlag(os.Args[1:], "simulate")) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(opts())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupSyslog(); err != nil {
+		log.Fatal(err)
+	}
+	transcript := os.Stdin
+	if opts().replayFile != "" {
+		if transcript, err = startReplay(opts().replayFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	timeouts := make(map[string]time.Duration)
+	lists, err := readLists(cfg, "lists", flag.Args(), timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(lists) == 0 {
+		flag.Usage()
+		log.Fatal("missing blocklist domains")
+	}
+	dnswls, err := readLists(cfg, "dnswl", opts().dnswlSpecs, timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rhsbls, err := readLists(cfg, "rhsbl", opts().rhsblSpecs, timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbls, err := readLists(cfg, "dbl", opts().dblSpecs, timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uribls, err := readLists(cfg, "uribl", opts().uriblSpecs, timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ebls, err := readLists(cfg, "ebl", opts().eblSpecs, timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := readListKeys(opts().listKeySpecs, lists, dnswls, rhsbls, dbls, uribls, ebls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	groups, err := readListGroups(opts().listGroupSpecs, lists)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits, err := readListLimits(opts().listLimitSpecs, lists, dnswls, rhsbls, dbls, uribls, ebls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	disabledLists, err := readDisabledLists(opts().disabledListSpecs, lists, dnswls, rhsbls, dbls, uribls, ebls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	zones, err := readLocalZones(opts().localZoneSpecs, lists, dnswls, rhsbls, dbls, uribls, ebls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listGroups = groups
+	setLists(lists, dnswls, rhsbls, dbls, uribls, ebls, timeouts)
+	setListKeys(keys)
+	setListLimits(limits)
+	setDisabledLists(disabledLists)
+	setLocalZones(zones)
+	if geoipRules, err = readGeoipRules(cfg, opts().geoipRuleSpecs); err != nil {
+		log.Fatal(err)
+	}
+	if rules, err = readRules(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if profiles, err = readProfiles(cfg, lists); err != nil {
+		log.Fatal(err)
+	}
+	if shadow, err = readShadowPolicy(opts().shadowConfig); err != nil {
+		log.Fatal(err)
+	}
+	if script, err = readScriptPolicy(opts().policyScript); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validateOptions(opts()); err != nil {
+		log.Fatal(err)
+	}
+	if dynamicPatterns, err = compileDynamicPatterns(opts().dynamicPatternSpecs); err != nil {
+		log.Fatal(err)
+	}
+	if allowlist, err = loadAccessLists(opts().allowlistFiles, "allowlist"); err != nil {
+		log.Fatal(err)
+	}
+	if blocklist, err = loadAccessList(opts().blocklistFile, "blocklist"); err != nil {
+		log.Fatal(err)
+	}
+	if opts().allowlistRefresh > 0 {
+		go refreshRemoteLists()
+	}
+	if opts().allowlistWatch > 0 {
+		go watchAccessLists()
+		go watchLocalZones()
+	}
+	if opts().configFile != "" && replay == nil {
+		go watchSchedules()
+	}
+	if greylist, err = loadGreylist(opts().greylistFile); err != nil {
+		log.Fatal(err)
+	}
+	go greylist.saveEvery()
+	if reputation, err = loadReputation(opts().reputationFile); err != nil {
+		log.Fatal(err)
+	}
+	if reputation != nil {
+		go reputation.saveEvery()
+	}
+	if authAllowed, err = loadAuthAllowlist(opts().authAllowFile); err != nil {
+		log.Fatal(err)
+	}
+	if spamd, err = loadSpamdFeed(opts().spamdFile); err != nil {
+		log.Fatal(err)
+	}
+	if countryDB, err = openMMDB(opts().geoipFile); err != nil {
+		log.Fatal(err)
+	}
+	if asnDB, err = openMMDB(opts().asnFile); err != nil {
+		log.Fatal(err)
+	}
+	if shared, err = dialSharedCache(opts().sharedCacheURL); err != nil {
+		log.Fatal(err)
+	}
+	if gossip, err = startGossip(opts().gossipChannel); err != nil {
+		log.Fatal(err)
+	}
+	if opts().cacheFile != "" {
+		if err := cache.load(opts().cacheFile); err != nil {
+			errorf("unable to load lookup cache: %v", err)
+		}
+	}
+	setupResolver()
+	if len(opts().partnerDomains) > 0 {
+		partners.refresh()
+		if opts().partnerRefresh > 0 {
+			go refreshPartners()
+		}
+	}
+	if opts().selfCheck {
+		os.Exit(checkSelfOnce())
+	}
+	if opts().lookupIP != "" {
+		addr := net.ParseIP(opts().lookupIP)
+		if addr == nil {
+			log.Fatalf("invalid IP address for -lookup: %s", opts().lookupIP)
+		}
+		os.Exit(lookupOnce(addr))
+	}
+	if !opts().testMode {
+		checkLists()
+	}
+	if opts().cacheRefresh > 0 && !opts().testMode {
+		go refreshCache()
+	}
+	if opts().warmupFeed != "" {
+		// sessions in test mode are scored synchronously, so the
+		// cache must be warm before the first one arrives
+		if opts().testMode {
+			warmCache()
+		} else {
+			go warmCache()
+		}
+		if opts().warmupInterval > 0 {
+			go warmCacheEvery()
+		}
+	}
+
+	if statsd, err = dialStatsd(opts().statsdAddr, opts().statsdPrefix); err != nil {
+		log.Fatal(err)
+	}
+	if decisions, err = openDecisionLog(opts().decisionLogFile); err != nil {
+		log.Fatal(err)
+	}
+	if archive, err = openArchive(opts().archiveDB); err != nil {
+		log.Fatal(err)
+	}
+	if webhook, err = openWebhook(opts().webhookURL); err != nil {
+		log.Fatal(err)
+	}
+	if err := listenControl(opts().controlSocket); err != nil {
+		log.Fatal(err)
+	}
+	if err := listenHTTP(opts().httpListen); err != nil {
+		log.Fatal(err)
+	}
+	expirePF()
+	reportStats()
+	if len(opts().selfIPs) > 0 && opts().selfCheckInterval > 0 && replay == nil && (!opts().testMode || opts().fakeDNS != "") {
+		go watchSelf()
+	}
+	if opts().sessionMaxIdle > 0 && replay == nil {
+		go sweepSessions()
+	}
+
+	input := smtpdfilter.NewLineReader(transcript, opts().maxLineLength)
+	input.Debugf = debugf
+	input.Malformed = func(err error) {
+		malformed("%v", err)
+	}
+	if err := smtpd.ReadConfig(input); errors.Is(err, io.EOF) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	filterInit()
+
+	if !opts().testMode {
+		outputChannel = make(chan string, 1024)
+		smtpd.Output = func(line string) {
+			outputChannel <- line
+		}
+		go func() {
+			if err := smtpdfilter.WriteOutput(outputChannel, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			close(outputDone)
+		}()
+		go answers.run()
+	}
+
+	lines := input.Lines()
+
+	// configuration reloads are handled in between events, so that no
+	// event is ever processed against a partially loaded configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		var line string
+		select {
+		case <-hup:
+			reloadConfig()
+			continue
+		case <-usr1:
+			decisions.reopen()
+			continue
+		case <-term:
+			shutdown()
+		case req := <-controlRequests:
+			req.reply <- req.run()
+			continue
+		case done := <-scoresDone:
+			finishScoring(done)
+			continue
+		case r := <-configReloads:
+			commitConfig(r)
+			continue
+		case l, ok := <-lines:
+			if !ok {
+				shutdown()
+			}
+			line = l
+		}
+
+		ev, err := smtpdfilter.ParseEvent(line)
+		if err != nil {
+			malformed("%v", err)
+			continue
+		}
+		dispatch(ev)
+	}
+}
+
+// shutdown answers all outstanding requests and flushes the output before
+// exiting, so that no session is left waiting for the filter, and saves the
+// databases and the lookup cache.
+func shutdown() {
+	close(shuttingDown)
+	abandonScoring()
+	if !opts().testMode {
+		<-answers.done
+	}
+	archive.close()
+	webhook.close()
+	if outputChannel != nil {
+		close(outputChannel)
+		<-outputDone
+	}
+	if opts().statsInterval > 0 {
+		stats.logSummary()
+	}
+	greylist.flush()
+	reputation.flush()
+	if opts().cacheFile != "" {
+		if err := cache.save(opts().cacheFile); err != nil {
+			errorf("unable to save lookup cache: %v", err)
+		}
+	}
+	os.Exit(0)
+}
+
+// dispatch hands an event to its handler. Events of sessions which are still
+// being scored are held back until the score is known.
+func dispatch(ev *event) {
+	if p, ok := pendingScores[ev.SessionID]; ok {
+		p.events = append(p.events, ev)
+		if ev.Stream == "report" && ev.Phase == "link-disconnect" {
+			// nobody is waiting for the lookups anymore
+			p.cancel()
+		}
+		return
+	}
+
+	if replay != nil {
+		replay.follow(ev.Timestamp)
+	}
+
+	s, known := sessions.Get(ev.SessionID)
+	if known {
+		s.lastSeen = clock()
+		// the lookups a request needs must not hold up the events of
+		// other sessions either
+		if queries := eventLookups(s, ev); len(queries) > 0 {
+			if !opts().testMode {
+				startLookups(ev.SessionID, ev, queries)
+				return
+			}
+			addAnswers(s, lookupQueries(context.Background(), queries))
+		}
+	}
+	smtpd.Dispatch(ev)
+}
@@ -0,0 +1,409 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalidMMDB = errors.New("invalid MaxMind database")
+
+// mmdbMaxDepth bounds the nesting of values, which is shallow in real
+// databases.
+const mmdbMaxDepth = 32
+
+// mmdbReader looks up IP addresses in a MaxMind DB file such as GeoLite2
+// Country or GeoLite2 ASN. The whole file is kept in memory.
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+}
+
+var countryDB *mmdbReader
+var asnDB *mmdbReader
+
+// openMMDB reads the database at path. An empty path yields a nil reader.
+func openMMDB(path string) (*mmdbReader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseMMDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// parseMMDB checks the metadata of a database and splits it into the search
+// tree and the data section.
+func parseMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errInvalidMMDB
+	}
+	meta := buf[i+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbReader{data: meta}).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 || ipVersion != 4 && ipVersion != 6 {
+		return nil, errInvalidMMDB
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errInvalidMMDB
+	}
+	return &mmdbReader{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+16 : i],
+		nodeCount:  nodeCount,
+		recordSize: recordSize,
+		ipVersion:  ipVersion,
+	}, nil
+}
+
+// lookup returns the record for addr, or nil if there is none.
+func (r *mmdbReader) lookup(addr net.IP) (map[string]any, error) {
+	ip := addr.To4()
+	if ip == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		ip = addr.To16()
+	}
+
+	// IPv4 addresses are stored in the ::/96 subtree of IPv6 databases
+	bits := len(ip) * 8
+	if r.ipVersion == 6 && len(ip) == net.IPv4len {
+		bits += 96
+	}
+
+	node := uint64(0)
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := 0
+		if j := i - (bits - len(ip)*8); j >= 0 {
+			bit = int(ip[j/8]>>(7-j%8)) & 1
+		}
+		node = r.record(node, bit)
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errInvalidMMDB
+	}
+	v, _, err := r.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	return m, nil
+}
+
+// record returns the left (0) or right (1) record of a search tree node.
+func (r *mmdbReader) record(node uint64, bit int) uint64 {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]>>4)<<24 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	}
+	return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// decode decodes the value at the given offset of the data section and
+// returns it along with the offset following it. depth counts the maps,
+// arrays and pointers the value is nested in, so that pointers looping back
+// to an enclosing value cannot recurse forever.
+func (r *mmdbReader) decode(offset uint64, depth int) (any, uint64, error) {
+	if offset >= uint64(len(r.data)) || depth > mmdbMaxDepth {
+		return nil, 0, errInvalidMMDB
+	}
+	ctrl := r.data[offset]
+	offset++
+	typ := uint64(ctrl >> 5)
+
+	if typ == 1 {
+		return r.decodePointer(ctrl, offset, depth)
+	}
+	if typ == 0 {
+		if offset >= uint64(len(r.data)) {
+			return nil, 0, errInvalidMMDB
+		}
+		typ = 7 + uint64(r.data[offset])
+		offset++
+	}
+
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint64(len(r.data)) {
+			return nil, 0, errInvalidMMDB
+		}
+		v := uint64(0)
+		for _, b := range r.data[offset : offset+n] {
+			v = v<<8 | uint64(b)
+		}
+		size = []uint64{29, 285, 65821}[n-1] + v
+		offset += n
+	}
+
+	// every element takes at least a byte, which bounds what a corrupt
+	// size can make us allocate
+	capacity := min(size, uint64(len(r.data))-offset)
+	switch typ {
+	case 7:
+		m := make(map[string]any, capacity)
+		for i := uint64(0); i < size; i++ {
+			k, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errInvalidMMDB
+			}
+			v, next, err := r.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]any, 0, capacity)
+		for i := uint64(0); i < size; i++ {
+			v, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint64(len(r.data)) {
+		return nil, 0, errInvalidMMDB
+	}
+	b := r.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errInvalidMMDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4:
+		return b, offset, nil
+	case 5, 6, 9:
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8:
+		v := int32(0)
+		for _, c := range b {
+			v = v<<8 | int32(c)
+		}
+		return int64(v), offset, nil
+	case 10:
+		return new(big.Int).SetBytes(b), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errInvalidMMDB
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, errInvalidMMDB
+}
+
+// decodePointer follows a pointer to another value in the data section. The
+// offset returned is the one following the pointer, not the value.
+func (r *mmdbReader) decodePointer(ctrl byte, offset uint64, depth int) (any, uint64, error) {
+	n := uint64(ctrl>>3&0x3) + 1
+	if offset+n > uint64(len(r.data)) {
+		return nil, 0, errInvalidMMDB
+	}
+	p := uint64(0)
+	if n < 4 {
+		p = uint64(ctrl & 0x7)
+	}
+	for _, b := range r.data[offset : offset+n] {
+		p = p<<8 | uint64(b)
+	}
+	p += []uint64{0, 2048, 526336, 0}[n-1]
+
+	v, _, err := r.decode(p, depth+1)
+	return v, offset + n, err
+}
+
+// geoipKeys returns the keys under which rules for addr may be given: the
+// ISO country code of the country or, failing that, the registered country,
+// and the autonomous system number prefixed with AS.
+func geoipKeys(addr net.IP) []string {
+	var keys []string
+	if countryDB != nil {
+		if m, err := countryDB.lookup(addr); err == nil && m != nil {
+			for _, k := range []string{"country", "registered_country"} {
+				c, _ := m[k].(map[string]any)
+				if code, ok := c["iso_code"].(string); ok {
+					keys = append(keys, code)
+					break
+				}
+			}
+		}
+	}
+	if asnDB != nil {
+		if m, err := asnDB.lookup(addr); err == nil && m != nil {
+			if asn, ok := m["autonomous_system_number"].(uint64); ok {
+				keys = append(keys, fmt.Sprintf("AS%d", asn))
+			}
+		}
+	}
+	return keys
+}
+
+var geoipRules = make(map[string]string)
+
+// readGeoipRules reads the rules given by -geoipRule or, if there are none,
+// by the [geoip] table of the configuration file. Each rule maps a country
+// code or an AS number to a score adjustment, allow, junk or block.
+func readGeoipRules(cfg configTable, specs []string) (map[string]string, error) {
+	rules := make(map[string]string)
+	if len(specs) == 0 && cfg != nil && cfg["geoip"] != nil {
+		table, ok := cfg["geoip"].(configTable)
+		if !ok {
+			return nil, errors.New("geoip is not a table")
+		}
+		for key, value := range table {
+			rules[key] = fmt.Sprint(value)
+		}
+	}
+
+	for _, s := range specs {
+		key, action, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid GeoIP rule: %q", s)
+		}
+		rules[key] = action
+	}
+
+	// several countries or AS numbers may share a rule, as in CN,RU:junk
+	for keys, action := range rules {
+		if !strings.Contains(keys, ",") {
+			continue
+		}
+		delete(rules, keys)
+		for _, key := range strings.Split(keys, ",") {
+			if key = strings.TrimSpace(key); key == "" {
+				return nil, fmt.Errorf("invalid GeoIP key: %q", keys)
+			}
+			rules[key] = action
+		}
+	}
+
+	for key, action := range rules {
+		if _, err := parseScore(action); err != nil && action != "allow" && action != "junk" && action != "block" {
+			return nil, fmt.Errorf("invalid action %q for GeoIP key %q", action, key)
+		}
+	}
+	return rules, nil
+}
+
+// geoipAllowed returns the key of the rule allowing addr, if any. Such
+// addresses are treated like allowlisted ones.
+func geoipAllowed(addr net.IP) (string, bool) {
+	for _, key := range geoipKeys(addr) {
+		if geoipRules[key] == "allow" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// geoipBlocked returns the key of the rule blocking addr, if any. Such
+// addresses are blocked like blocklisted ones without being looked up.
+func geoipBlocked(addr net.IP) (string, bool) {
+	for _, key := range geoipKeys(addr) {
+		if geoipRules[key] == "block" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// applyGeoip applies the rules matching the country and AS of the session's
+// IP address. Score adjustments add up; negative ones never take the score
+// below 0 nor turn an unknown score into a known one.
+func applyGeoip(s *session) {
+	for _, key := range geoipKeys(s.Addr) {
+		action, ok := geoipRules[key]
+		if !ok {
+			continue
+		}
+		logf("IP address %s matches GeoIP rule %s:%s", s.Addr, key, action)
+		switch action {
+		case "allow":
+			// handled by geoipAllowed before any lookups
+		case "junk":
+			s.junk = true
+		case "block":
+			// handled by geoipBlocked before any lookups
+		default:
+			adj, _ := parseScore(action)
+			if adj < 0 && s.Score == -1 {
+				continue
+			}
+			s.Score = max(max(s.Score, 0)+adj, 0)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func FuzzMMDB(f *testing.F) {
+	for _, path := range []string{"../../test/country.mmdb", "../../test/asn.mmdb"} {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+	// a pointer to itself
+	f.Add(append([]byte("\xab\xcd\xefMaxMind.com"), 0x20, 0x00))
+	addrs := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("81.2.69.142"), net.ParseIP("2001:db8::1")}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		r, err := parseMMDB(buf)
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			r.lookup(addr)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gossipBacklog = 1024
+
+// gossiper shares rejects and blocked repeat offenders with the filters of
+// other MXes through a channel on the shared cache server. Messages are the
+// ID of the sender followed by reject <addr> or block <addr> <until>.
+type gossiper struct {
+	channel string
+	id      string
+	out     chan string
+}
+
+var gossip *gossiper
+
+// startGossip joins the given channel, if any.
+func startGossip(channel string) (*gossiper, error) {
+	if channel == "" {
+		return nil, nil
+	}
+	if shared == nil {
+		return nil, errors.New("-gossipChannel requires -sharedCache")
+	}
+	g := &gossiper{
+		channel: channel,
+		id:      strconv.FormatInt(random(1<<62), 36),
+		out:     make(chan string, gossipBacklog),
+	}
+	go g.publishMessages()
+	go g.receiveMessages()
+	return g, nil
+}
+
+// publish queues a message for the other filters. Messages are dropped
+// rather than holding up sessions if the server cannot keep up.
+func (g *gossiper) publish(format string, a ...any) {
+	if g == nil {
+		return
+	}
+	select {
+	case g.out <- g.id + " " + fmt.Sprintf(format, a...):
+	default:
+	}
+}
+
+func (g *gossiper) publishMessages() {
+	for msg := range g.out {
+		shared.do([]string{"PUBLISH", g.channel, msg})
+	}
+}
+
+// receiveMessages subscribes to the channel on a connection of its own,
+// reconnecting whenever it is lost.
+func (g *gossiper) receiveMessages() {
+	broken := false
+	for {
+		err := g.subscribe(func() {
+			if broken {
+				logf("gossip channel %s is available again", g.channel)
+				broken = false
+			}
+		})
+		if !broken {
+			errorf("gossip channel %s is unavailable: %v", g.channel, err)
+			broken = true
+		}
+		time.Sleep(sharedCacheRetry)
+	}
+}
+
+func (g *gossiper) subscribe(subscribed func()) error {
+	sub := &sharedCache{addr: shared.addr, password: shared.password}
+	if err := sub.connect(); err != nil {
+		if sub.conn != nil {
+			sub.conn.Close()
+		}
+		return err
+	}
+	defer sub.conn.Close()
+	if err := sub.send([][]string{{"SUBSCRIBE", g.channel}}); err != nil {
+		return err
+	}
+	if _, err := sub.readArray(); err != nil {
+		return err
+	}
+	subscribed()
+
+	sub.conn.SetDeadline(time.Time{})
+	for {
+		msg, err := sub.readArray()
+		if err != nil {
+			return err
+		}
+		if len(msg) == 3 && msg[0] == "message" {
+			g.receive(msg[2])
+		}
+	}
+}
+
+// receive applies a message of another filter.
+func (g *gossiper) receive(msg string) {
+	fields := strings.Fields(msg)
+	if len(fields) < 3 || fields[0] == g.id || net.ParseIP(fields[2]) == nil {
+		return
+	}
+	switch {
+	case fields[1] == "reject" && len(fields) == 3:
+		debugf("peer %s rejected IP address %s", fields[0], fields[2])
+		offenders.record(fields[2])
+	case fields[1] == "block" && len(fields) == 4:
+		until, err := strconv.ParseInt(fields[3], 10, 64)
+		if err == nil {
+			offenders.block(fields[2], time.Unix(until, 0))
+		}
+	}
+}
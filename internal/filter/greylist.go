@@ -0,0 +1,178 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// greylistPassTTL is the time for which a tuple which passed greylisting is
+// remembered after it was last seen.
+const greylistPassTTL = 36 * 24 * time.Hour
+
+// databaseSaveInterval is how often the greylisting and reputation databases
+// are purged and, if they changed, written to disk.
+const databaseSaveInterval = 10 * time.Second
+
+type greylistEntry struct {
+	firstSeen time.Time
+	expires   time.Time
+	passed    bool
+}
+
+// greylistDB tracks (IP address, sender, recipient) tuples. A tuple is
+// accepted once it is retried after -greylistDelay but before -greylistExpire
+// has passed since it was first seen. The database is kept in memory and, if
+// a path is given, written to disk every databaseSaveInterval and on exit.
+type greylistDB struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	path    string
+	entries map[string]greylistEntry
+	dirty   bool
+}
+
+var greylist *greylistDB
+
+// loadGreylist reads the greylisting database from path. A missing file is
+// treated as an empty database.
+func loadGreylist(path string) (*greylistDB, error) {
+	db := &greylistDB{path: path, entries: make(map[string]greylistEntry)}
+	if path == "" {
+		return db, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid greylisting database entry: %s", scanner.Text())
+		}
+		firstSeen, err1 := strconv.ParseInt(fields[3], 10, 64)
+		expires, err2 := strconv.ParseInt(fields[4], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid greylisting database entry: %s", scanner.Text())
+		}
+		db.entries[strings.Join(fields[:3], "\t")] = greylistEntry{
+			firstSeen: time.Unix(firstSeen, 0),
+			expires:   time.Unix(expires, 0),
+			passed:    fields[5] == "1",
+		}
+	}
+	return db, scanner.Err()
+}
+
+// pass reports whether the given tuple may proceed and records the attempt.
+func (db *greylistDB) pass(addr string, sender string, recipient string) bool {
+	key := strings.Join([]string{addr, strings.ToLower(sender), strings.ToLower(recipient)}, "\t")
+	now := clock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entries[key]
+	switch {
+	case ok && entry.passed && now.Before(entry.expires):
+		entry.expires = now.Add(greylistPassTTL)
+	case ok && now.Before(entry.expires) && now.Sub(entry.firstSeen) >= opts().greylistDelay:
+		entry.passed = true
+		entry.expires = now.Add(greylistPassTTL)
+	case ok && now.Before(entry.expires):
+		return false
+	default:
+		entry = greylistEntry{firstSeen: now, expires: now.Add(opts().greylistExpire)}
+	}
+	db.entries[key] = entry
+	db.dirty = true
+	return entry.passed
+}
+
+func (db *greylistDB) saveEvery() {
+	for range time.Tick(databaseSaveInterval) {
+		db.flush()
+	}
+}
+
+// flush forgets expired tuples and saves the database if it changed. The
+// entries are only locked while they are copied, not while they are written.
+func (db *greylistDB) flush() {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+
+	now := clock()
+	var b strings.Builder
+	db.mu.Lock()
+	for key, e := range db.entries {
+		if now.After(e.expires) {
+			delete(db.entries, key)
+			db.dirty = true
+			continue
+		}
+		passed := 0
+		if e.passed {
+			passed = 1
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%d\t%d\n", key, e.firstSeen.Unix(), e.expires.Unix(), passed)
+	}
+	dirty := db.dirty
+	db.dirty = false
+	db.mu.Unlock()
+
+	if !dirty || db.path == "" {
+		return
+	}
+	if err := writeDatabase(db.path, b.String()); err != nil {
+		errorf("unable to save greylisting database: %v", err)
+		db.mu.Lock()
+		db.dirty = true
+		db.mu.Unlock()
+	}
+}
+
+// writeDatabase writes data to a temporary file which then replaces the
+// database at path, so that a crash never leaves a truncated database behind.
+func writeDatabase(path string, data string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
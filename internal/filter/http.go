@@ -0,0 +1,92 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const httpTimeout = 30 * time.Second
+
+// listenHTTP serves /healthz, /score/<ip>, /stats and /allowlist on the
+// address given by -httpListen, if any.
+func listenHTTP(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, runControl(func() string { return "ok" }))
+	})
+	mux.HandleFunc("GET /score/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		addr := net.ParseIP(r.PathValue("ip"))
+		if addr == nil {
+			http.Error(w, "invalid IP address", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, runControl(func() string { return queryAddress(addr) }))
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, runControl(func() string {
+			return strings.Join(append([]string{stats.current()}, stats.currentLists()...), "\n")
+		}))
+	})
+	mux.HandleFunc("GET /allowlist", func(w http.ResponseWriter, r *http.Request) {
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			addr := net.ParseIP(ip)
+			if addr == nil {
+				http.Error(w, "invalid IP address", http.StatusBadRequest)
+				return
+			}
+			entry := runControl(func() string {
+				entry, _ := allowlist.Match(addr)
+				return entry
+			})
+			if entry == "" {
+				http.Error(w, "not allowlisted", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, entry)
+			return
+		}
+		entries := runControl(func() string {
+			return strings.Join(allowlist.Entries(), "\n")
+		})
+		if entries != "" {
+			fmt.Fprintln(w, entries)
+		}
+	})
+
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  httpTimeout,
+		WriteTimeout: httpTimeout,
+	}
+	go func() {
+		errorf("HTTP API stopped: %v", server.Serve(ln))
+	}()
+	return nil
+}
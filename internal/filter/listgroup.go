@@ -0,0 +1,77 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// listGroups maps the DNSBLs given by -listGroup to the name of their group.
+// Members of a group are mirrors or aliases of the same list, such as a
+// commercial zone and its public equivalent configured side by side for
+// availability, so a hit on any of them counts once.
+var listGroups map[string]string
+
+// readListGroups parses the name=list,list... specifiers given by
+// -listGroup. Members must be DNSBLs in use and belong to one group at most.
+func readListGroups(specs []string, lists map[string]float64) (map[string]string, error) {
+	groups := make(map[string]string)
+	names := make(map[string]bool)
+	for _, s := range specs {
+		name, members, ok := strings.Cut(s, "=")
+		if !ok || name == "" || strings.Contains(name, ".") || !strings.Contains(members, ",") {
+			return nil, fmt.Errorf("invalid list group specifier: %q", s)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate list group: %s", name)
+		}
+		names[name] = true
+		for _, list := range strings.Split(members, ",") {
+			if _, ok := lists[list]; !ok {
+				return nil, fmt.Errorf("list %s of group %s is not a DNSBL in use", list, name)
+			}
+			if other, ok := groups[list]; ok {
+				return nil, fmt.Errorf("list %s is in both groups %s and %s", list, other, name)
+			}
+			groups[list] = name
+		}
+	}
+	return groups, nil
+}
+
+// groupOf returns the group of a list, or the list itself if it is in none.
+func groupOf(list string) string {
+	if group, ok := listGroups[list]; ok {
+		return group
+	}
+	return list
+}
+
+// groupedWeights returns the weights of the given lists with those of each
+// group collapsed into the highest of them, so that a group counts as one
+// list.
+func groupedWeights(weights map[string]float64) []float64 {
+	highest := make(map[string]float64)
+	for list, weight := range weights {
+		group := groupOf(list)
+		highest[group] = max(highest[group], weight)
+	}
+	return slices.Collect(maps.Values(highest))
+}
@@ -0,0 +1,376 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// zoneData holds the entries of an rbldnsd data file: listed and excluded
+// IPv4 networks, keyed by prefix length and network address, and listed and
+// excluded names, those starting with *. covering subdomains only. Each
+// entry maps to the address it is answered with.
+type zoneData struct {
+	networks map[int]map[uint32]string
+	excluded map[int]map[uint32]bool
+	names    map[string]string
+	excNames map[string]bool
+	entries  int
+}
+
+// localZone is a list answered from a local rbldnsd data file instead of
+// the DNS, e.g. a private blocklist. It is reloaded when the file changes.
+type localZone struct {
+	path    string
+	data    atomic.Pointer[zoneData]
+	modTime time.Time
+	size    int64
+}
+
+var localZones atomic.Pointer[map[string]*localZone]
+
+// localZoneOf returns the local zone answering the queries of list, or nil
+// if the list is looked up in the DNS.
+func localZoneOf(list string) *localZone {
+	m := localZones.Load()
+	if m == nil {
+		return nil
+	}
+	return (*m)[list]
+}
+
+// readLocalZones loads the list=file pairs given by -localZone. Each must
+// belong to one of the given lists.
+func readLocalZones(specs []string, lists ...map[string]float64) (map[string]*localZone, error) {
+	result := make(map[string]*localZone)
+	for _, s := range specs {
+		list, path, ok := strings.Cut(s, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid local zone specifier: %q", s)
+		}
+		if !slices.ContainsFunc(lists, func(m map[string]float64) bool {
+			_, ok := m[list]
+			return ok
+		}) {
+			return nil, fmt.Errorf("local zone given for unknown list: %s", list)
+		}
+		z := &localZone{path: path}
+		if err := z.load(); err != nil {
+			return nil, err
+		}
+		result[list] = z
+	}
+	return result, nil
+}
+
+// setLocalZones puts a new set of local zones into effect.
+func setLocalZones(m map[string]*localZone) {
+	localZones.Store(&m)
+}
+
+// load reads the data file of the zone and puts it into effect.
+func (z *localZone) load() error {
+	f, err := os.Open(z.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := parseZone(f, z.path)
+	if err != nil {
+		return err
+	}
+	z.data.Store(data)
+	z.modTime, z.size = fi.ModTime(), fi.Size()
+	logf("%s: loaded %d entries", z.path, data.entries)
+	return nil
+}
+
+// parseZone parses an rbldnsd data file in the ip4set or dnset format, or a
+// mix of both. Entries starting with ! are excluded even if a broader entry
+// lists them.
+func parseZone(r io.Reader, name string) (*zoneData, error) {
+	data := &zoneData{
+		networks: make(map[int]map[uint32]string),
+		excluded: make(map[int]map[uint32]bool),
+		names:    make(map[string]string),
+		excNames: make(map[string]bool),
+	}
+	code := "127.0.0.2"
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '$' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if line[0] == ':' {
+			c, err := zoneCode(line, code)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+			code = c
+			continue
+		}
+		entry, excluded := strings.CutPrefix(fields[0], "!")
+		entryCode := code
+		if len(fields) > 1 && !excluded {
+			c, err := zoneCode(strings.Join(fields[1:], " "), code)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+			entryCode = c
+		}
+		prefixes, err := zonePrefixes(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		if prefixes == nil {
+			// not an address, so a name
+			entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+			names := []string{entry}
+			if rest, ok := strings.CutPrefix(entry, "."); ok {
+				names = []string{rest, "*" + entry}
+			}
+			for _, key := range names {
+				if !isDomainName(strings.TrimPrefix(key, "*.")) {
+					return nil, fmt.Errorf("%s:%d: invalid entry: %s", name, n, entry)
+				}
+				if excluded {
+					data.excNames[key] = true
+				} else {
+					data.names[key] = entryCode
+				}
+			}
+			data.entries++
+			continue
+		}
+		for _, p := range prefixes {
+			network := ip4Uint(p.Addr())
+			if excluded {
+				if data.excluded[p.Bits()] == nil {
+					data.excluded[p.Bits()] = make(map[uint32]bool)
+				}
+				data.excluded[p.Bits()][network] = true
+			} else {
+				if data.networks[p.Bits()] == nil {
+					data.networks[p.Bits()] = make(map[uint32]string)
+				}
+				data.networks[p.Bits()][network] = entryCode
+			}
+		}
+		data.entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// zoneCode returns the address given in the value of an entry, such as
+// :127.0.0.3:text or 127.0.0.3, or def if it has none.
+func zoneCode(value string, def string) (string, error) {
+	value = strings.TrimPrefix(value, ":")
+	addr, _, _ := strings.Cut(value, ":")
+	if addr == "" {
+		return def, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("invalid return code: %s", addr)
+	}
+	return ip.String(), nil
+}
+
+// zonePrefixes returns the networks covered by an IPv4 entry, or nil if the
+// entry is a name, which may start with digits as well.
+func zonePrefixes(entry string) ([]netip.Prefix, error) {
+	if addr, last, ok := strings.Cut(entry, "-"); ok {
+		lo, err := netip.ParseAddr(addr)
+		if err != nil || !lo.Is4() {
+			return nil, nil
+		}
+		if !strings.Contains(last, ".") {
+			// 192.0.2.10-20 only gives the last octet
+			octets := lo.As4()
+			n, err := strconv.ParseUint(last, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range: %s", entry)
+			}
+			octets[3] = byte(n)
+			last = netip.AddrFrom4(octets).String()
+		}
+		hi, err := netip.ParseAddr(last)
+		if err != nil || !hi.Is4() || hi.Less(lo) {
+			return nil, fmt.Errorf("invalid range: %s", entry)
+		}
+		return rangePrefixes(ip4Uint(lo), ip4Uint(hi)), nil
+	}
+
+	addr, bits, hasBits := strings.Cut(entry, "/")
+	octets := strings.Split(addr, ".")
+	for _, octet := range octets {
+		if _, err := strconv.ParseUint(octet, 10, 8); err != nil && !hasBits {
+			return nil, nil
+		}
+	}
+	if len(octets) > 4 {
+		return nil, fmt.Errorf("invalid address: %s", entry)
+	}
+	// 192.0.2 is short for 192.0.2.0/24
+	length := 8 * len(octets)
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	ip, err := netip.ParseAddr(strings.Join(octets, "."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", entry)
+	}
+	if hasBits {
+		if length, err = strconv.Atoi(bits); err != nil || length < 0 || length > 32 {
+			return nil, fmt.Errorf("invalid network: %s", entry)
+		}
+	}
+	p, err := ip.Prefix(length)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network: %s", entry)
+	}
+	return []netip.Prefix{p}, nil
+}
+
+// rangePrefixes returns the smallest set of networks covering the addresses
+// from lo to hi.
+func rangePrefixes(lo uint32, hi uint32) []netip.Prefix {
+	var result []netip.Prefix
+	for {
+		bits := 32
+		for bits > 0 {
+			size := uint64(1) << (32 - bits + 1)
+			if uint64(lo)%size != 0 || uint64(lo)+size-1 > uint64(hi) {
+				break
+			}
+			bits--
+		}
+		var octets [4]byte
+		octets[0], octets[1], octets[2], octets[3] = byte(lo>>24), byte(lo>>16), byte(lo>>8), byte(lo)
+		result = append(result, netip.PrefixFrom(netip.AddrFrom4(octets), bits))
+		next := uint64(lo) + uint64(1)<<(32-bits)
+		if next > uint64(hi) {
+			return result
+		}
+		lo = uint32(next)
+	}
+}
+
+func ip4Uint(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// lookup answers a query for the zone: a reversed IPv4 address, as sent to
+// DNSBLs, or a name.
+func (z *localZone) lookup(query string) []net.IP {
+	data := z.data.Load()
+	var code string
+	if ip, ok := reversedIPv4(query); ok {
+		for bits := 32; bits >= 0; bits-- {
+			network := ip
+			if bits < 32 {
+				network &^= 1<<(32-bits) - 1
+			}
+			if data.excluded[bits][network] {
+				return nil
+			}
+		}
+		for bits := 32; bits >= 0 && code == ""; bits-- {
+			network := ip
+			if bits < 32 {
+				network &^= 1<<(32-bits) - 1
+			}
+			code = data.networks[bits][network]
+		}
+	} else {
+		name := strings.ToLower(strings.TrimSuffix(query, "."))
+		if data.excNames[name] {
+			return nil
+		}
+		code = data.names[name]
+		for parent := name; code == ""; {
+			_, rest, ok := strings.Cut(parent, ".")
+			if !ok {
+				break
+			}
+			if data.excNames["*."+rest] {
+				return nil
+			}
+			code, parent = data.names["*."+rest], rest
+		}
+	}
+	if code == "" {
+		return nil
+	}
+	return []net.IP{net.ParseIP(code).To4()}
+}
+
+// reversedIPv4 parses a reversed IPv4 address such as 4.3.2.1.
+func reversedIPv4(query string) (uint32, bool) {
+	labels := strings.Split(query, ".")
+	if len(labels) != 4 {
+		return 0, false
+	}
+	slices.Reverse(labels)
+	addr, err := netip.ParseAddr(strings.Join(labels, "."))
+	if err != nil || !addr.Is4() {
+		return 0, false
+	}
+	return ip4Uint(addr), true
+}
+
+// watchLocalZones reloads local zones whose files changed, checking every
+// -allowlistWatch. A zone which fails to load keeps its previous entries.
+func watchLocalZones() {
+	for {
+		time.Sleep(opts().allowlistWatch)
+		m := localZones.Load()
+		if m == nil {
+			continue
+		}
+		for _, z := range *m {
+			fi, err := os.Stat(z.path)
+			if err != nil || fi.ModTime().Equal(z.modTime) && fi.Size() == z.size {
+				continue
+			}
+			if err := z.load(); err != nil {
+				errorf("unable to reload local zone: %v", err)
+				z.modTime, z.size = fi.ModTime(), fi.Size()
+			}
+		}
+	}
+}
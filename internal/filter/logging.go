@@ -0,0 +1,186 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+var syslogWriter *syslog.Writer
+
+// logFields are the structured details of a log message. They are only
+// written in JSON mode; in text mode, the message is expected to contain them.
+type logFields map[string]any
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelInfo
+	levelDebug
+)
+
+var logLevels = map[string]logLevel{
+	"error": levelError,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+var logMu sync.Mutex
+
+// errorf logs failures and blocked sessions.
+func errorf(format string, a ...any) {
+	logEvent(levelError, nil, format, a...)
+}
+
+// logf logs scores, decisions and other events of interest.
+func logf(format string, a ...any) {
+	logEvent(levelInfo, nil, format, a...)
+}
+
+// debugf logs details such as individual DNS queries.
+func debugf(format string, a ...any) {
+	logEvent(levelDebug, nil, format, a...)
+}
+
+// logEvent writes a log message to stderr, either as is or, with -logFormat
+// json, as a JSON object holding the time, the level, the message and the
+// given fields. Messages above -logLevel are discarded.
+func logEvent(level logLevel, fields logFields, format string, a ...any) {
+	if level > logLevels[opts().logLevelName] {
+		return
+	}
+
+	msg := redactKeys(fmt.Sprintf(format, a...))
+	line := msg
+	if opts().logFormat == "json" {
+		obj := logFields{"time": time.Now().UTC().Format(time.RFC3339), "level": level.String(), "msg": msg}
+		for k, v := range fields {
+			obj[k] = v
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			b, _ = json.Marshal(logFields{"msg": msg})
+		}
+		line = string(b)
+	}
+
+	if syslogWriter != nil {
+		switch level {
+		case levelError:
+			syslogWriter.Err(line)
+		case levelInfo:
+			syslogWriter.Info(line)
+		default:
+			syslogWriter.Debug(line)
+		}
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintln(os.Stderr, line)
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevels {
+		if level == l {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// setupSyslog sends log messages, including fatal errors, to syslog instead
+// of stderr if -syslog is given.
+func setupSyslog() error {
+	if !opts().useSyslog {
+		return nil
+	}
+	facility, ok := syslogFacilities[opts().syslogFacility]
+	if !ok {
+		return fmt.Errorf("invalid syslog facility: %s", opts().syslogFacility)
+	}
+	w, err := syslog.New(facility|syslog.LOG_INFO, opts().syslogTag)
+	if err != nil {
+		return err
+	}
+	syslogWriter = w
+	log.SetOutput(w)
+	log.SetFlags(0)
+	return nil
+}
+
+// sessionFields returns the details of a session to be logged with a message
+// about it.
+func sessionFields(sessionId string, s *session) logFields {
+	fields := logFields{"session": sessionId, "score": s.Score, "lists": s.Lists}
+	if s.Lists == nil {
+		fields["lists"] = []string{}
+	}
+	if s.Addr != nil {
+		fields["ip"] = s.Addr.String()
+	}
+	if s.phase != "" {
+		fields["phase"] = s.phase
+	}
+	if s.tx != nil {
+		fields["msgid"] = s.tx.msgid
+	}
+	if s.entry != "" {
+		fields["entry"] = s.entry
+	}
+	if s.source != "" {
+		fields["source"] = s.source
+	}
+	if s.profile != nil {
+		fields["profile"] = s.profile.name
+	}
+	if s.decisionId != "" {
+		fields["id"] = s.decisionId
+	}
+	return fields
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// lookupPhases are the phases at which -lookup reports the first action taken,
+// in the order a session goes through them.
+var lookupPhases = []string{"connect", "helo", "ehlo", "mail-from", "rcpt-to", "data", "commit"}
+
+// lookupOnce scores addr for -lookup as a connecting client would be, printing
+// the answer of each list followed by the score and the decision, and returns
+// the exit status: 0 if the address would be let through, 1 if it would be
+// blocked or junked.
+func lookupOnce(addr net.IP) int {
+	if addr.To4() != nil {
+		labels := strings.Split(addr.To4().String(), ".")
+		slices.Reverse(labels)
+		revip := strings.Join(labels, ".")
+		for _, list := range slices.Sorted(maps.Keys(domainWeights)) {
+			fmt.Printf("%s weight=%v: %s\n", list, domainWeights[list], describeListing(list, revip, false))
+		}
+		for _, list := range slices.Sorted(maps.Keys(dnswlWeights)) {
+			fmt.Printf("%s dnswl weight=%v: %s\n", list, dnswlWeights[list], describeListing(list, revip, true))
+		}
+	}
+
+	// the lookups above are cached, so this only aggregates their answers
+	result, detail := lookupAddress(addr)
+	s := &session{Session: dnsbl.Session{Addr: addr}}
+	s.Apply(result)
+	if result.Failed {
+		s.dnsFailed, s.outage = true, result.Outage
+		s.junk = failurePolicy(s) == "junk"
+	}
+	applyUnknown(s)
+	if len(result.Lists) > 0 && slices.Contains([]string{"geoip", "offender", "blocklist"}, result.Lists[0]) {
+		s.blocklisted = true
+	}
+	line := fmt.Sprintf("score=%v lists=%s", s.Score, strings.Join(s.Lists, ","))
+	if detail != "" {
+		line += " " + detail
+	}
+	fmt.Println(line)
+
+	for _, phase := range lookupPhases {
+		if d := blockAction(s, phase); d.Action != "" {
+			fmt.Printf("decision: %s at %s\n", d.Result(), phase)
+			return 1
+		}
+	}
+	if shouldJunk(s) {
+		fmt.Println("decision: junk")
+		return 1
+	}
+	fmt.Println("decision: proceed")
+	return 0
+}
+
+// describeListing looks up revip on a single list and describes the answer.
+func describeListing(list string, revip string, dnswl bool) string {
+	b := breakers[list]
+	if !b.allow() {
+		return "disabled"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts().lookupTimeout)
+	defer cancel()
+	ctx, cancelList := listContext(ctx, list)
+	defer cancelList()
+	addrs, err := lookup(ctx, list, revip)
+	if !errors.Is(err, errRateLimited) {
+		b.record(err)
+	}
+	switch {
+	case err != nil:
+		return "failed: " + err.Error()
+	case len(addrs) == 0:
+		return "not listed"
+	case dnswl:
+		return fmt.Sprintf("trust level %d", dnsbl.TrustLevel(addrs))
+	}
+	codes := make([]string, len(addrs))
+	for i, addr := range addrs {
+		codes[i] = addr.String()
+	}
+	description := "listed " + strings.Join(codes, ",")
+	if opts().lookupTXT {
+		if reason := listingReason(ctx, list, revip); reason != "" {
+			description += " (" + reason + ")"
+		}
+	}
+	return description
+}
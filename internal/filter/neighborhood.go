@@ -0,0 +1,122 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// neighborhoodTracker remembers the addresses which scored above
+// -neighborhoodAbove within -neighborhoodWindow by neighborhood, an IPv4
+// subnet of -neighborhoodPrefix or IPv6 subnet of -neighborhoodPrefix6 bits.
+// Snowshoe campaigns rotate through their ranges faster than the DNSBLs list
+// each address, so the company an address keeps says something about it.
+type neighborhoodTracker struct {
+	mu         sync.Mutex
+	seen       map[string]map[string]time.Time
+	lastPurged time.Time
+}
+
+var neighborhoods = &neighborhoodTracker{seen: make(map[string]map[string]time.Time)}
+
+// neighborhoodOf returns the subnet the neighbors of addr are counted in.
+func neighborhoodOf(addr net.IP) string {
+	if addr4 := addr.To4(); addr4 != nil {
+		return (&net.IPNet{IP: addr4.Mask(net.CIDRMask(opts().neighborhoodPrefix, 32)), Mask: net.CIDRMask(opts().neighborhoodPrefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(opts().neighborhoodPrefix6, 128)), Mask: net.CIDRMask(opts().neighborhoodPrefix6, 128)}).String()
+}
+
+// observe returns the number of other addresses of the neighborhood of addr
+// which scored high within the window and whether addr is one of them
+// already, and then remembers addr if it scored high itself.
+func (t *neighborhoodTracker) observe(addr net.IP, high bool) (int, bool) {
+	now := clock()
+	key := neighborhoodOf(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// quiet neighborhoods are forgotten once per window
+	if now.Sub(t.lastPurged) > opts().neighborhoodWindow {
+		for k, addrs := range t.seen {
+			for a, seen := range addrs {
+				if now.Sub(seen) > opts().neighborhoodWindow {
+					delete(addrs, a)
+				}
+			}
+			if len(addrs) == 0 {
+				delete(t.seen, k)
+			}
+		}
+		t.lastPurged = now
+	}
+
+	addrs := t.seen[key]
+	others, known := 0, false
+	for a, seen := range addrs {
+		switch {
+		case now.Sub(seen) > opts().neighborhoodWindow:
+		case a == addr.String():
+			known = true
+		default:
+			others++
+		}
+	}
+	if high {
+		if addrs == nil {
+			addrs = make(map[string]time.Time)
+			t.seen[key] = addrs
+		}
+		addrs[addr.String()] = now
+	}
+	return others, known
+}
+
+// applyNeighborhood adds -neighborhoodPenalty to the score of addresses new
+// to a neighborhood in which at least -neighborhoodCount other addresses
+// scored above -neighborhoodAbove within -neighborhoodWindow. The score
+// before the penalty decides whether the address counts against its
+// neighbors in turn, so that penalties do not feed on themselves.
+func applyNeighborhood(s *session) {
+	if opts().neighborhoodCount <= 0 || s.Score < 0 {
+		return
+	}
+	others, known := neighborhoods.observe(s.Addr, s.Score > opts().neighborhoodAbove)
+	if known || int64(others) < opts().neighborhoodCount {
+		return
+	}
+	statsd.send("neighborhood.penalized:1|c")
+	logf("IP address %s: %d other addresses of %s scored above %v within %s, adding %v", s.Addr, others, neighborhoodOf(s.Addr), opts().neighborhoodAbove, opts().neighborhoodWindow, opts().neighborhoodPenalty)
+	s.Score += opts().neighborhoodPenalty
+}
+
+// validateNeighborhood checks the neighborhood options.
+func validateNeighborhood() error {
+	switch {
+	case opts().neighborhoodCount < 0 || opts().neighborhoodWindow <= 0:
+		return fmt.Errorf("invalid neighborhood count: %d per %s", opts().neighborhoodCount, opts().neighborhoodWindow)
+	case opts().neighborhoodPrefix < 0 || opts().neighborhoodPrefix > 32 || opts().neighborhoodPrefix6 < 0 || opts().neighborhoodPrefix6 > 128:
+		return fmt.Errorf("invalid neighborhood prefix length: %d or %d", opts().neighborhoodPrefix, opts().neighborhoodPrefix6)
+	case opts().neighborhoodPenalty < 0 || opts().neighborhoodAbove < 0:
+		return errors.New("invalid neighborhood penalty or threshold")
+	}
+	return nil
+}
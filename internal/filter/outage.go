@@ -0,0 +1,100 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"sync"
+	"time"
+)
+
+// outageTracker notices when every DNSBL fails for an address, which means
+// that the resolver or the network is down rather than a single list, and
+// logs the start and the end of such an outage prominently, as all sessions
+// are left to -onOutage meanwhile.
+type outageTracker struct {
+	mu     sync.Mutex
+	active bool
+	since  time.Time
+	failed int64
+}
+
+var outage = &outageTracker{}
+
+// observe records whether the lookups for an address all failed.
+func (t *outageTracker) observe(down bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case down && !t.active:
+		t.active, t.since, t.failed = true, clock(), 0
+		stats.addOutage()
+		statsd.send("dns.outage:1|g")
+		errorf("all DNSBLs are unreachable, applying %s policy until they recover", outagePolicy())
+		webhook.notify("outage", logFields{"policy": outagePolicy()})
+	case !down && t.active:
+		t.active = false
+		statsd.send("dns.outage:0|g")
+		logf("DNSBLs are reachable again after %s, failed=%d", clock().Sub(t.since).Round(time.Second), t.failed)
+		webhook.notify("outage-end", logFields{"duration": clock().Sub(t.since).Round(time.Second).String(), "failed": t.failed})
+	}
+	if down {
+		t.failed++
+	}
+}
+
+// outagePolicy returns what to do with sessions during an outage, by
+// default the same as with any other failed lookups.
+func outagePolicy() string {
+	if opts().onOutage != "" {
+		return opts().onOutage
+	}
+	return opts().onDnsFailure
+}
+
+// failurePolicy returns what to do with a session whose lookups failed.
+func failurePolicy(s *session) string {
+	if s.outage {
+		return outagePolicy()
+	}
+	return opts().onDnsFailure
+}
+
+// unknownMessage is sent to sessions disconnected by -onUnknown tempfail.
+const unknownMessage = "unable to assess your IP address, please try again later"
+
+// unknownPolicy returns what to do with a session whose score is unknown for
+// reasons other than failed lookups, which are left to -onDnsFailure, e.g.
+// as IPv6 addresses are not looked up. It is empty for all other sessions.
+func unknownPolicy(s *session) string {
+	if s.Score != -1 || s.dnsFailed || s.exempt || s.Addr == nil {
+		return ""
+	}
+	return opts().onUnknown
+}
+
+// applyUnknown marks sessions with an unknown score as junk with -onUnknown
+// junk. The other policies take effect as the session goes on.
+func applyUnknown(s *session) {
+	switch policy := unknownPolicy(s); policy {
+	case "", "proceed":
+	case "junk":
+		s.junk = true
+		fallthrough
+	default:
+		logf("IP address %s has an unknown score, applying %s policy", s.Addr, policy)
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partnerSet holds the addresses of the mail servers of the domains given
+// by -partnerDomain, resolved from their MX records, so that partners are
+// exempted even when their mail servers move to new addresses. A failed
+// lookup leaves the last good answer for the domain in effect.
+type partnerSet struct {
+	sync.Mutex
+	addrs map[string][]net.IP
+}
+
+var partners = &partnerSet{addrs: make(map[string][]net.IP)}
+
+// resolvePartner returns the addresses of the mail servers of domain. As
+// with delivery, a domain without MX records is its own mail server, and a
+// null MX record means that it has none.
+func resolvePartner(domain string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts().lookupTimeout)
+	defer cancel()
+
+	var dnsErr *net.DNSError
+	hosts := []string{domain}
+	mxs, err := resolver.LookupMX(ctx, domain)
+	switch {
+	case err == nil:
+		hosts = nil
+		for _, mx := range mxs {
+			if host := strings.TrimSuffix(mx.Host, "."); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	case !(errors.As(err, &dnsErr) && dnsErr.IsNotFound):
+		return nil, err
+	}
+
+	var addrs []net.IP
+	for _, host := range hosts {
+		ips, err := resolver.LookupIP(ctx, "ip", host)
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			debugf("mail server %s of partner domain %s does not exist", host, domain)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, ips...)
+	}
+	return addrs, nil
+}
+
+// refresh resolves the mail servers of all partner domains again.
+func (p *partnerSet) refresh() {
+	for _, domain := range opts().partnerDomains {
+		addrs, err := resolvePartner(domain)
+		if err != nil {
+			errorf("unable to resolve the mail servers of partner domain %s, keeping the last good answer: %v", domain, err)
+			continue
+		}
+		p.Lock()
+		p.addrs[domain] = addrs
+		p.Unlock()
+		debugf("partner domain %s has %d mail server addresses", domain, len(addrs))
+	}
+}
+
+// match returns the partner domain addr is a mail server of, if any.
+func (p *partnerSet) match(addr net.IP) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for _, domain := range opts().partnerDomains {
+		for _, ip := range p.addrs[domain] {
+			if ip.Equal(addr) {
+				return domain, true
+			}
+		}
+	}
+	return "", false
+}
+
+// refreshPartners resolves the mail servers of the partner domains every
+// -partnerRefresh.
+func refreshPartners() {
+	for {
+		time.Sleep(opts().partnerRefresh)
+		partners.refresh()
+	}
+}
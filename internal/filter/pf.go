@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pfBans remembers the IP addresses added to the pf table given by -pfTable
+// so that each is only added once until it expires.
+var pfBans = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// pfctl runs pfctl on the configured table with the given command and
+// arguments.
+func pfctl(command string, args ...string) {
+	cmd := exec.Command(opts().pfctlPath, append([]string{"-q", "-t", opts().pfTable, "-T", command}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		errorf("pfctl -T %s failed: %v: %s", command, err, out)
+	}
+}
+
+// pfBan adds an IP address to the pf table, so that the firewall drops
+// further connections before they reach smtpd.
+func pfBan(addr string) {
+	if opts().pfTable == "" {
+		return
+	}
+	now := clock()
+
+	pfBans.Lock()
+	if now.Before(pfBans.until[addr]) {
+		pfBans.Unlock()
+		return
+	}
+	pfBans.until[addr] = now.Add(opts().pfExpire)
+	for k, until := range pfBans.until {
+		if now.After(until) {
+			delete(pfBans.until, k)
+		}
+	}
+	pfBans.Unlock()
+
+	logf("adding IP address %s to pf table %s", addr, opts().pfTable)
+	if opts().testMode {
+		pfctl("add", addr)
+	} else {
+		go pfctl("add", addr)
+	}
+}
+
+// pfCheck bans the IP address of a session whose score exceeds -pfAbove.
+func pfCheck(s *session) {
+	if opts().pfAbove >= 0 && s.Score > opts().pfAbove && !s.exempt {
+		pfBan(s.Addr.String())
+	}
+}
+
+// expirePF periodically removes addresses from the pf table once they were
+// added more than -pfExpire ago.
+func expirePF() {
+	if opts().pfTable == "" || opts().testMode {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			pfctl("expire", strconv.FormatInt(int64(opts().pfExpire.Seconds()), 10))
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// policyRequest holds the facts about a session passed to the policy
+// command at each phase.
+type policyRequest struct {
+	Session       string   `json:"session"`
+	Phase         string   `json:"phase"`
+	IP            string   `json:"ip"`
+	Rdns          string   `json:"rdns"`
+	Score         float64  `json:"score"`
+	Lists         []string `json:"lists"`
+	Helo          string   `json:"helo"`
+	MailFrom      string   `json:"mailFrom"`
+	Authenticated bool     `json:"authenticated"`
+	TLSVersion    string   `json:"tlsVersion"`
+	TLSCipher     string   `json:"tlsCipher"`
+}
+
+// policyDecision is the answer of the policy command or a matching rule. An
+// empty action leaves the decision to the built-in logic.
+type policyDecision struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+	Delay   *int64 `json:"delay"`
+	Header  string `json:"header"`
+}
+
+// policyProcess is the long-running command given by -policyCommand. It
+// reads one JSON request per line on stdin and answers each with one JSON
+// decision per line on stdout. The command is started on first use and
+// restarted if it exits or fails to answer in time.
+type policyProcess struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	lines  chan string
+	done   chan struct{}
+}
+
+var policy = &policyProcess{}
+
+func (p *policyProcess) start() error {
+	cmd := exec.Command("/bin/sh", "-c", opts().policyCommand)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer cmd.Wait()
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+	p.cmd, p.stdin, p.stdout, p.lines, p.done = cmd, stdin, stdout, lines, done
+	return nil
+}
+
+// stop kills the command. Closing its output ends the reader even if a child
+// of the command keeps it open.
+func (p *policyProcess) stop() {
+	close(p.done)
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.stdout.Close()
+	p.cmd = nil
+}
+
+// ask sends a request to the policy command and waits for its decision.
+// Requests are answered one after the other.
+func (p *policyProcess) ask(ctx context.Context, req policyRequest) (policyDecision, error) {
+	var decision policyDecision
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return decision, err
+	}
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return decision, err
+		}
+	}
+
+	b, _ := json.Marshal(req)
+	if _, err := fmt.Fprintf(p.stdin, "%s\n", b); err != nil {
+		p.stop()
+		return decision, err
+	}
+	timer := time.NewTimer(opts().policyTimeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-p.lines:
+		if !ok {
+			p.stop()
+			return decision, errors.New("policy command exited")
+		}
+		err := json.Unmarshal([]byte(line), &decision)
+		return decision, err
+	case <-timer.C:
+		// the answer may still arrive, so the command can no longer
+		// be trusted to be in sync with us
+		p.stop()
+		return decision, errors.New("policy command timed out")
+	case <-ctx.Done():
+		p.stop()
+		return decision, ctx.Err()
+	}
+}
+
+// newPolicyRequest collects the facts about the given phase of a session.
+func newPolicyRequest(s *session, sessionId string, phase string) policyRequest {
+	req := policyRequest{
+		Session:       sessionId,
+		Phase:         phase,
+		Rdns:          s.rdns,
+		Score:         s.Score,
+		Lists:         slices.Clone(s.Lists),
+		Helo:          s.helo,
+		MailFrom:      s.sender,
+		Authenticated: s.authenticated,
+		TLSVersion:    s.tlsVersion,
+		TLSCipher:     s.tlsCipher,
+	}
+	if s.Addr != nil {
+		req.IP = s.Addr.String()
+	}
+	if req.Lists == nil {
+		req.Lists = []string{}
+	}
+	return req
+}
+
+// askPolicy consults the policy command about a request.
+func askPolicy(ctx context.Context, req policyRequest) policyDecision {
+	decision, err := policy.ask(ctx, req)
+	if err != nil {
+		errorf("policy command failed for session %s: %v", req.Session, err)
+		return policyDecision{}
+	}
+	return decision
+}
+
+// decision turns a policy decision into the answer to a filter request,
+// leaving the action empty if it has none. Delays are remembered for the
+// rest of the session and headers added regardless of the action.
+func (d policyDecision) decision(s *session) decision {
+	if d.Delay != nil && *d.Delay >= 0 {
+		s.delay = *d.Delay
+	}
+	var answer decision
+	if d.Header != "" && !strings.ContainsAny(d.Header, "\r\n") && strings.Contains(d.Header, ":") {
+		answer.Headers = []string{d.Header}
+	}
+
+	message := d.Message
+	if message == "" || strings.ContainsAny(message, "\r\n") {
+		message = "550 " + rejectionMessage(s)
+	}
+	switch d.Action {
+	case "proceed", "junk":
+		answer.Action = d.Action
+	case "reject", "disconnect":
+		answer.Action = d.Action
+		answer.Code, answer.Message = dnsbl.ParseReply(message)
+	}
+	return answer
+}
@@ -0,0 +1,235 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// profile is an entry of the [[profile]] array of the configuration file: a
+// named policy for the sessions received on some of the listeners of smtpd.
+type profile struct {
+	name      string
+	listeners []string
+	block     *thresholdFlag
+	tempfail  *thresholdFlag
+	reject    *thresholdFlag
+	junk      *float64
+	message   *string
+	slow      *int64
+	weights   map[string]float64
+}
+
+var profiles []*profile
+
+// readProfiles reads the [[profile]] array of the configuration file. The
+// lists of a profile must be among the DNSBLs given, as only those are
+// looked up.
+func readProfiles(cfg configTable, lists map[string]float64) ([]*profile, error) {
+	var result []*profile
+	if cfg == nil || cfg["profile"] == nil {
+		return result, nil
+	}
+	tables, ok := cfg["profile"].([]configTable)
+	if !ok {
+		return nil, errors.New("profile is not an array of tables")
+	}
+	for i, table := range tables {
+		p, err := parseProfile(table, lists)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d: %v", i+1, err)
+		}
+		if slices.ContainsFunc(result, func(other *profile) bool { return other.name == p.name }) {
+			return nil, fmt.Errorf("profile %d: duplicate name: %s", i+1, p.name)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func parseProfile(table configTable, lists map[string]float64) (*profile, error) {
+	p := &profile{}
+	for key, value := range table {
+		var ok bool
+		switch key {
+		case "name":
+			p.name, ok = value.(string)
+			ok = ok && p.name != ""
+		case "listeners":
+			p.listeners, ok = configStrings(value)
+		case "blockAbove", "tempfailAbove", "rejectAbove":
+			t := newThresholdFlag(-1)
+			if err := t.Set(fmt.Sprint(value)); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+			switch key {
+			case "blockAbove":
+				p.block = t
+			case "tempfailAbove":
+				p.tempfail = t
+			default:
+				p.reject = t
+			}
+			ok = true
+		case "junkAbove":
+			var score float64
+			score, ok = configScore(value)
+			p.junk = &score
+		case "blockMessage":
+			var message string
+			message, ok = value.(string)
+			p.message = &message
+		case "slowFactor":
+			var factor int64
+			factor, ok = value.(int64)
+			ok = ok && factor >= 0
+			p.slow = &factor
+		case "lists":
+			var err error
+			if p.weights, err = configLists(table, key, make(map[string]time.Duration)); err != nil {
+				return nil, err
+			}
+			for list := range p.weights {
+				if _, ok := lists[list]; !ok {
+					return nil, fmt.Errorf("list %s is not a DNSBL in use", list)
+				}
+			}
+			ok = true
+		default:
+			return nil, fmt.Errorf("option %s cannot be part of a profile", key)
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %s", key)
+		}
+	}
+	switch {
+	case p.name == "":
+		return nil, errors.New("missing name")
+	case len(p.listeners) == 0:
+		return nil, fmt.Errorf("%s: missing listeners", p.name)
+	}
+	return p, nil
+}
+
+// profileFor returns the first profile whose listeners match the destination
+// address of a session, if any.
+func profileFor(dest string) *profile {
+	for _, p := range profiles {
+		if listenerMatches(p.listeners, dest) {
+			return p
+		}
+	}
+	return nil
+}
+
+// blockThreshold, tempfailThreshold, rejectThreshold and junkThreshold
+// return the thresholds which apply to sessions of the profile, which may be
+// nil for sessions without one.
+func (p *profile) blockThreshold() *thresholdFlag {
+	if p == nil || p.block == nil {
+		return opts().blockAbove
+	}
+	return p.block
+}
+
+func (p *profile) tempfailThreshold() *thresholdFlag {
+	if p == nil || p.tempfail == nil {
+		return opts().tempfailAbove
+	}
+	return p.tempfail
+}
+
+func (p *profile) rejectThreshold() *thresholdFlag {
+	if p == nil || p.reject == nil {
+		return opts().rejectAbove
+	}
+	return p.reject
+}
+
+func (p *profile) junkThreshold() float64 {
+	if p == nil || p.junk == nil {
+		return junkThreshold()
+	}
+	return *p.junk
+}
+
+func (p *profile) blockMessage() string {
+	if p == nil || p.message == nil {
+		return opts().blockMessage
+	}
+	return *p.message
+}
+
+func (p *profile) slowFactor() int64 {
+	if p == nil || p.slow == nil {
+		return opts().slowFactor
+	}
+	return *p.slow
+}
+
+// maxScore returns the highest score the lists in rotation can assign to
+// sessions of the profile, see activeMaxScore.
+func (p *profile) maxScore() float64 {
+	if p == nil || p.weights == nil {
+		return activeMaxScore()
+	}
+	return maxScoreOf(p.weights)
+}
+
+// applyProfile rescores a session with the weights of its profile once its
+// lookups are done. Everything other than the DNSBL hits which makes up the
+// score carries over, and lists missing from the profile are dropped.
+func applyProfile(s *session) {
+	p := s.profile
+	if p == nil || p.weights == nil || s.Score < 0 {
+		return
+	}
+	active, candidate := make(map[string]float64), make(map[string]float64)
+	var lists []string
+	for _, list := range s.Lists {
+		weight, ok := domainWeights[list]
+		if !ok {
+			lists = append(lists, list)
+			continue
+		}
+		active[list] = weight * reliability.confidence(list)
+		if w, ok := p.weights[list]; ok {
+			candidate[list] = w * reliability.confidence(list)
+			lists = append(lists, list)
+		}
+	}
+	s.Score = max(s.Score-aggregateWeights(groupedWeights(active))+aggregateWeights(groupedWeights(candidate)), 0)
+	s.Lists = lists
+}
+
+// earlyExitThreshold returns the score above which queryLists may skip the
+// remaining lookups of an address: the highest block threshold of all
+// profiles, or -1 if the weights of a profile differ from those in effect,
+// as its score cannot be told in advance.
+func earlyExitThreshold() float64 {
+	threshold := opts().blockAbove.highest()
+	for _, p := range profiles {
+		if p.weights != nil {
+			return -1
+		}
+		threshold = max(threshold, p.blockThreshold().highest())
+	}
+	return threshold
+}
@@ -0,0 +1,40 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"github.com/lfos/filter-dnsblscore/pkg/smtpdfilter"
+)
+
+// event is a report or a filter request received from smtpd.
+type event = smtpdfilter.Event
+
+// smtpd speaks the filter protocol with smtpd. The handlers of the events
+// are set up by filterInit.
+var smtpd = &smtpdfilter.Filter{Name: "filter-dnsblscore"}
+
+// handlers adapts the handlers of reporters or filters to the protocol
+// layer.
+func handlers(m map[string]func(string, string, []string)) map[string]smtpdfilter.Handler {
+	hs := make(map[string]smtpdfilter.Handler)
+	for phase, handler := range m {
+		hs[phase] = smtpdfilter.HandlerFunc(func(ev *event) {
+			handler(ev.Phase, ev.SessionID, ev.Params)
+		})
+	}
+	return hs
+}
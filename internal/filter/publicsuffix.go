@@ -0,0 +1,64 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import "strings"
+
+// multiLabelSuffixes are public suffixes of more than one label under which
+// domains are registered, e.g. co.uk, so that URLs are looked up by the
+// registered domain rather than by the suffix.
+var multiLabelSuffixes = make(map[string]bool)
+
+func init() {
+	for _, suffix := range strings.Fields(`
+		ac.uk co.uk gov.uk ltd.uk me.uk net.uk nhs.uk org.uk plc.uk sch.uk
+		asn.au com.au edu.au gov.au id.au net.au org.au
+		ac.nz co.nz geek.nz govt.nz net.nz org.nz school.nz
+		ac.jp ad.jp co.jp ed.jp go.jp gr.jp lg.jp ne.jp or.jp
+		ac.kr co.kr go.kr ne.kr or.kr re.kr
+		ac.cn com.cn edu.cn gov.cn net.cn org.cn
+		com.hk edu.hk gov.hk idv.hk net.hk org.hk
+		com.tw edu.tw gov.tw idv.tw net.tw org.tw
+		com.sg edu.sg gov.sg net.sg org.sg
+		com.my edu.my gov.my net.my org.my
+		ac.id co.id go.id my.id or.id web.id
+		com.ph net.ph org.ph
+		com.vn edu.vn gov.vn net.vn org.vn
+		ac.th co.th go.th in.th net.th or.th
+		ac.in co.in edu.in firm.in gen.in gov.in ind.in net.in org.in res.in
+		com.pk net.pk org.pk
+		ac.il co.il gov.il net.il org.il
+		com.sa net.sa org.sa
+		com.tr gen.tr net.tr org.tr web.tr
+		com.eg com.ng com.gh
+		co.ke or.ke co.tz co.ug
+		ac.za co.za gov.za net.za org.za web.za
+		art.br blog.br com.br edu.br gov.br net.br org.br
+		com.ar gob.ar net.ar org.ar
+		com.mx edu.mx gob.mx net.mx org.mx
+		com.co net.co org.co
+		com.pe net.pe org.pe
+		co.ve com.ve com.ec com.uy com.py com.bo
+		ac.at co.at gv.at or.at
+		com.es edu.es gob.es nom.es org.es
+		com.pt org.pt com.gr com.cy com.mt com.ro com.hr co.hu co.rs
+		biz.pl com.pl info.pl net.pl org.pl waw.pl
+		com.ua in.ua kiev.ua net.ua org.ua
+	`) {
+		multiLabelSuffixes[suffix] = true
+	}
+}
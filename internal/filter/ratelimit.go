@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimit caps the queries sent to a list per second and per UTC day, so
+// that free tiers of commercial lists are not exceeded. Cached answers do
+// not count.
+type rateLimit struct {
+	perSecond float64
+	perDay    int64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	day     string
+	used    int64
+	limited int64
+}
+
+var rateLimits atomic.Pointer[map[string]*rateLimit]
+
+var errRateLimited = errors.New("query rate limit of list exceeded")
+
+// refill adds the tokens accrued since the last call and starts a new daily
+// budget at midnight UTC. It must be called with l.mu held.
+func (l *rateLimit) refill(now time.Time) {
+	if day := now.UTC().Format(time.DateOnly); day != l.day {
+		l.day, l.used = day, 0
+	}
+	if l.perSecond > 0 {
+		l.tokens = min(l.perSecond, l.tokens+now.Sub(l.last).Seconds()*l.perSecond)
+	}
+	l.last = now
+}
+
+// exhausted reports whether a query would currently exceed the limit.
+func (l *rateLimit) exhausted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(clock())
+	return (l.perDay > 0 && l.used >= l.perDay) || (l.perSecond > 0 && l.tokens < 1)
+}
+
+// take accounts for a query, unless it would exceed the limit.
+func (l *rateLimit) take() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(clock())
+	if (l.perDay > 0 && l.used >= l.perDay) || (l.perSecond > 0 && l.tokens < 1) {
+		l.limited++
+		return false
+	}
+	if l.perSecond > 0 {
+		l.tokens--
+	}
+	l.used++
+	return true
+}
+
+func (l *rateLimit) format(list string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(clock())
+	budget := "unlimited"
+	if l.perDay > 0 {
+		budget = strconv.FormatInt(l.perDay, 10)
+	}
+	return fmt.Sprintf("list=%s used=%d budget=%s limited=%d", list, l.used, budget, l.limited)
+}
+
+// rateLimitOf returns the rate limit of list, or nil if it has none.
+func rateLimitOf(list string) *rateLimit {
+	if m := rateLimits.Load(); m != nil {
+		return (*m)[list]
+	}
+	return nil
+}
+
+// readListLimits parses the list=rate specifiers given by -listLimit, where
+// rate is a number of queries followed by /s or /d. A list may be given
+// both a per-second and a per-day limit.
+func readListLimits(specs []string, lists ...map[string]float64) (map[string]*rateLimit, error) {
+	result := make(map[string]*rateLimit)
+	for _, s := range specs {
+		list, rate, _ := strings.Cut(s, "=")
+		count, unit, _ := strings.Cut(rate, "/")
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil || n <= 0 || (unit != "s" && unit != "d") {
+			return nil, fmt.Errorf("invalid list limit specifier: %q", s)
+		}
+		if !slices.ContainsFunc(lists, func(m map[string]float64) bool {
+			_, ok := m[list]
+			return ok
+		}) {
+			return nil, fmt.Errorf("limit given for unknown list: %s", list)
+		}
+		l, ok := result[list]
+		if !ok {
+			l = &rateLimit{}
+			result[list] = l
+		}
+		if unit == "s" {
+			l.perSecond = float64(n)
+		} else {
+			l.perDay = n
+		}
+	}
+	return result, nil
+}
+
+// setListLimits puts a new set of rate limits into effect. Lists which keep
+// a limit keep their consumption, so that reloading the configuration does
+// not reset the daily budget.
+func setListLimits(m map[string]*rateLimit) {
+	now := clock()
+	for list, l := range m {
+		l.tokens, l.last = l.perSecond, now
+		if old := rateLimitOf(list); old != nil {
+			old.mu.Lock()
+			l.day, l.used, l.limited = old.day, old.used, old.limited
+			l.tokens = min(l.perSecond, old.tokens)
+			old.mu.Unlock()
+		}
+	}
+	rateLimits.Store(&m)
+}
@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// receivedFromPattern matches the address literal a Received header gives
+// for the host the message was received from, as in
+// from mail.example.com (mail.example.com [192.0.2.1]) by ...
+var receivedFromPattern = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// receivedByPattern separates the from clause of a Received header from the
+// rest of it.
+var receivedByPattern = regexp.MustCompile(`(?i)\sby\s`)
+
+// parseTrustedRelay parses an entry of -trustedRelays, which is either a
+// subnet in CIDR notation or a single address.
+func parseTrustedRelay(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if addr := net.ParseIP(entry); addr != nil {
+		bits := 128
+		if addr.To4() != nil {
+			addr, bits = addr.To4(), 32
+		}
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted relay: %s", entry)
+	}
+	return subnet, nil
+}
+
+// isTrustedRelay reports whether addr belongs to one of the forwarders or
+// secondary MXes given by -trustedRelays.
+func isTrustedRelay(addr net.IP) bool {
+	if opts().trustedRelays == "" {
+		return false
+	}
+	for _, entry := range strings.Split(opts().trustedRelays, ",") {
+		if subnet, err := parseTrustedRelay(entry); err == nil && subnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// untrustedHop returns the address of the host the topmost Received header
+// not added by a trusted relay says the message came from, or nil if there
+// is none. Received headers are prepended by each hop, so the first one
+// naming an untrusted host is the last one which can be believed.
+func untrustedHop(lines []string) net.IP {
+	var headers []string
+	for _, line := range lines {
+		if line == "" {
+			break
+		}
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+			headers[len(headers)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "received") {
+			continue
+		}
+		from := receivedByPattern.Split(value, 2)[0]
+		m := receivedFromPattern.FindStringSubmatch(from)
+		if m == nil {
+			continue
+		}
+		addr := net.ParseIP(m[1])
+		if addr == nil || isTrustedRelay(addr) {
+			continue
+		}
+		return addr
+	}
+	return nil
+}
+
+// scoreRelayedMessage replaces the score of a session from a trusted relay
+// with that of the first untrusted hop of the message, given its header
+// lines, so that the headers and the junk decision at commit reflect where
+// the message really came from.
+func scoreRelayedMessage(sessionId string, s *session, lines []string) {
+	s.hopScored = true
+	addr := untrustedHop(lines)
+	if addr == nil {
+		logf("session %s: no untrusted Received hop found in message from trusted relay %s", sessionId, s.Addr)
+		return
+	}
+	if !opts().scoreSpecialUse && isSpecialUse(addr) {
+		logf("session %s: Received hop %s is a special-use address", sessionId, addr)
+		return
+	}
+	result, _ := lookupAddress(addr)
+	s.Score, s.Lists, s.Codes, s.Reasons = result.Score, slices.Clone(result.Lists), maps.Clone(result.Codes), maps.Clone(result.Reasons)
+	stats.addHits(s.Lists...)
+	logf("session %s: message relayed by %s from %s, score=%v lists=%s", sessionId, s.Addr, addr, s.Score, strings.Join(s.Lists, ","))
+}
@@ -0,0 +1,108 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"math"
+	"sync"
+)
+
+// learnPrior is the number of agreeing hits each list is credited with up
+// front, so that a few early hits do not swing its confidence.
+const learnPrior = 5
+
+// listReliability holds the exponentially decaying number of hits of a list
+// and how many of them agreed with another list or ended in a block.
+type listReliability struct {
+	hits   float64
+	agreed float64
+	logged int
+}
+
+// reliabilityTracker learns how far each DNSBL can be trusted from how its
+// hits relate to those of the other lists, so that lists which have become
+// noisy lose weight without manual re-tuning.
+type reliabilityTracker struct {
+	mu    sync.Mutex
+	lists map[string]*listReliability
+}
+
+var reliability = &reliabilityTracker{lists: make(map[string]*listReliability)}
+
+// observe records the DNSBL hits of a finished session. A hit agrees if
+// another DNSBL listed the address as well or if the session was blocked.
+func (rt *reliabilityTracker) observe(lists []string, blocked bool) {
+	if !opts().learnWeights {
+		return
+	}
+	var hits []string
+	for _, list := range lists {
+		if _, ok := domainWeights[list]; ok {
+			hits = append(hits, list)
+		}
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	decay := 1 - 1/float64(opts().learnWindow)
+	for _, list := range hits {
+		lr, ok := rt.lists[list]
+		if !ok {
+			lr = &listReliability{logged: 10}
+			rt.lists[list] = lr
+		}
+		lr.hits = lr.hits*decay + 1
+		lr.agreed *= decay
+		if blocked || len(hits) > 1 {
+			lr.agreed++
+		}
+
+		// only log when the confidence moves to another tenth, rather than
+		// after every session
+		c := lr.confidence()
+		if tenth := int(math.Round(c * 10)); tenth != lr.logged {
+			direction := "dropped"
+			if tenth > lr.logged {
+				direction = "rose"
+			}
+			logf("confidence in %s %s to %.2f, scaling its weight of %v to %.1f", list, direction, c, domainWeights[list], domainWeights[list]*c)
+			lr.logged = tenth
+		}
+	}
+}
+
+func (lr *listReliability) confidence() float64 {
+	return (lr.agreed + learnPrior) / (lr.hits + learnPrior)
+}
+
+// confidence returns the factor the weight of a list is scaled by, 1 unless
+// -learnWeights is set.
+func (rt *reliabilityTracker) confidence(list string) float64 {
+	if !opts().learnWeights {
+		return 1
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	lr, ok := rt.lists[list]
+	if !ok {
+		return 1
+	}
+	return lr.confidence()
+}
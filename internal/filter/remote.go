@@ -0,0 +1,164 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+const (
+	remoteListTimeout = 30 * time.Second
+	remoteListMaxSize = 16 << 20
+)
+
+// remoteList is an access list published at an HTTPS URL, such as the
+// outbound ranges of a large mail provider. Only the last good copy is ever
+// used, so a failed download leaves the list as it was.
+type remoteList struct {
+	url  string
+	name string
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	list         *dnsbl.Allowlist
+}
+
+var remoteLists struct {
+	sync.Mutex
+	lists []*remoteList
+}
+
+var remoteClient = &http.Client{Timeout: remoteListTimeout}
+
+// isRemote reports whether an allowlist or blocklist is given by URL.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "https://")
+}
+
+// loadRemoteList returns the last good copy of the list at url, downloading
+// it first if there is none yet. Later downloads are left to
+// refreshRemoteLists.
+func loadRemoteList(url string, name string) (*dnsbl.Allowlist, error) {
+	remoteLists.Lock()
+	var r *remoteList
+	for _, l := range remoteLists.lists {
+		if l.url == url {
+			r = l
+		}
+	}
+	if r == nil {
+		r = &remoteList{url: url, name: name}
+		remoteLists.lists = append(remoteLists.lists, r)
+	}
+	remoteLists.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.list == nil {
+		if _, err := r.fetch(); err != nil {
+			return nil, fmt.Errorf("unable to fetch %s from %s: %v", name, url, err)
+		}
+	}
+	return r.list, nil
+}
+
+// fetch downloads the list, sending the validators of the last download so
+// that the server can tell us it is unchanged, in which case fetch returns
+// false.
+func (r *remoteList) fetch() (bool, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && r.list != nil {
+		debugf("%s at %s is unchanged", r.name, r.url)
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteListMaxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > remoteListMaxSize {
+		return false, fmt.Errorf("list exceeds %d bytes", remoteListMaxSize)
+	}
+	l, err := parseAccessList(bytes.NewReader(body), r.name, r.url)
+	if err != nil {
+		return false, err
+	}
+
+	r.list = l
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	logf("%s fetched from %s", r.name, r.url)
+	return true, nil
+}
+
+// refreshRemoteLists downloads all remote lists every -allowlistRefresh and
+// has the main loop put them into effect if any of them changed.
+func refreshRemoteLists() {
+	for {
+		time.Sleep(opts().allowlistRefresh)
+
+		remoteLists.Lock()
+		lists := remoteLists.lists
+		remoteLists.Unlock()
+
+		changed := false
+		for _, r := range lists {
+			r.mu.Lock()
+			ok, err := r.fetch()
+			r.mu.Unlock()
+			if err != nil {
+				errorf("unable to refresh %s from %s, keeping the last good copy: %v", r.name, r.url, err)
+			}
+			changed = changed || ok
+		}
+		if changed {
+			runControl(func() string {
+				if err := reloadAccessLists(); err != nil {
+					errorf("unable to reload allowlist and blocklist: %v", err)
+				}
+				return ""
+			})
+		}
+	}
+}
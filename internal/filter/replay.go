@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clock and random are the sources of time and randomness decisions are
+// based on, so that replays can make them deterministic.
+var clock = time.Now
+var random = rand.Int63n
+
+// replayClock is the clock of a replay. It starts at the Unix epoch and
+// follows the timestamps of the replayed events as well as the delays of
+// answers, which are not actually waited for.
+type replayClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+var replay *replayClock
+
+// startReplay opens the transcript of a session with smtpd to be read instead
+// of standard input. Lookups are faked as in -testMode.
+func startReplay(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	opts().testMode = true
+	replay = &replayClock{t: time.Unix(0, 0)}
+	clock = replay.now
+	random = rand.New(rand.NewSource(1)).Int63n
+	return file, nil
+}
+
+func (c *replayClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// follow moves the clock to the timestamp of an event. Events without one,
+// or with one in the past, leave the clock alone.
+func (c *replayClock) follow(timestamp string) {
+	secs, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil {
+		return
+	}
+	t := time.Unix(0, int64(secs*float64(time.Second)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.t) {
+		c.t = t
+	}
+}
+
+// sleep advances the clock by d.
+func (c *replayClock) sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
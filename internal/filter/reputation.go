@@ -0,0 +1,323 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type reputationEntry struct {
+	score      float64
+	rejects    int64
+	deliveries int64
+	lastSeen   time.Time
+}
+
+// reputationDB keeps the history of IP addresses across restarts: the score
+// last assigned, the number of sessions which were blocked or rejected and
+// the number of messages delivered without being junked. Entries are
+// forgotten after -reputationExpire without any activity. Like the
+// greylisting database, it is written every databaseSaveInterval and on exit.
+type reputationDB struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	path    string
+	entries map[string]reputationEntry
+	dirty   bool
+}
+
+var reputation *reputationDB
+
+// loadReputation reads the reputation database from path. A missing file is
+// treated as an empty database. If path is empty, no history is kept.
+func loadReputation(path string) (*reputationDB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	db := &reputationDB{path: path, entries: make(map[string]reputationEntry)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid reputation database entry: %s", scanner.Text())
+		}
+		// scores used to be integers, which still parse as floats
+		score, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reputation database entry: %s", scanner.Text())
+		}
+		var values [3]int64
+		for i := range values {
+			if values[i], err = strconv.ParseInt(fields[i+2], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid reputation database entry: %s", scanner.Text())
+			}
+		}
+		db.entries[fields[0]] = reputationEntry{
+			score:      score,
+			rejects:    values[0],
+			deliveries: values[1],
+			lastSeen:   time.Unix(values[2], 0),
+		}
+	}
+	return db, scanner.Err()
+}
+
+// lookup returns the history of the given IP address.
+func (db *reputationDB) lookup(addr string) reputationEntry {
+	if db == nil {
+		return reputationEntry{}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry := db.entries[addr]
+	if clock().Sub(entry.lastSeen) > opts().reputationExpire {
+		return reputationEntry{}
+	}
+	return entry
+}
+
+// record adds a rejected session or a delivered message to the history of
+// the given IP address.
+func (db *reputationDB) record(addr string, score float64, rejected bool) {
+	if db == nil {
+		return
+	}
+	now := clock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry := db.entries[addr]
+	if now.Sub(entry.lastSeen) > opts().reputationExpire {
+		entry = reputationEntry{}
+	}
+	entry.score = score
+	entry.lastSeen = now
+	if rejected {
+		entry.rejects++
+	} else {
+		entry.deliveries++
+	}
+	db.entries[addr] = entry
+	db.dirty = true
+}
+
+// feedback applies the verdict of an operator on a message from the given IP
+// address: spam which got through counts as a reject, while ham which was
+// junked takes back a reject, if any, and counts as a delivery.
+func (db *reputationDB) feedback(addr string, spam bool) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry := db.entries[addr]
+	if clock().Sub(entry.lastSeen) > opts().reputationExpire {
+		entry = reputationEntry{}
+	}
+	entry.lastSeen = clock()
+	if spam {
+		entry.rejects++
+	} else {
+		entry.rejects = max(entry.rejects-1, 0)
+		entry.deliveries++
+	}
+	db.entries[addr] = entry
+	db.dirty = true
+}
+
+func (db *reputationDB) saveEvery() {
+	for range time.Tick(databaseSaveInterval) {
+		db.flush()
+	}
+}
+
+// flush forgets expired entries and saves the database if it changed.
+func (db *reputationDB) flush() {
+	if db == nil {
+		return
+	}
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+
+	now := clock()
+	var b strings.Builder
+	db.mu.Lock()
+	for addr, e := range db.entries {
+		if now.Sub(e.lastSeen) > opts().reputationExpire {
+			delete(db.entries, addr)
+			db.dirty = true
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%v\t%d\t%d\t%d\n", addr, e.score, e.rejects, e.deliveries, e.lastSeen.Unix())
+	}
+	dirty := db.dirty
+	db.dirty = false
+	db.mu.Unlock()
+
+	if !dirty {
+		return
+	}
+	if err := writeDatabase(db.path, b.String()); err != nil {
+		errorf("unable to save reputation database: %v", err)
+		db.mu.Lock()
+		db.dirty = true
+		db.mu.Unlock()
+	}
+}
+
+// applyReputation subtracts -reputationGrace from the score of IP addresses
+// with at least -reputationClean deliveries and no rejects, and adds
+// -reputationPenalty to the score of those rejected at least
+// -reputationOffenses times.
+func applyReputation(s *session) {
+	if reputation == nil {
+		return
+	}
+	entry := reputation.lookup(s.Addr.String())
+	switch {
+	case opts().reputationPenalty > 0 && entry.rejects >= opts().reputationOffenses:
+		logf("IP address %s is a repeat offender with %d rejects, adding %v", s.Addr, entry.rejects, opts().reputationPenalty)
+		s.Score = max(s.Score, 0) + opts().reputationPenalty
+	case opts().reputationGrace > 0 && entry.rejects == 0 && entry.deliveries >= opts().reputationClean && s.Score > 0:
+		logf("IP address %s has a clean history of %d deliveries, subtracting %v", s.Addr, entry.deliveries, opts().reputationGrace)
+		s.Score = max(s.Score-opts().reputationGrace, 0)
+	}
+}
+
+// recordReputation adds the outcome of a session to the history of its IP
+// address and to the list of offenders. A session counts as rejected at most
+// once.
+func recordReputation(s *session, rejected bool) {
+	if s.exempt || s.Addr == nil || s.rejected {
+		return
+	}
+	s.rejected = rejected
+	reputation.record(s.Addr.String(), s.Score, rejected)
+	if rejected {
+		offenders.add(s.Addr.String())
+	}
+}
+
+// offenderList temporarily blocks IP addresses which were blocked or rejected
+// -escalateAfter times within -escalateWindow, so that further sessions are
+// dropped without any lookups until -escalateDuration has passed.
+type offenderList struct {
+	mu      sync.Mutex
+	rejects map[string][]time.Time
+	until   map[string]time.Time
+}
+
+var offenders = &offenderList{
+	rejects: make(map[string][]time.Time),
+	until:   make(map[string]time.Time),
+}
+
+// add records a rejected session from the given IP address and shares it
+// with the other filters of the gossip channel.
+func (l *offenderList) add(addr string) {
+	if opts().escalateAfter <= 0 {
+		return
+	}
+	gossip.publish("reject %s", addr)
+	if until, ok := l.record(addr); ok {
+		gossip.publish("block %s %d", addr, until.Unix())
+	}
+}
+
+// record counts a rejected session from the given IP address and blocks it
+// once it was rejected -escalateAfter times, returning the end of the block.
+func (l *offenderList) record(addr string) (time.Time, bool) {
+	if opts().escalateAfter <= 0 {
+		return time.Time{}, false
+	}
+	now := clock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, times := range l.rejects {
+		for len(times) > 0 && now.Sub(times[0]) > opts().escalateWindow {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(l.rejects, k)
+		} else {
+			l.rejects[k] = times
+		}
+	}
+	for k, until := range l.until {
+		if now.After(until) {
+			delete(l.until, k)
+		}
+	}
+
+	l.rejects[addr] = append(l.rejects[addr], now)
+	if int64(len(l.rejects[addr])) >= opts().escalateAfter {
+		logf("IP address %s was rejected %d times, blocking it for %s", addr, len(l.rejects[addr]), opts().escalateDuration)
+		l.until[addr] = now.Add(opts().escalateDuration)
+		delete(l.rejects, addr)
+		pfBan(addr)
+		return l.until[addr], true
+	}
+	return time.Time{}, false
+}
+
+// block blocks the given IP address until the given time, as requested by
+// another filter of the gossip channel.
+func (l *offenderList) block(addr string, until time.Time) {
+	if !clock().Before(until) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.until[addr].Before(until) {
+		return
+	}
+	if !clock().Before(l.until[addr]) {
+		logf("IP address %s was blocked by a peer until %s", addr, until.UTC().Format(time.RFC3339))
+		pfBan(addr)
+	}
+	l.until[addr] = until
+	delete(l.rejects, addr)
+}
+
+// blocked reports whether the given IP address is temporarily blocked.
+func (l *offenderList) blocked(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return clock().Before(l.until[addr])
+}
@@ -0,0 +1,214 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rule is an entry of the [[rules]] array of the configuration file. All
+// conditions given must hold for the rule to match.
+type rule struct {
+	phases   map[string]bool
+	minScore *float64
+	maxScore *float64
+	lists    []string
+	helo     *regexp.Regexp
+	rdns     string
+	decision policyDecision
+}
+
+var rules []rule
+
+// readRules reads the ordered [[rules]] of the configuration file.
+func readRules(cfg configTable) ([]rule, error) {
+	var result []rule
+	if cfg == nil || cfg["rules"] == nil {
+		return result, nil
+	}
+	tables, ok := cfg["rules"].([]configTable)
+	if !ok {
+		return nil, errors.New("rules is not an array of tables")
+	}
+	for i, table := range tables {
+		r, err := parseRule(table)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func parseRule(table configTable) (rule, error) {
+	var r rule
+	for key, value := range table {
+		var ok bool
+		switch key {
+		case "phase", "lists":
+			var values []string
+			if values, ok = configStrings(value); !ok {
+				break
+			}
+			if key == "lists" {
+				r.lists = values
+				break
+			}
+			r.phases = make(map[string]bool)
+			for _, phase := range values {
+				if filters[phase] == nil || phase == "data-line" {
+					return r, fmt.Errorf("invalid phase: %s", phase)
+				}
+				r.phases[phase] = true
+			}
+		case "minScore", "maxScore":
+			var score float64
+			if score, ok = configScore(value); !ok {
+				break
+			}
+			if key == "minScore" {
+				r.minScore = &score
+			} else {
+				r.maxScore = &score
+			}
+		case "delay":
+			var n int64
+			if n, ok = value.(int64); ok {
+				r.decision.Delay = &n
+			}
+		case "helo":
+			var pattern string
+			if pattern, ok = value.(string); !ok {
+				break
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return r, fmt.Errorf("invalid helo pattern: %v", err)
+			}
+			r.helo = re
+		case "rdns", "action", "message", "header":
+			var s string
+			if s, ok = value.(string); !ok {
+				break
+			}
+			switch key {
+			case "rdns":
+				r.rdns = strings.ToLower(strings.TrimSuffix(s, "."))
+			case "action":
+				r.decision.Action = s
+			case "message":
+				r.decision.Message = s
+			default:
+				r.decision.Header = s
+			}
+		default:
+			return r, fmt.Errorf("unknown key: %s", key)
+		}
+		if !ok {
+			return r, fmt.Errorf("invalid value for %s", key)
+		}
+	}
+
+	switch r.decision.Action {
+	case "", "proceed", "junk", "reject", "disconnect":
+	default:
+		return r, fmt.Errorf("invalid action: %s", r.decision.Action)
+	}
+	if strings.ContainsAny(r.decision.Message, "\r\n") {
+		return r, errors.New("invalid message")
+	}
+	if r.decision.Header != "" && (strings.ContainsAny(r.decision.Header, "\r\n") || !strings.Contains(r.decision.Header, ":")) {
+		return r, errors.New("invalid header")
+	}
+	return r, nil
+}
+
+// configStrings accepts a string or an array of strings.
+func configStrings(value any) ([]string, bool) {
+	if s, ok := value.(string); ok {
+		return []string{s}, true
+	}
+	values, ok := value.([]any)
+	if !ok {
+		return nil, false
+	}
+	var result []string
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, s)
+	}
+	return result, true
+}
+
+func (r *rule) matches(s *session, phase string) bool {
+	if r.phases != nil && !r.phases[phase] {
+		return false
+	}
+	if (r.minScore != nil || r.maxScore != nil) && s.Score == -1 {
+		return false
+	}
+	if r.minScore != nil && s.Score < *r.minScore {
+		return false
+	}
+	if r.maxScore != nil && s.Score > *r.maxScore {
+		return false
+	}
+	if r.lists != nil && !listedOnAny(s, r.lists) {
+		return false
+	}
+	if r.helo != nil && !r.helo.MatchString(s.helo) {
+		return false
+	}
+	if r.rdns != "" {
+		rdns := strings.ToLower(strings.TrimSuffix(s.rdns, "."))
+		if rdns != r.rdns && !strings.HasSuffix(rdns, "."+r.rdns) {
+			return false
+		}
+	}
+	return true
+}
+
+func listedOnAny(s *session, lists []string) bool {
+	for _, list := range lists {
+		for _, l := range s.Lists {
+			if strings.EqualFold(l, list) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchRules returns the decision of the first rule matching the given phase
+// of a session. Exempt sessions are not subject to rules.
+func matchRules(s *session, phase string) policyDecision {
+	if s.exempt {
+		return policyDecision{}
+	}
+	for _, r := range rules {
+		if r.matches(s, phase) {
+			return r.decision
+		}
+	}
+	return policyDecision{}
+}
@@ -0,0 +1,204 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is an entry of the [[schedule]] array of the configuration file.
+// While the current time matches its cron-like when expression, its options
+// override those given at the top level of the file.
+type schedule struct {
+	when    string
+	fields  [5]map[int]bool
+	options configTable
+}
+
+// cronRanges are the bounds of the minute, hour, day of month, month and day
+// of week fields of a when expression. Sunday is both 0 and 7.
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// schedules holds the windows of the configuration file in effect, active the
+// indices of those which applied when it was last loaded.
+var schedules []schedule
+var activeSchedules []int
+
+// readSchedules reads the [[schedule]] array of the configuration file.
+// Options which cannot be changed at runtime cannot vary by time either.
+func readSchedules(cfg configTable) ([]schedule, error) {
+	var result []schedule
+	if cfg == nil || cfg["schedule"] == nil {
+		return result, nil
+	}
+	tables, ok := cfg["schedule"].([]configTable)
+	if !ok {
+		return nil, errors.New("schedule is not an array of tables")
+	}
+	for i, table := range tables {
+		when, ok := table["when"].(string)
+		if !ok {
+			return nil, fmt.Errorf("schedule %d: missing when expression", i+1)
+		}
+		fields, err := parseCron(when)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %v", i+1, err)
+		}
+		options := make(configTable)
+		for key, value := range table {
+			if key == "when" {
+				continue
+			}
+			switch value.(type) {
+			case configTable, []configTable:
+				return nil, fmt.Errorf("schedule %d: tables cannot be scheduled: %s", i+1, key)
+			}
+			if flag.Lookup(key) == nil || key == "config" {
+				return nil, fmt.Errorf("schedule %d: unknown option: %s", i+1, key)
+			}
+			if staticOptions[key] {
+				return nil, fmt.Errorf("schedule %d: option %s cannot be changed at runtime", i+1, key)
+			}
+			options[key] = value
+		}
+		result = append(result, schedule{when: when, fields: fields, options: options})
+	}
+	return result, nil
+}
+
+// parseCron parses the five fields of a when expression, each of which is a
+// comma-separated list of *, a number or a range, optionally followed by a
+// step as in */15 or 8-18/2.
+func parseCron(expr string) ([5]map[int]bool, error) {
+	var fields [5]map[int]bool
+	tokens := strings.Fields(expr)
+	if len(tokens) != len(fields) {
+		return fields, fmt.Errorf("invalid when expression: %q", expr)
+	}
+	for i, token := range tokens {
+		lo, hi := cronRanges[i][0], cronRanges[i][1]
+		if token == "*" {
+			continue
+		}
+		fields[i] = make(map[int]bool)
+		for _, part := range strings.Split(token, ",") {
+			span, stepStr, hasStep := strings.Cut(part, "/")
+			step := 1
+			if hasStep {
+				n, err := strconv.Atoi(stepStr)
+				if err != nil || n <= 0 {
+					return fields, fmt.Errorf("invalid step in when expression: %q", part)
+				}
+				step = n
+			}
+			first, last := lo, hi
+			if span != "*" {
+				a, b, isRange := strings.Cut(span, "-")
+				var err1, err2 error
+				first, err1 = strconv.Atoi(a)
+				last = first
+				if isRange {
+					last, err2 = strconv.Atoi(b)
+				} else if hasStep {
+					last = hi
+				}
+				if err1 != nil || err2 != nil || first < lo || last > hi || first > last {
+					return fields, fmt.Errorf("invalid value in when expression: %q", part)
+				}
+			}
+			for n := first; n <= last; n += step {
+				fields[i][n] = true
+			}
+		}
+		if i == 4 && fields[i][7] {
+			fields[i][0] = true
+		}
+	}
+	return fields, nil
+}
+
+// matches reports whether t falls into the window. As with cron, a time
+// matches either the day of month or the day of week if both are given.
+func (sc *schedule) matches(t time.Time) bool {
+	match := func(i int, n int) bool {
+		return sc.fields[i] == nil || sc.fields[i][n]
+	}
+	if !match(0, t.Minute()) || !match(1, t.Hour()) || !match(3, int(t.Month())) {
+		return false
+	}
+	if sc.fields[2] != nil && sc.fields[4] != nil {
+		return match(2, t.Day()) || match(4, int(t.Weekday()))
+	}
+	return match(2, t.Day()) && match(4, int(t.Weekday()))
+}
+
+// activeAt returns the indices of the windows t falls into.
+func activeAt(list []schedule, t time.Time) []int {
+	var active []int
+	for i := range list {
+		if list[i].matches(t) {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+// applySchedules reads the [[schedule]] array and applies the options of the
+// windows the current local time falls into to flags, later ones taking
+// precedence. Options given on the command line are left alone.
+func applySchedules(flags *flag.FlagSet, cfg configTable) error {
+	list, err := readSchedules(cfg)
+	if err != nil {
+		return err
+	}
+	active := activeAt(list, clock())
+	for _, i := range active {
+		if err := applyConfig(flags, list[i].options); err != nil {
+			return fmt.Errorf("schedule %d: %v", i+1, err)
+		}
+	}
+	schedules, activeSchedules = list, active
+	return nil
+}
+
+// watchSchedules reloads the configuration at the start of each minute in
+// which the set of windows in effect changes.
+func watchSchedules() {
+	for {
+		now := clock()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		runControl(func() string {
+			active := activeAt(schedules, clock())
+			if slices.Equal(active, activeSchedules) {
+				return ""
+			}
+			var whens []string
+			for _, i := range active {
+				whens = append(whens, fmt.Sprintf("%q", schedules[i].when))
+			}
+			logf("schedules in effect changed to [%s], reloading the configuration", strings.Join(whens, " "))
+			reloadConfig()
+			return ""
+		})
+	}
+}
@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"container/heap"
+	"slices"
+	"sync"
+	"time"
+)
+
+// answerSlack is how much earlier than due an answer may be sent, so that
+// answers falling due close together are sent in one wakeup.
+const answerSlack = 10 * time.Millisecond
+
+// pendingAnswer is the answer to a filter request waiting for its delay to
+// pass.
+type pendingAnswer struct {
+	due       time.Time
+	sessionId string
+	token     string
+	result    string
+	index     int
+}
+
+// answerHeap orders pending answers by when they are due.
+type answerHeap []*pendingAnswer
+
+func (h answerHeap) Len() int           { return len(h) }
+func (h answerHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h answerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *answerHeap) Push(x any) {
+	a := x.(*pendingAnswer)
+	a.index = len(*h)
+	*h = append(*h, a)
+}
+func (h *answerHeap) Pop() any {
+	old := *h
+	a := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return a
+}
+
+// answerScheduler sends delayed answers from a single goroutine once they
+// are due, so that a pending answer costs a heap entry instead of a goroutine
+// and a timer.
+type answerScheduler struct {
+	mu        sync.Mutex
+	pending   answerHeap
+	bySession map[string][]*pendingAnswer
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+var answers = &answerScheduler{
+	bySession: make(map[string][]*pendingAnswer),
+	wake:      make(chan struct{}, 1),
+	done:      make(chan struct{}),
+}
+
+// schedule queues an answer to be sent after delay milliseconds.
+func (q *answerScheduler) schedule(sessionId string, token string, delay int64, result string) {
+	a := &pendingAnswer{
+		due:       clock().Add(time.Duration(delay) * time.Millisecond),
+		sessionId: sessionId,
+		token:     token,
+		result:    result,
+	}
+	q.mu.Lock()
+	heap.Push(&q.pending, a)
+	q.bySession[sessionId] = append(q.bySession[sessionId], a)
+	earliest := q.pending[0] == a
+	q.mu.Unlock()
+
+	if earliest {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancel drops the pending answers of a session which went away, so that
+// they are never sent, and returns how many there were.
+func (q *answerScheduler) cancel(sessionId string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.bySession[sessionId]
+	for _, a := range pending {
+		heap.Remove(&q.pending, a.index)
+	}
+	delete(q.bySession, sessionId)
+	return len(pending)
+}
+
+// forget removes an answer which is about to be sent from the answers of its
+// session.
+func (q *answerScheduler) forget(a *pendingAnswer) {
+	pending := slices.DeleteFunc(q.bySession[a.sessionId], func(p *pendingAnswer) bool { return p == a })
+	if len(pending) == 0 {
+		delete(q.bySession, a.sessionId)
+	} else {
+		q.bySession[a.sessionId] = pending
+	}
+}
+
+// due removes and returns the answers due by now, and the time until the
+// next one is due.
+func (q *answerScheduler) due(now time.Time) ([]*pendingAnswer, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []*pendingAnswer
+	for len(q.pending) > 0 && !q.pending[0].due.After(now.Add(answerSlack)) {
+		a := heap.Pop(&q.pending).(*pendingAnswer)
+		q.forget(a)
+		due = append(due, a)
+	}
+	if len(q.pending) == 0 {
+		return due, -1
+	}
+	return due, q.pending[0].due.Sub(now)
+}
+
+// run sends answers as they fall due until the filter shuts down, and then
+// the remaining ones.
+func (q *answerScheduler) run() {
+	defer close(q.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		due, next := q.due(clock())
+		for _, a := range due {
+			q.send(a)
+		}
+		if next >= 0 {
+			timer.Reset(next)
+		}
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		case <-shuttingDown:
+			timer.Stop()
+			q.flush()
+			return
+		}
+	}
+}
+
+// flush sends all pending answers regardless of when they are due.
+func (q *answerScheduler) flush() {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending, q.bySession = nil, make(map[string][]*pendingAnswer)
+	q.mu.Unlock()
+	for pending.Len() > 0 {
+		q.send(heap.Pop(&pending).(*pendingAnswer))
+	}
+}
+
+// send answers a filter request unless its session went away meanwhile.
+func (q *answerScheduler) send(a *pendingAnswer) {
+	if _, ok := sessions.Get(a.sessionId); !ok {
+		debugf("session %s disconnected before being answered", a.sessionId)
+		return
+	}
+	produceOutput("filter-result", a.sessionId, a.token, "%s", a.result)
+}
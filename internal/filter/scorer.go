@@ -0,0 +1,60 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const execScorerWaitDelay = 100 * time.Millisecond
+
+// execScore runs the command given by -execScorer with the IP address, the
+// reverse DNS name and the forward-confirmation result of a session as
+// arguments and adds the score delta it prints to the score of the session.
+// Failures and timeouts are logged and leave the score untouched.
+func execScore(s *session, rdns string, fcrdns string) {
+	if opts().execScorer == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts().execScorerTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, opts().execScorer, s.Addr.String(), rdns, fcrdns)
+	cmd.Stdout = &stdout
+	// don't wait for children of the scorer holding on to its stdout
+	cmd.WaitDelay = execScorerWaitDelay
+	if err := cmd.Run(); err != nil {
+		errorf("external scorer failed for %s: %v", s.Addr, err)
+		return
+	}
+	delta, err := parseScore(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		errorf("external scorer returned invalid score delta for %s: %q", s.Addr, stdout.String())
+		return
+	}
+	if delta == 0 || delta < 0 && s.Score == -1 {
+		return
+	}
+
+	logf("external scorer returned %v for IP address %s", delta, s.Addr)
+	s.Score = max(max(s.Score, 0)+delta, 0)
+}
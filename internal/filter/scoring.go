@@ -0,0 +1,227 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingScore is a session whose score is being computed in the background.
+// Its events are held back until the score is known or -scoreTimeout has
+// passed, so that the main loop can go on serving other sessions.
+type pendingScore struct {
+	events []*event
+	timer  *time.Timer
+	cancel context.CancelFunc
+
+	// timedOut takes the place of the result after -scoreTimeout
+	timedOut func(s *session)
+}
+
+var pendingScores = make(map[string]*pendingScore)
+
+// scoreDone tells the main loop that scoring a session has finished or timed
+// out, in which case apply is nil.
+type scoreDone struct {
+	sessionId string
+	pending   *pendingScore
+	apply     func(s *session)
+}
+
+var scoresDone = make(chan scoreDone)
+
+// configMu keeps the configuration from being reloaded while sessions are
+// scored in the background.
+var configMu sync.RWMutex
+
+// startScoring runs lookups for a session in the background. The function
+// they return puts their result into effect on the main loop; until then, all
+// events of the session are held back, starting with held, if any.
+func startScoring(sessionId string, held *event, lookup func(ctx context.Context) func(s *session), timedOut func(s *session)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pendingScore{cancel: cancel, timedOut: timedOut}
+	if held != nil {
+		p.events = append(p.events, held)
+	}
+	pendingScores[sessionId] = p
+	p.timer = time.AfterFunc(opts().scoreTimeout, func() {
+		scoresDone <- scoreDone{sessionId: sessionId, pending: p}
+	})
+
+	go func() {
+		configMu.RLock()
+		apply := lookup(ctx)
+		configMu.RUnlock()
+		scoresDone <- scoreDone{sessionId: sessionId, pending: p, apply: apply}
+	}()
+}
+
+// startSessionScoring scores a copy of the session in the background. The
+// copy replaces the session once done; until then, the session is left alone
+// as all of its events are held back.
+func startSessionScoring(sessionId string, s *session, rdns string, fcrdns string) {
+	scored := *s
+	startScoring(sessionId, nil, func(ctx context.Context) func(s *session) {
+		scoreSession(ctx, sessionId, &scored, rdns, fcrdns)
+		return func(s *session) { *s = scored }
+	}, func(s *session) {
+		// as with failed lookups, nothing is known about the address
+		errorf("scoring session %s timed out after %s, applying %s policy", sessionId, opts().scoreTimeout, opts().onDnsFailure)
+		markDNSFailed(s, false)
+	})
+}
+
+// rhsblQuery is a name to look up in an RHSBL, URIBL or EBL.
+type rhsblQuery struct {
+	name   string
+	list   string
+	weight float64
+
+	// what describes the name in log messages
+	what string
+}
+
+func (q rhsblQuery) key() string {
+	return q.name + "." + q.list
+}
+
+type rhsblAnswer struct {
+	listed bool
+	err    error
+}
+
+var errNotLookedUp = errors.New("not looked up")
+
+// eventLookups returns the lookups a filter request needs before it can be
+// decided on.
+func eventLookups(s *session, ev *event) []rhsblQuery {
+	if ev.Stream != "filter" || s.exempt {
+		return nil
+	}
+	var queries []rhsblQuery
+	switch {
+	case (ev.Phase == "helo" || ev.Phase == "ehlo") && len(ev.Params) > 1:
+		queries = domainQueries(s, ev.Params[1], rhsblWeights)
+	case ev.Phase == "mail-from" && len(ev.Params) > 1:
+		if _, domain, ok := strings.Cut(strings.Trim(ev.Params[1], "<>"), "@"); ok {
+			queries = domainQueries(s, domain, dblWeights)
+		}
+	case ev.Phase == "commit":
+		queries = s.queries
+	}
+	return slices.DeleteFunc(slices.Clone(queries), func(q rhsblQuery) bool {
+		_, ok := s.answers[q.key()]
+		return ok
+	})
+}
+
+// startLookups looks up the names an event needs in the background and holds
+// the event back until they are answered.
+func startLookups(sessionId string, ev *event, queries []rhsblQuery) {
+	startScoring(sessionId, ev, func(ctx context.Context) func(s *session) {
+		answers := lookupQueries(ctx, queries)
+		return func(s *session) { addAnswers(s, answers) }
+	}, func(s *session) {
+		errorf("lookups for session %s timed out after %s", sessionId, opts().scoreTimeout)
+		answers := make(map[string]rhsblAnswer)
+		for _, q := range queries {
+			answers[q.key()] = rhsblAnswer{err: context.DeadlineExceeded}
+		}
+		addAnswers(s, answers)
+	})
+}
+
+func lookupQueries(ctx context.Context, queries []rhsblQuery) map[string]rhsblAnswer {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	answers := make(map[string]rhsblAnswer)
+	for _, q := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listed, err := queryRHSBL(ctx, q.name, q.list)
+			mu.Lock()
+			answers[q.key()] = rhsblAnswer{listed, err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return answers
+}
+
+func addAnswers(s *session, answers map[string]rhsblAnswer) {
+	if s.answers == nil {
+		s.answers = make(map[string]rhsblAnswer)
+	}
+	maps.Copy(s.answers, answers)
+}
+
+// takeAnswer returns the answer to a query looked up ahead of time.
+func takeAnswer(s *session, q rhsblQuery) (bool, error) {
+	a, ok := s.answers[q.key()]
+	if !ok {
+		return false, errNotLookedUp
+	}
+	delete(s.answers, q.key())
+	return a.listed, a.err
+}
+
+// finishScoring puts the score of a session into effect and replays the
+// events held back in the meantime. Results arriving after the timeout are
+// discarded.
+func finishScoring(done scoreDone) {
+	p, ok := pendingScores[done.sessionId]
+	if !ok || p != done.pending {
+		return
+	}
+	delete(pendingScores, done.sessionId)
+	p.timer.Stop()
+	// lookups still outstanding after a timeout no longer matter
+	p.cancel()
+
+	if s, ok := sessions.Get(done.sessionId); ok {
+		if done.apply != nil {
+			done.apply(s)
+		} else {
+			p.timedOut(s)
+		}
+	}
+	for _, ev := range p.events {
+		dispatch(ev)
+	}
+}
+
+// abandonScoring lets the requests held back for sessions still being scored
+// proceed when the filter stops.
+func abandonScoring() {
+	for sessionId, p := range pendingScores {
+		delete(pendingScores, sessionId)
+		p.timer.Stop()
+		p.cancel()
+		for _, ev := range p.events {
+			if ev.Stream == "filter" {
+				smtpd.PassThrough(ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// scriptSteps bounds the work of a policy script for one phase. Starlark
+// has no while loops or recursion, so only a runaway loop over a huge range
+// gets near it.
+const scriptSteps = 100000
+
+// scriptPolicy is the Starlark script given by -policyScript. Its policy
+// function is called at every phase with the facts passed to the policy
+// command and answers like the policy command does.
+type scriptPolicy struct {
+	policy *starlark.Function
+}
+
+var script *scriptPolicy
+
+// scriptBuiltins are the functions scripts can use besides those of
+// Starlark itself.
+var scriptBuiltins = starlark.StringDict{
+	"inNet":   starlark.NewBuiltin("inNet", scriptInNet),
+	"matches": starlark.NewBuiltin("matches", scriptMatches),
+}
+
+func readScriptPolicy(path string) (*scriptPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return parseScript(path, nil)
+}
+
+// parseScript runs the top level of a script, read from src or, if it is
+// nil, from the file name, and returns its policy function.
+func parseScript(name string, src any) (*scriptPolicy, error) {
+	thread := &starlark.Thread{Name: name}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	globals, err := starlark.ExecFile(thread, name, src, scriptBuiltins)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+	policy, ok := globals["policy"].(*starlark.Function)
+	if !ok || policy.NumParams() != 1 {
+		return nil, fmt.Errorf("%s: no function policy(session) defined", name)
+	}
+	return &scriptPolicy{policy: policy}, nil
+}
+
+// facts returns the facts of a request as the struct passed to the policy
+// function, with the names the policy command knows them by.
+func (r policyRequest) facts() *starlarkstruct.Struct {
+	lists := make([]starlark.Value, len(r.Lists))
+	for i, list := range r.Lists {
+		lists[i] = starlark.String(list)
+	}
+	facts := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"session":       starlark.String(r.Session),
+		"phase":         starlark.String(r.Phase),
+		"ip":            starlark.String(r.IP),
+		"rdns":          starlark.String(r.Rdns),
+		"score":         starlark.Float(r.Score),
+		"lists":         starlark.NewList(lists),
+		"helo":          starlark.String(r.Helo),
+		"mailFrom":      starlark.String(r.MailFrom),
+		"authenticated": starlark.Bool(r.Authenticated),
+		"tlsVersion":    starlark.String(r.TLSVersion),
+		"tlsCipher":     starlark.String(r.TLSCipher),
+	})
+	facts.Freeze()
+	return facts
+}
+
+// run calls the policy function on the facts about a session. It returns
+// None to leave the decision to the filter, or a dict with the keys of the
+// answer of the policy command.
+func (sp *scriptPolicy) run(req policyRequest) (policyDecision, error) {
+	var d policyDecision
+	thread := &starlark.Thread{Name: req.Session}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	v, err := starlark.Call(thread, sp.policy, starlark.Tuple{req.facts()}, nil)
+	if err != nil {
+		// the innermost position in the script is enough for a log line
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			for i := range len(evalErr.CallStack) {
+				if pos := evalErr.CallStack.At(i).Pos; pos.IsValid() {
+					return d, fmt.Errorf("%s: %s", pos, evalErr.Msg)
+				}
+			}
+		}
+		return d, err
+	}
+	if v == starlark.None {
+		return d, nil
+	}
+	answer, ok := v.(*starlark.Dict)
+	if !ok {
+		return d, fmt.Errorf("policy returned %s, want dict or None", v.Type())
+	}
+	for _, item := range answer.Items() {
+		key, _ := starlark.AsString(item[0])
+		var err error
+		switch key {
+		case "action":
+			d.Action, err = scriptString(key, item[1])
+			if err == nil && d.Action != "proceed" && d.Action != "junk" && d.Action != "reject" && d.Action != "disconnect" {
+				err = fmt.Errorf("invalid action %q", d.Action)
+			}
+		case "message":
+			d.Message, err = scriptString(key, item[1])
+		case "header":
+			d.Header, err = scriptString(key, item[1])
+		case "delay":
+			var delay int64
+			if err = starlark.AsInt(item[1], &delay); err == nil {
+				d.Delay = &delay
+			} else {
+				err = fmt.Errorf("delay must be an int, got %s", item[1].Type())
+			}
+		default:
+			err = fmt.Errorf("unknown key %s", item[0])
+		}
+		if err != nil {
+			return policyDecision{}, err
+		}
+	}
+	return d, nil
+}
+
+func scriptString(key string, v starlark.Value) (string, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %s", key, v.Type())
+	}
+	return s, nil
+}
+
+// scriptInNet implements inNet(ip, cidr), which reports whether the IP
+// address is in the subnet.
+func scriptInNet(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var ip, cidr string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &ip, &cidr); err != nil {
+		return nil, err
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	addr := net.ParseIP(ip)
+	return starlark.Bool(addr != nil && network.Contains(addr)), nil
+}
+
+// scriptMatches implements matches(string, regexp), which reports whether
+// the regular expression matches the string.
+func scriptMatches(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s, pattern string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &s, &pattern); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return starlark.Bool(re.MatchString(s)), nil
+}
+
+// runScript runs the policy script, if any, on the given phase of a session.
+func runScript(s *session, sessionId string, phase string) policyDecision {
+	if script == nil {
+		return policyDecision{}
+	}
+	d, err := script.run(newPolicyRequest(s, sessionId, phase))
+	if err != nil {
+		errorf("policy script failed for session %s: %v", sessionId, err)
+		return policyDecision{}
+	}
+	return d
+}
@@ -0,0 +1,72 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScriptPolicy(t *testing.T) {
+	req := policyRequest{
+		Phase: "mail-from",
+		IP:    "192.0.2.1",
+		Score: 60,
+		Lists: []string{"bl.spamcop.net"},
+	}
+	tests := []struct {
+		body   string
+		action string
+		delay  int64
+		err    string
+	}{
+		{`return None`, "", -1, ""},
+		{`return {"action": "junk", "delay": 2000}`, "junk", 2000, ""},
+		{`return {"action": "reject"} if "bl.spamcop.net" in s.lists and inNet(s.ip, "192.0.2.0/24") else None`, "reject", -1, ""},
+		{`return {"action": "junk"} if matches(s.phase, "^mail-") else None`, "junk", -1, ""},
+		{`return {"action": "block"}`, "", -1, `invalid action "block"`},
+		{`return {"actoin": "junk"}`, "", -1, `unknown key "actoin"`},
+		{`return {"delay": "2s"}`, "", -1, "delay must be an int"},
+		{`return "junk"`, "", -1, "want dict or None"},
+		{`return s.nonexistent`, "", -1, "script:2:13: struct has no .nonexistent attribute"},
+		{`return [x for x in range(1000000)]`, "", -1, "too many steps"},
+	}
+	for _, test := range tests {
+		sp, err := parseScript("script", "def policy(s):\n    "+test.body+"\n")
+		if err != nil {
+			t.Fatalf("%s: %v", test.body, err)
+		}
+		d, err := sp.run(req)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %s", test.body, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.body, err)
+			continue
+		}
+		delay := int64(-1)
+		if d.Delay != nil {
+			delay = *d.Delay
+		}
+		if d.Action != test.action || delay != test.delay {
+			t.Errorf("%s: got action %q and delay %d, want %q and %d", test.body, d.Action, delay, test.action, test.delay)
+		}
+	}
+}
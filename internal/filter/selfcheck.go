@@ -0,0 +1,136 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// selfListings holds the listings of the own addresses of the MX found by
+// the previous check, so that only changes are logged.
+var selfListings map[string]bool
+
+// selfZones returns the zones the own addresses are checked against: the
+// blocklists used for scoring and those given by -selfZone.
+func selfZones() []string {
+	zones := slices.Collect(maps.Keys(domainWeights))
+	for _, zone := range opts().selfZoneSpecs {
+		if !slices.Contains(zones, zone) {
+			zones = append(zones, zone)
+		}
+	}
+	slices.Sort(zones)
+	return zones
+}
+
+// checkSelf looks up each of the addresses given by -selfIP in the given
+// zones and returns the listings found, as address and zone separated by a
+// space, along with the reasons given by the lists. Lookups which fail are
+// logged and counted.
+func checkSelf(zones []string) (map[string]string, int) {
+	listings := make(map[string]string)
+	failed := 0
+	for _, self := range opts().selfIPs {
+		labels := strings.Split(net.ParseIP(self).To4().String(), ".")
+		slices.Reverse(labels)
+		revip := strings.Join(labels, ".")
+		for _, zone := range zones {
+			ctx, cancel := context.WithTimeout(context.Background(), opts().lookupTimeout)
+			addrs, err := lookup(ctx, zone, revip)
+			if err != nil && !errors.Is(err, errRateLimited) {
+				errorf("unable to check own IP address %s on %s: %v", self, zone, err)
+				failed++
+			} else if len(addrs) > 0 {
+				reason := ""
+				if opts().lookupTXT {
+					reason = listingReason(ctx, zone, revip)
+				}
+				listings[self+" "+zone] = reason
+			}
+			cancel()
+		}
+	}
+	return listings, failed
+}
+
+// reportSelf logs the listings which are new since the previous check as
+// errors, the ones which are gone as well, and reports their number to
+// StatsD.
+func reportSelf(listings map[string]string) {
+	for _, listing := range slices.Sorted(maps.Keys(listings)) {
+		if selfListings[listing] {
+			continue
+		}
+		self, zone, _ := strings.Cut(listing, " ")
+		message := fmt.Sprintf("own IP address %s is listed on %s", self, zone)
+		if reason := listings[listing]; reason != "" {
+			message += ": " + reason
+		}
+		errorf("%s", message)
+		webhook.notify("self-listed", logFields{"ip": self, "list": zone, "reason": listings[listing]})
+	}
+	for _, listing := range slices.Sorted(maps.Keys(selfListings)) {
+		if _, ok := listings[listing]; !ok {
+			self, zone, _ := strings.Cut(listing, " ")
+			logf("own IP address %s is no longer listed on %s", self, zone)
+			webhook.notify("self-delisted", logFields{"ip": self, "list": zone})
+		}
+	}
+	selfListings = make(map[string]bool)
+	for listing := range listings {
+		selfListings[listing] = true
+	}
+	statsd.send(fmt.Sprintf("self.listed:%d|g", len(listings)))
+}
+
+// watchSelf checks the own addresses every -selfCheckInterval, as a listing
+// of the MX itself silently keeps its mail from being delivered.
+func watchSelf() {
+	for {
+		var zones []string
+		runControl(func() string {
+			zones = selfZones()
+			return ""
+		})
+		listings, _ := checkSelf(zones)
+		reportSelf(listings)
+		time.Sleep(opts().selfCheckInterval)
+	}
+}
+
+// checkSelfOnce checks the own addresses once for -check and returns the
+// exit status: 0 if none of them is listed, 1 if one is and 2 if they could
+// not all be checked.
+func checkSelfOnce() int {
+	listings, failed := checkSelf(selfZones())
+	reportSelf(listings)
+	switch {
+	case len(listings) > 0:
+		return 1
+	case failed > 0:
+		return 2
+	}
+	logf("own IP addresses %s are not listed", strings.Join(opts().selfIPs, ","))
+	return 0
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"time"
+)
+
+// shadowPolicy is a candidate set of thresholds and DNSBL weights which is
+// evaluated alongside the active one without affecting any session, so that
+// a policy change can be tried on live traffic first. Thresholds and weights
+// it does not set are those in effect.
+type shadowPolicy struct {
+	blockAbove    *thresholdFlag
+	tempfailAbove *thresholdFlag
+	rejectAbove   *thresholdFlag
+	junkAbove     *float64
+	weights       map[string]float64
+}
+
+var shadow *shadowPolicy
+
+// readShadowPolicy reads the candidate policy from a file in the syntax of
+// the configuration file, which may only set the thresholds and the [lists]
+// table.
+func readShadowPolicy(path string) (*shadowPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &shadowPolicy{}
+	for key, value := range cfg {
+		switch key {
+		case "blockAbove", "tempfailAbove", "rejectAbove":
+			t := newThresholdFlag(-1)
+			if err := t.Set(fmt.Sprint(value)); err != nil {
+				return nil, fmt.Errorf("%s: invalid value for %s: %v", path, key, err)
+			}
+			switch key {
+			case "blockAbove":
+				p.blockAbove = t
+			case "tempfailAbove":
+				p.tempfailAbove = t
+			default:
+				p.rejectAbove = t
+			}
+		case "junkAbove":
+			score, ok := configScore(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid value for junkAbove", path)
+			}
+			p.junkAbove = &score
+		case "lists":
+			if p.weights, err = configLists(cfg, key, make(map[string]time.Duration)); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: option %s cannot be part of a shadow policy", path, key)
+		}
+	}
+	return p, nil
+}
+
+// score returns the score the session would have with the weights of the
+// policy. Everything other than the DNSBL hits which makes up the score
+// carries over.
+func (p *shadowPolicy) score(s *session) float64 {
+	if s.Score < 0 || len(p.weights) == 0 {
+		return s.Score
+	}
+	active, candidate := make(map[string]float64), make(map[string]float64)
+	for _, list := range s.Lists {
+		weight, ok := domainWeights[list]
+		if !ok {
+			continue
+		}
+		active[list] = weight * reliability.confidence(list)
+		if w, ok := p.weights[list]; ok {
+			weight = w
+		}
+		candidate[list] = weight
+	}
+	return max(s.Score-aggregateWeights(groupedWeights(active))+aggregateWeights(groupedWeights(candidate)), 0)
+}
+
+// verdict returns what a policy with the given thresholds would do with the
+// session at the given phase, with score in place of that of the session.
+func verdict(s *session, phase string, score float64, block, tempfail, reject *thresholdFlag, junk float64) string {
+	switch {
+	case s.exempt, s.senderAllowed, s.relayed:
+		return "proceed"
+	case s.blocklisted:
+		if hasPhase(opts().blockPhase, phase) {
+			return "block"
+		}
+		return "proceed"
+	case block.exceeded(phase, score) && countLists(s.Lists) >= opts().minLists:
+		return "block"
+	case s.dnsFailed && failurePolicy(s) == "tempfail" && hasPhase(opts().blockPhase, phase):
+		return "tempfail"
+	case score == -1:
+		return "proceed"
+	case tempfail.exceeded(phase, score):
+		return "tempfail"
+	case reject.exceeded(phase, score):
+		return "reject"
+	case opts().junkAction && hasPhase(opts().junkPhase, phase) && (s.junk || junk >= 0 && score > junk):
+		return "junk"
+	}
+	return "proceed"
+}
+
+// compareShadow logs the first phase of a session at which the shadow policy
+// would take another action than the active one.
+func compareShadow(s *session, sessionId string, phase string) {
+	p := shadow
+	if p == nil || s.shadowLogged {
+		return
+	}
+	block, tempfail, reject, junk := opts().blockAbove, opts().tempfailAbove, opts().rejectAbove, junkThreshold()
+	active := verdict(s, phase, s.Score, block, tempfail, reject, junk)
+	if p.blockAbove != nil {
+		block = p.blockAbove
+	}
+	if p.tempfailAbove != nil {
+		tempfail = p.tempfailAbove
+	}
+	if p.rejectAbove != nil {
+		reject = p.rejectAbove
+	}
+	if p.junkAbove != nil {
+		junk = *p.junkAbove
+	}
+	score := p.score(s)
+	candidate := verdict(s, phase, score, block, tempfail, reject, junk)
+	if candidate == active {
+		return
+	}
+	s.shadowLogged = true
+	logf("session %s: shadow policy would %s at %s where the active policy would %s, score=%v shadowScore=%v", sessionId, candidate, phase, active, s.Score, score)
+}
@@ -0,0 +1,262 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sharedCacheTimeout = 250 * time.Millisecond
+	sharedCacheRetry   = 10 * time.Second
+	sharedCachePrefix  = "dnsblscore:"
+)
+
+// sharedCache is a lookup cache shared by several filters on a server
+// speaking the Redis protocol. If the server is unavailable, lookups carry on
+// as if there was none.
+type sharedCache struct {
+	addr     string
+	password string
+	db       string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	broken  bool
+	retryAt time.Time
+}
+
+var shared *sharedCache
+
+// dialSharedCache sets up the shared cache given by a URL of the form
+// redis://[:password@]host:port[/db], if any. The connection itself is only
+// established when it is first needed.
+func dialSharedCache(rawURL string) (*sharedCache, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid shared cache URL: %s", rawURL)
+	}
+	c := &sharedCache{addr: u.Host, db: strings.TrimPrefix(u.Path, "/")}
+	if c.db != "" {
+		if _, err := strconv.Atoi(c.db); err != nil {
+			return nil, fmt.Errorf("invalid shared cache database: %s", c.db)
+		}
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	return c, nil
+}
+
+// get returns the answer cached for name along with its remaining TTL.
+func (c *sharedCache) get(name string) ([]net.IP, time.Duration, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	replies, err := c.do([]string{"GET", sharedCachePrefix + name}, []string{"PTTL", sharedCachePrefix + name})
+	if err != nil || replies[0] == nil {
+		return nil, 0, false
+	}
+	ttl, err := strconv.ParseInt(*replies[1], 10, 64)
+	if err != nil || ttl <= 0 {
+		return nil, 0, false
+	}
+
+	var addrs []net.IP
+	for _, s := range strings.Split(*replies[0], ",") {
+		if addr := net.ParseIP(s); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Millisecond, true
+}
+
+// put caches the answer for name for the given TTL.
+func (c *sharedCache) put(name string, addrs []net.IP, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	values := make([]string, len(addrs))
+	for i, addr := range addrs {
+		values[i] = addr.String()
+	}
+	c.do([]string{"SET", sharedCachePrefix + name, strings.Join(values, ","), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)})
+}
+
+// do sends the given commands in one go and returns their replies. Nil
+// replies are returned as nil. Errors are logged once until the server is
+// reachable again, which is only tried every sharedCacheRetry so that an
+// unreachable server does not slow down lookups.
+func (c *sharedCache) do(commands ...[]string) ([]*string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.broken && time.Now().Before(c.retryAt) {
+		return nil, errors.New("unavailable")
+	}
+	replies, err := c.roundTrip(commands)
+	if err != nil {
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		if !c.broken {
+			errorf("shared cache at %s is unavailable: %v", c.addr, err)
+			c.broken = true
+		}
+		c.retryAt = time.Now().Add(sharedCacheRetry)
+		return nil, err
+	}
+	if c.broken {
+		logf("shared cache at %s is available again", c.addr)
+		c.broken = false
+	}
+	return replies, nil
+}
+
+func (c *sharedCache) roundTrip(commands [][]string) ([]*string, error) {
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	if err := c.send(commands); err != nil {
+		return nil, err
+	}
+
+	replies := make([]*string, len(commands))
+	for i := range replies {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// connect establishes the connection to the server, unless there is one
+// already, and authenticates and selects the database if necessary.
+func (c *sharedCache) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, sharedCacheTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != "" {
+		setup = append(setup, []string{"SELECT", c.db})
+	}
+	if len(setup) == 0 {
+		return nil
+	}
+	_, err = c.roundTrip(setup)
+	return err
+}
+
+// send writes the given commands without waiting for their replies.
+func (c *sharedCache) send(commands [][]string) error {
+	c.conn.SetDeadline(time.Now().Add(sharedCacheTimeout))
+	var b strings.Builder
+	for _, args := range commands {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+// readArray reads an array of bulk strings, as sent for messages published
+// on a channel.
+func (c *sharedCache) readArray() ([]string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	if !strings.HasPrefix(line, "*") || err != nil {
+		return nil, fmt.Errorf("unexpected reply: %s", line)
+	}
+
+	var values []string
+	for range n {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			values = append(values, *reply)
+		}
+	}
+	return values, nil
+}
+
+// readReply reads a simple string, error, integer or bulk string reply.
+func (c *sharedCache) readReply() (*string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		s := line[1:]
+		return &s, nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply: %s", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		s := string(buf[:n])
+		return &s, nil
+	}
+	return nil, fmt.Errorf("unexpected reply: %s", line)
+}
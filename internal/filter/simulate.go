@@ -0,0 +1,318 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/smtpdfilter"
+)
+
+// simulateTimeout is how long an expect line of a simulation waits for the
+// answer it expects.
+const simulateTimeout = 10 * time.Second
+
+// simulation plays the smtpd side of the filter protocol against a filter
+// process: it sends the config block, checks the registration, sends the
+// events of a script and checks that every filter request is answered
+// exactly once, with the token and session it was sent with.
+type simulation struct {
+	stdin      io.WriteCloser
+	output     chan string
+	registered map[string]bool
+
+	// tokens holds the unanswered filter requests of each session, oldest
+	// first, dataTokens the token shared by the data lines of its current
+	// message, and results and lines the answers and data lines which have
+	// not been checked by an expect line yet
+	tokens     map[string][]string
+	dataTokens map[string]string
+	results    map[string][]string
+	lines      map[string][]string
+
+	requests int
+	next     int
+	failures int
+	where    string
+}
+
+// simulate runs the filter with args and the script at path against it and
+// reports whether everything went as expected.
+func simulate(path string, args []string) bool {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		errorf("%v", err)
+		return false
+	}
+	self, err := os.Executable()
+	if err != nil {
+		errorf("%v", err)
+		return false
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		errorf("%v", err)
+		return false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		errorf("%v", err)
+		return false
+	}
+	if err := cmd.Start(); err != nil {
+		errorf("%v", err)
+		return false
+	}
+
+	sim := &simulation{
+		stdin:      stdin,
+		output:     make(chan string, 100),
+		registered: make(map[string]bool),
+		tokens:     make(map[string][]string),
+		dataTokens: make(map[string]string),
+		results:    make(map[string][]string),
+		lines:      make(map[string][]string),
+	}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			sim.output <- scanner.Text()
+		}
+		close(sim.output)
+	}()
+
+	sim.where = "handshake"
+	sim.send("config|smtpd-version|7.6.0")
+	sim.send("config|protocol|" + smtpdfilter.Latest.String())
+	sim.send("config|smtp-session-timeout|300")
+	sim.send("config|subsystem|smtp-in")
+	sim.send("config|ready")
+	if sim.register() {
+		for i, line := range strings.Split(string(script), "\n") {
+			sim.where = fmt.Sprintf("%s:%d", path, i+1)
+			sim.run(strings.TrimSpace(line))
+		}
+	}
+
+	// smtpd closing the pipe makes the filter answer everything still
+	// pending before it exits
+	sim.where = "shutdown"
+	stdin.Close()
+	for line := range sim.output {
+		sim.answer(line)
+	}
+	if err := cmd.Wait(); err != nil {
+		sim.fail("filter exited: %v", err)
+	}
+	for session, tokens := range sim.tokens {
+		for _, token := range tokens {
+			sim.fail("request %s of session %s was never answered", token, session)
+		}
+	}
+	logf("simulated %d requests, %d failures", sim.requests, sim.failures)
+	return sim.failures == 0
+}
+
+func (sim *simulation) fail(format string, a ...any) {
+	sim.failures++
+	errorf("%s: %s", sim.where, fmt.Sprintf(format, a...))
+}
+
+func (sim *simulation) send(line string) {
+	if _, err := io.WriteString(sim.stdin, line+"\n"); err != nil {
+		sim.fail("unable to write to the filter: %v", err)
+	}
+}
+
+// register reads the registration of the filter up to register|ready.
+func (sim *simulation) register() bool {
+	timeout := time.After(simulateTimeout)
+	for {
+		select {
+		case line, ok := <-sim.output:
+			if !ok {
+				sim.fail("filter exited before registering")
+				return false
+			}
+			if line == "register|ready" {
+				return true
+			}
+			atoms := strings.Split(line, "|")
+			if len(atoms) != 4 || atoms[0] != "register" || atoms[1] != "report" && atoms[1] != "filter" || atoms[2] != "smtp-in" {
+				sim.fail("invalid registration: %s", line)
+				continue
+			}
+			sim.registered[atoms[1]+"|"+atoms[3]] = true
+		case <-timeout:
+			sim.fail("filter did not register within %v", simulateTimeout)
+			return false
+		}
+	}
+}
+
+// run executes a line of the script. Empty lines and comments are skipped.
+func (sim *simulation) run(line string) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	fields := strings.SplitN(line, " ", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	command, session, name, params := fields[0], fields[1], fields[2], fields[3]
+	timestamp := fmt.Sprintf("%.6f", float64(time.Now().UnixMicro())/1e6)
+	switch command {
+	case "report":
+		if !sim.registered["report|"+name] {
+			sim.fail("filter did not register for %s reports", name)
+			return
+		}
+		sim.send(strings.Join([]string{"report", smtpdfilter.Latest.String(), timestamp, "smtp-in", name, session, params}, "|"))
+	case "filter":
+		if !sim.registered["filter|"+name] {
+			sim.fail("filter did not register for %s requests", name)
+			return
+		}
+		// like smtpd, only send a request once the previous one
+		// of the session has been answered
+		if name != "data-line" && !sim.await(session, func() bool { return len(sim.tokens[session]) == 0 }) {
+			return
+		}
+		sim.next++
+		token := fmt.Sprintf("%016x", sim.next)
+		switch {
+		case name == "data-line" && sim.dataTokens[session] != "":
+			// all lines of a message share a token
+			token = sim.dataTokens[session]
+		case name == "data-line":
+			// data lines are answered by the lines to pass on
+			// instead of a result
+			sim.dataTokens[session] = token
+		default:
+			if name == "data" {
+				delete(sim.dataTokens, session)
+			}
+			sim.tokens[session] = append(sim.tokens[session], token)
+		}
+		sim.requests++
+		sim.send(strings.Join([]string{"filter", smtpdfilter.Latest.String(), timestamp, "smtp-in", name, session, token, params}, "|"))
+	case "expect":
+		sim.expect(session, sim.results, strings.TrimPrefix(line, "expect "+session+" "))
+	case "expect-line":
+		sim.expect(session, sim.lines, strings.TrimPrefix(line, "expect-line "+session+" "))
+	case "sleep":
+		d, err := time.ParseDuration(session)
+		if err != nil {
+			sim.fail("invalid duration: %s", session)
+			return
+		}
+		time.Sleep(d)
+	default:
+		sim.fail("unknown command: %s", command)
+	}
+}
+
+// expect waits for the next answer of the filter to the session in queue
+// and compares it to want.
+func (sim *simulation) expect(session string, queue map[string][]string, want string) {
+	if !sim.await(session, func() bool { return len(queue[session]) > 0 }) {
+		return
+	}
+	got := queue[session][0]
+	queue[session] = queue[session][1:]
+	if got != want {
+		sim.fail("session %s: expected %q, got %q", session, want, got)
+	}
+}
+
+// await reads the output of the filter until done reports true.
+func (sim *simulation) await(session string, done func() bool) bool {
+	timeout := time.After(simulateTimeout)
+	for !done() {
+		select {
+		case line, ok := <-sim.output:
+			if !ok {
+				sim.fail("filter exited while waiting for session %s", session)
+				return false
+			}
+			sim.answer(line)
+		case <-timeout:
+			sim.fail("no answer for session %s within %v", session, simulateTimeout)
+			return false
+		}
+	}
+	return true
+}
+
+// answer checks a line written by the filter against the outstanding
+// requests and queues it for the expect lines.
+func (sim *simulation) answer(line string) {
+	atoms := strings.SplitN(line, "|", 4)
+	if len(atoms) != 4 {
+		sim.fail("invalid output: %s", line)
+		return
+	}
+	kind, session, token, result := atoms[0], atoms[1], atoms[2], atoms[3]
+	switch kind {
+	case "filter-result":
+		tokens := sim.tokens[session]
+		if len(tokens) == 0 {
+			sim.fail("unexpected answer for session %s: %s", session, line)
+			return
+		}
+		if token != tokens[0] {
+			sim.fail("answer for session %s with token %s, expected %s", session, token, tokens[0])
+			return
+		}
+		sim.tokens[session] = tokens[1:]
+		sim.results[session] = append(sim.results[session], result)
+	case "filter-dataline":
+		if want, ok := sim.dataTokens[session]; !ok || token != want {
+			sim.fail("unexpected data line for session %s: %s", session, line)
+			return
+		}
+		sim.lines[session] = append(sim.lines[session], result)
+	default:
+		sim.fail("invalid output: %s", line)
+	}
+}
+
+// withoutFlag returns args without the given flag and its value, so that the
+// filter run by a simulation gets all other arguments.
+func withoutFlag(args []string, name string) []string {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-"+name || arg == "--"+name:
+			i++
+		case strings.HasPrefix(arg, "-"+name+"=") || strings.HasPrefix(arg, "--"+name+"="):
+		default:
+			result = append(result, arg)
+		}
+	}
+	return result
+}
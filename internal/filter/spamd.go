@@ -0,0 +1,136 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spamdFeed lists blocked IP addresses in a file which spamd-setup(8) can
+// read as a blacklist, one address per line. The expiry of each entry is kept
+// in a trailing comment, which spamd-setup ignores, so that it survives
+// restarts.
+type spamdFeed struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]time.Time
+}
+
+var spamd *spamdFeed
+
+// loadSpamdFeed reads the feed at path. A missing file is treated as an
+// empty feed. An empty path yields a nil feed.
+func loadSpamdFeed(path string) (*spamdFeed, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f := &spamdFeed{path: path, entries: make(map[string]time.Time)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		addr, comment, _ := strings.Cut(scanner.Text(), "#")
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		expires, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(comment), "expires "), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spamd feed entry: %s", scanner.Text())
+		}
+		f.entries[addr] = time.Unix(expires, 0)
+	}
+	return f, scanner.Err()
+}
+
+// add lists the given IP address for -spamdExpire.
+func (f *spamdFeed) add(addr string) {
+	if f == nil {
+		return
+	}
+	now := clock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, listed := f.entries[addr]
+	f.entries[addr] = now.Add(opts().spamdExpire)
+	changed := !listed
+	for k, expires := range f.entries {
+		if now.After(expires) {
+			delete(f.entries, k)
+			changed = true
+		}
+	}
+	if !changed {
+		// spamd-setup only needs to know about changed entries, a new
+		// expiry is saved along with the next change
+		return
+	}
+	if err := f.save(); err != nil {
+		errorf("unable to save spamd feed: %v", err)
+	}
+}
+
+// save writes the feed to a temporary file which then replaces the previous
+// one, so that spamd-setup never reads a truncated feed.
+func (f *spamdFeed) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".spamd")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	var addrs []string
+	for addr := range f.entries {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintln(w, "# blocked by filter-dnsblscore")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "%s # expires %d\n", addr, f.entries[addr].Unix())
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,387 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+// filterStats counts sessions and decisions since the last summary.
+type filterStats struct {
+	mu          sync.Mutex
+	connections int64
+	blocked     int64
+	junked      int64
+	dnsFailures int64
+	outages     int64
+	unknown     int64
+	scored      int64
+	scoreSum    float64
+
+	// tarpitted is the total delay imposed on answers, listedTime the
+	// lifetime of listed sessions which disconnected and blockedDelay
+	// the delay of those among them which were blocked
+	tarpitted    time.Duration
+	listedTime   time.Duration
+	blockedDelay time.Duration
+	blockedLinks int64
+	hits         map[string]int64
+	lists        map[string]*listStats
+
+	// entryHits counts the matches of each allowlist and blocklist entry
+	// since the start, as stale entries only show over a long time
+	entryHits map[string]map[string]int64
+}
+
+// listStats accounts for the lookups in a single list, so that slow or
+// useless lists can be told apart.
+type listStats struct {
+	queries  int64
+	listed   int64
+	failures int64
+	limited  int64
+
+	// latencies holds the most recent uncached lookups, next is where
+	// the following one goes
+	latencies []time.Duration
+	next      int
+}
+
+// maxLatencies bounds the number of lookups latency percentiles are computed
+// from, as the counters are never reset without -statsInterval.
+const maxLatencies = 1024
+
+var stats = &filterStats{
+	hits:      make(map[string]int64),
+	lists:     make(map[string]*listStats),
+	entryHits: make(map[string]map[string]int64),
+}
+
+// addSession counts a connection along with its score. Unknown scores do not
+// count towards the average.
+func (st *filterStats) addSession(score float64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.connections++
+	statsd.send("connections:1|c")
+	if score >= 0 {
+		st.scored++
+		st.scoreSum += score
+	} else {
+		st.unknown++
+		statsd.send("scores.unknown:1|c")
+	}
+}
+
+// addHits counts a hit on each of the given lists.
+func (st *filterStats) addHits(lists ...string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, list := range lists {
+		st.hits[list]++
+		statsd.send(fmt.Sprintf("hits.%s:1|c", statsdName(list)))
+	}
+}
+
+// addEntryHit counts a match of an entry of the allowlist or the blocklist.
+func (st *filterStats) addEntryHit(list string, entry string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.entryHits[list] == nil {
+		st.entryHits[list] = make(map[string]int64)
+	}
+	st.entryHits[list][entry]++
+	statsd.send(fmt.Sprintf("entries.%s:1|c", list))
+}
+
+// formatEntries returns the number of matches of each entry of an access
+// list since the start, in the order of the entries, along with the number
+// of entries which never matched.
+func (st *filterStats) formatEntries(list string, l *dnsbl.Allowlist) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entries := l.Written()
+	hits := make([]string, len(entries))
+	unused := 0
+	for i, entry := range entries {
+		n := st.entryHits[list][entry]
+		if n == 0 {
+			unused++
+		}
+		hits[i] = fmt.Sprintf("%s:%d", entry, n)
+	}
+	return fmt.Sprintf("stats %s entries=%d unused=%d hits=%s", list, len(entries), unused, strings.Join(hits, ","))
+}
+
+func (st *filterStats) addBlocked() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.blocked++
+	statsd.send("decisions.blocked:1|c")
+}
+
+func (st *filterStats) addJunked() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.junked++
+	statsd.send("decisions.junked:1|c")
+}
+
+func (st *filterStats) list(list string) *listStats {
+	ls, ok := st.lists[list]
+	if !ok {
+		ls = &listStats{}
+		st.lists[list] = ls
+	}
+	return ls
+}
+
+// addLookup counts a lookup in a list, whether answered from the cache or
+// not.
+func (st *filterStats) addLookup(list string, listed bool, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ls := st.list(list)
+	ls.queries++
+	if listed {
+		ls.listed++
+	}
+	if err != nil {
+		ls.failures++
+	}
+	statsd.send(fmt.Sprintf("queries.%s:1|c", statsdName(list)))
+}
+
+// addLimited counts a lookup not sent to a list because of its rate limit.
+func (st *filterStats) addLimited(list string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.list(list).limited++
+	statsd.send(fmt.Sprintf("limited.%s:1|c", statsdName(list)))
+}
+
+// addLatency records the time a query to a list took.
+func (st *filterStats) addLatency(list string, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ls := st.list(list)
+	if len(ls.latencies) < maxLatencies {
+		ls.latencies = append(ls.latencies, d)
+	} else {
+		ls.latencies[ls.next] = d
+		ls.next = (ls.next + 1) % maxLatencies
+	}
+	statsd.send(fmt.Sprintf("lookups.%s:%d|ms", statsdName(list), d.Milliseconds()))
+}
+
+// percentile returns the latency below which p percent of the recent
+// lookups fall.
+func (ls *listStats) percentile(p int) time.Duration {
+	if len(ls.latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Sorted(slices.Values(ls.latencies))
+	return sorted[(len(sorted)*p+99)/100-1]
+}
+
+func (ls *listStats) format(list string) string {
+	hitRate := 0.0
+	if ls.queries > 0 {
+		hitRate = float64(ls.listed) * 100 / float64(ls.queries)
+	}
+	line := fmt.Sprintf("stats list=%s queries=%d hitRate=%.1f%% failures=%d limited=%d p50=%dms p95=%dms p99=%dms",
+		list, ls.queries, hitRate, ls.failures, ls.limited,
+		ls.percentile(50).Milliseconds(), ls.percentile(95).Milliseconds(), ls.percentile(99).Milliseconds())
+	if _, ok := domainWeights[list]; ok && opts().learnWeights {
+		line += fmt.Sprintf(" confidence=%.2f", reliability.confidence(list))
+	}
+	return line
+}
+
+func (st *filterStats) addDNSFailure() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.dnsFailures++
+	statsd.send("dns.failures:1|c")
+}
+
+// addDelay accounts for an answer delayed by the given number of
+// milliseconds.
+func (st *filterStats) addDelay(ms int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.tarpitted += time.Duration(ms) * time.Millisecond
+	statsd.send(fmt.Sprintf("tarpit.delay:%d|ms", ms))
+}
+
+// addListedSession accounts for the lifetime of a session from a listed IP
+// address and for the total delay of its answers once it disconnects, which
+// is the time the sender wasted on it.
+func (st *filterStats) addListedSession(lifetime time.Duration, delay int64, blocked bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.listedTime += lifetime
+	statsd.send(fmt.Sprintf("tarpit.lifetime:%d|ms", lifetime.Milliseconds()))
+	if blocked {
+		st.blockedLinks++
+		st.blockedDelay += time.Duration(delay) * time.Millisecond
+	}
+}
+
+// addOutage counts the start of an outage of all lists.
+func (st *filterStats) addOutage() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.outages++
+	statsd.send("dns.outages:1|c")
+}
+
+// summary returns a one-line summary of the counters followed by one line
+// per list, and resets them.
+func (st *filterStats) summary() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	lines := []string{st.format()}
+	for _, list := range slices.Sorted(maps.Keys(st.lists)) {
+		lines = append(lines, st.lists[list].format(list))
+	}
+	st.connections, st.blocked, st.junked, st.dnsFailures, st.outages, st.unknown, st.scored, st.scoreSum = 0, 0, 0, 0, 0, 0, 0, 0
+	st.tarpitted, st.listedTime, st.blockedDelay, st.blockedLinks = 0, 0, 0, 0
+	st.hits = make(map[string]int64)
+	st.lists = make(map[string]*listStats)
+	return lines
+}
+
+// current returns a one-line summary of the counters without resetting them.
+func (st *filterStats) current() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.format()
+}
+
+// currentList returns the summary line of a single list without resetting
+// its counters.
+func (st *filterStats) currentList(list string) (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ls, ok := st.lists[list]
+	if !ok {
+		return "", false
+	}
+	return ls.format(list), true
+}
+
+// currentLists returns the summary lines of all lists without resetting
+// their counters.
+func (st *filterStats) currentLists() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var lines []string
+	for _, list := range slices.Sorted(maps.Keys(st.lists)) {
+		lines = append(lines, st.lists[list].format(list))
+	}
+	return lines
+}
+
+// logSummary logs the summary lines and resets the counters.
+func (st *filterStats) logSummary() {
+	for _, line := range st.summary() {
+		logf("%s", line)
+	}
+}
+
+func (st *filterStats) format() string {
+	avg := 0.0
+	if st.scored > 0 {
+		avg = st.scoreSum / float64(st.scored)
+	}
+	var hits []string
+	for list, n := range st.hits {
+		hits = append(hits, fmt.Sprintf("%s:%d", list, n))
+	}
+	sort.Strings(hits)
+
+	avgBlockDelay := time.Duration(0)
+	if st.blockedLinks > 0 {
+		avgBlockDelay = st.blockedDelay / time.Duration(st.blockedLinks)
+	}
+	return fmt.Sprintf("stats connections=%d sessions=%d blocked=%d junked=%d dnsFailures=%d outages=%d unknown=%d avgScore=%.1f tarpitted=%s wasted=%s avgBlockDelay=%s hits=%s",
+		st.connections, sessions.Len(), st.blocked, st.junked, st.dnsFailures, st.outages, st.unknown, avg,
+		st.tarpitted.Round(time.Millisecond), st.listedTime.Round(time.Millisecond), avgBlockDelay.Round(time.Millisecond), strings.Join(hits, ","))
+}
+
+// reportStats writes a summary to stderr every -statsInterval.
+func reportStats() {
+	if opts().statsInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(opts().statsInterval) {
+			stats.logSummary()
+		}
+	}()
+}
+
+// statsdClient pushes metrics to a StatsD server over UDP. Metrics are sent
+// as they occur; errors are ignored as StatsD is lossy by design.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+}
+
+var statsd *statsdClient
+
+// dialStatsd sets up the StatsD client for the given address, if any.
+func dialStatsd(addr string, prefix string) (*statsdClient, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	return &statsdClient{conn: conn, prefix: prefix}, nil
+}
+
+func (c *statsdClient) send(metric string) {
+	if c == nil {
+		return
+	}
+	c.conn.Write([]byte(c.prefix + metric))
+}
+
+// timing records the time elapsed since start under the given name.
+func (c *statsdClient) timing(name string, start time.Time) {
+	c.send(fmt.Sprintf("%s:%d|ms", name, time.Since(start).Milliseconds()))
+}
+
+// statsdName turns a list domain into a single StatsD name component.
+func statsdName(list string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "{", "", "}", "").Replace(list)
+}
@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// thresholdFlag is a score threshold which may differ between phases. It is
+// given either as a single score, which applies at the phases given by
+// -blockPhase, or as a comma-separated list of phase=score pairs, optionally
+// combined with a default score, e.g. 4,rcpt-to=2.
+type thresholdFlag struct {
+	raw    string
+	score  float64
+	phases map[string]float64
+}
+
+func newThresholdFlag(score float64) *thresholdFlag {
+	return &thresholdFlag{raw: strconv.FormatFloat(score, 'f', -1, 64), score: score}
+}
+
+func (t *thresholdFlag) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.raw
+}
+
+func (t *thresholdFlag) Set(value string) error {
+	score := float64(-1)
+	phases := make(map[string]float64)
+	for _, entry := range strings.Split(value, ",") {
+		phase, s, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			s = phase
+		}
+		n, err := parseScore(s)
+		if err != nil {
+			return fmt.Errorf("invalid score: %s", s)
+		}
+		if !found {
+			score = n
+			continue
+		}
+		if err := validatePhases("threshold", phase); err != nil {
+			return err
+		}
+		phases[phase] = n
+	}
+
+	t.raw, t.score, t.phases = value, score, phases
+	return nil
+}
+
+// parseScore parses a score, weight or score adjustment. Integers are valid
+// floats, so configurations predating fractional scores keep working.
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid score: %s", s)
+	}
+	return f, nil
+}
+
+// highest returns the highest threshold set for any phase, or -1 if there is
+// none.
+func (t *thresholdFlag) highest() float64 {
+	highest := t.score
+	for _, threshold := range t.phases {
+		highest = max(highest, threshold)
+	}
+	return highest
+}
+
+// exceeded reports whether score is above the threshold which applies at the
+// given phase.
+func (t *thresholdFlag) exceeded(phase string, score float64) bool {
+	threshold, ok := t.phases[phase]
+	if !ok {
+		if !hasPhase(opts().blockPhase, phase) {
+			return false
+		}
+		threshold = t.score
+	}
+	return threshold >= 0 && score > threshold
+}
@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// weakCiphers are the fragments of cipher names which give away ciphers no
+// current mail server should negotiate.
+var weakCiphers = []string{"RC4", "3DES", "DES-CBC", "NULL", "EXPORT", "EXP-", "MD5", "ANON"}
+
+// linkTLS records the protocol version and cipher a session negotiated, as
+// reported by smtpd in the form version:cipher:bits, and adjusts its score
+// with -tlsBonus or -weakTLSPenalty.
+func linkTLS(phase string, sessionId string, params []string) {
+	if len(params) < 1 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	fields := strings.Split(params[0], ":")
+	s.tls = true
+	s.tlsVersion = fields[0]
+	if len(fields) > 1 {
+		s.tlsCipher = fields[1]
+	}
+	var bits int64
+	if len(fields) > 2 {
+		bits, _ = strconv.ParseInt(fields[2], 10, 64)
+	}
+	applyTLS(s, sessionId, bits)
+}
+
+// weakTLS reports whether a protocol version, cipher and key size are below
+// what can be expected of a legitimate mail server.
+func weakTLS(version string, cipher string, bits int64) bool {
+	switch version {
+	case "SSLv2", "SSLv3", "TLSv1", "TLSv1.0", "TLSv1.1":
+		return true
+	}
+	if bits > 0 && bits < 128 {
+		return true
+	}
+	cipher = strings.ToUpper(cipher)
+	for _, weak := range weakCiphers {
+		if strings.Contains(cipher, weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTLS subtracts -tlsBonus from the score of listed sessions which
+// negotiated TLS 1.3 and adds -weakTLSPenalty to that of sessions which
+// negotiated an obsolete protocol version or a weak cipher, which refines
+// decisions on borderline senders.
+func applyTLS(s *session, sessionId string, bits int64) {
+	if s.exempt || s.Score < 0 {
+		return
+	}
+	switch {
+	case opts().weakTLSPenalty > 0 && weakTLS(s.tlsVersion, s.tlsCipher, bits):
+		logf("session %s negotiated weak TLS (%s %s), adding %v", sessionId, s.tlsVersion, s.tlsCipher, opts().weakTLSPenalty)
+		s.Score += opts().weakTLSPenalty
+	case opts().tlsBonus > 0 && s.Score > 0 && s.tlsVersion == "TLSv1.3":
+		logf("session %s negotiated %s, subtracting %v", sessionId, s.tlsVersion, opts().tlsBonus)
+		s.Score = max(s.Score-opts().tlsBonus, 0)
+	}
+}
@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import "strings"
+
+// transaction is the state of the current transaction of a session as
+// reported by smtpd, which lets decisions be correlated with its message IDs
+// and limits be applied to the messages actually accepted.
+type transaction struct {
+	msgid      string
+	sender     string
+	recipients int64
+}
+
+// isTxResult reports whether s is the result of a tx-mail or tx-rcpt report.
+func isTxResult(s string) bool {
+	return s == "ok" || s == "permfail" || s == "tempfail"
+}
+
+// txAddress returns the result and address of a tx-mail or tx-rcpt report.
+// Older protocol versions send the address first, newer ones the result, as
+// the address may contain separators.
+func txAddress(params []string) (string, string) {
+	if isTxResult(params[1]) {
+		return params[1], strings.Join(params[2:], "|")
+	}
+	return params[len(params)-1], strings.Join(params[1:len(params)-1], "|")
+}
+
+func txBegin(phase string, sessionId string, params []string) {
+	if len(params) < 1 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	s.tx = &transaction{msgid: params[0]}
+}
+
+func txMail(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	if len(params) < 3 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+	if s.tx == nil || s.tx.msgid != params[0] {
+		return
+	}
+	if result, address := txAddress(params); result == "ok" {
+		s.tx.sender = address
+	}
+}
+
+func txRcpt(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	if len(params) < 3 {
+		malformed("invalid %s parameters for session %s", phase, sessionId)
+		return
+	}
+	if s.tx == nil || s.tx.msgid != params[0] {
+		return
+	}
+	if result, _ := txAddress(params); result == "ok" {
+		s.tx.recipients++
+	}
+}
+
+// txCommit counts the message towards -messageLimit and ends the
+// transaction.
+func txCommit(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	if s.tx != nil {
+		debugf("session %s: message %s committed with %d recipients", sessionId, s.tx.msgid, s.tx.recipients)
+	}
+	s.messages++
+	feedback.remember(s)
+	s.tx = nil
+}
+
+// txEnd ends a transaction which was rolled back or reset.
+func txEnd(phase string, sessionId string, params []string) {
+	s, ok := getSession(sessionId)
+	if !ok {
+		unknownSession(phase, sessionId)
+		return
+	}
+	s.tx = nil
+}
@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lfos/filter-dnsblscore/pkg/dnsbl"
+)
+
+var uriPattern = regexp.MustCompile(`(?i)\b(?:https?|ftp)://([a-z0-9][a-z0-9.-]*[a-z0-9])`)
+
+// scanURIs extracts the domains of all URLs in a message line to be looked up
+// in the configured URIBLs before the message is committed. Each domain is
+// only looked up once per message and no more than -uriblMaxLookups domains
+// are looked up in total.
+func scanURIs(s *session, line string) {
+	for _, m := range uriPattern.FindAllStringSubmatch(line, -1) {
+		domain := baseDomain(strings.ToLower(m[1]))
+		if !isDomainName(domain) || s.uris[domain] {
+			continue
+		}
+		if s.uriLookups >= opts().uriblMaxLookups {
+			return
+		}
+		if s.uris == nil {
+			s.uris = make(map[string]bool)
+		}
+		s.uris[domain] = true
+		s.uriLookups++
+
+		for list, weight := range uriblWeights {
+			s.queries = append(s.queries, rhsblQuery{name: domain, list: list, weight: weight, what: "URL domain " + domain})
+		}
+	}
+}
+
+// baseDomain reduces a hostname to the domain registered under its public
+// suffix, e.g. example.com or example.co.uk, which is what most URIBLs expect
+// to be queried for.
+func baseDomain(hostname string) string {
+	labels := strings.Split(hostname, ".")
+	n := 2
+	if len(labels) > 2 && multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return hostname
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// scoreMessage adds the weights of the URIBLs and EBLs the URL domains and
+// addresses of the current message are listed on to its score.
+func scoreMessage(s *session) {
+	for _, q := range s.queries {
+		if listed, _ := takeAnswer(s, q); listed {
+			logf("%s is listed on %s", q.what, q.list)
+			s.messageScore += q.weight
+			stats.addHits(q.list)
+		}
+	}
+	s.queries = nil
+}
+
+// messageAction returns the decision on a message whose score exceeds
+// -messageRejectAbove or -messageJunkAbove, or no decision otherwise.
+// Messages from senders given by -allowSenders always pass.
+func messageAction(s *session) decision {
+	switch {
+	case s.senderAllowed:
+		return decision{}
+	case opts().messageRejectAbove >= 0 && s.messageScore > opts().messageRejectAbove:
+		return dnsbl.Reject(550, "message contains blocklisted URLs")
+	case opts().messageJunkAbove >= 0 && s.messageScore > opts().messageJunkAbove:
+		return dnsbl.Junk()
+	}
+	return decision{}
+}
@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupConcurrency is the number of addresses looked up at the same time
+// while warming the cache, so that a long feed does not flood the lists.
+const warmupConcurrency = 8
+
+// readWarmupFeed reads the addresses to warm the cache with from a file or
+// an https:// URL: one per line, optionally followed by other fields such as
+// a count, with comments starting with #. Only IPv4 addresses are looked up
+// on DNSBLs, so other lines are skipped.
+func readWarmupFeed(source string) ([]net.IP, error) {
+	var r io.Reader
+	if isRemote(source) {
+		resp, err := remoteClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		r = io.LimitReader(resp.Body, remoteListMaxSize)
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var addrs []net.IP
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if addr := net.ParseIP(fields[0]).To4(); addr != nil {
+			addrs = append(addrs, addr)
+		} else {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		debugf("warmup feed %s: skipped %d lines without an IPv4 address", source, skipped)
+	}
+	return addrs, scanner.Err()
+}
+
+// warmCache looks up the addresses of the -warmup feed on all DNSBLs and DNS
+// allowlists in rotation, so that their answers are cached before the
+// addresses connect. A feed which cannot be read leaves the cache as it is.
+func warmCache() {
+	start := time.Now()
+	addrs, err := readWarmupFeed(opts().warmupFeed)
+	if err != nil {
+		errorf("unable to read warmup feed %s: %v", opts().warmupFeed, err)
+		return
+	}
+
+	queue := make(chan net.IP)
+	var wg sync.WaitGroup
+	for range warmupConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range queue {
+				warmAddress(addr)
+			}
+		}()
+	}
+	for _, addr := range addrs {
+		queue <- addr
+	}
+	close(queue)
+	wg.Wait()
+	logf("warmed the lookup cache with %d addresses from %s in %s", len(addrs), opts().warmupFeed, time.Since(start).Round(time.Millisecond))
+}
+
+// warmAddress looks up an address on all lists in rotation, which caches the
+// answers.
+func warmAddress(addr net.IP) {
+	atoms := strings.Split(addr.String(), ".")
+	revip := atoms[3] + "." + atoms[2] + "." + atoms[1] + "." + atoms[0]
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), opts().lookupTimeout)
+	defer cancel()
+	for _, m := range []map[string]float64{domainWeights, dnswlWeights} {
+		for list := range m {
+			if !breakers[list].allow() {
+				continue
+			}
+			ctx, cancel := listContext(ctx, list)
+			lookup(ctx, list, revip)
+			cancel()
+		}
+	}
+}
+
+// warmCacheEvery warms the cache every -warmupInterval.
+func warmCacheEvery() {
+	for range time.Tick(opts().warmupInterval) {
+		warmCache()
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookQueue      = 1000
+	webhookBatch      = 100
+	webhookRetries    = 3
+	webhookRetryDelay = time.Second
+	webhookTimeout    = 10 * time.Second
+)
+
+// webhookNotifier posts block decisions and operational events to -webhook
+// as JSON, in batches at most every -webhookInterval. Events are dropped if
+// the queue is full, so that a slow endpoint never holds up sessions.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	events  chan logFields
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+var webhook *webhookNotifier
+
+// openWebhook starts posting events to the given URL. An empty URL yields a
+// nil notifier.
+func openWebhook(rawURL string) (*webhookNotifier, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %s", rawURL)
+	}
+	w := &webhookNotifier{
+		url:    u.String(),
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan logFields, webhookQueue),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// notify queues an event of the given kind with the given details.
+func (w *webhookNotifier) notify(event string, fields logFields) {
+	if w == nil {
+		return
+	}
+	obj := logFields{"event": event, "time": clock().UTC().Format(time.RFC3339)}
+	for k, v := range fields {
+		obj[k] = v
+	}
+	select {
+	case w.events <- obj:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// run collects the queued events into batches until the queue is closed.
+func (w *webhookNotifier) run() {
+	defer close(w.done)
+	for {
+		event, ok := <-w.events
+		if !ok {
+			return
+		}
+		batch := []logFields{event}
+		timer := time.NewTimer(opts().webhookInterval)
+	collect:
+		for len(batch) < webhookBatch {
+			select {
+			case event, ok := <-w.events:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, event)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		w.post(batch)
+		if n := w.dropped.Swap(0); n > 0 {
+			errorf("webhook fell behind, dropped %d events", n)
+		}
+	}
+}
+
+// post sends a batch of events, retrying server errors and failed
+// connections. Client errors are not retried, as the same request would
+// fail again.
+func (w *webhookNotifier) post(batch []logFields) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		errorf("unable to encode webhook events: %v", err)
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < 300:
+				return
+			case resp.StatusCode < 500:
+				errorf("webhook rejected %d events: %s", len(batch), resp.Status)
+				return
+			}
+			err = fmt.Errorf("server error: %s", resp.Status)
+		}
+		if attempt >= webhookRetries {
+			errorf("unable to post %d events to webhook: %v", len(batch), err)
+			return
+		}
+		debugf("posting to webhook failed, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// close posts the queued events and waits for them to be sent.
+func (w *webhookNotifier) close() {
+	if w == nil {
+		return
+	}
+	close(w.events)
+	<-w.done
+}
@@ -0,0 +1,448 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matcher is a set of addresses searched as it is, such as a compiled list,
+// which an Allowlist consults after its own subnets.
+type Matcher interface {
+	Match(addr net.IP) (string, bool)
+	Entries() []string
+}
+
+// Allowlist is a set of subnets and hostnames, some of which may expire.
+// Hostnames starting with a dot match any subdomain. Each entry remembers
+// where it was written, even once merged by Aggregate.
+type Allowlist struct {
+	// Name is the name of the list in debug messages
+	Name string
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+	// Debugf logs added and expired entries if not nil
+	Debugf func(format string, args ...any)
+
+	subnets   map[string]bool
+	masks4    map[int]bool
+	masks6    map[int]bool
+	hostnames []string
+	expires   map[string]time.Time
+	matchers  []Matcher
+	sources   map[string]string
+	origins   map[string][]string
+}
+
+func NewAllowlist(name string) *Allowlist {
+	return &Allowlist{
+		Name:    name,
+		subnets: make(map[string]bool),
+		masks4:  make(map[int]bool),
+		masks6:  make(map[int]bool),
+		expires: make(map[string]time.Time),
+		sources: make(map[string]string),
+		origins: make(map[string][]string),
+	}
+}
+
+func (l *Allowlist) now() time.Time {
+	if l.Now == nil {
+		return time.Now()
+	}
+	return l.Now()
+}
+
+func (l *Allowlist) debugf(format string, args ...any) {
+	if l.Debugf != nil {
+		l.Debugf(format, args...)
+	}
+}
+
+// Add adds a matcher which is searched after the subnets of the list.
+func (l *Allowlist) Add(m Matcher) {
+	l.matchers = append(l.matchers, m)
+}
+
+// Matchers returns the matchers added to the list.
+func (l *Allowlist) Matchers() []Matcher {
+	return l.matchers
+}
+
+// Hostnames returns the hostnames of the list.
+func (l *Allowlist) Hostnames() []string {
+	return l.hostnames
+}
+
+// Expiring reports whether any entry of the list expires.
+func (l *Allowlist) Expiring() bool {
+	return len(l.expires) > 0
+}
+
+// Subnets returns the subnets of the list in no particular order.
+func (l *Allowlist) Subnets() []*net.IPNet {
+	var subnets []*net.IPNet
+	for entry := range l.subnets {
+		if _, subnet, err := net.ParseCIDR(entry); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// setExpiry records when an entry which may already be in the list expires.
+// Of several expiries of the same entry, the latest one wins, and a zero
+// expiry, meaning never, beats all others.
+func (l *Allowlist) setExpiry(entry string, expires time.Time, known bool) {
+	old, hasOld := l.expires[entry]
+	switch {
+	case expires.IsZero():
+		delete(l.expires, entry)
+	case !known || hasOld && expires.After(old):
+		l.expires[entry] = expires
+	}
+}
+
+// expired reports whether an entry has expired.
+func (l *Allowlist) expired(entry string) bool {
+	expires, ok := l.expires[entry]
+	return ok && !l.now().Before(expires)
+}
+
+// Aggregate drops subnets covered by broader ones and merges pairs of
+// adjacent subnets into the subnet spanning both, e.g. two /25 into a /24,
+// until no more can be merged. Subnets which expire are left alone. It
+// returns the number of subnets before and after.
+func (l *Allowlist) Aggregate() (int, int) {
+	var subnets []*net.IPNet
+	for entry := range l.subnets {
+		if _, ok := l.expires[entry]; ok {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(entry)
+		if err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	before := len(subnets)
+
+	// sorted by address and then by prefix length, a subnet comes right
+	// after any subnets covering it
+	slices.SortFunc(subnets, func(a, b *net.IPNet) int {
+		if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+			return c
+		}
+		aOnes, _ := a.Mask.Size()
+		bOnes, _ := b.Mask.Size()
+		return aOnes - bOnes
+	})
+	var merged []*net.IPNet
+	for _, subnet := range subnets {
+		if n := len(merged); n > 0 && merged[n-1].Contains(subnet.IP) {
+			continue
+		}
+		merged = append(merged, subnet)
+		for n := len(merged); n >= 2; n = len(merged) {
+			parent, ok := mergeSubnets(merged[n-2], merged[n-1])
+			if !ok {
+				break
+			}
+			merged = append(merged[:n-2], parent)
+		}
+	}
+
+	// subnets are contained in the merged subnet at or after the one
+	// containing the previous subnet, as both are sorted
+	origins := make(map[string][]string)
+	i := 0
+	for _, subnet := range subnets {
+		for !merged[i].Contains(subnet.IP) {
+			i++
+		}
+		parent, entry := merged[i].String(), subnet.String()
+		if entries, ok := l.origins[entry]; ok {
+			origins[parent] = append(origins[parent], entries...)
+		} else {
+			origins[parent] = append(origins[parent], entry)
+		}
+	}
+	for parent, entries := range origins {
+		if len(entries) == 1 && entries[0] == parent {
+			delete(origins, parent)
+		}
+	}
+	l.origins = origins
+
+	for _, subnet := range subnets {
+		delete(l.subnets, subnet.String())
+	}
+	for _, subnet := range merged {
+		l.subnets[subnet.String()] = true
+	}
+	l.masks4, l.masks6 = make(map[int]bool), make(map[int]bool)
+	for entry := range l.subnets {
+		_, subnet, _ := net.ParseCIDR(entry)
+		maskOnes, maskBits := subnet.Mask.Size()
+		if maskBits == 32 {
+			l.masks4[maskOnes] = true
+		} else {
+			l.masks6[maskOnes] = true
+		}
+	}
+	return before, len(merged)
+}
+
+// mergeSubnets returns the subnet spanning a and b if they are the two halves
+// of it.
+func mergeSubnets(a *net.IPNet, b *net.IPNet) (*net.IPNet, bool) {
+	aOnes, bits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	if aOnes != bOnes || bits != bBits || aOnes == 0 || a.IP.Equal(b.IP) {
+		return nil, false
+	}
+	mask := net.CIDRMask(aOnes-1, bits)
+	if !a.IP.Mask(mask).Equal(b.IP.Mask(mask)) {
+		return nil, false
+	}
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}, true
+}
+
+// Merge adds the entries and matchers of other to the list. Entries in both
+// keep their source in the list.
+func (l *Allowlist) Merge(other *Allowlist) {
+	for entry, source := range other.sources {
+		if _, ok := l.sources[entry]; !ok {
+			l.sources[entry] = source
+		}
+	}
+	for parent, entries := range other.origins {
+		l.origins[parent] = append(l.origins[parent], entries...)
+	}
+	for subnet := range other.subnets {
+		l.setExpiry(subnet, other.expires[subnet], l.subnets[subnet])
+		l.subnets[subnet] = true
+	}
+	for maskOnes := range other.masks4 {
+		l.masks4[maskOnes] = true
+	}
+	for maskOnes := range other.masks6 {
+		l.masks6[maskOnes] = true
+	}
+	for _, hostname := range other.hostnames {
+		known := slices.Contains(l.hostnames, hostname)
+		l.setExpiry(hostname, other.expires[hostname], known)
+		if !known {
+			l.hostnames = append(l.hostnames, hostname)
+		}
+	}
+	l.matchers = append(l.matchers, other.matchers...)
+}
+
+// Parse adds the entries of a list read from origin, a path or URL, with one
+// IP address, subnet in CIDR notation or hostname per line. Comments start
+// with a hash sign. An entry followed by a comment containing until=<date>
+// expires at the end of that day (UTC), or at the given time for RFC 3339
+// timestamps. Entries which have already expired are skipped.
+func (l *Allowlist) Parse(r io.Reader, origin string) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		// remove comments and whitespace, skip empty lines
+		line, comment, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		expires, err := parseExpiry(comment)
+		if err != nil {
+			return fmt.Errorf("%v for entry %s", err, line)
+		}
+		if !expires.IsZero() && !l.now().Before(expires) {
+			l.debugf("Entry %s of %s expired at %s", line, l.Name, expires.Format(time.RFC3339))
+			continue
+		}
+
+		if isHostname(line) {
+			hostname := strings.ToLower(line)
+			known := slices.Contains(l.hostnames, hostname)
+			l.setExpiry(hostname, expires, known)
+			if !known {
+				l.hostnames = append(l.hostnames, hostname)
+				l.sources[hostname] = fmt.Sprintf("%s:%d", origin, lineno)
+				l.debugf("Hostname %s added to %s", line, l.Name)
+			}
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, subnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("invalid subnet: %s", line)
+		}
+
+		maskOnes, maskBits := subnet.Mask.Size()
+		if maskBits == 32 {
+			l.masks4[maskOnes] = true
+		} else {
+			l.masks6[maskOnes] = true
+		}
+		subnetStr := subnet.String()
+		l.setExpiry(subnetStr, expires, l.subnets[subnetStr])
+		if !l.subnets[subnetStr] {
+			l.subnets[subnetStr] = true
+			l.sources[subnetStr] = fmt.Sprintf("%s:%d", origin, lineno)
+			l.debugf("Subnet %s added to %s", subnetStr, l.Name)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseExpiry extracts the expiry given by until=<date> from the comment of
+// an entry. Entries without one never expire.
+func parseExpiry(comment string) (time.Time, error) {
+	for _, field := range strings.Fields(comment) {
+		value, ok := strings.CutPrefix(field, "until=")
+		if !ok {
+			continue
+		}
+		if t, err := time.Parse(time.DateOnly, value); err == nil {
+			return t.AddDate(0, 0, 1), nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry %q", value)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// isHostname tells hostnames apart from IP addresses and subnets, which never
+// contain letters other than the hexadecimal digits of IPv6 addresses.
+func isHostname(s string) bool {
+	if strings.HasPrefix(s, ".") {
+		return true
+	}
+	return !strings.Contains(s, ":") && strings.ContainsFunc(s, func(r rune) bool {
+		return r != '.' && r != '/' && (r < '0' || r > '9')
+	})
+}
+
+// Match returns the subnet containing addr, if any.
+func (l *Allowlist) Match(addr net.IP) (string, bool) {
+	masks, maskBits := l.masks6, 128
+	if addr4 := addr.To4(); addr4 != nil {
+		addr, masks, maskBits = addr4, l.masks4, 32
+	}
+
+	for maskOnes := range masks {
+		mask := net.CIDRMask(maskOnes, maskBits)
+		maskedAddr := addr.Mask(mask).String()
+		query := fmt.Sprintf("%s/%d", maskedAddr, maskOnes)
+		if l.subnets[query] && !l.expired(query) {
+			return query, true
+		}
+	}
+	for _, m := range l.matchers {
+		if entry, ok := m.Match(addr); ok {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// Attribute returns the entry as written which made the list match addr with
+// the given entry, which differs for aggregated subnets, along with the file
+// or URL and line it came from, if known.
+func (l *Allowlist) Attribute(entry string, addr net.IP) (string, string) {
+	for _, origin := range l.origins[entry] {
+		_, subnet, err := net.ParseCIDR(origin)
+		if err == nil && subnet.Contains(addr) {
+			return origin, l.sources[origin]
+		}
+	}
+	return entry, l.sources[entry]
+}
+
+// Written returns the entries of the list as written, before aggregation, in
+// sorted order, leaving out expired ones. Entries of matchers are not known.
+func (l *Allowlist) Written() []string {
+	var entries []string
+	for entry := range l.sources {
+		if !l.expired(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// Entries returns the subnets and hostnames of the list in sorted order,
+// leaving out expired ones, followed by the entries of its matchers.
+func (l *Allowlist) Entries() []string {
+	var subnets []string
+	for subnet := range l.subnets {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+
+	var entries []string
+	for _, entry := range append(subnets, l.hostnames...) {
+		if l.expired(entry) {
+			continue
+		}
+		if expires, ok := l.expires[entry]; ok {
+			entry += " # until=" + expires.UTC().Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+	for _, m := range l.matchers {
+		entries = append(entries, m.Entries()...)
+	}
+	return entries
+}
+
+// MatchHostname returns the entry matching the given hostname, if any. The
+// hostname is expected to be forward-confirmed by the caller.
+func (l *Allowlist) MatchHostname(hostname string) (string, bool) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if hostname == "" {
+		return "", false
+	}
+	for _, entry := range l.hostnames {
+		if l.expired(entry) {
+			continue
+		}
+		if hostname == entry || strings.HasPrefix(entry, ".") && strings.HasSuffix(hostname, entry) {
+			return entry, true
+		}
+	}
+	return "", false
+}
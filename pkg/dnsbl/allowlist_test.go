@@ -0,0 +1,152 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAllowlist parses list as read from list.txt at the given time.
+func testAllowlist(t *testing.T, now *time.Time, list string) *Allowlist {
+	l := NewAllowlist("test")
+	l.Now = func() time.Time { return *now }
+	if err := l.Parse(strings.NewReader(list), "list.txt"); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestAllowlistParse(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := testAllowlist(t, &now, `# partners
+192.0.2.1 # until=2025-05-31
+192.0.2.2 # until=2025-06-01
+192.0.2.3 # until=2025-06-01T13:00:00Z
+2001:db8::1
+198.51.100.0/24
+`)
+	want := []string{
+		"192.0.2.2/32 # until=2025-06-02T00:00:00Z",
+		"192.0.2.3/32 # until=2025-06-01T13:00:00Z",
+		"198.51.100.0/24",
+		"2001:db8::1/128",
+	}
+	if got := l.Entries(); !slices.Equal(got, want) {
+		t.Fatalf("got entries %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		addr  string
+		after time.Duration
+		want  string
+	}{
+		{"192.0.2.1", 0, ""},
+		{"192.0.2.2", 0, "192.0.2.2/32"},
+		{"192.0.2.3", 0, "192.0.2.3/32"},
+		{"192.0.2.3", time.Hour, ""},
+		{"192.0.2.2", 12 * time.Hour, ""},
+		{"2001:db8::1", 0, "2001:db8::1/128"},
+		{"2001:db8::2", 0, ""},
+		{"198.51.100.77", 0, "198.51.100.0/24"},
+	}
+	for _, test := range tests {
+		now = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC).Add(test.after)
+		if got, _ := l.Match(net.ParseIP(test.addr)); got != test.want {
+			t.Errorf("%s after %v: got %q, want %q", test.addr, test.after, got, test.want)
+		}
+	}
+}
+
+func TestAllowlistParseInvalid(t *testing.T) {
+	for _, list := range []string{"192.0.2.1/33\n", "192.0.2.1 # until=tomorrow\n"} {
+		if err := NewAllowlist("test").Parse(strings.NewReader(list), "list.txt"); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+}
+
+func TestAllowlistAggregate(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := testAllowlist(t, &now, `192.0.2.0/25
+192.0.2.128/25
+192.0.2.77
+198.51.100.0/25 # until=2025-07-01
+198.51.100.128/25
+`)
+	before, after := l.Aggregate()
+	if before != 4 || after != 2 {
+		t.Fatalf("aggregated %d subnets into %d, want 4 into 2", before, after)
+	}
+	want := []string{
+		"192.0.2.0/24",
+		"198.51.100.0/25 # until=2025-07-02T00:00:00Z",
+		"198.51.100.128/25",
+	}
+	if got := l.Entries(); !slices.Equal(got, want) {
+		t.Fatalf("got entries %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		addr   string
+		entry  string
+		source string
+	}{
+		{"192.0.2.1", "192.0.2.0/25", "list.txt:1"},
+		{"192.0.2.200", "192.0.2.128/25", "list.txt:2"},
+		{"192.0.2.77", "192.0.2.0/25", "list.txt:1"},
+		{"198.51.100.1", "198.51.100.0/25", "list.txt:4"},
+	}
+	for _, test := range tests {
+		addr := net.ParseIP(test.addr)
+		match, ok := l.Match(addr)
+		if !ok {
+			t.Errorf("%s not matched", test.addr)
+			continue
+		}
+		if entry, source := l.Attribute(match, addr); entry != test.entry || source != test.source {
+			t.Errorf("%s attributed to %s from %s, want %s from %s", test.addr, entry, source, test.entry, test.source)
+		}
+	}
+}
+
+func TestAllowlistMatchHostname(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := testAllowlist(t, &now, `.example.org
+mail.example.net
+`)
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{"mail.example.org", ".example.org"},
+		{"MX1.Mail.Example.Org.", ".example.org"},
+		{"example.org", ""},
+		{"badexample.org", ""},
+		{"mail.example.net", "mail.example.net"},
+		{"other.mail.example.net", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got, _ := l.MatchHostname(test.hostname); got != test.want {
+			t.Errorf("MatchHostname(%q) = %q, want %q", test.hostname, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+// Package dnsbl scores SMTP sessions by the DNS lists their IP addresses are
+// listed on and decides how the filter answers them.
+package dnsbl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Decision is the answer to a filter request. The zero Decision leaves the
+// request to be decided by the next layer.
+type Decision struct {
+	// Action is proceed, junk, reject, disconnect or rewrite
+	Action string
+	// Code and Message make up the reply of rejections and disconnects;
+	// the message of a rewrite is the new recipient
+	Code    int
+	Message string
+	// Delay is the time in milliseconds the answer is held back
+	Delay int64
+	// Headers are added to the message of the session
+	Headers []string
+}
+
+func Proceed() Decision {
+	return Decision{Action: "proceed"}
+}
+
+func Junk() Decision {
+	return Decision{Action: "junk"}
+}
+
+func Reject(code int, message string) Decision {
+	return Decision{Action: "reject", Code: code, Message: message}
+}
+
+func Disconnect(code int, message string) Decision {
+	return Decision{Action: "disconnect", Code: code, Message: message}
+}
+
+func Rewrite(rcpt string) Decision {
+	return Decision{Action: "rewrite", Message: rcpt}
+}
+
+// ParseReply splits a reply such as "550 go away" into its code and text. A
+// reply without a valid code is returned whole with a code of 0.
+func ParseReply(reply string) (int, string) {
+	code, text, _ := strings.Cut(reply, " ")
+	n, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || n < 200 {
+		return 0, reply
+	}
+	return n, text
+}
+
+// Blocks reports whether the decision turns the client away.
+func (d Decision) Blocks() bool {
+	return d.Action == "reject" || d.Action == "disconnect"
+}
+
+// Permanent reports whether the decision is a permanent failure.
+func (d Decision) Permanent() bool {
+	return d.Blocks() && d.Code >= 500
+}
+
+// Reply returns the reply of a rejection or disconnect.
+func (d Decision) Reply() string {
+	if d.Code == 0 {
+		return d.Message
+	}
+	return fmt.Sprintf("%d %s", d.Code, d.Message)
+}
+
+// Result returns the filter result the request is answered with.
+func (d Decision) Result() string {
+	switch {
+	case d.Blocks():
+		return d.Action + "|" + d.Reply()
+	case d.Action == "rewrite":
+		return "rewrite|" + d.Message
+	}
+	return d.Action
+}
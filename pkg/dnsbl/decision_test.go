@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import "testing"
+
+func TestDecision(t *testing.T) {
+	tests := []struct {
+		decision  Decision
+		blocks    bool
+		permanent bool
+		result    string
+	}{
+		{Decision{}, false, false, ""},
+		{Proceed(), false, false, "proceed"},
+		{Junk(), false, false, "junk"},
+		{Reject(550, "go away"), true, true, "reject|550 go away"},
+		{Reject(451, "try again later"), true, false, "reject|451 try again later"},
+		{Disconnect(421, "too busy"), true, false, "disconnect|421 too busy"},
+		{Reject(0, "550 5.7.1 listed"), true, false, "reject|550 5.7.1 listed"},
+		{Rewrite("<spam@example.org>"), false, false, "rewrite|<spam@example.org>"},
+	}
+	for _, test := range tests {
+		d := test.decision
+		if d.Blocks() != test.blocks || d.Permanent() != test.permanent || d.Result() != test.result {
+			t.Errorf("%+v: got blocks %v, permanent %v, result %q, want %v, %v, %q", d,
+				d.Blocks(), d.Permanent(), d.Result(), test.blocks, test.permanent, test.result)
+		}
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		code  int
+		text  string
+	}{
+		{"550 go away", 550, "go away"},
+		{"421 4.7.0 try again later", 421, "4.7.0 try again later"},
+		{"go away", 0, "go away"},
+		{"55 go away", 0, "55 go away"},
+		{"150 go away", 0, "150 go away"},
+	}
+	for _, test := range tests {
+		if code, text := ParseReply(test.reply); code != test.code || text != test.text {
+			t.Errorf("ParseReply(%q) = %d, %q, want %d, %q", test.reply, code, text, test.code, test.text)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Result is the outcome of looking up an address on all lists of a Scorer.
+type Result struct {
+	Score   float64
+	Lists   []string
+	Codes   map[string]string
+	Reasons map[string]string
+	// Failed is set if a blocklist could not be queried, Outage if none
+	// could, in which case Score is -1
+	Failed bool
+	Outage bool
+}
+
+// Scorer looks up IP addresses on weighted DNS blocklists and DNS allowlists
+// (DNSWLs) at once, so that a slow list does not hold up the others. Only
+// Lookup is required.
+type Scorer struct {
+	Blocklists map[string]float64
+	DNSWLs     map[string]float64
+
+	// Lookup returns the answer of list for name, the reversed address
+	Lookup func(ctx context.Context, list string, name string) ([]net.IP, error)
+	// Allow reports whether list may be queried at all, e.g. as its
+	// circuit breaker is closed
+	Allow func(list string) bool
+	// Skip reports whether a lookup which failed with err was not made,
+	// e.g. as it was rate limited, and thus does not count as failed
+	Skip func(err error) bool
+	// Reason returns why name is listed on list
+	Reason func(ctx context.Context, list string, name string) string
+	// Weight returns the weight of a hit on list, its weight by default
+	Weight func(list string, weight float64) float64
+	// Combine returns the score of the given weights, their sum by default
+	Combine func(weights map[string]float64) float64
+	// Enough reports whether the remaining lookups can be skipped as the
+	// score is high enough even if all pending DNSWLs vouch for the address
+	Enough func(lists []string, score float64) bool
+}
+
+// ReverseName returns the name under which addr is looked up on DNS lists:
+// the octets of IPv4 addresses and the nibbles of IPv6 addresses in reverse
+// order.
+func ReverseName(addr net.IP) string {
+	if addr4 := addr.To4(); addr4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", addr4[3], addr4[2], addr4[1], addr4[0])
+	}
+	addr16 := addr.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(addr16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", addr16[i]&0xf, addr16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// TrustLevel extracts the trust level from a DNSWL answer of the form
+// 127.0.x.y, where y ranges from 0 (none) to 3 (high). The special answer
+// 127.0.0.255, denoting that queries are refused, is ignored.
+func TrustLevel(addrs []net.IP) int64 {
+	var level int64
+	for _, a := range addrs {
+		a4 := a.To4()
+		if a4 == nil || a4[0] != 127 || a4[3] > 3 {
+			continue
+		}
+		level = max(level, int64(a4[3]))
+	}
+	return level
+}
+
+// Score looks up the address of s and sets its score and lists.
+func (sc *Scorer) Score(ctx context.Context, s *Session) Result {
+	r := sc.Query(ctx, s.Addr)
+	s.Apply(r)
+	return r
+}
+
+// Query looks up addr on all lists. DNSWLs can only offset blocklist hits,
+// so the score is never negative unless nothing is known about the address,
+// i.e. all blocklists failed. As soon as Enough holds, the remaining lookups
+// are cancelled.
+func (sc *Scorer) Query(ctx context.Context, addr net.IP) Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	name := ReverseName(addr)
+
+	type answer struct {
+		list   string
+		dnswl  bool
+		addrs  []net.IP
+		reason string
+		err    error
+	}
+	// buffered so that lookups finishing after an early exit do not block
+	answers := make(chan answer, len(sc.Blocklists)+len(sc.DNSWLs))
+	pending, open := 0, 0
+	var maxTrust float64
+	for i, m := range []map[string]float64{sc.Blocklists, sc.DNSWLs} {
+		for list := range m {
+			if sc.Allow != nil && !sc.Allow(list) {
+				if i == 0 {
+					open++
+				}
+				continue
+			}
+			pending++
+			if i == 1 {
+				maxTrust += sc.DNSWLs[list] * 3
+			}
+			go func() {
+				addrs, err := sc.Lookup(ctx, list, name)
+				var reason string
+				if i == 0 && len(addrs) > 0 && sc.Reason != nil {
+					reason = sc.Reason(ctx, list, name)
+				}
+				answers <- answer{list: list, dnswl: i == 1, addrs: addrs, reason: reason, err: err}
+			}()
+		}
+	}
+
+	var result Result
+	weights := make(map[string]float64)
+	var trust float64
+	queried, failed := 0, 0
+	for ; pending > 0; pending-- {
+		a := <-answers
+		if a.dnswl {
+			trust += sc.DNSWLs[a.list] * float64(TrustLevel(a.addrs))
+			maxTrust -= sc.DNSWLs[a.list] * 3
+			continue
+		}
+		if a.err != nil && sc.Skip != nil && sc.Skip(a.err) {
+			// a list which is not queried cannot fail either
+			continue
+		}
+		queried++
+		if a.err != nil {
+			failed++
+		}
+		if len(a.addrs) == 0 {
+			continue
+		}
+		weights[a.list] = sc.weight(a.list)
+		result.Lists = append(result.Lists, a.list)
+		if result.Codes == nil {
+			result.Codes = make(map[string]string)
+		}
+		codes := make([]string, len(a.addrs))
+		for i, addr := range a.addrs {
+			codes[i] = addr.String()
+		}
+		result.Codes[a.list] = strings.Join(codes, ",")
+		if a.reason != "" {
+			if result.Reasons == nil {
+				result.Reasons = make(map[string]string)
+			}
+			result.Reasons[a.list] = a.reason
+		}
+		if pending > 1 && sc.Enough != nil && sc.Enough(result.Lists, sc.combine(weights)-trust-maxTrust) {
+			break
+		}
+	}
+	result.Score = max(sc.combine(weights)-trust, 0)
+	result.Failed = failed > 0
+	// lists which may not be queried failed recently, so if none of the
+	// others answered either, the resolver is most likely down
+	if failed == queried && (queried > 0 || open > 0 && open == len(sc.Blocklists)) {
+		result.Score = -1
+		result.Failed, result.Outage = true, true
+	}
+	sort.Strings(result.Lists)
+	return result
+}
+
+func (sc *Scorer) weight(list string) float64 {
+	if sc.Weight == nil {
+		return sc.Blocklists[list]
+	}
+	return sc.Weight(list, sc.Blocklists[list])
+}
+
+func (sc *Scorer) combine(weights map[string]float64) float64 {
+	if sc.Combine != nil {
+		return sc.Combine(weights)
+	}
+	var score float64
+	for _, weight := range weights {
+		score += weight
+	}
+	return score
+}
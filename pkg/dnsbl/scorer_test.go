@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestScorerQuery(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	tests := []struct {
+		name       string
+		blocklists map[string]float64
+		dnswls     map[string]float64
+		answers    map[string][]net.IP
+		errs       map[string]error
+		// lookups of the lists in hang only return once cancelled
+		hang   map[string]bool
+		enough func(lists []string, score float64) bool
+		want   Result
+	}{
+		{
+			name:       "listed",
+			blocklists: map[string]float64{"a.example": 60, "b.example": 40},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}},
+			want:       Result{Score: 60, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "enough",
+			blocklists: map[string]float64{"a.example": 60, "b.example": 40},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}},
+			hang:       map[string]bool{"b.example": true},
+			enough: func(lists []string, score float64) bool {
+				return score >= 50
+			},
+			want: Result{Score: 60, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "enough despite DNSWLs",
+			blocklists: map[string]float64{"a.example": 60, "b.example": 40},
+			dnswls:     map[string]float64{"wl.example": 5},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}},
+			hang:       map[string]bool{"b.example": true, "wl.example": true},
+			enough: func(lists []string, score float64) bool {
+				return score >= 40
+			},
+			want: Result{Score: 60, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "DNSWL trust",
+			blocklists: map[string]float64{"a.example": 60},
+			dnswls:     map[string]float64{"wl.example": 10},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}, "wl.example": {net.ParseIP("127.0.10.2")}},
+			want:       Result{Score: 40, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "DNSWL trust beyond the score",
+			blocklists: map[string]float64{"a.example": 20},
+			dnswls:     map[string]float64{"wl.example": 10},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}, "wl.example": {net.ParseIP("127.0.10.3")}},
+			want:       Result{Score: 0, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "DNSWL refusing queries",
+			blocklists: map[string]float64{"a.example": 60},
+			dnswls:     map[string]float64{"wl.example": 10},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}, "wl.example": {net.ParseIP("127.0.0.255")}},
+			want:       Result{Score: 60, Lists: []string{"a.example"}},
+		},
+		{
+			name:       "failed",
+			blocklists: map[string]float64{"a.example": 60, "b.example": 40},
+			answers:    map[string][]net.IP{"a.example": {net.ParseIP("127.0.0.2")}},
+			errs:       map[string]error{"b.example": errTimeout},
+			want:       Result{Score: 60, Lists: []string{"a.example"}, Failed: true},
+		},
+		{
+			name:       "outage",
+			blocklists: map[string]float64{"a.example": 60, "b.example": 40},
+			errs:       map[string]error{"a.example": errTimeout, "b.example": errTimeout},
+			want:       Result{Score: -1, Failed: true, Outage: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := &Scorer{
+				Blocklists: test.blocklists,
+				DNSWLs:     test.dnswls,
+				Lookup: func(ctx context.Context, list string, name string) ([]net.IP, error) {
+					if name != "1.2.0.192" {
+						t.Errorf("looked up %s, want 1.2.0.192", name)
+					}
+					if test.hang[list] {
+						<-ctx.Done()
+						return nil, ctx.Err()
+					}
+					return test.answers[list], test.errs[list]
+				},
+				Enough: test.enough,
+			}
+			got := sc.Query(context.Background(), net.ParseIP("192.0.2.1"))
+			if got.Score != test.want.Score || !slices.Equal(got.Lists, test.want.Lists) ||
+				got.Failed != test.want.Failed || got.Outage != test.want.Outage {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for _, test := range tests {
+		if got := ReverseName(net.ParseIP(test.addr)); got != test.want {
+			t.Errorf("ReverseName(%s) = %s, want %s", test.addr, got, test.want)
+		}
+	}
+}
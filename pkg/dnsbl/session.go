@@ -0,0 +1,42 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package dnsbl
+
+import (
+	"maps"
+	"net"
+	"slices"
+)
+
+// Session is what is known about the client of an SMTP session for scoring.
+// A Score of -1 means that nothing is known about it.
+type Session struct {
+	Addr    net.IP
+	Score   float64
+	Lists   []string
+	Codes   map[string]string
+	Reasons map[string]string
+}
+
+// Apply sets the score and lists of the session to the result of looking up
+// its address, which may be shared with other sessions.
+func (s *Session) Apply(r Result) {
+	s.Score = r.Score
+	s.Lists = slices.Clone(r.Lists)
+	s.Codes = maps.Clone(r.Codes)
+	s.Reasons = maps.Clone(r.Reasons)
+}
@@ -0,0 +1,78 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Event is a report or a filter request received from smtpd.
+type Event struct {
+	Stream    string
+	Version   Version
+	Timestamp string
+	Phase     string
+	SessionID string
+
+	// Params holds the remaining fields, starting with the token to
+	// answer with for filter requests
+	Params []string
+}
+
+// ParseEvent splits a line received from smtpd into its fields and checks
+// that it has all those its stream requires, so that no handler ever sees an
+// incomplete event.
+func ParseEvent(line string) (*Event, error) {
+	atoms := strings.Split(line, "|")
+	if len(atoms) < 6 {
+		return nil, fmt.Errorf("missing atoms: %s", line)
+	}
+	switch atoms[0] {
+	case "report":
+	case "filter":
+		// filter requests always carry a token to answer with
+		if len(atoms) < 7 {
+			return nil, fmt.Errorf("missing atoms: %s", line)
+		}
+	default:
+		return nil, fmt.Errorf("invalid stream: %s", atoms[0])
+	}
+	if atoms[3] != "smtp-in" {
+		return nil, fmt.Errorf("invalid subsystem: %s", atoms[3])
+	}
+	version, err := ParseVersion(atoms[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		Stream:    atoms[0],
+		Version:   version,
+		Timestamp: atoms[2],
+		Phase:     atoms[4],
+		SessionID: atoms[5],
+		Params:    atoms[6:],
+	}, nil
+}
+
+// Token returns the token a filter request is answered with.
+func (ev *Event) Token() string {
+	if ev.Stream != "filter" || len(ev.Params) == 0 {
+		return ""
+	}
+	return ev.Params[0]
+}
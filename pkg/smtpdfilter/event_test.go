@@ -0,0 +1,38 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import "testing"
+
+func FuzzParseEvent(f *testing.F) {
+	f.Add("report|0.7|1576146008.006099|smtp-in|link-connect|7641df9771b4ed00|mail.openbsd.org|pass|199.185.178.25:33174|45.77.67.80:25")
+	f.Add("filter|0.7|1576146008.006099|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|a|b")
+	f.Add("filter|0.4|1576146008.006099|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d")
+	f.Add("filter|0.7|1|smtp-in|helo|id")
+	f.Fuzz(func(t *testing.T, line string) {
+		ev, err := ParseEvent(line)
+		if err != nil {
+			return
+		}
+		if ev.Stream == "filter" && len(ev.Params) == 0 {
+			t.Fatalf("filter request without token: %q", line)
+		}
+		if ev.Stream != "filter" && ev.Stream != "report" {
+			t.Fatalf("invalid stream %q accepted", ev.Stream)
+		}
+	})
+}
@@ -0,0 +1,273 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Handler handles the events of one phase.
+type Handler interface {
+	Handle(ev *Event)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(ev *Event)
+
+// Handle calls f(ev).
+func (f HandlerFunc) Handle(ev *Event) {
+	f(ev)
+}
+
+// SessionTracker tells a Filter which sessions are known and is told when
+// smtpd reports that one is gone. Sessions implements it.
+type SessionTracker interface {
+	Known(sessionId string) bool
+	Remove(sessionId string)
+}
+
+// Filter speaks the filter protocol with smtpd on behalf of the handlers of
+// the events it registers. Reports of unknown sessions other than
+// link-connect are ignored and filter requests of unknown sessions are let
+// through, e.g. those of sessions which connected before the filter was
+// started. Sessions are forgotten after the handler of link-disconnect ran.
+type Filter struct {
+	// Name is the name of the filter in error messages
+	Name string
+	// Reports and Filters map the events registered to their handlers
+	Reports map[string]Handler
+	Filters map[string]Handler
+	// Sessions tracks the sessions of the filter; all sessions are
+	// known if nil
+	Sessions SessionTracker
+	// Output writes an answer to smtpd, to standard output if nil
+	Output func(line string)
+
+	// Debugf and Errorf log if not nil, Malformed is called with events
+	// which cannot be made sense of
+	Debugf    func(format string, args ...any)
+	Errorf    func(format string, args ...any)
+	Malformed func(err error)
+
+	// Config holds the key/value pairs of the config block smtpd sends
+	// before registration, e.g. smtpd-version and subsystem
+	Config map[string]string
+
+	// protocol is the version spoken by smtpd, set from the first event
+	protocol *Version
+}
+
+func (f *Filter) debugf(format string, args ...any) {
+	if f.Debugf != nil {
+		f.Debugf(format, args...)
+	}
+}
+
+func (f *Filter) errorf(format string, args ...any) {
+	if f.Errorf != nil {
+		f.Errorf(format, args...)
+	}
+}
+
+func (f *Filter) malformed(err error) {
+	if f.Malformed != nil {
+		f.Malformed(err)
+	}
+}
+
+// ReadConfig reads the config block smtpd sends at startup, which ends with
+// config|ready. It returns io.EOF if the input ends cleanly before, and the
+// error of the reader if reading fails.
+func (f *Filter) ReadConfig(lr *LineReader) error {
+	if f.Config == nil {
+		f.Config = make(map[string]string)
+	}
+	for {
+		line, err := lr.Next()
+		if err != nil {
+			return err
+		}
+		if line == "config|ready" {
+			break
+		}
+		atoms := strings.SplitN(line, "|", 3)
+		if len(atoms) == 3 && atoms[0] == "config" {
+			f.Config[atoms[1]] = atoms[2]
+		}
+	}
+
+	if subsystem, ok := f.Config["subsystem"]; ok && subsystem != "smtp-in" {
+		return fmt.Errorf("unsupported subsystem %s, %s only filters smtp-in", subsystem, f.Name)
+	}
+	if v, ok := f.Config["smtpd-version"]; ok {
+		f.debugf("smtpd version %s", v)
+	}
+	if s, ok := f.Config["protocol"]; ok {
+		v, err := ParseVersion(s)
+		if err != nil {
+			return err
+		}
+		f.SetProtocol(v)
+	}
+	return nil
+}
+
+// SetProtocol records the protocol version of the first event. It cannot
+// change while we are running; setting it only once keeps goroutines
+// answering requests from racing with the dispatching of events.
+func (f *Filter) SetProtocol(v Version) {
+	if f.protocol != nil {
+		return
+	}
+	if Latest.Before(v) {
+		f.errorf("filter protocol version %s is newer than %s, answering in the format of %s", v, Latest, Latest)
+	} else {
+		f.debugf("filter protocol version %s", v)
+	}
+	f.protocol = &v
+}
+
+// Protocol returns the protocol version spoken by smtpd, Latest until it is
+// known.
+func (f *Filter) Protocol() Version {
+	if f.protocol == nil {
+		return Latest
+	}
+	return *f.protocol
+}
+
+// registration returns the protocol version to register events for. smtpd
+// only tells us the version with the first event, after registration, so it
+// is derived from the smtpd version unless the config block has it.
+func (f *Filter) registration() Version {
+	if f.protocol != nil {
+		return *f.protocol
+	}
+	return versionOf(f.Config["smtpd-version"])
+}
+
+// Register registers the events with handlers which smtpd knows about.
+func (f *Filter) Register(w io.Writer) error {
+	v := f.registration()
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(f.Reports)) {
+		if v.Supports(k) {
+			fmt.Fprintf(&b, "register|report|smtp-in|%s\n", k)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(f.Filters)) {
+		if v.Supports(k) {
+			fmt.Fprintf(&b, "register|filter|smtp-in|%s\n", k)
+		}
+	}
+	b.WriteString("register|ready\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Send answers smtpd in the format of the protocol version it speaks.
+func (f *Filter) Send(msgType string, sessionId string, token string, result string) {
+	out := FormatOutput(f.Protocol(), msgType, sessionId, token, result)
+	if f.Output == nil {
+		fmt.Println(out)
+		return
+	}
+	f.Output(out)
+}
+
+// Result answers a filter request.
+func (f *Filter) Result(sessionId string, token string, result string) {
+	f.Send("filter-result", sessionId, token, result)
+}
+
+// DataLine passes on a line of a message.
+func (f *Filter) DataLine(sessionId string, token string, line string) {
+	f.Send("filter-dataline", sessionId, token, line)
+}
+
+// PassThrough answers a filter request without looking at it.
+func (f *Filter) PassThrough(ev *Event) {
+	if ev.Phase == "data-line" {
+		f.DataLine(ev.SessionID, ev.Token(), strings.Join(ev.Params[1:], "|"))
+	} else {
+		f.Result(ev.SessionID, ev.Token(), "proceed")
+	}
+}
+
+// Dispatch hands an event to its handler.
+func (f *Filter) Dispatch(ev *Event) {
+	f.SetProtocol(ev.Version)
+	known := f.Sessions == nil || f.Sessions.Known(ev.SessionID)
+
+	handlers := f.Reports
+	if ev.Stream == "filter" {
+		handlers = f.Filters
+	}
+	h, ok := handlers[ev.Phase]
+	switch {
+	case !ok:
+		f.malformed(fmt.Errorf("invalid phase: %s", ev.Phase))
+		// smtpd waits for an answer to every filter request
+		if ev.Stream == "filter" {
+			f.Result(ev.SessionID, ev.Token(), "proceed")
+		}
+	case ev.Stream == "report" && !known && ev.Phase != "link-connect":
+		f.debugf("ignoring %s report for unknown session %s", ev.Phase, ev.SessionID)
+	case ev.Stream == "filter" && !known:
+		f.errorf("%s request for unknown session %s, proceeding", ev.Phase, ev.SessionID)
+		f.PassThrough(ev)
+	default:
+		h.Handle(ev)
+		if ev.Stream == "report" && ev.Phase == "link-disconnect" && f.Sessions != nil {
+			f.Sessions.Remove(ev.SessionID)
+		}
+	}
+}
+
+// Run reads the config block from r, registers the events and dispatches
+// the events smtpd sends until the input ends. Lines longer than max bytes
+// are dropped, except for data lines. Filters which need to wait for other
+// things in between events use ReadConfig, Register, LineReader.Lines and
+// Dispatch instead.
+func (f *Filter) Run(r io.Reader, max int) error {
+	lr := NewLineReader(r, max)
+	lr.Debugf, lr.Malformed = f.Debugf, f.Malformed
+	if err := f.ReadConfig(lr); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	if err := f.Register(os.Stdout); err != nil {
+		return err
+	}
+	for line := range lr.Lines() {
+		ev, err := ParseEvent(line)
+		if err != nil {
+			f.malformed(err)
+			continue
+		}
+		f.Dispatch(ev)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadConfig(t *testing.T) {
+	errRead := errors.New("read failed")
+	tests := []struct {
+		name  string
+		input io.Reader
+		want  error
+	}{
+		{"ready", strings.NewReader("config|subsystem|smtp-in\nconfig|protocol|0.7\nconfig|ready\n"), nil},
+		{"end of input", strings.NewReader("config|subsystem|smtp-in\n"), io.EOF},
+		{"read error", io.MultiReader(strings.NewReader("config|subsystem|smtp-in\n"), iotest.ErrReader(errRead)), errRead},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &Filter{Name: "test"}
+			if err := f.ReadConfig(NewLineReader(test.input, 1024)); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
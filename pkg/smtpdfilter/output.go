@@ -0,0 +1,51 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// WriteOutput writes the lines produced for smtpd until the channel is
+// closed. The lines of a message are only flushed at its end, as smtpd
+// doesn't wait for them, which saves a system call per line when passing
+// large messages through.
+func WriteOutput(lines <-chan string, w io.Writer) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	for line := range lines {
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+		if atoms := strings.SplitN(line, "|", 4); len(atoms) == 4 && atoms[0] == "filter-dataline" && atoms[3] != "." {
+			continue
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// FormatOutput returns an answer to smtpd in the format of protocol version
+// v: the session ID and the token are swapped before 0.5.
+func FormatOutput(v Version, msgType string, sessionId string, token string, result string) string {
+	if v.Before(Version{0, 5}) {
+		return msgType + "|" + token + "|" + sessionId + "|" + result
+	}
+	return msgType + "|" + sessionId + "|" + token + "|" + result
+}
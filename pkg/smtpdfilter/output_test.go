@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeRecorder records every write, each of which is a flush of the
+// buffered writer as long as the buffer does not fill up.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestWriteOutput(t *testing.T) {
+	lines := make(chan string)
+	w := &writeRecorder{}
+	done := make(chan error)
+	go func() {
+		done <- WriteOutput(lines, w)
+	}()
+	for _, line := range []string{
+		"filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed",
+		"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: test",
+		"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|",
+		"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|a|b|.",
+		"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.",
+		"filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed",
+	} {
+		lines <- line
+	}
+	close(lines)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed\n",
+		"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: test\n" +
+			"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|\n" +
+			"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|a|b|.\n" +
+			"filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.\n",
+		"filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed\n",
+	}
+	if !slices.Equal(w.writes, want) {
+		t.Fatalf("got writes %q, want %q", w.writes, want)
+	}
+}
+
+// BenchmarkWriteOutput passes messages of 1000 lines of 76 characters
+// through WriteOutput.
+func BenchmarkWriteOutput(b *testing.B) {
+	line := "filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|" + strings.Repeat("x", 76)
+	lines := make(chan string, 1024)
+	done := make(chan error)
+	go func() {
+		done <- WriteOutput(lines, io.Discard)
+	}()
+	b.SetBytes(int64(len(line) + 1))
+	b.ResetTimer()
+	for i := range b.N {
+		if i%1000 == 999 {
+			lines <- "filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|."
+			continue
+		}
+		lines <- line
+	}
+	close(lines)
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LineReader reads the lines smtpd sends. Unlike bufio.Scanner, it doesn't
+// give up on lines longer than its limit: data lines are passed on unchanged,
+// as splitting them would alter the message, anything else is dropped. Such
+// data lines are held in memory whole, so their length is only bounded by
+// what smtpd accepts.
+type LineReader struct {
+	// Debugf logs data lines longer than the limit if not nil
+	Debugf func(format string, args ...any)
+	// Malformed is called with the lines which are dropped if not nil
+	Malformed func(err error)
+
+	r    *bufio.Reader
+	max  int
+	rest []byte
+}
+
+// NewLineReader returns a LineReader reading from r with a limit of max
+// bytes per line.
+func NewLineReader(r io.Reader, max int) *LineReader {
+	return &LineReader{r: bufio.NewReader(r), max: max}
+}
+
+// fill reads more input once the previous chunk has been consumed.
+func (lr *LineReader) fill() error {
+	if len(lr.rest) > 0 {
+		return nil
+	}
+	chunk, err := lr.r.ReadSlice('\n')
+	if len(chunk) == 0 {
+		return err
+	}
+	lr.rest = append(lr.rest[:0], chunk...)
+	return nil
+}
+
+// segment returns the next max bytes of the current line, and whether they
+// complete it.
+func (lr *LineReader) segment() ([]byte, bool, error) {
+	var seg []byte
+	for len(seg) < lr.max {
+		if err := lr.fill(); err != nil {
+			if len(seg) > 0 {
+				return seg, true, nil
+			}
+			return nil, false, err
+		}
+		n := min(len(lr.rest), lr.max-len(seg))
+		if i := bytes.IndexByte(lr.rest[:n], '\n'); i >= 0 {
+			seg = append(seg, lr.rest[:i]...)
+			lr.rest = lr.rest[i+1:]
+			return seg, true, nil
+		}
+		seg = append(seg, lr.rest[:n]...)
+		lr.rest = lr.rest[n:]
+	}
+	// the limit may fall right before the end of the line
+	if lr.fill() == nil && lr.rest[0] == '\n' {
+		lr.rest = lr.rest[1:]
+		return seg, true, nil
+	}
+	return seg, false, nil
+}
+
+// Next returns the next line.
+func (lr *LineReader) Next() (string, error) {
+	for {
+		seg, complete, err := lr.segment()
+		if err != nil {
+			return "", err
+		}
+		if complete {
+			return string(bytes.TrimSuffix(seg, []byte("\r"))), nil
+		}
+
+		atoms := strings.SplitN(string(seg), "|", 8)
+		if len(atoms) == 8 && atoms[0] == "filter" && atoms[4] == "data-line" {
+			if lr.Debugf != nil {
+				lr.Debugf("passing on data line longer than %d bytes for session %s", lr.max, atoms[5])
+			}
+			line := seg
+			for !complete {
+				if seg, complete, err = lr.segment(); err != nil {
+					return "", err
+				}
+				line = append(line, seg...)
+			}
+			return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+		}
+		if lr.Malformed != nil {
+			lr.Malformed(fmt.Errorf("line longer than %d bytes: %.64s...", lr.max, seg))
+		}
+		for !complete {
+			if _, complete, err = lr.segment(); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// Lines returns a channel receiving the lines read until the input ends, so
+// that a filter can wait for them along with other things.
+func (lr *LineReader) Lines() <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := lr.Next()
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	return lines
+}
@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package smtpdfilter
+
+import "sync"
+
+// Sessions holds the state of the active sessions of a filter. It is safe
+// for concurrent use, as delayed answers look up whether their session is
+// still around.
+type Sessions[S any] struct {
+	mu sync.Mutex
+	m  map[string]S
+}
+
+// NewSessions returns an empty session table.
+func NewSessions[S any]() *Sessions[S] {
+	return &Sessions[S]{m: make(map[string]S)}
+}
+
+// Get returns the state of a session and whether it is known.
+func (st *Sessions[S]) Get(sessionId string) (S, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.m[sessionId]
+	return s, ok
+}
+
+// Put sets the state of a session, adding it if it is new.
+func (st *Sessions[S]) Put(sessionId string, s S) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.m[sessionId] = s
+}
+
+// Remove forgets a session.
+func (st *Sessions[S]) Remove(sessionId string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.m, sessionId)
+}
+
+// Known reports whether a session is in the table.
+func (st *Sessions[S]) Known(sessionId string) bool {
+	_, ok := st.Get(sessionId)
+	return ok
+}
+
+// Len returns the number of sessions in the table.
+func (st *Sessions[S]) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.m)
+}
+
+// Evict removes the sessions for which evict returns true and returns their
+// IDs.
+func (st *Sessions[S]) Evict(evict func(sessionId string, s S) bool) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var evicted []string
+	for sessionId, s := range st.m {
+		if evict(sessionId, s) {
+			delete(st.m, sessionId)
+			evicted = append(evicted, sessionId)
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2025 Lukas Fleischer <lfleischer@lfos.de>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+// Package smtpdfilter implements the OpenSMTPD filter protocol for smtp-in
+// filters: reading the config block, registering events, parsing events,
+// answering them in the format of the protocol version smtpd speaks and
+// keeping track of sessions.
+package smtpdfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a version of the smtpd filter protocol.
+type Version struct {
+	Major, Minor int
+}
+
+// Latest is the newest protocol version the package knows about. Newer
+// versions are answered in its format.
+var Latest = Version{0, 7}
+
+// eventsSince gives the protocol versions which introduced the events that
+// not all supported versions know about. smtpd refuses to register events it
+// doesn't know.
+var eventsSince = map[string]Version{
+	"tx-reset": {0, 6},
+}
+
+// ParseVersion parses a protocol version of the form major.minor.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	major, minor, ok := strings.Cut(s, ".")
+	if !ok {
+		return v, fmt.Errorf("invalid protocol version: %s", s)
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(major); err != nil || v.Major < 0 {
+		return v, fmt.Errorf("invalid protocol version: %s", s)
+	}
+	if v.Minor, err = strconv.Atoi(minor); err != nil || v.Minor < 0 {
+		return v, fmt.Errorf("invalid protocol version: %s", s)
+	}
+	return v, nil
+}
+
+// Before reports whether v is older than o.
+func (v Version) Before(o Version) bool {
+	return v.Major < o.Major || v.Major == o.Major && v.Minor < o.Minor
+}
+
+// String returns the version as smtpd writes it, e.g. 0.7.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Supports reports whether smtpd speaking version v knows the event.
+func (v Version) Supports(event string) bool {
+	since, ok := eventsSince[event]
+	return !ok || !v.Before(since)
+}
+
+// versionOf returns the protocol version spoken by the given smtpd version,
+// or Latest if it is unknown.
+func versionOf(smtpdVersion string) Version {
+	major, minor, ok := strings.Cut(smtpdVersion, ".")
+	if !ok {
+		return Latest
+	}
+	minor, _, _ = strings.Cut(minor, ".")
+	hi, err1 := strconv.Atoi(major)
+	lo, err2 := strconv.Atoi(minor)
+	switch {
+	case err1 != nil || err2 != nil:
+		return Latest
+	case hi < 6 || hi == 6 && lo < 7:
+		return Version{0, 5}
+	case hi == 6:
+		return Version{0, 6}
+	}
+	return Latest
+}
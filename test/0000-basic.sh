@@ -19,8 +19,16 @@ test_run 'initialization' '
 	register|filter|smtp-in|rcpt-to
 	register|filter|smtp-in|starttls
 	register|ready
+	register|report|smtp-in|link-auth
 	register|report|smtp-in|link-connect
 	register|report|smtp-in|link-disconnect
+	register|report|smtp-in|link-tls
+	register|report|smtp-in|tx-begin
+	register|report|smtp-in|tx-commit
+	register|report|smtp-in|tx-mail
+	register|report|smtp-in|tx-rcpt
+	register|report|smtp-in|tx-reset
+	register|report|smtp-in|tx-rollback
 	EOD
 	test_cmp actual expected
 '
@@ -46,6 +54,12 @@ test_run 'test behavior with negative blocklist weight' '
 	EOD
 '
 
+test_run 'test behavior with negative DNS allowlist weight' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -dnswl list.dnswl.org:-10 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
 test_run 'test behavior with a single valid blocklist' '
 	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 some.domain.com:20 >&2
 	config|ready
@@ -60,33 +74,186 @@ test_run 'test behavior with a multiple valid blocklists' '
 	EOD
 '
 
-test_run 'test behavior with invalid stream' '
-	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+test_run 'test behavior with invalid stream in strict mode' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -strict -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
 	config|ready
 	invalid|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
 	EOD
 '
 
-test_run 'test behavior with invalid phase' '
-	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+test_run 'test behavior with invalid phase in strict mode' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -strict -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
 	config|ready
 	report|0.5|0|smtp-in|invalid|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
 	EOD
 '
 
-test_run 'test behavior with too few atoms' '
-	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+test_run 'test behavior with too few atoms in strict mode' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -strict -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	report|0.5|0|smtp-in|link-connect
+	EOD
+'
+
+test_run 'test behavior with unknown events and malformed lines' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
 	config|ready
+	invalid|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
 	report|0.5|0|smtp-in|link-connect
+	report|.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-out|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|invalid|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|invalid|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	grep -q "invalid stream: invalid, ignoring" log &&
+	grep -q "invalid phase: invalid, ignoring" log &&
+	grep -q "invalid protocol version: .5, ignoring" log &&
+	grep -q "invalid subsystem: smtp-out, ignoring" log
+'
+
+test_run 'test behavior with data lines longer than 64KB' '
+	line=$(head -c 100000 /dev/zero | tr "\\0" A) &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|$line
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|$line
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test behavior with lines longer than maxLineLength' '
+	line=$(head -c 1000 /dev/zero | tr "\\0" A) &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -maxLineLength 512 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-identify|7641df9771b4ed00|helo|$line
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|$line
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	prefix="filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|" &&
+	cat <<-EOD >expected &&
+	$prefix$line
+	${prefix}.
+	EOD
+	test_cmp actual expected &&
+	grep -q "line longer than 512 bytes" log
+'
+
+test_run 'test passing on long lines ending where they would be split' '
+	line=$(head -c 447 /dev/zero | tr "\\0" A). &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -maxLineLength 512 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|$line
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	prefix="filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|" &&
+	cat <<-EOD >expected &&
+	$prefix$line
+	${prefix}.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test behavior with a too small maxLineLength' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -maxLineLength 100 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
 	EOD
 '
 
 test_run 'test behavior with invalid session ID' '
-	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
 	config|ready
 	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
 	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
 	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test behavior with both DNS-over-TLS and DNS-over-HTTPS' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -dot 127.0.0.1 -doh https://127.0.0.1/dns-query $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test behavior with an invalid syslog facility' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -syslog -syslogFacility bogus $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test behavior with an invalid aggregation' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -aggregate average $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test behavior with an invalid DNS failure policy' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -onDnsFailure ignore $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test behavior with an invalid lookup timeout' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -lookupTimeout 0s $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test requests for unknown sessions' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: a|b
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|pass|user
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: a|b
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test simulating smtpd' '
+	cat <<-EOD >script &&
+	# a blocked session and one sending a message
+	report s1 link-connect |pass|1.2.3.60:33174|1.1.1.1:25
+	filter s1 connect |pass|1.2.3.60:33174|1.1.1.1:25
+	expect s1 disconnect|550 your IP reputation is too low for this MX
+	report s2 link-connect |pass|1.2.3.4:33174|1.1.1.1:25
+	filter s2 connect |pass|1.2.3.4:33174|1.1.1.1:25
+	filter s2 helo mail.example.org
+	expect s2 proceed
+	expect s2 proceed
+	filter s2 data
+	filter s2 data-line Subject: hello
+	filter s2 data-line .
+	expect s2 proceed
+	expect-line s2 Subject: hello
+	expect-line s2 .
+	EOD
+	"$FILTER_BIN" -simulate script $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS 2>log &&
+	grep -q "simulated 6 requests, 0 failures" log &&
+	sed "s/^expect s1 .*/expect s1 proceed/" script >wrong-script &&
+	"$FILTER_BIN" -simulate wrong-script $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	grep -q "wrong-script:4: session s1: expected \"proceed\", got \"disconnect|550 your IP reputation is too low for this MX\"" log
 '
 
 test_complete
@@ -108,6 +108,1064 @@ test_run 'test block phase: rcpt-to' '
 	test_cmp actual expected
 '
 
+test_run 'test exempt recipients' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase rcpt-to -exemptRecipients "postmaster,abuse@example.org,@example.net" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|<Postmaster>
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|abuse@example.org
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@example.net
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|abuse@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase rcpt-to -exemptRecipientAction proceed $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|abuse@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -exemptRecipientAction reject $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test sender allowlist' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -junkAbove 10 -junkPhase mail-from -blockPhase mail-from,rcpt-to -allowSenders "alerts@example.org,@example.net" $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|<Alerts@example.org>
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|billing@example.net
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|<>
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|alerts@example.org
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|alerts@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected &&
+	grep -q "sender <Alerts@example.org> matches sender allowlist entry alerts@example.org" log
+'
+
+test_run 'test multiple block phases' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase helo,rcpt-to $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test RHSBL hits on the HELO hostname' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -rhsbl dbl.example.org:20 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|listed.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed01|1ef1c203cc576e5d|mx.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the minimum number of lists' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -minLists 1 -rhsbl dbl.example.org:1 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.55:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|listed.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.55:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed01|1ef1c203cc576e5d|mx.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the DNS failure policy' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -onDnsFailure tempfail -statsInterval 1h $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.254:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.254:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.255:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.255:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|451 temporary failure checking your IP address, please try again later
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "dnsFailures=1" log
+'
+
+test_run 'test evicting idle sessions' '
+	{ cat <<-EOD && sleep 1 && cat <<-EOF; } | "$FILTER_BIN" $FILTER_OPTS -sessionMaxIdle 100ms $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOF
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00 idle for more than 100ms, evicting it" log &&
+	grep -q "connect request for unknown session 7641df9771b4ed00, proceeding" log
+'
+
+test_run 'test the outage policy' '
+	cat <<-EOD >outage-dns &&
+	*.3.2.1.b.barracudacentral.org SERVFAIL
+	*.3.2.1.bl.spamcop.net SERVFAIL
+	5.7.6.5.b.barracudacentral.org SERVFAIL
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS outage-dns -dnsRetries 0 -onOutage tempfail -statsInterval 1h $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|5.6.7.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|5.6.7.5:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|451 temporary failure checking your IP address, please try again later
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "all DNSBLs are unreachable, applying tempfail policy until they recover" log &&
+	grep -q "DNS lookups for IP address 5.6.7.5 failed, applying proceed policy" log &&
+	grep -q "DNSBLs are reachable again after 0s, failed=1" log &&
+	grep -q "dnsFailures=2 outages=1" log
+'
+
+test_run 'test junking sessions on DNS failures' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -onDnsFailure junk $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.254:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.254:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the unknown score policy' '
+	cat <<-EOD >unknown-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.255:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.255:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.254:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.254:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -onUnknown junk $FILTER_DOMAINS <unknown-input 2>log | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.255 has an unknown score, applying junk policy" log &&
+	"$FILTER_BIN" $FILTER_OPTS -onUnknown tempfail $FILTER_DOMAINS <unknown-input | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|451 unable to assess your IP address, please try again later
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -onUnknown delay -slowFactor 100 -dryRun $FILTER_DOMAINS <unknown-input 2>log >/dev/null &&
+	grep -q "session 7641df9771b4ed00 would proceed after 100ms" log &&
+	"$FILTER_BIN" $FILTER_OPTS -onUnknown block $FILTER_DOMAINS </dev/null 2>/dev/null; [ "$?" -eq 1 ]
+'
+
+test_run 'test scripted DNS answers' '
+	cat <<-EOD >dns &&
+	# 1.2.3.4 is only on the first list, 1.2.3.5 on all lists
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net NXDOMAIN
+	5.3.2.1.bl.spamcop.net 127.0.0.2 127.0.0.3
+	*.b.barracudacentral.org 127.0.0.2
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -blockAbove 80 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test lookups scripted per list in test mode' '
+	# lists in alphabetical order: b.barracudacentral.org, bl.spamcop.net,
+	# list.dnswl.org
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -dnsRetries 0 -blockAbove 50 -onOutage tempfail -dnswl list.dnswl.org:10 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|99.1.0.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|99.1.0.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|99.6.0.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|99.6.0.1:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|99.1.2.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|99.1.2.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|99.3.3.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|99.3.3.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed04|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|451 temporary failure checking your IP address, please try again later
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "addr=99.1.0.2 score=60 lists=b.barracudacentral.org" log &&
+	grep -q "addr=99.6.0.1 score=30 lists=bl.spamcop.net" log &&
+	grep -q "addr=99.1.2.4 score=60 lists=b.barracudacentral.org" log &&
+	grep -q "addr=99.3.3.2 score=-1" log &&
+	grep -q "addr=1.2.3.4 score=4" log
+'
+
+test_run 'test warming the cache from a feed' '
+	cat <<-EOD >warmup-dns &&
+	*.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net NXDOMAIN
+	EOD
+	cat <<-EOD >warmup &&
+	# expected senders
+	1.2.3.5 1200
+	2001:db8::1
+	not an address
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS warmup-dns -logLevel debug -warmup warmup $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "warmed the lookup cache with 1 addresses from warmup" log &&
+	grep -q "skipped 2 lines without an IPv4 address" log &&
+	grep -q "query 5.3.2.1.b.barracudacentral.org: addrs=\[127.0.0.2\] (cached)" log &&
+	grep -q "query 5.3.2.1.bl.spamcop.net: addrs=\[\] (cached)" log &&
+	"$FILTER_BIN" $FILTER_OPTS -warmup warmup -warmupInterval -1s $FILTER_DOMAINS </dev/null 2>log; [ "$?" -eq 1 ] &&
+	grep -q "invalid warmup interval" log
+'
+
+test_run 'test listing reasons from TXT records' '
+	cat <<-EOD >reason-dns &&
+	*.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net 127.0.0.2
+	*.bl.spamcop.net TXT Blocked - see https://www.spamcop.net/bl.shtml?1.2.3.5
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS reason-dns -blockAbove 80 -lookupTXT -blockMessage "blocked, {reasons}" -decisionLog reason-decisions $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 blocked, bl.spamcop.net: Blocked - see https://www.spamcop.net/bl.shtml?1.2.3.5
+	EOD
+	test_cmp actual expected &&
+	grep -q "reasons=\"bl.spamcop.net: Blocked - see https://www.spamcop.net/bl.shtml?1.2.3.5\"" reason-decisions
+'
+
+test_run 'test checking the own addresses' '
+	cat <<-EOD >self-dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	4.3.2.1.bl.spamcop.net 127.0.0.2
+	4.3.2.1.bl.spamcop.net TXT Listed, see https://www.spamcop.net/bl.shtml?1.2.3.4
+	*.extra.example.net SERVFAIL
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS self-dns -check -selfIP 5.6.7.8 $FILTER_DOMAINS 2>log; [ "$?" -eq 0 ] &&
+	grep -q "own IP addresses 5.6.7.8 are not listed" log &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS self-dns -dnsRetries 0 -check -selfIP 5.6.7.8 -selfZone extra.example.net $FILTER_DOMAINS 2>log; [ "$?" -eq 2 ] &&
+	grep -q "unable to check own IP address 5.6.7.8 on extra.example.net" log &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS self-dns -lookupTXT -check -selfIP 1.2.3.4 -selfIP 5.6.7.8 $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	grep -q "own IP address 1.2.3.4 is listed on b.barracudacentral.org$" log &&
+	grep -q "own IP address 1.2.3.4 is listed on bl.spamcop.net: Listed, see https://www.spamcop.net/bl.shtml?1.2.3.4" log &&
+	! grep -q "own IP address 5.6.7.8 is listed" log &&
+	{ echo "config|ready"; sleep 1; } | "$FILTER_BIN" $FILTER_OPTS -fakeDNS self-dns -selfIP 1.2.3.4 $FILTER_DOMAINS 2>log >/dev/null &&
+	grep -q "own IP address 1.2.3.4 is listed on b.barracudacentral.org$" log
+'
+
+test_run 'test looking up a single address' '
+	cat <<-EOD >lookup-dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	4.3.2.1.b.barracudacentral.org TXT Listed, see https://www.barracudacentral.org/lookups
+	*.bl.spamcop.net NXDOMAIN
+	*.list.dnswl.org NXDOMAIN
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS lookup-dns -lookupTXT -lookup 1.2.3.4 -dnswl list.dnswl.org:10 $FILTER_DOMAINS >actual; [ "$?" -eq 0 ] &&
+	cat <<-EOD >expected &&
+	b.barracudacentral.org weight=60: listed 127.0.0.2 (Listed, see https://www.barracudacentral.org/lookups)
+	bl.spamcop.net weight=40: not listed
+	list.dnswl.org dnswl weight=10: not listed
+	score=60 lists=b.barracudacentral.org
+	decision: proceed
+	EOD
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS lookup-dns -blockAbove 50 -lookup 1.2.3.4 $FILTER_DOMAINS >actual; [ "$?" -eq 1 ] &&
+	grep -q "^decision: disconnect|550 your IP reputation is too low for this MX at connect$" actual &&
+	"$FILTER_BIN" $FILTER_OPTS -lookup 1.2.3 $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	grep -q "invalid IP address for -lookup: 1.2.3" log
+'
+
+command -v python3 >/dev/null && test_run 'test webhook notifications' '
+	cat <<-EOD >webhook.py &&
+	import http.server
+	class Handler(http.server.BaseHTTPRequestHandler):
+	    failed = False
+	    def do_POST(self):
+	        body = self.rfile.read(int(self.headers["Content-Length"]))
+	        if not Handler.failed:
+	            Handler.failed = True
+	            self.send_response(503)
+	        else:
+	            open("webhook-events", "ab").write(body + b"\n")
+	            self.send_response(200)
+	        self.end_headers()
+	    def log_message(self, *args):
+	        pass
+	server = http.server.HTTPServer(("127.0.0.1", 0), Handler)
+	open("webhook-port", "w").write(str(server.server_port))
+	server.serve_forever()
+	EOD
+	rm -f webhook-port webhook-events &&
+	{ python3 webhook.py & } &&
+	pid=$! &&
+	sleep 1 &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -webhook "http://127.0.0.1:$(cat webhook-port)/hook" -webhookInterval 100ms $FILTER_DOMAINS >/dev/null 2>log &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	EOD
+	kill $pid &&
+	grep -q "\"event\":\"block\"" webhook-events &&
+	grep -q "\"message\":\"550 your IP reputation is too low for this MX\"" webhook-events &&
+	grep -q "\"ip\":\"1.2.3.60\"" webhook-events &&
+	! grep -q "1.2.3.20" webhook-events
+'
+
+test_run 'test learning list weights' '
+	cat <<-EOD >learn-dns &&
+	*.noisy.example.net 127.0.0.2
+	99.3.2.1.other.example.net 127.0.0.2
+	EOD
+	echo "config|ready" >learn-input &&
+	for i in 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20; do
+		cat <<-EOD >>learn-input
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed$i||pass|1.2.3.$i:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed$i|1ef1c203cc576e5d||pass|1.2.3.$i:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed$i
+		EOD
+	done &&
+	cat <<-EOD >>learn-input &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.99:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.99:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS learn-dns -blockAbove 50 noisy.example.net:40 other.example.net:40 <learn-input | sed "0,/^register|ready/d" | grep 7641df9771b4ed00 >actual &&
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX" >expected &&
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS learn-dns -blockAbove 50 -learnWeights noisy.example.net:40 other.example.net:40 <learn-input 2>log | sed "0,/^register|ready/d" | grep 7641df9771b4ed00 >actual &&
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "confidence in noisy.example.net dropped to 0.24, scaling its weight of 40 to 9.6" log &&
+	! grep -q "confidence in other.example.net" log
+'
+
+test_run 'test local rbldnsd zones' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -localZone private.local=missing-zone private.local:60 >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD >zone &&
+	# private blocklist
+	:127.0.0.2:Listed in the private list
+	1.2.3.1
+	5.6.7.0/24
+	!5.6.7.7
+	8.9.10 :127.0.0.3:listed network
+	11.0.0.10-20
+	*.example.org
+	EOD
+	: >zone-dns &&
+	{
+		cat <<-EOD
+		config|ready
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.1:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|5.6.7.9:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|5.6.7.7:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|8.9.10.5:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|11.0.0.15:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed05||pass|11.0.0.21:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|helo|7641df9771b4ed05|1ef1c203cc576e5d|mx.example.org
+		EOD
+		sleep 0.5
+		echo 11.0.0.21 >>zone
+		sleep 0.5
+		cat <<-EOD
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed06||pass|11.0.0.21:33174|1.1.1.1:25
+		EOD
+	} | "$FILTER_BIN" $FILTER_OPTS -fakeDNS zone-dns -logLevel debug -allowlistWatch 100ms -localZone private.local=zone -localZone rhs.local=zone -rhsbl rhs.local:5 private.local:60 2>log >/dev/null &&
+	grep -q "link-connect addr=1.2.3.1 score=60 lists=private.local" log &&
+	grep -q "link-connect addr=5.6.7.9 score=60 lists=private.local" log &&
+	grep -q "link-connect addr=5.6.7.7 score=0 lists= id=" log &&
+	grep -q "query 5.10.9.8: addrs=\[127.0.0.3\]" log &&
+	grep -q "link-connect addr=11.0.0.15 score=60 lists=private.local" log &&
+	grep -q "link-connect addr=11.0.0.21 score=0 lists= id=" log &&
+	grep -q "mx.example.org is listed on rhs.local, score=5" log &&
+	grep -q "zone: loaded 7 entries" log &&
+	grep -q "link-connect addr=11.0.0.21 score=60 lists=private.local" log
+'
+
+test_run 'test scripted DNS failures' '
+	cat <<-EOD >dns &&
+	*.b.barracudacentral.org SERVFAIL
+	*.bl.spamcop.net TIMEOUT
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -dnsRetries 1 -dnsRetryDelay 1ms -onDnsFailure junk $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected &&
+	grep -q "score=-1" log
+'
+
+test_run 'test per-list timeouts' '
+	cat <<-EOD >dns &&
+	*.slow.example.net HANG
+	*.fast.example.net 127.0.0.2
+	EOD
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -scoreTimeout 500ms slow.example.net:40:100ms fast.example.net:60 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "link-connect addr=1.2.3.4 score=60 lists=fast.example.net" log &&
+	! grep -q "timed out" log
+'
+
+test_run 'test skipping lookups above the block threshold' '
+	cat <<-EOD >dns &&
+	*.slow.example.net HANG
+	*.fast.example.net 127.0.0.2
+	EOD
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -lookupTimeout 10s -scoreTimeout 10s -blockAbove 50 slow.example.net:40 fast.example.net:60 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX" >expected &&
+	test_cmp actual expected &&
+	grep -q "link-connect addr=1.2.3.4 score=60 lists=fast.example.net" log
+'
+
+test_run 'test per-list timeouts in the configuration file' '
+	printf "[lists.a]\nweight = 40\ntimeout = 5\n" >config &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	echo "*.slow.example.net HANG" >dns &&
+	cat <<-EOD >config &&
+	[lists."slow.example.net"]
+	weight = 40
+	timeout = "100ms"
+	EOD
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -scoreTimeout 500ms -config config 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	grep -q "link-connect addr=1.2.3.4 score=-1" log &&
+	! grep -q "timed out" log
+'
+
+test_run 'test cancelling lookups on disconnect' '
+	echo "*.slow.example.net HANG" >dns &&
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -scoreTimeout 10s slow.example.net:40 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	EOD
+	grep -q "link-connect addr=1.2.3.4" log &&
+	! grep -q "DNS lookups for IP address 1.2.3.4 failed" log
+'
+
+test_run 'test sharing lookups with a session that goes away' '
+	echo "*.slow.example.net DELAY 1s 127.0.0.2" >dns &&
+	cat <<-EOD >first &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.4:33175|1.1.1.1:25
+	EOD
+	cat <<-EOD >second &&
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.4:33175|1.1.1.1:25
+	EOD
+	{ cat first; sleep 0.3; cat second; sleep 2; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -scoreTimeout 10s slow.example.net:60 2>log >/dev/null &&
+	grep -q "link-connect addr=1.2.3.4 score=60 lists=slow.example.net" log &&
+	! grep -q "DNS lookups for IP address 1.2.3.4 failed" log
+'
+
+test_run 'test serving other sessions during slow RHSBL lookups' '
+	echo "*.slow.example.net DELAY 1s 127.0.0.2" >dns &&
+	cat <<-EOD >first &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|mail.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >second &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	EOD
+	{ cat first; sleep 0.3; cat second; sleep 2; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -blockAbove 50 -blockPhase mail-from -rhsbl slow.example.net:60 bl.example.org:10 2>/dev/null | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test scoring messages after slow URIBL lookups' '
+	echo "*.slow.example.net DELAY 500ms 127.0.0.2" >dns &&
+	cat <<-EOD | { cat; sleep 2; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -uribl slow.example.net:20 -messageRejectAbove 10 bl.example.org:10 2>/dev/null | grep "^filter-result" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.example.com/offer
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 message contains blocklisted URLs
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test keeping the lookup cache across restarts' '
+	rm -f cache &&
+	echo "4.3.2.1.b.barracudacentral.org 127.0.0.2" >dns &&
+	cat <<-EOD >input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -cacheFile cache $FILTER_DOMAINS <input 2>log >/dev/null &&
+	grep -q "score=60 lists=b.barracudacentral.org" log &&
+	grep -q "^4.3.2.1.b.barracudacentral.org	[0-9]*	127.0.0.2$" cache &&
+	grep -q "^4.3.2.1.bl.spamcop.net	[0-9]*	$" cache &&
+	: >dns &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -cacheFile cache $FILTER_DOMAINS <input 2>log >/dev/null &&
+	grep -q "score=60 lists=b.barracudacentral.org" log
+'
+
+test_run 'test an unavailable shared cache' '
+	echo "4.3.2.1.b.barracudacentral.org 127.0.0.2" >dns &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -sharedCache redis://127.0.0.1:1 $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	grep -q "score=60 lists=b.barracudacentral.org" log &&
+	[ "$(grep -c "shared cache at 127.0.0.1:1 is unavailable" log)" -eq 1 ] &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -sharedCache memcached://127.0.0.1:1 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test an invalid cache refresh threshold' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -cacheRefresh -1 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test an invalid DNS script' '
+	echo "4.3.2.1.bl.spamcop.net 127.0.0" >dns &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test query templates' '
+	cat <<-EOD >dns &&
+	4.3.2.1.key123.dnsbl.example.com 127.0.0.2
+	1.2.3.4.forward.example.org 127.0.0.2
+	listed.example.com.names.example.net 127.0.0.2
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -rhsbl "dbl.{name}.names.example.net:1" -rhsbl "{name}.names.example.net:2" "{revip}.key123.dnsbl.example.com:60" "{ip}.forward.example.org:40" 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|listed.example.com
+	EOD
+	grep -q "score=100 lists={ip}.forward.example.org,{revip}.key123.dnsbl.example.com" log &&
+	grep -q "listed.example.com is listed on {name}.names.example.net, score=102" log
+'
+
+test_run 'test an invalid query template' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS "{addr}.dnsbl.example.com:60" >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test list keys' '
+	cat <<-EOD >dns &&
+	4.3.2.1.s3cr3t.zen.dq.example.net 127.0.0.2
+	listed.example.com.s3cr3t.dbl.dq.example.net 127.0.0.2
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -logLevel debug -listKey zen.dq.example.net=s3cr3t -listKey "{name}.{key}.dbl.dq.example.net=s3cr3t" -rhsbl "{name}.{key}.dbl.dq.example.net:2" zen.dq.example.net:100 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|listed.example.com
+	EOD
+	grep -q "score=100 lists=zen.dq.example.net" log &&
+	grep -q "listed.example.com is listed on {name}.{key}.dbl.dq.example.net, score=102" log &&
+	grep -q "query 4.3.2.1.<redacted>.zen.dq.example.net" log &&
+	! grep -q s3cr3t log
+'
+
+test_run 'test invalid list keys' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listKey zen.dq.example.net=s3cr3t $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS "{revip}.{key}.zen.dq.example.net:100" >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listKey zen.dq.example.net=s3.cr3t zen.dq.example.net:100 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	! grep -q s3.cr3t log
+'
+
+test_run 'test refused queries' '
+	echo "*.zen.dq.example.net 127.255.255.254" >dns &&
+	cat <<-EOD | "$FILTER_BIN" -fakeDNS dns -listCheck strict zen.dq.example.net:100 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "unable to check blocklist zen.dq.example.net: query refused by list" log &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -onDnsFailure junk zen.dq.example.net:100 | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk" >expected &&
+	test_cmp actual expected
+'
+
+test_run 'test public resolvers' '
+	cat <<-EOD | "$FILTER_BIN" -listCheck strict -dot 8.8.8.8 $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "public resolver 8.8.8.8" log &&
+	cat <<-EOD | "$FILTER_BIN" -listCheck strict -doh https://dns.google/dns-query $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "public resolver dns.google" log
+'
+
+test_run 'test fractional weights and thresholds' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 2.25 -blockPhase mail-from -rhsbl dbl.example.org:0.5 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|listed.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed01|1ef1c203cc576e5d|mx.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "disconnect after 0ms (score=2.5 lists=dbl.example.org id=00000001)" log
+'
+
+test_run 'test DBL hits on the sender domain' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase rcpt-to -dbl dbl.example.org:20 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|<user@listed.example.com>
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|<user@listed.example.com>
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test URIBL hits in messages' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -uribl uribl.example.org:20 -messageRejectAbove 10 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.listed.com/offer
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.example.com/
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.listed.co.uk/offer
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.listed.com/offer
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 message contains blocklisted URLs
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.example.com/
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|see https://www.listed.co.uk/offer
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 message contains blocklisted URLs
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test EBL hits in message headers' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -ebl ebl.example.org:20 -messageJunkAbove 10 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Reply-To: Dropbox <LISTED@example.net>
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com,
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|	Support <listed@example.org>
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Reply-To: Dropbox <LISTED@example.net>
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com,
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|	Support <listed@example.org>
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test reverse DNS penalties' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -noRdnsScore 20 -fcrdnsScore 10 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||fail|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||fail|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01|mx.example.com|fail|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d|mx.example.com|fail|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02|mx.example.com|pass|1.2.3.45:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d|mx.example.com|pass|1.2.3.45:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test dynamic reverse DNS penalty' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -dynamicRdnsScore 20 -dynamicPattern "^home[0-9]+[.]" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00|dsl-1-2-3-40.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d|dsl-1-2-3-40.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01|home42.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d|home42.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02|mx.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d|mx.example.net|pass|1.2.3.40:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test HELO forgery penalty' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -heloForgeryScore 20 -localHostnames mx.example.org,mail.example.org $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed00|1ef1c203cc576e5d|MX.example.org.
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed01|1ef1c203cc576e5d|[1.1.1.1]
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed02|1ef1c203cc576e5d|bot
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed02|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed03|1ef1c203cc576e5d|client.example.net
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed03|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed04|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed04|1ef1c203cc576e5d|[1.2.3.40]
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed04|1ef1c203cc576e5d|root@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test requiring STARTTLS' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 80 -requireTLSAbove 30 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	filter|0.5|0|smtp-in|starttls|7641df9771b4ed00|1ef1c203cc576e5d|tls
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|530 5.7.0 must issue a STARTTLS command first
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test scoring TLS properties' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -junkAbove 30 -junkPhase mail-from -tlsBonus 10 -weakTLSPenalty 20 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.35:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.35:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-tls|7641df9771b4ed00|TLSv1.3:TLS_AES_256_GCM_SHA384:256
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.25:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.25:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-tls|7641df9771b4ed01|TLSv1:ECDHE-RSA-DES-CBC3-SHA:112
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.35:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.35:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed02|1ef1c203cc576e5d|root@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00 negotiated TLSv1.3, subtracting 10" log &&
+	grep -q "session 7641df9771b4ed01 negotiated weak TLS (TLSv1 ECDHE-RSA-DES-CBC3-SHA), adding 20" log
+'
+
+test_run 'test message limit' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -messageLimit 1 -messageLimitAbove 30 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d
+	report|0.5|0|smtp-in|tx-commit|7641df9771b4ed00|1ef1c203|1024
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed01|1ef1c203cc576e5d
+	report|0.5|0|smtp-in|tx-commit|7641df9771b4ed01|1ef1c203|1024
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|451 too many messages in this session, please try again later
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test size limit' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -sizeLimit 20 -sizeLimitAbove 30 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|0123456789
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|more
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed01|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|0123456789
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed01|1ef1c203cc576e5d
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|552 5.3.4 message too big for your IP reputation
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|0123456789
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -sizeLimit 20 -sizeLimitAbove 30 -sizeLimitAction disconnect $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|0123456789
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|552 5.3.4 message too big for your IP reputation
+	EOD
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -sizeLimitAction foo $FILTER_DOMAINS </dev/null; [ "$?" -eq 1 ]
+'
+
+test_run 'test quarantine' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -quarantineAbove 30 -quarantineAddress quarantine@example.org $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|postmaster@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed01|1ef1c203cc576e5d|root@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|rewrite|quarantine@example.org
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -quarantineAbove 30 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test with invalid block phase in list' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase connect,data-line $FILTER_DOMAINS; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
 test_run 'test with invalid block phase: data-line' '
 	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase data-line $FILTER_DOMAINS; [ "$?" -eq 1 ]
 	config|ready
@@ -116,4 +1174,713 @@ test_run 'test with invalid block phase: data-line' '
 	EOD
 '
 
+test_run 'test tempfailAbove' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 80 -tempfailAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.90:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.90:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|451 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test rejectAbove' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 80 -rejectAbove 50 -blockPhase rcpt-to $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|postmaster@localhost
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test per-phase thresholds' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove connect=80 -rejectAbove rcpt-to=50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.90:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.90:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test with invalid per-phase threshold' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove data-line=50 $FILTER_DOMAINS; [ "$?" -eq 2 ]
+	config|ready
+	EOD
+'
+
+test_run 'test invalid domain weight' '
+	"$FILTER_BIN" $FILTER_OPTS bl.spamcop.net:4O </dev/null 2>log; [ "$?" -eq 1 ] &&
+	grep -q "invalid weight for domain \"bl.spamcop.net\": 4O" log
+'
+
+test_run 'test recipient limit' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -recipientLimit 1 -recipientLimitAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed00|1ef1c203
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	report|0.5|0|smtp-in|tx-rcpt|7641df9771b4ed00|1ef1c203|ok|root@localhost
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|postmaster@localhost
+	report|0.5|0|smtp-in|tx-rcpt|7641df9771b4ed00|1ef1c203|tempfail|postmaster@localhost
+	report|0.5|0|smtp-in|tx-commit|7641df9771b4ed00|1ef1c203|1024
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed00|2ef1c203
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|postmaster@localhost
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed01|3ef1c203
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed01|1ef1c203cc576e5d|root@localhost
+	report|0.5|0|smtp-in|tx-rcpt|7641df9771b4ed01|3ef1c203|ok|root@localhost
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed01|1ef1c203cc576e5d|postmaster@localhost
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|452 too many recipients
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test rejection message template' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockMessage "score {score} for {ip} on {lists}, see {url}" -blockURL "https://example.com/?ip={ip}" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 score 60 for 1.2.3.60 on none, see https://example.com/?ip=1.2.3.60
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test decision IDs' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockMessage "blocked, quote {id} at {url}" -blockURL "https://example.com/?id={id}" -scoreHeader -headerDetails id -decisionLog id-decisions $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 blocked, quote 00000001 at https://example.com/?id=00000001
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|X-DNSBL-Score: 20 id=00000002
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected &&
+	grep -q "link-connect addr=1.2.3.60 score=60 lists= id=00000001" log &&
+	grep -q "session 7641df9771b4ed00: disconnect after 0ms (score=60 lists= id=00000001)" log &&
+	grep -q "decision=disconnect delay=0 id=00000001 ip=1.2.3.60" id-decisions
+'
+
+test_run 'test disclosing details in rejection messages' '
+	cat <<-EOD >disclose-dns &&
+	*.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net 127.0.0.2
+	*.bl.spamcop.net TXT Blocked - see https://www.spamcop.net/bl.shtml
+	EOD
+	cat <<-EOD >disclose-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	EOD
+	for level in none score full; do
+		"$FILTER_BIN" $FILTER_OPTS -fakeDNS disclose-dns -blockAbove 80 -lookupTXT -disclose $level -blockMessage "blocked by {lists}" $FILTER_DOMAINS <disclose-input | sed "0,/^register|ready/d"
+	done >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 policy rejection
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 blocked by withheld (score 100)
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 blocked by b.barracudacentral.org,bl.spamcop.net (score 100, listed on b.barracudacentral.org,bl.spamcop.net; bl.spamcop.net: Blocked - see https://www.spamcop.net/bl.shtml)
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test failing blocked sessions fast' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -slowFactor 1000 -blockDelay 10 -dryRun $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|1ef1c203cc576e5d|mail.example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	! grep -q "session 7641df9771b4ed00 would proceed" log &&
+	grep -q "session 7641df9771b4ed00 would disconnect after 10ms (score=60" log &&
+	grep -q "session 7641df9771b4ed01 would proceed after 300ms (score=30" log &&
+	"$FILTER_BIN" $FILTER_OPTS -blockDelay -2 $FILTER_DOMAINS </dev/null 2>log; [ "$?" -eq 1 ] &&
+	grep -q "invalid block delay" log
+'
+
+test_run 'test dry run' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -slowFactor 1000 -dryRun $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00 would disconnect after 600ms (score=60" log
+'
+
+test_run 'test delay with the maximum aggregation' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -aggregate max -slowFactor 1000 -dryRun $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	grep -q "proceed after 500ms (score=30" log
+'
+
+test_run 'test sampling' '
+	echo 1.2.3.70 >sample-blocklist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -sampleRate 0 -blocklist sample-blocklist $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.70:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.70:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.60 is not sampled" log &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -sampleRate 101 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test disabled lists' '
+	cat <<-EOD >disable-dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	4.3.2.1.bl.spamcop.net 127.0.0.2
+	EOD
+	cat <<-EOD >disable-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS disable-dns -slowFactor 1000 -dryRun $FILTER_DOMAINS <disable-input 2>log >/dev/null &&
+	grep -q "proceed after 1000ms (score=100 " log &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS disable-dns -slowFactor 1000 -dryRun -disableList bl.spamcop.net $FILTER_DOMAINS <disable-input 2>log >/dev/null &&
+	grep -q "proceed after 1000ms (score=60 " log &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -disableList unknown.example $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test maximum delay' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -slowFactor 100000 -slowJitter 30 -maxDelay 500 -dryRun $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	grep -q "session 7641df9771b4ed00 would disconnect after 500ms" log
+'
+
+test_run 'test delay growth' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -slowFactor 100 -slowGrowth 100 -maxDelay 100 -dryRun $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|1ef1c203cc576e5d|example.com
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	EOD
+	grep -o "proceed after [0-9]*ms" log >actual &&
+	cat <<-EOD >expected &&
+	proceed after 60ms
+	proceed after 100ms
+	proceed after 100ms
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test banner delay' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -slowFactor 100 -bannerDelay -dryRun $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|1ef1c203cc576e5d|example.com
+	EOD
+	grep -o "proceed after [0-9]*ms" log >actual &&
+	cat <<-EOD >expected &&
+	proceed after 60ms
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test stats summary' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -junkAbove 10 -rhsbl rhsbl.example:10 -statsInterval 1h $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|ehlo|7641df9771b4ed01|1ef1c203cc576e5d|listed.example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.255:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.255:33174|1.1.1.1:25
+	EOD
+	grep "^stats " log >actual &&
+	cat <<-EOD >expected &&
+	stats connections=3 sessions=3 blocked=1 junked=1 dnsFailures=0 outages=0 unknown=1 avgScore=40.0 tarpitted=0s wasted=0s avgBlockDelay=0s hits=rhsbl.example:1
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test connection rates' '
+	cat <<-EOD >connrate-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.41:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.41:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|5.6.7.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed04|1ef1c203cc576e5d||pass|5.6.7.40:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -blockAbove 45 -connRate 2 -connRatePrefix 24 $FILTER_DOMAINS <connrate-input 2>log | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.42: more than 2 connections from 1.2.3.0/24 within 1m0s, adding 10" log &&
+	"$FILTER_BIN" $FILTER_OPTS -blockAbove 45 -connRate 2 -connRateAction tempfail $FILTER_DOMAINS <connrate-input | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -blockAbove 45 -connRate 2 -connRatePrefix 24 -connRateAction tempfail $FILTER_DOMAINS <connrate-input | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|451 too many connections from your network, please try again later
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -connRateAction drop $FILTER_DOMAINS </dev/null 2>/dev/null; [ "$?" -eq 1 ]
+'
+
+test_run 'test dropping the delayed answers of disconnected sessions' '
+	cat <<-EOD >cancel-dns &&
+	*.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net 127.0.0.2
+	EOD
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -fakeDNS cancel-dns -slowFactor 600000 -logLevel debug $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00 disconnected, dropping 1 pending answers" log
+'
+
+test_run 'test list groups' '
+	cat <<-EOD >group-dns &&
+	*.b.barracudacentral.org 127.0.0.2
+	*.mirror.example.net 127.0.0.2
+	*.bl.spamcop.net NXDOMAIN
+	EOD
+	cat <<-EOD >group-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS group-dns -blockAbove 80 $FILTER_DOMAINS mirror.example.net:60 <group-input 2>log | sed "0,/^register|ready/d" >actual &&
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX" >expected &&
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS group-dns -blockAbove 80 -listGroup barracuda=b.barracudacentral.org,mirror.example.net $FILTER_DOMAINS mirror.example.net:60 <group-input 2>log | sed "0,/^register|ready/d" >actual &&
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "link-connect addr=1.2.3.4 score=60 lists=b.barracudacentral.org,mirror.example.net" log &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS group-dns -blockAbove 50 -minLists 2 -listGroup barracuda=b.barracudacentral.org,mirror.example.net $FILTER_DOMAINS mirror.example.net:60 <group-input 2>/dev/null | sed "0,/^register|ready/d" >actual &&
+	test_cmp actual expected &&
+	"$FILTER_BIN" $FILTER_OPTS -listGroup barracuda=b.barracudacentral.org,zen.spamhaus.org $FILTER_DOMAINS </dev/null 2>/dev/null; [ "$?" -eq 1 ]
+'
+
+test_run 'test neighborhood penalties' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 70 -neighborhoodCount 2 -neighborhoodPenalty 40 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.61:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|5.6.7.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|5.6.7.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed04|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed04|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.40: 2 other addresses of 1.2.3.0/24 scored above 50 within 1h0m0s, adding 40" log &&
+	"$FILTER_BIN" $FILTER_OPTS -neighborhoodPrefix 33 $FILTER_DOMAINS </dev/null 2>/dev/null; [ "$?" -eq 1 ]
+'
+
+test_run 'test tarpit accounting' '
+	echo "*.b.barracudacentral.org 127.0.0.2" >tarpit-dns &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS tarpit-dns -blockAbove 50 -slowFactor 50 -statsInterval 1h b.barracudacentral.org:60 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.61:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed01
+	EOD
+	grep -q "^stats connections=2 sessions=0 blocked=2 .* tarpitted=100ms wasted=1[0-9][0-9]ms avgBlockDelay=50ms " log
+'
+
+test_run 'test stats per list' '
+	cat <<-EOD >dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	*.b.barracudacentral.org NXDOMAIN
+	*.bl.spamcop.net SERVFAIL
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -dnsRetries 0 -statsInterval 1h $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.6:33174|1.1.1.1:25
+	EOD
+	grep "^stats list=" log | sed "s/ p50=.*//" >actual &&
+	cat <<-EOD >expected &&
+	stats list=b.barracudacentral.org queries=4 hitRate=50.0% failures=0 limited=0
+	stats list=bl.spamcop.net queries=4 hitRate=0.0% failures=4 limited=0
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test list limits' '
+	cat <<-EOD >limit-dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	*.b.barracudacentral.org NXDOMAIN
+	*.bl.spamcop.net NXDOMAIN
+	EOD
+	cat <<-EOD >limit-input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.6:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS limit-dns -statsInterval 1h -listLimit b.barracudacentral.org=2/d $FILTER_DOMAINS <limit-input 2>log >/dev/null &&
+	grep "^stats list=" log | sed "s/ p50=.*//" >actual &&
+	"$FILTER_BIN" $FILTER_OPTS -fakeDNS limit-dns -statsInterval 1h -listLimit b.barracudacentral.org=2/d -listLimitAction skip $FILTER_DOMAINS <limit-input 2>log >/dev/null &&
+	grep "^stats list=" log | sed "s/ p50=.*//" >>actual &&
+	cat <<-EOD >expected &&
+	stats list=b.barracudacentral.org queries=3 hitRate=66.7% failures=0 limited=1
+	stats list=bl.spamcop.net queries=4 hitRate=0.0% failures=0 limited=0
+	stats list=b.barracudacentral.org queries=2 hitRate=50.0% failures=0 limited=2
+	stats list=bl.spamcop.net queries=4 hitRate=0.0% failures=0 limited=0
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test invalid list limits' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listLimit b.barracudacentral.org=2/h $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listLimit unknown.example=2/d $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listLimitAction drop $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test JSON logging' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -logFormat json $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	grep -q "^{\"decision\":\"disconnect\",\"delay\":0,\"id\":\"00000001\",\"ip\":\"1.2.3.60\",\"level\":\"error\",\"lists\":\[\],\"msg\":\"[^\"]*\",\"phase\":\"connect\",\"score\":60,\"session\":\"7641df9771b4ed00\"," log
+'
+
+test_run 'test log level' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -logLevel error $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	session 7641df9771b4ed00: disconnect after 0ms (score=60 lists= id=00000001)
+	EOD
+	test_cmp log expected
+'
+
+test_run 'test decision log' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -junkAbove 10 -decisionLog decisions $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	EOD
+	cut -d" " -f2- decisions >actual &&
+	cat <<-EOD >expected &&
+	decision=disconnect delay=0 id=00000001 ip=1.2.3.60 lists= phase=connect score=60 session=7641df9771b4ed00
+	decision=junk delay=0 id=00000002 ip=1.2.3.20 lists= phase=connect score=20 session=7641df9771b4ed01
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test transaction reports' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -quarantineAbove 30 -quarantineAddress quarantine@example.org -decisionLog tx-decisions $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed00|1ef1c203
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	report|0.5|0|smtp-in|tx-mail|7641df9771b4ed00|1ef1c203|ok|root@example.com
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@example.net
+	report|0.5|0|smtp-in|tx-rcpt|7641df9771b4ed00|1ef1c203|root@example.net|ok
+	report|0.5|0|smtp-in|tx-reset|7641df9771b4ed00|1ef1c203
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|root@example.com
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@example.net
+	EOD
+	cut -d" " -f2- tx-decisions >actual &&
+	cat <<-EOD >expected &&
+	decision=rewrite delay=0 id=00000001 ip=1.2.3.40 lists= msgid=1ef1c203 phase=rcpt-to score=40 session=7641df9771b4ed00
+	decision=rewrite delay=0 id=00000001 ip=1.2.3.40 lists= phase=rcpt-to score=40 session=7641df9771b4ed00
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test decision log rotation' '
+	rm -f decisions &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -decisionLog decisions -decisionLogSize 100 -decisionLogKeep 1 $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.61:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.62:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.62:33174|1.1.1.1:25
+	EOD
+	grep -q "ip=1.2.3.62" decisions &&
+	grep -q "ip=1.2.3.61" decisions.1 &&
+	[ ! -e decisions.2 ]
+'
+
+command -v sqlite3 >/dev/null && test_run 'test decision archive' '
+	echo "*.bl.spamcop.net 127.0.0.2 127.0.0.3" >archive-dns &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -archiveDB archive.db $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	EOD
+	sqlite3 archive.db "INSERT INTO decisions (time, session, action) VALUES (\"2000-01-01 00:00:00\", \"old\", \"proceed\")" &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS archive-dns -blockAbove 50 -archiveDB archive.db $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed01|1ef1c203cc576e5d|mail.example.org
+	EOD
+	sqlite3 archive.db "SELECT d.session, d.ip, d.score, d.action, d.phase, h.list, h.codes FROM decisions d LEFT JOIN hits h ON h.decision = d.id ORDER BY d.id" >actual &&
+	cat <<-EOD >expected &&
+	7641df9771b4ed00|1.2.3.60|40.0|proceed|connect|bl.spamcop.net|127.0.0.2,127.0.0.3
+	7641df9771b4ed01|1.2.3.61|40.0|proceed|connect|bl.spamcop.net|127.0.0.2,127.0.0.3
+	7641df9771b4ed01|1.2.3.61|40.0|proceed|helo|bl.spamcop.net|127.0.0.2,127.0.0.3
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test spamd feed' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -rejectAbove 20 -spamdFeed spamd $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -spamdFeed spamd $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.55:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.55:33174|1.1.1.1:25
+	EOD
+	grep -v "^#" spamd | sed "s/ #.*//" >actual &&
+	cat <<-EOD >expected &&
+	1.2.3.55
+	1.2.3.60
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test external scorer' '
+	printf "#!/bin/sh\ncase \"\$2\" in *.bad) echo 30;; *) echo -10;; esac\n" >scorer &&
+	chmod +x scorer &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -execScorer ./scorer $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00|mx.example.bad|pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d|mx.example.bad|pass|1.2.3.30:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01|mx.example.com|pass|1.2.3.55:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d|mx.example.com|pass|1.2.3.55:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test external scorer timeout' '
+	printf "#!/bin/sh\nsleep 5\necho 30\n" >scorer &&
+	chmod +x scorer &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -execScorer ./scorer -execScorerTimeout 100ms $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test sessions not waiting for the score of others' '
+	printf "#!/bin/sh\nsleep 1\necho 0\n" >scorer &&
+	chmod +x scorer &&
+	{ cat <<-EOD; sleep 2; } | "$FILTER_BIN" -listCheck none -execScorer ./scorer $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|10.0.0.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|10.0.0.1:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test score timeout' '
+	printf "#!/bin/sh\nsleep 1\necho 0\n" >scorer &&
+	chmod +x scorer &&
+	{ cat <<-EOD; sleep 2; } | "$FILTER_BIN" -listCheck none -execScorer ./scorer -scoreTimeout 100ms -onDnsFailure junk $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test delay growth without maximum delay' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -slowFactor 100 -slowGrowth 100 $FILTER_DOMAINS; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test delayed answers at the end of input' '
+	printf "#!/bin/sh\necho 50\n" >scorer &&
+	chmod +x scorer &&
+	start=$(date +%s) &&
+	{ cat <<-EOD; sleep 1; } | "$FILTER_BIN" -listCheck none -execScorer ./scorer -slowFactor 100000 -maxDelay 10000 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	[ $(($(date +%s) - start)) -lt 5 ]
+'
+
+test_run 'test sessions being scored at the end of input' '
+	printf "#!/bin/sh\nsleep 10\necho 0\n" >scorer &&
+	chmod +x scorer &&
+	start=$(date +%s) &&
+	cat <<-EOD | "$FILTER_BIN" -listCheck none -execScorer ./scorer $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	[ $(($(date +%s) - start)) -lt 5 ]
+'
+
+test_run 'test delayed answers on SIGTERM' '
+	printf "#!/bin/sh\necho 50\n" >scorer &&
+	chmod +x scorer
+	{ cat <<-EOD; sleep 5; } | "$FILTER_BIN" -listCheck none -execScorer ./scorer -slowFactor 100000 -maxDelay 10000 $FILTER_DOMAINS >output &
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2a00:1450::1]:33174|1.1.1.1:25
+	EOD
+	sleep 1 &&
+	kill $! &&
+	wait $! &&
+	sed "0,/^register|ready/d" output >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
 test_complete
@@ -16,6 +16,27 @@ test_run 'test the junkBelow parameter with a non-reputable IP address' '
 	test_cmp actual expected
 '
 
+test_run 'test adjusting the junk threshold to a target rate' '
+	echo "config|ready" >tune-input &&
+	for i in 1 2 3 4 5 6 7 8 9 10; do
+		echo "report|0.5|0|smtp-in|link-connect|7641df9771b4ed$i||pass|1.2.3.${i}0:33174|1.1.1.1:25" >>tune-input
+	done &&
+	cat <<-EOD >>tune-input &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.75:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.75:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed11||pass|1.2.3.45:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed11|1ef1c203cc576e5d||pass|1.2.3.45:33174|1.1.1.1:25
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -junkAbove 90 -junkTarget 50 -junkTargetWindow 10 $FILTER_DOMAINS <tune-input 2>log | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed11|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "adjusting junk threshold from 90 to 50, 10.0% of the last 10 scored sessions were above it, target 50%" log &&
+	grep -q "adjusting junk threshold from 50 to 60, 60.0% of the last 10 scored sessions were above it, target 50%" log
+'
+
 test_run 'test the junkBelow parameter with a reputable IP address' '
 	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -junkAbove 1 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
 	config|ready
@@ -28,4 +49,53 @@ test_run 'test the junkBelow parameter with a reputable IP address' '
 	test_cmp actual expected
 '
 
+test_run 'test junk header and subject tagging' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -junkAbove 1 -junkAction=false -junkHeader -junkSubject "[DNSBL]" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: body
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-Spam: yes
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|From: user@example.com
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: [DNSBL] hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: body
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test junk phase: rcpt-to' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -junkAbove 1 -junkPhase rcpt-to $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed01|pass|user
+	filter|0.5|0|smtp-in|rcpt-to|7641df9771b4ed01|1ef1c203cc576e5d|root@localhost
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test with invalid junk phase: data-line' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -junkAbove 1 -junkPhase data-line $FILTER_DOMAINS; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
 test_complete
@@ -19,4 +19,275 @@ test_run 'test the scoreHeader parameter' '
 	test_cmp actual expected
 '
 
+test_run 'test the headerDetails parameter' '
+	cat <<-EOD >dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	4.3.2.1.bl.spamcop.net 127.0.0.4
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -scoreHeader -headerDetails lists,host,version -localHostnames mx1.example.org $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 100 (b.barracudacentral.org=127.0.0.2 bl.spamcop.net=127.0.0.4) by mx1.example.org (filter-dnsblscore unknown)
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerDetails time $FILTER_DOMAINS | grep -Eq "^filter-dataline\|7641df9771b4ed00\|1ef1c203cc576e5d\|X-DNSBL-Score: 42; [A-Z][a-z]{2}, [0-9]{2} [A-Z][a-z]{2} [0-9]{4} [0-9:]{8} [-+][0-9]{4}$" &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -headerDetails lists,date $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test scoring the first untrusted Received hop' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -trustedRelays 1.2.3.0/33 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -junkAbove 50 -trustedRelays 1.2.3.0/24 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" | cut -d"|" -f4- >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.90:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.90:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from backup.example.org (backup.example.org [1.2.3.90])
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d| by mx.example.org
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from spam.example.net (spam.example.net [5.6.7.80]) by backup.example.org
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from forged.example.com ([9.9.9.9]) by spam.example.net
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|body
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD >expected &&
+	proceed
+	proceed
+	X-DNSBL-Score: 80
+	Received: from backup.example.org (backup.example.org [1.2.3.90])
+	 by mx.example.org
+	Received: from spam.example.net (spam.example.net [5.6.7.80]) by backup.example.org
+	Received: from forged.example.com ([9.9.9.9]) by spam.example.net
+	Subject: hello
+
+	body
+	.
+	junk
+	EOD
+	test_cmp actual expected &&
+	grep -q "message relayed by 1.2.3.90 from 5.6.7.80, score=80" log
+'
+
+test_run 'test the headerPosition parameter' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerPosition top $FILTER_DOMAINS | sed "0,/^register|ready/d" | cut -d"|" -f4- >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From sender@example.com Tue Jul  1 12:00:00 2025
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from a
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d| by b
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|body
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	proceed
+	proceed
+	From sender@example.com Tue Jul  1 12:00:00 2025
+	X-DNSBL-Score: 42
+	Received: from a
+	 by b
+	Subject: hello
+	
+	body
+	.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerPosition received $FILTER_DOMAINS | sed "0,/^register|ready/d" | cut -d"|" -f4- >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From sender@example.com Tue Jul  1 12:00:00 2025
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from a
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d| by b
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|body
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	proceed
+	proceed
+	From sender@example.com Tue Jul  1 12:00:00 2025
+	Received: from a
+	 by b
+	X-DNSBL-Score: 42
+	Subject: hello
+	
+	body
+	.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerPosition end $FILTER_DOMAINS | sed "0,/^register|ready/d" | cut -d"|" -f4- >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|From sender@example.com Tue Jul  1 12:00:00 2025
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Received: from a
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d| by b
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|body
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	proceed
+	proceed
+	From sender@example.com Tue Jul  1 12:00:00 2025
+	Received: from a
+	 by b
+	Subject: hello
+	X-DNSBL-Score: 42
+	
+	body
+	.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -headerPosition bottom $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test the headerName and stripHeaders parameters' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerName X-Score -stripHeaders $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|x-score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|	folded
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-Score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-Score: 42
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-Score: 0
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the stripHeaderNames parameter' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -stripHeaders $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Listed : none
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-Spam-Score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 42
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-Spam-Score: 0
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -stripHeaders -stripHeaderNames "x-spam-score, X-DNSBL-Listed" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Listed: none
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|X-Spam-Score: 0
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 0
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -stripHeaders -stripHeaderNames "X-Spam:" $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test the headerAbove parameter' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -scoreHeader -headerAbove 0 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 42
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the listedHeader parameter' '
+	echo 1.2.3.42 >blocklist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -listedHeader -blocklist blocklist -blocklistScore 10 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.43:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.43:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Listed: blocklist
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test the authservID parameter' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -authservID mx.example.org $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.42:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Authentication-Results: mx.example.org; dnsbl=fail (score=42) ip=1.2.3.42
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|Authentication-Results: mx.example.org; dnsbl=pass (score=0) ip=1.2.3.0
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
 test_complete
@@ -26,6 +26,58 @@ test_run 'test IP address allowlisting' '
 	test_cmp actual expected
 '
 
+test_run 'test allowlist aggregation' '
+	cat <<-EOD >aggregate-allowlist &&
+	1.1.1.0/25
+	1.1.1.128/25
+	1.1.1.5
+	3.3.3.3
+	4.4.4.4 # until=2999-12-31
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist aggregate-allowlist $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.200:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.200:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|4.4.4.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|4.4.4.4:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "allowlist: aggregated 4 subnets into 2" log &&
+	grep -q "IP address 1.1.1.200 matches allowlist entry 1.1.1.0/24" log
+'
+
+test_run 'test compiled allowlists' '
+	cat <<-EOD >compile-source &&
+	1.1.1.0/25
+	1.1.1.0/24
+	3.3.3.3
+	2001:db8::/32
+	EOD
+	"$FILTER_BIN" -compile compiled-allowlist compile-source 2>/dev/null &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist compiled-allowlist $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.1:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|2.2.2.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|2.2.2.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|3.3.3.3:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|3.3.3.3:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.1.1.1 matches allowlist entry 1.1.1.0/24" log &&
+	echo mail.example.com >compile-hostnames &&
+	! "$FILTER_BIN" -compile compiled-hostnames compile-hostnames 2>/dev/null
+'
+
 test_run 'test subnet allowlisting' '
 	cat <<-EOD >allowlist &&
 	1.1.0.0/16
@@ -58,4 +110,305 @@ test_run 'test subnet allowlisting' '
 	test_cmp actual expected
 '
 
+test_run 'test hostname allowlisting' '
+	cat <<-EOD >allowlist &&
+	.outbound.example.com
+	mx.example.org
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist allowlist $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00|mail-1.outbound.example.com|pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01|mail-1.outbound.example.com|fail|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02|MX.example.org.|pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03|other.mx.example.org|pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test exemption of special-use addresses' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|10.1.2.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|10.1.2.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|127.0.0.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|127.0.0.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|[fe80::1]:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|[fe80::1]:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test scoring of special-use addresses' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -scoreSpecialUse $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|10.1.2.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|10.1.2.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test IPv6 allowlisting' '
+	cat <<-EOD >allowlist &&
+	2001:db8::/32
+	2001:db9::1
+	1.2.3.0/24
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -scoreHeader -allowlist allowlist $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|[2001:db8:1::1]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|[2001:db8:1::1]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|[2001:db9::1]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|[2001:db9::1]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|[2001:db9::2]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|[2001:db9::2]:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed02|1ef1c203cc576e5d|.
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 0
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|X-DNSBL-Score: 0
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed02|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test multiple allowlists' '
+	echo 1.1.1.1 >exceptions &&
+	echo 3.3.3.0/24 >vendor &&
+	cat <<-EOD >input &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.1:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|2.2.2.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|2.2.2.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|3.3.3.3:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|3.3.3.3:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	"$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist exceptions -allowlist vendor $FILTER_DOMAINS <input | sed "0,/^register|ready/d" >actual &&
+	test_cmp actual expected &&
+	echo "allowlist = [\"exceptions\", \"vendor\"]" >config &&
+	"$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -config config $FILTER_DOMAINS <input | sed "0,/^register|ready/d" >actual &&
+	test_cmp actual expected
+'
+
+test_run 'test reloading changed allowlists' '
+	echo 1.1.1.1 >allowlist &&
+	{
+		cat <<-EOD
+		config|ready
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|2.2.2.2:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|2.2.2.2:33174|1.1.1.1:25
+		EOD
+		sleep 0.5
+		echo 2.2.2.0/24 >allowlist
+		sleep 0.5
+		cat <<-EOD
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|2.2.2.2:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|2.2.2.2:33174|1.1.1.1:25
+		EOD
+	} | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist allowlist -allowlistWatch 100ms $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "allowlist and blocklist reloaded" log
+'
+
+test_run 'test expiring allowlist entries' '
+	cat <<-EOD >allowlist &&
+	1.1.1.1 # until=2000-01-01
+	2.2.2.2 # granted during incident 42, until=2999-12-31
+	3.3.3.3 # until=$(date -u -d "+1 second" +%Y-%m-%dT%H:%M:%SZ)
+	EOD
+	{
+		cat <<-EOD
+		config|ready
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.1:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.1:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|2.2.2.2:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|2.2.2.2:33174|1.1.1.1:25
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|3.3.3.3:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|3.3.3.3:33174|1.1.1.1:25
+		EOD
+		sleep 2
+		cat <<-EOD
+		report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|3.3.3.3:33174|1.1.1.1:25
+		filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|3.3.3.3:33174|1.1.1.1:25
+		EOD
+	} | "$FILTER_BIN" $FILTER_OPTS -blockAbove 0 -allowlist allowlist $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test an invalid allowlist expiry' '
+	echo "1.1.1.1 # until=tomorrow" >allowlist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -allowlist allowlist $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "invalid expiry \"tomorrow\" for entry 1.1.1.1" log
+'
+
+test_run 'test allowlisting authenticated IP addresses' '
+	rm -f authdb &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -authAllowDuration 24h -authAllowDB authdb $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|pass|user
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-disconnect|7641df9771b4ed00
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.61:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed02|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	grep -q "^1.2.3.60	" authdb &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -authAllowDuration 24h -authAllowDB authdb $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.60 authenticated successfully before" log
+'
+
+test_run 'test attributing allowlist matches to their entries' '
+	cat <<-EOD >entry-allowlist &&
+	# aggregated into 1.1.1.0/24
+	1.1.1.0/25
+	1.1.1.128/25
+	3.3.3.3
+	EOD
+	echo 5.5.5.0/24 >entry-blocklist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -allowlist entry-allowlist -blocklist entry-blocklist -decisionLog entry-decisions $FILTER_DOMAINS 2>log >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.200:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.200:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|5.5.5.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|5.5.5.5:33174|1.1.1.1:25
+	EOD
+	grep -q "IP address 1.1.1.200 matches allowlist entry 1.1.1.0/24 (1.1.1.128/25 at entry-allowlist:3)" log &&
+	grep -q "IP address 5.5.5.5 matches blocklist entry 5.5.5.0/24 at entry-blocklist:1" log &&
+	grep -q "decision=allow entry=1.1.1.128/25 id=[0-9]* ip=1.1.1.200 .*source=entry-allowlist:3" entry-decisions &&
+	grep -q "decision=disconnect .*entry=5.5.5.0/24 id=[0-9]* ip=5.5.5.5 .*source=entry-blocklist:1" entry-decisions
+'
+
+command -v python3 >/dev/null && test_run 'test allowlist entry statistics' '
+	cat <<-EOD >stats-allowlist &&
+	1.1.1.0/25
+	1.1.1.128/25
+	3.3.3.3
+	EOD
+	cat <<-EOD >control.py &&
+	import socket, sys, time
+	for _ in range(50):
+	    try:
+	        s = socket.socket(socket.AF_UNIX)
+	        s.connect(sys.argv[1])
+	        break
+	    except OSError:
+	        time.sleep(0.1)
+	s.sendall(b"stats allowlist\n")
+	print(s.makefile().readline().strip())
+	EOD
+	{ cat <<-EOD; sleep 2; } | "$FILTER_BIN" $FILTER_OPTS -allowlist stats-allowlist -controlSocket stats-control $FILTER_DOMAINS 2>/dev/null >/dev/null &
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.200:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.200:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.1.1.201:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.1.1.201:33174|1.1.1.1:25
+	EOD
+	sleep 1 &&
+	python3 control.py stats-control >actual &&
+	wait &&
+	echo "stats allowlist entries=3 unused=2 hits=1.1.1.0/25:0,1.1.1.128/25:2,3.3.3.3/32:0" >expected &&
+	test_cmp actual expected
+'
+
+test_run 'test allowlisting the mail servers of partner domains' '
+	cat <<-EOD >partner-dns &&
+	partner.example MX mx1.partner.example mx2.partner.example
+	mx1.partner.example 1.2.3.4
+	other.example 1.2.3.6
+	broken.example SERVFAIL
+	*.b.barracudacentral.org 127.0.0.2
+	*.bl.spamcop.net 127.0.0.2
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS partner-dns -blockAbove 80 -partnerDomain partner.example -partnerDomain other.example -partnerDomain broken.example $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.6:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.6:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.4 is a mail server of partner domain partner.example" log &&
+	grep -q "IP address 1.2.3.6 is a mail server of partner domain other.example" log &&
+	grep -q "unable to resolve the mail servers of partner domain broken.example" log
+'
+
+test_run 'test an unreachable remote allowlist' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -allowlist https://127.0.0.1:1/allowlist $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "unable to fetch allowlist from https://127.0.0.1:1/allowlist" log
+'
+
 test_complete
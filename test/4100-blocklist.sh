@@ -0,0 +1,61 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+test_init
+
+test_run 'test IP address and subnet blocklisting' '
+	cat <<-EOD >blocklist &&
+	1.1.1.1
+	2.0.0.0/8
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blocklist blocklist $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.0:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|2.3.4.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|2.3.4.0:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.1.1.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.1.1.1:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test blocklisting with a fixed score' '
+	cat <<-EOD >blocklist &&
+	1.1.1.0/24
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blocklist blocklist -blocklistScore 80 -blockAbove 90 -scoreHeader $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 80
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test allowlist taking precedence over blocklist' '
+	echo 1.1.1.1 >allowlist &&
+	echo 1.1.1.0/24 >blocklist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -allowlist allowlist -blocklist blocklist $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.1.1.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.1.1.1:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_complete
@@ -0,0 +1,316 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+test_init
+
+test_run 'test options and blocklists from the configuration file' '
+	cat <<-EOD >config &&
+	# thresholds
+	blockAbove = 50
+	junkAbove = 10 # trailing comment
+
+	[lists]
+	"b.barracudacentral.org" = 60
+	"bl.spamcop.net" = 40
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.20:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.20:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test command line options overriding the configuration file' '
+	cat <<-EOD >config &&
+	blockAbove = 50
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config -blockAbove 70 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test configuration file with an unknown option' '
+	cat <<-EOD >config &&
+	blockBelow = 50
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test reloading the configuration file on SIGHUP' '
+	cat <<-EOD >config &&
+	blockAbove = 50
+	EOD
+	mkfifo input &&
+	{ "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS <input >output & } &&
+	pid=$! &&
+	exec 3>input &&
+	cat <<-EOD >&3 &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	sleep 1 &&
+	cat <<-EOD >config &&
+	blockAbove = 70
+	EOD
+	kill -HUP "$pid" &&
+	sleep 1 &&
+	cat <<-EOD >&3 &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	exec 3>&- &&
+	wait "$pid" &&
+	sed "0,/^register|ready/d" output >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test switching to a reloaded configuration' '
+	echo "*.b.barracudacentral.org 127.0.0.2" >switch-dns &&
+	echo "blockAbove = 50" >config &&
+	mkfifo switch-input &&
+	{ "$FILTER_BIN" -fakeDNS switch-dns -config config $FILTER_DOMAINS <switch-input >output 2>log & } &&
+	pid=$! &&
+	exec 3>switch-input &&
+	cat <<-EOD >&3 &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	sleep 0.5 &&
+	printf "blockAbove = 70\nallowlist = \"missing\"\n" >config &&
+	kill -HUP "$pid" &&
+	sleep 0.5 &&
+	cat <<-EOD >&3 &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	sleep 0.5 &&
+	echo "blockAbove = 70" >config &&
+	kill -HUP "$pid" &&
+	sleep 0.5 &&
+	cat <<-EOD >&3 &&
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	exec 3>&- &&
+	wait "$pid" &&
+	sed "0,/^register|ready/d" output >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected &&
+	grep -q "failed to reload configuration: open missing" log &&
+	grep -q "configuration reloaded" log
+'
+
+test_run 'test rules from the configuration file' '
+	cat <<-EOD >config &&
+	[[rules]]
+	phase = "helo"
+	helo = "^\\\\["
+	action = "reject"
+	message = "550 no address literals"
+
+	[[rules]]
+	phase = ["mail-from", "rcpt-to"]
+	minScore = 20
+	maxScore = 40
+	rdns = "dyn.example.net."
+	action = "junk"
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00|host.dyn.example.net|pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|1ef1c203cc576e5d|[1.2.3.30]
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|1ef1c203cc576e5d|host.dyn.example.net
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01|host.example.net|pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 no address literals
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test scheduled options' '
+	cat <<-EOD >config &&
+	blockAbove = 70
+
+	[[schedule]]
+	when = "* * * * *"
+	blockAbove = 50
+
+	[[schedule]]
+	when = "* * 31 2 *"
+	blockAbove = 10
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test invalid schedules' '
+	printf "[[schedule]]\nwhen = \"* 25 * * *\"\nblockAbove = 50\n" >config &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	printf "[[schedule]]\nwhen = \"* * * * 1-5\"\ncacheFile = \"cache\"\n" >config &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test per-listener profiles' '
+	cat <<-EOD >profile-config &&
+	blockAbove = 50
+
+	[[profile]]
+	name = "submission"
+	listeners = [":587", ":465"]
+	blockAbove = 70
+	blockMessage = "blocked on submission"
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config profile-config $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|1.1.1.1:587
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:587
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.80:33174|1.1.1.1:465
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.80:33174|1.1.1.1:465
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 blocked on submission
+	EOD
+	test_cmp actual expected &&
+	cat <<-EOD >profile-dns &&
+	4.3.2.1.b.barracudacentral.org 127.0.0.2
+	*.b.barracudacentral.org NXDOMAIN
+	5.3.2.1.bl.spamcop.net 127.0.0.2
+	*.bl.spamcop.net NXDOMAIN
+	EOD
+	cat <<-EOD >profile-config &&
+	blockAbove = 50
+
+	[[profile]]
+	name = "relay"
+	listeners = "10.0.0.1:25"
+
+	[profile.lists]
+	"bl.spamcop.net" = 60
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS profile-dns -config profile-config $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.4:33174|10.0.0.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.4:33174|10.0.0.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.5:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.5:33174|10.0.0.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.5:33174|10.0.0.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	printf "[[profile]]\nname = \"relay\"\nlisteners = \":25\"\n[profile.lists]\n\"zen.spamhaus.org\" = 10\n" >profile-config &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config profile-config $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	grep -q "profile 1: list zen.spamhaus.org is not a DNSBL in use" log &&
+	printf "[[profile]]\nname = \"relay\"\nlisteners = \":25\"\ncacheFile = \"cache\"\n" >profile-config &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config profile-config $FILTER_DOMAINS 2>log; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_run 'test shadow policies' '
+	echo "cacheFile = \"cache\"" >shadow-invalid &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -shadowConfig shadow-invalid $FILTER_DOMAINS >&2; [ "$?" -eq 1 ] &&
+	config|ready
+	EOD
+	echo "blockAbove = 30" >shadow &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -shadowConfig shadow $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.40:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.40:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00: shadow policy would block at connect where the active policy would proceed, score=40 shadowScore=40" log &&
+	! grep -q "session 7641df9771b4ed01: shadow policy" log &&
+	echo "*.bl.spamcop.net 127.0.0.2" >shadow-dns &&
+	printf "[lists]\n\"bl.spamcop.net\" = 60\n" >shadow &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS shadow-dns -blockAbove 50 -shadowConfig shadow $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.4:33174|1.1.1.1:25
+	EOD
+	echo "filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed" >expected &&
+	test_cmp actual expected &&
+	grep -q "session 7641df9771b4ed00: shadow policy would block at connect where the active policy would proceed, score=40 shadowScore=60" log
+'
+
+test_run 'test configuration file with an invalid rule' '
+	cat <<-EOD >config &&
+	[[rules]]
+	phase = "mail-from"
+	action = "bounce"
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+test_complete
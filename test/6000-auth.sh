@@ -0,0 +1,209 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+test_init
+
+test_run 'test authenticated session with a non-reputable IP address' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from -scoreHeader $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|pass|user
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test failed authentication with a non-reputable IP address' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -blockPhase mail-from $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|user|fail
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test sessions on skipped listeners' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 -skipListeners ":587,[2001:db8::25]" $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:587
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:587
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.60:33174|[2001:db8::25]:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.60:33174|[2001:db8::25]:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test policy command' '
+	cat <<-"EOS" >policy &&
+	#!/bin/sh
+	while read -r line; do
+		case "$line" in
+		*\"phase\":\"mail-from\"*\"lists\":\[\]*\"authenticated\":false*) echo "{\"action\":\"reject\",\"message\":\"550 not without authentication\"}" ;;
+		*\"phase\":\"data\"*) echo "{\"header\":\"X-Policy: checked\"}" ;;
+		*) echo "{}" ;;
+		esac
+	done
+	EOS
+	chmod +x policy &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -policyCommand ./policy $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|pass|user
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 not without authentication
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-Policy: checked
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test restarting a policy command which does not answer' '
+	rm -f hung &&
+	cat <<-"EOS" >policy &&
+	#!/bin/sh
+	while read -r line; do
+		if [ ! -e hung ]; then
+			touch hung
+			sleep 5
+		fi
+		echo "{\"action\":\"reject\",\"message\":\"550 no\"}"
+	done
+	EOS
+	chmod +x policy &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -policyCommand ./policy -policyTimeout 200ms $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.10:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.10:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 no
+	EOD
+	test_cmp actual expected &&
+	grep -q "policy command failed for session 7641df9771b4ed00: policy command timed out" log
+'
+
+test_run 'test serving other sessions while the policy command is slow' '
+	: >dns &&
+	rm -f ready release seen &&
+	mkfifo ready release seen &&
+	# the FIFOs order the steps below; their timeouts only keep a broken
+	# filter from hanging the test
+	notify() { timeout 10 sh -c "echo >$1"; } &&
+	await() { timeout 10 sh -c "read -r _ <$1"; } &&
+	cat <<-"EOS" >policy &&
+	#!/bin/sh
+	while read -r line; do
+		case "$line" in
+		*\"phase\":\"helo\"*) timeout 10 sh -c "read -r _ <release" ;;
+		esac
+		echo "{}"
+	done
+	EOS
+	chmod +x policy &&
+	cat <<-EOD >first &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed01|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD >second &&
+	filter|0.5|0|smtp-in|helo|7641df9771b4ed00|2ef1c203cc576e5d|mail.example.com
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	# the policy command only answers the helo once the end of the message
+	# of the other session was passed on, and the input only ends once the
+	# helo was answered
+	{ cat first; await ready; cat second; await seen; } | "$FILTER_BIN" -listCheck none -fakeDNS dns -policyCommand ./policy -policyTimeout 30s bl.example.org:10 2>/dev/null | while read -r line; do
+		case "$line" in
+		filter-result\|7641df9771b4ed01\|*)
+			notify ready
+			;;
+		*"|.")
+			echo "$line"
+			notify release
+			;;
+		*2ef1c203cc576e5d*)
+			echo "$line"
+			notify seen
+			;;
+		esac
+	done >actual &&
+	cat <<-EOD >expected &&
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	filter-result|7641df9771b4ed00|2ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test policy script' '
+	printf "%s\n" "4.3.2.1.b.barracudacentral.org 127.0.0.2" "4.3.2.1.bl.spamcop.net 127.0.0.2" "5.3.2.1.b.barracudacentral.org 127.0.0.2" >dns &&
+	cat <<-"EOS" >script &&
+	def policy(s):
+	    # block only if listed on both, unless authenticated
+	    if "b.barracudacentral.org" in s.lists and "bl.spamcop.net" in s.lists and not s.authenticated:
+	        return {"action": "reject", "message": "550 listed on " + "both"}
+	    if s.phase == "data" and inNet(s.ip, "1.2.3.0/24"):
+	        return {"header": "X-Policy: " + s.phase}
+	    return None
+	EOS
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS dns -policyScript script $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.4:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-auth|7641df9771b4ed00|pass|user
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.5:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed01|1ef1c203cc576e5d|user@example.com
+	filter|0.5|0|smtp-in|data|7641df9771b4ed01|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 listed on both
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|X-Policy: data
+	filter-dataline|7641df9771b4ed01|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test invalid policy script' '
+	printf "%s\n" "def policy(s):" "    if s.score > {:" "        return None" >script &&
+	"$FILTER_BIN" $FILTER_OPTS -policyScript script $FILTER_DOMAINS </dev/null 2>log; [ "$?" -eq 1 ] &&
+	grep -q "script:2:19: got .:., want primary expression" log
+'
+
+test_complete
@@ -0,0 +1,150 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+test_init
+
+test_run 'test penalty for repeat offenders across restarts' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -reputationDB reputation -rejectAbove 40 $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	EOD
+	grep -q "^1.2.3.50	50	2	0	" reputation &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -reputationDB reputation -reputationOffenses 2 -reputationPenalty 50 -blockAbove 60 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test grace margin for a clean history' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -reputationDB reputation $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -reputationDB reputation -reputationClean 2 -reputationGrace 20 -junkAbove 15 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.31:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.31:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test temporary blocking of repeat offenders' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -escalateAfter 2 -rejectAbove 40 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|reject|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed02|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed03|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test adding offenders to a pf table' '
+	printf "#!/bin/sh\necho \"\$*\" >>pfctl.log\n" >pfctl &&
+	chmod +x pfctl &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -pfTable spammers -pfAbove 80 -pfctl ./pfctl -escalateAfter 2 -rejectAbove 40 $FILTER_DOMAINS >/dev/null &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.90:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.90:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed02||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed02|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed03||pass|1.2.3.50:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed03|1ef1c203cc576e5d||pass|1.2.3.50:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed04||pass|1.2.3.20:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	-q -t spammers -T add 1.2.3.90
+	-q -t spammers -T add 1.2.3.50
+	EOD
+	test_cmp pfctl.log expected
+'
+
+test_run 'test sharing offenders without a shared cache' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -gossipChannel offenders -escalateAfter 2 $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|ready
+	EOD
+'
+
+command -v python3 >/dev/null && test_run 'test verdicts reported by operators' '
+	cat <<-EOD >feedback.py &&
+	import socket, sys, time
+	for _ in range(50):
+	    try:
+	        s = socket.socket(socket.AF_UNIX)
+	        s.connect(sys.argv[1])
+	        break
+	    except OSError:
+	        time.sleep(0.1)
+	f = s.makefile()
+	for command in sys.argv[2:]:
+	    s.sendall(command.encode() + b"\n")
+	    print(f.readline().strip())
+	EOD
+	{ cat <<-EOD; sleep 2; } | "$FILTER_BIN" $FILTER_OPTS -reputationDB feedback-reputation -junkAbove 50 -controlSocket feedback-control $FILTER_DOMAINS 2>log >/dev/null &
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|99.1.0.2:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|99.1.0.2:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed00|1ef1c203
+	filter|0.5|0|smtp-in|data|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Message-ID: <Abc@example.com>
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed00|1ef1c203cc576e5d|
+	report|0.5|0|smtp-in|tx-commit|7641df9771b4ed00|1ef1c203|1024
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.10:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.10:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|tx-begin|7641df9771b4ed01|2ef1c203
+	filter|0.5|0|smtp-in|data|7641df9771b4ed01|1ef1c203cc576e5d|
+	filter|0.5|0|smtp-in|data-line|7641df9771b4ed01|1ef1c203cc576e5d|.
+	filter|0.5|0|smtp-in|commit|7641df9771b4ed01|1ef1c203cc576e5d|
+	report|0.5|0|smtp-in|tx-commit|7641df9771b4ed01|2ef1c203|1024
+	EOD
+	sleep 1 &&
+	python3 feedback.py feedback-control "report-ham <abc@example.com>" "report-ham 1ef1c203" "report-spam 2ef1c203" "report-spam 3ef1c203" "report-spam 5.6.7.8" "stats feedback" >actual &&
+	wait &&
+	cat <<-EOD >expected &&
+	ok addr=99.1.0.2 lists=b.barracudacentral.org junked=true
+	error: message already reported
+	ok addr=1.2.3.10 lists= junked=false
+	error: unknown message
+	ok
+	stats feedback falsePositives=b.barracudacentral.org:1,bl.spamcop.net:0 falseNegatives=b.barracudacentral.org:1,bl.spamcop.net:1
+	EOD
+	test_cmp actual expected &&
+	grep -q "operator reported ham for message <abc@example.com> from 99.1.0.2 (junked=true), false positive of b.barracudacentral.org" log &&
+	grep -q "^99.1.0.2	0	0	1	" feedback-reputation &&
+	grep -q "^1.2.3.10	10	1	1	" feedback-reputation &&
+	grep -q "^5.6.7.8	0	1	0	" feedback-reputation
+'
+
+test_complete
@@ -0,0 +1,118 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+FIXTURES="$(pwd)"
+
+test_init
+
+test_run 'test junking sessions by country' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -geoipDB "$FIXTURES/country.mmdb" -geoipRule XA:junk $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test score adjustment by registered country' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -geoipDB "$FIXTURES/country.mmdb" -geoipRule XB:40 -blockAbove 100 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.64:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.64:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test blocking sessions by AS number' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -asnDB "$FIXTURES/asn.mmdb" -geoipRule AS64496:block $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.1:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.1:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test blocking by country before any lookups' '
+	echo "*.b.barracudacentral.org 127.0.0.2" >geoip-dns &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -fakeDNS geoip-dns -logLevel debug -geoipDB "$FIXTURES/country.mmdb" -geoipRule XA,XB:block $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.64:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.64:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected &&
+	grep -q "IP address 1.2.3.64 matches GeoIP rule XB:block" log &&
+	! grep -q "^query " log
+'
+
+test_run 'test GeoIP rules from the configuration file' '
+	cat <<-EOD >config &&
+	geoipDB = "$FIXTURES/country.mmdb"
+	asnDB = "$FIXTURES/asn.mmdb"
+
+	[lists]
+	"b.barracudacentral.org" = 60
+	"bl.spamcop.net" = 40
+
+	[geoip]
+	XA = "junk"
+	AS64496 = -5
+	EOD
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -config config -junkAbove 70 | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.12:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.12:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.74:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.74:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|junk
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test allowlisted addresses are exempt from GeoIP rules' '
+	echo 1.2.3.0/24 >allowlist &&
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -allowlist allowlist -geoipDB "$FIXTURES/country.mmdb" -geoipRule XA:junk $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test allowing sessions by AS number' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -asnDB "$FIXTURES/asn.mmdb" -geoipRule AS64496:allow -blockAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|ready
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.100:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.100:33174|1.1.1.1:25
+	report|0.5|0|smtp-in|link-connect|7641df9771b4ed01||pass|1.2.3.200:33174|1.1.1.1:25
+	filter|0.5|0|smtp-in|connect|7641df9771b4ed01|1ef1c203cc576e5d||pass|1.2.3.200:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed01|1ef1c203cc576e5d|disconnect|550 your IP reputation is too low for this MX
+	EOD
+	test_cmp actual expected
+'
+
+test_complete
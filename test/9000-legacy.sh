@@ -16,16 +16,68 @@ test_run 'test with protocol version 0.4' '
 	test_cmp actual expected
 '
 
-test_run 'test with protocol version 0.42' '
+test_run 'test with protocol version 0.7' '
 	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
 	config|ready
+	report|0.7|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.7|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test with an unknown future protocol version' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS 2>log | sed "0,/^register|ready/d" >actual &&
+	config|ready
 	report|0.42|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
 	filter|0.42|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
 	EOD
 	cat <<-EOD >expected &&
 	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
 	EOD
+	test_cmp actual expected &&
+	grep -q "filter protocol version 0.42 is newer than 0.7" log
+'
+
+test_run 'test registering only events older smtpd versions know' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >actual &&
+	config|smtpd-version|6.6.4
+	config|ready
+	EOD
+	grep -q "^register|report|smtp-in|tx-rollback$" actual &&
+	! grep -q "^register|report|smtp-in|tx-reset$" actual
+'
+
+test_run 'test registering all events for current smtpd versions' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS >actual &&
+	config|smtpd-version|7.4.0
+	config|ready
+	EOD
+	grep -q "^register|report|smtp-in|tx-reset$" actual
+'
+
+test_run 'test with a full config block' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS -blockAbove 50 $FILTER_DOMAINS | sed "0,/^register|ready/d" >actual &&
+	config|smtpd-version|7.4.0
+	config|smtp-session-timeout|300
+	config|subsystem|smtp-in
+	config|ready
+	report|0.7|0|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.0:33174|1.1.1.1:25
+	filter|0.7|0|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.0:33174|1.1.1.1:25
+	EOD
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
 	test_cmp actual expected
 '
 
+test_run 'test with another subsystem' '
+	cat <<-EOD | "$FILTER_BIN" $FILTER_OPTS $FILTER_DOMAINS >&2; [ "$?" -eq 1 ]
+	config|subsystem|smtp-out
+	config|ready
+	EOD
+'
+
 test_complete
@@ -0,0 +1,73 @@
+#!/bin/sh
+
+. ./test-lib.sh
+
+test_init
+
+test_run 'test replaying a transcript' '
+	cat <<-EOD >transcript &&
+	config|smtpd-version|7.4.0
+	config|subsystem|smtp-in
+	config|ready
+	report|0.7|1700000000.000000|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.7|1700000000.000100|smtp-in|connect|7641df9771b4ed00|1ef1c203cc576e5d||pass|1.2.3.30:33174|1.1.1.1:25
+	filter|0.7|1700000001.000000|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter|0.7|1700000001.000100|smtp-in|data-line|7641df9771b4ed00|1ef1c203cc576e5d|.
+	report|0.7|1700000002.000000|smtp-in|link-disconnect|7641df9771b4ed00
+	EOD
+	"$FILTER_BIN" -replay transcript -slowFactor 100000 -scoreHeader $FILTER_DOMAINS >actual </dev/null &&
+	cat <<-EOD >expected &&
+	register|report|smtp-in|link-auth
+	register|report|smtp-in|link-connect
+	register|report|smtp-in|link-disconnect
+	register|report|smtp-in|link-tls
+	register|report|smtp-in|tx-begin
+	register|report|smtp-in|tx-commit
+	register|report|smtp-in|tx-mail
+	register|report|smtp-in|tx-rcpt
+	register|report|smtp-in|tx-reset
+	register|report|smtp-in|tx-rollback
+	register|filter|smtp-in|auth
+	register|filter|smtp-in|commit
+	register|filter|smtp-in|connect
+	register|filter|smtp-in|data
+	register|filter|smtp-in|data-line
+	register|filter|smtp-in|ehlo
+	register|filter|smtp-in|helo
+	register|filter|smtp-in|mail-from
+	register|filter|smtp-in|quit
+	register|filter|smtp-in|rcpt-to
+	register|filter|smtp-in|starttls
+	register|ready
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|X-DNSBL-Score: 30
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|Subject: hello
+	filter-dataline|7641df9771b4ed00|1ef1c203cc576e5d|.
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test replaying a transcript against the clock of its events' '
+	cat <<-EOD >transcript &&
+	config|ready
+	report|0.7|1700000000.000000|smtp-in|link-connect|7641df9771b4ed00||pass|1.2.3.60:33174|1.1.1.1:25
+	filter|0.7|1700000000.000100|smtp-in|mail-from|7641df9771b4ed00|1ef1c203cc576e5d|user@example.com
+	filter|0.7|1700000000.000200|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.7|1700000060.000000|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	filter|0.7|1700000600.000000|smtp-in|rcpt-to|7641df9771b4ed00|1ef1c203cc576e5d|root@localhost
+	EOD
+	"$FILTER_BIN" -replay transcript -greylistAbove 50 -greylistDelay 5m $FILTER_DOMAINS </dev/null | sed "0,/^register|ready/d" >actual &&
+	cat <<-EOD >expected &&
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|451 greylisted, please try again later
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|reject|451 greylisted, please try again later
+	filter-result|7641df9771b4ed00|1ef1c203cc576e5d|proceed
+	EOD
+	test_cmp actual expected
+'
+
+test_run 'test replaying a missing transcript' '
+	"$FILTER_BIN" -replay missing $FILTER_DOMAINS </dev/null >&2; [ "$?" -eq 1 ]
+'
+
+test_complete